@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ldsec/medco-unlynx/services"
+	"github.com/urfave/cli"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3/app"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// auditLogFromApp verifies the chain of an audit log (and the signatures of its records if the public toml file of the
+// server is given) and prints its records (optionally filtered)
+func auditLogFromApp(c *cli.Context) error {
+	// cli arguments
+	logPath := c.String(optionAuditLogFile)
+	publicTomlPath := c.String(optionPublicTomlPath)
+	surveyID := c.String(optionAuditSurvey)
+	requestType := c.String(optionAuditType)
+	querier := c.String(optionAuditQuerier)
+	outputJSON := c.Bool(optionAuditJSON)
+
+	if logPath == "" || c.NArg() != 0 {
+		err := fmt.Errorf("arguments not OK")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+	var since, until time.Time
+	var err error
+	if v := c.String(optionAuditSince); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			log.Error("Wrong start time (RFC3339 expected)", err)
+			return cli.NewExitError(err, 3)
+		}
+	}
+	if v := c.String(optionAuditUntil); v != "" {
+		if until, err = time.Parse(time.RFC3339, v); err != nil {
+			log.Error("Wrong end time (RFC3339 expected)", err)
+			return cli.NewExitError(err, 3)
+		}
+	}
+
+	var public kyber.Point
+	if publicTomlPath != "" {
+		if public, err = readServerPublicKey(publicTomlPath); err != nil {
+			log.Error("Error while reading public toml file", err)
+			return cli.NewExitError(err, 4)
+		}
+	} else {
+		log.Warn("The signatures of the records are not checked (no public toml file of the server)")
+	}
+
+	fRead, err := os.Open(logPath)
+	if err != nil {
+		log.Error("Error while opening audit log", err)
+		return cli.NewExitError(err, 4)
+	}
+	defer fRead.Close()
+
+	// the records before a broken link are printed anyway
+	records, chainErr := servicesmedco.VerifyAuditLog(fRead, public)
+
+	for _, record := range records {
+		if (surveyID != "" && string(record.SurveyID) != surveyID) ||
+			(requestType != "" && record.RequestType != requestType) ||
+			(querier != "" && !auditRecordInvolves(record, querier)) ||
+			(!since.IsZero() && record.Time.Before(since)) ||
+			(!until.IsZero() && record.Time.After(until)) {
+			continue
+		}
+
+		var line string
+		if outputJSON {
+			b, err := json.Marshal(record)
+			if err != nil {
+				log.Error("Error while writing result.", err)
+				return cli.NewExitError(err, 4)
+			}
+			line = string(b) + "\n"
+		} else {
+			line = formatAuditRecord(record)
+		}
+		if _, err := io.WriteString(os.Stdout, line); err != nil {
+			log.Error("Error while writing result.", err)
+			return cli.NewExitError(err, 4)
+		}
+	}
+
+	if chainErr != nil {
+		err := fmt.Errorf("audit log chain broken after %d records: %v", len(records), chainErr)
+		log.Error(err)
+		return cli.NewExitError(err, 5)
+	}
+	log.Info("Audit log verified:", len(records), "records")
+	return nil
+}
+
+// readServerPublicKey returns the key the server signs its audit records with, from its public toml file
+func readServerPublicKey(path string) (kyber.Point, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	group, err := app.ReadGroupDescToml(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(group.Roster.List) != 1 {
+		return nil, fmt.Errorf("%d servers in %s (1 expected)", len(group.Roster.List), path)
+	}
+	return group.Roster.List[0].ServicePublic(servicesmedco.Name), nil
+}
+
+// auditRecordInvolves returns whether the querier signed the request or got its results
+func auditRecordInvolves(record servicesmedco.AuditRecord, querier string) bool {
+	if record.Querier == querier {
+		return true
+	}
+	for _, key := range record.ClientPubKeys {
+		if key == querier {
+			return true
+		}
+	}
+	return false
+}
+
+func formatAuditRecord(record servicesmedco.AuditRecord) string {
+	fields := []string{
+		"#" + strconv.FormatUint(record.Index, 10),
+		record.Time.Format(time.RFC3339),
+		record.RequestType,
+		"survey=" + string(record.SurveyID),
+		"outcome=" + strconv.Quote(record.Outcome),
+		"duration=" + record.Duration.String(),
+		"proofs=" + strconv.FormatBool(record.Proofs),
+		"roster=" + strings.Join(record.Roster, ","),
+	}
+	if record.Root != "" {
+		fields = append(fields, "root="+record.Root)
+	}
+	if record.Querier != "" {
+		fields = append(fields, "querier="+record.Querier)
+	}
+	if len(record.ClientPubKeys) > 0 {
+		fields = append(fields, "clients="+strings.Join(record.ClientPubKeys, ","))
+	}
+	return strings.Join(fields, " ") + "\n"
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ldsec/medco-unlynx/services"
+	"github.com/ldsec/unlynx/lib"
+	"github.com/urfave/cli"
+	"go.dedis.ch/kyber/v3/util/encoding"
+	"go.dedis.ch/kyber/v3/util/key"
+	"go.dedis.ch/onet/v3/app"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// dkgGroupToml is a group file with the collective key generated by the nodes (the [dkg] table is ignored by the
+// commands that only read the servers)
+type dkgGroupToml struct {
+	Servers []*app.ServerToml `toml:"servers"`
+	DKG     *dkgToml          `toml:"dkg"`
+}
+
+// dkgToml is the public outcome of a distributed key generation, the points are hex-encoded
+type dkgToml struct {
+	ID            string
+	Threshold     int
+	CollectiveKey string
+	Commits       []string
+}
+
+// dkgSetup asks the nodes of a group file to generate a collective key by distributed key generation and writes a new
+// group file with it
+func dkgSetup(c *cli.Context) error {
+	// cli arguments
+	groupTomlPath := c.String(optionGroupFile)
+	id := c.String(optionDKGID)
+	threshold := c.Int(optionDKGThreshold)
+	outputPath := c.String(optionDKGOutput)
+	querierKey := c.String(optionDecryptKey)
+
+	if groupTomlPath == "" || id == "" || outputPath == "" || threshold < 0 || c.NArg() != 0 {
+		err := fmt.Errorf("arguments not OK")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	group := dkgGroupToml{}
+	if _, err := toml.DecodeFile(groupTomlPath, &group); err != nil {
+		log.Error("Error while reading group file", err)
+		return cli.NewExitError(err, 4)
+	}
+	if group.DKG != nil {
+		err := fmt.Errorf("group file %s already has a collective key (%s)", groupTomlPath, group.DKG.ID)
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+	fGroup, err := os.Open(groupTomlPath)
+	if err != nil {
+		log.Error("Error while opening group file", err)
+		return cli.NewExitError(err, 4)
+	}
+	defer fGroup.Close()
+	el, err := app.ReadGroupDescToml(fGroup)
+	if err != nil {
+		log.Error("Error while reading group file", err)
+		return cli.NewExitError(err, 4)
+	}
+	if len(el.Roster.List) <= 0 {
+		err := fmt.Errorf("empty or invalid group file")
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	// the querier signs the request, the nodes that check the requests have to know its key
+	keys := key.NewKeyPair(libunlynx.SuiTe)
+	if querierKey != "" {
+		if keys.Private, err = libunlynx.DeserializeScalar(querierKey); err != nil {
+			log.Error("Error while reading the querier key", err)
+			return cli.NewExitError(err, 3)
+		}
+		keys.Public = libunlynx.SuiTe.Point().Mul(keys.Private, nil)
+	}
+
+	start := time.Now()
+	client := servicesmedco.NewMedCoClientWithKeys(el.Roster.List[0], "dkg-setup", keys)
+	resp, err := client.SendDKGRequest(el.Roster, id, threshold)
+	if err != nil {
+		log.Error("Error during the distributed key generation", err)
+		return cli.NewExitError(err, 2)
+	}
+	log.Lvl1("Generated the collective key", id, "in", time.Since(start), "(threshold", resp.Threshold, "of",
+		len(el.Roster.List), ")")
+
+	group.DKG = &dkgToml{ID: resp.ID, Threshold: resp.Threshold}
+	if group.DKG.CollectiveKey, err = encoding.PointToStringHex(libunlynx.SuiTe, resp.CollectiveKey); err != nil {
+		return cli.NewExitError(err, 4)
+	}
+	for _, commit := range resp.Commits {
+		commitString, err := encoding.PointToStringHex(libunlynx.SuiTe, commit)
+		if err != nil {
+			return cli.NewExitError(err, 4)
+		}
+		group.DKG.Commits = append(group.DKG.Commits, commitString)
+	}
+
+	fOutput, err := os.Create(outputPath)
+	if err != nil {
+		log.Error("Error while creating the group file", err)
+		return cli.NewExitError(err, 4)
+	}
+	defer fOutput.Close()
+	if err := toml.NewEncoder(fOutput).Encode(&group); err != nil {
+		log.Error("Error while writing the group file", err)
+		return cli.NewExitError(err, 4)
+	}
+	return nil
+}
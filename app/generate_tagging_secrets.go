@@ -6,8 +6,10 @@ import (
 	libunlynx "github.com/ldsec/unlynx/lib"
 	"github.com/urfave/cli"
 	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/app"
 	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
 	"os"
 	"path"
 	"strconv"
@@ -15,6 +17,135 @@ import (
 )
 
 func generateTaggingSecrets(c *cli.Context) error {
+	roster, providedSecrets, secretsPath, err := readTaggingSecretsArgs(c)
+	if err != nil {
+		return err
+	}
+	key, err := ddtSecretsKeyFromApp(c)
+	if err != nil {
+		return err
+	}
+
+	store, err := servicesmedco.OpenSecretStoreFromEnv(secretsPath, key)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer store.Close()
+
+	// setup secrets
+	for i, dest := range roster.List {
+		var err error
+		if len(providedSecrets) > 0 {
+			_, err = store.Secret(dest.Address, 0, providedSecrets[i])
+		} else {
+			_, err = store.Secret(dest.Address, 0, nil)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rotateTaggingSecrets adds a new epoch of DDT secrets for the participating nodes, keeping the previous ones. A goleveldb
+// store can only be opened by one process: the server has to be stopped while the secrets are rotated.
+func rotateTaggingSecrets(c *cli.Context) error {
+	roster, providedSecrets, secretsPath, err := readTaggingSecretsArgs(c)
+	if err != nil {
+		return err
+	}
+	key, err := ddtSecretsKeyFromApp(c)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]network.Address, 0, len(roster.List))
+	for _, dest := range roster.List {
+		ids = append(ids, dest.Address)
+	}
+	store, err := servicesmedco.OpenSecretStoreFromEnv(secretsPath, key)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer store.Close()
+
+	epoch, err := store.Rotate(ids, providedSecrets)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	log.Info("DDT secrets of epoch", epoch, "added to", secretsPath)
+	return nil
+}
+
+// encryptTaggingSecrets encrypts the plaintext DDT secrets file of the node with the key configured by the environment
+func encryptTaggingSecrets(c *cli.Context) error {
+	_, _, secretsPath, err := readTaggingSecretsArgs(c)
+	if err != nil {
+		return err
+	}
+	key, err := ddtSecretsKeyFromApp(c)
+	if err != nil {
+		return err
+	}
+	if kind := os.Getenv(servicesmedco.DDTSecretsStoreEnv); kind != "" && kind != servicesmedco.DDTSecretsStoreTOML {
+		err := fmt.Errorf("only the TOML DDT secrets files can be encrypted (%s is %s)", servicesmedco.DDTSecretsStoreEnv,
+			kind)
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+	if key == nil {
+		err := fmt.Errorf("%s is not set", servicesmedco.DDTSecretsEncryptionEnv)
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	if err := servicesmedco.EncryptDDTSecretsFile(secretsPath, key); err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	log.Info("DDT secrets of", secretsPath, "encrypted")
+	return nil
+}
+
+// ddtSecretsKeyFromApp returns the key the DDT secrets are encrypted with (nil if they are not), the private key of
+// the node is read from its private toml file if the key is derived from it
+func ddtSecretsKeyFromApp(c *cli.Context) (*servicesmedco.DDTSecretsKey, error) {
+	var private kyber.Scalar
+	if os.Getenv(servicesmedco.DDTSecretsEncryptionEnv) == servicesmedco.DDTSecretsKeyPrivateKey {
+		privateTomlPath := c.String(optionPrivateTomlPath)
+		if privateTomlPath == "" {
+			err := fmt.Errorf("the private toml file of the node is needed to derive the key of the DDT secrets")
+			log.Error(err)
+			return nil, cli.NewExitError(err, 3)
+		}
+		hc, err := app.LoadCothority(privateTomlPath)
+		if err != nil {
+			log.Error("Error while reading private toml file", err)
+			return nil, cli.NewExitError(err, 4)
+		}
+		si, err := hc.GetServerIdentity()
+		if err != nil {
+			log.Error("Error while reading private toml file", err)
+			return nil, cli.NewExitError(err, 4)
+		}
+		private = si.ServicePrivate(servicesmedco.Name)
+	}
+
+	key, err := servicesmedco.DDTSecretsKeyFromEnv(private)
+	if err != nil {
+		log.Error(err)
+		return nil, cli.NewExitError(err, 3)
+	}
+	return key, nil
+}
+
+// readTaggingSecretsArgs reads the roster, the provided secrets and the path of the DDT secrets file of the node
+func readTaggingSecretsArgs(c *cli.Context) (*onet.Roster, []kyber.Scalar, string, error) {
 	// cli arguments
 	groupTomlPath := c.String("file")
 	providedSecretsString := c.String("secrets")
@@ -23,24 +154,25 @@ func generateTaggingSecrets(c *cli.Context) error {
 	if groupTomlPath == "" {
 		err := fmt.Errorf("arguments not OK")
 		log.Error(err)
-		return cli.NewExitError(err, 3)
+		return nil, nil, "", cli.NewExitError(err, 3)
 	}
 
 	fRead, err := os.Open(groupTomlPath)
 	if err != nil {
 		log.Error("Error while opening group file", err)
-		return err
+		return nil, nil, "", err
 	}
 	defer fRead.Close()
 
 	el, err := app.ReadGroupDescToml(fRead)
 	if err != nil {
 		log.Error("Error while reading group file", err)
-		return err
+		return nil, nil, "", err
 	}
 	if len(el.Roster.List) <= 0 {
-		log.Error("Empty or invalid group file", err)
-		return err
+		err := fmt.Errorf("empty or invalid group file")
+		log.Error(err)
+		return nil, nil, "", err
 	}
 
 	// parse provided secrets
@@ -51,41 +183,20 @@ func generateTaggingSecrets(c *cli.Context) error {
 		if len(providedSecretsStringSplit) != len(el.Roster.List) {
 			err := fmt.Errorf("provided secrets list does not match the length of the roster list")
 			log.Error(err, len(providedSecretsStringSplit), " != ", len(el.Roster.List))
-			return err
+			return nil, nil, "", err
 		}
 
 		for _, s := range providedSecretsStringSplit {
 			providedSecretScalar, err := libunlynx.DeserializeScalar(s)
 			if err != nil {
 				log.Error(err)
-				return err
+				return nil, nil, "", err
 			}
 
 			providedSecrets = append(providedSecrets, providedSecretScalar)
 		}
 	}
 
-	// setup secrets
 	dir, _ := path.Split(groupTomlPath)
-
-	for i, dest := range el.Roster.List {
-		var err error
-		if len(providedSecrets) > 0 {
-			_, err = servicesmedco.CheckDDTSecrets(
-				dir+"srv"+strconv.FormatInt(int64(nodeIndex), 10)+"-ddtsecrets.toml",
-				dest.Address,
-				providedSecrets[i])
-		} else {
-			_, err = servicesmedco.CheckDDTSecrets(
-				dir+"srv"+strconv.FormatInt(int64(nodeIndex), 10)+"-ddtsecrets.toml",
-				dest.Address,
-				nil)
-		}
-
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
+	return el.Roster, providedSecrets, dir + "srv" + strconv.FormatInt(int64(nodeIndex), 10) + "-ddtsecrets.toml", nil
 }
@@ -52,6 +52,30 @@ const (
 
 	optionNodeIndex      = "nodeIndex"
 	optionNodeIndexShort = "i"
+
+	// audit log options
+	optionAuditLogFile      = "logFile"
+	optionAuditLogFileShort = "l"
+
+	optionAuditSurvey  = "survey"
+	optionAuditType    = "type"
+	optionAuditQuerier = "querier"
+	optionAuditSince   = "since"
+	optionAuditUntil   = "until"
+	optionAuditJSON    = "json"
+
+	// distributed key generation options
+	optionDKGID = "id"
+
+	optionDKGThreshold      = "threshold"
+	optionDKGThresholdShort = "t"
+
+	optionDKGOutput      = "output"
+	optionDKGOutputShort = "o"
+
+	// proof verification options
+	optionProofBundle      = "bundle"
+	optionProofBundleShort = "b"
 )
 
 /*
@@ -167,6 +191,84 @@ func main() {
 		},
 	}
 
+	taggingSecretsFlags := append([]cli.Flag{
+		cli.StringFlag{
+			Name:  optionPrivateTomlPath + ", " + optionPrivateTomlPathShort,
+			Usage: "Private toml file of the server (needed if the DDT secrets are encrypted with its private key)",
+		},
+	}, getAggregateKeyFlags...)
+
+	auditLogFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  optionAuditLogFile + ", " + optionAuditLogFileShort,
+			Usage: "Audit log file of the server",
+		},
+		cli.StringFlag{
+			Name:  optionAuditSurvey,
+			Usage: "Only print the records of this survey",
+		},
+		cli.StringFlag{
+			Name:  optionAuditType,
+			Usage: "Only print the records of this type of request (e.g. KSRequestName)",
+		},
+		cli.StringFlag{
+			Name:  optionAuditQuerier,
+			Usage: "Only print the records involving this (base64-encoded) querier key",
+		},
+		cli.StringFlag{
+			Name:  optionAuditSince,
+			Usage: "Only print the records from this time on (RFC3339)",
+		},
+		cli.StringFlag{
+			Name:  optionAuditUntil,
+			Usage: "Only print the records up to this time (RFC3339)",
+		},
+		cli.BoolFlag{
+			Name:  optionAuditJSON,
+			Usage: "Print the records in JSON",
+		},
+		cli.StringFlag{
+			Name:  optionPublicTomlPath + ", " + optionPublicTomlPathShort,
+			Usage: "Public toml file of the server, to check the signatures of the records (optional)",
+		},
+	}
+
+	dkgFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  optionGroupFile + ", " + optionGroupFileShort,
+			Value: DefaultGroupFile,
+			Usage: "Unlynx group definition file",
+		},
+		cli.StringFlag{
+			Name:  optionDKGID,
+			Usage: "Identifier of the collective key",
+		},
+		cli.IntFlag{
+			Name:  optionDKGThreshold + ", " + optionDKGThresholdShort,
+			Usage: "Number of nodes needed to use the collective key (default: majority of the nodes)",
+		},
+		cli.StringFlag{
+			Name:  optionDKGOutput + ", " + optionDKGOutputShort,
+			Usage: "Group definition file written with the collective key",
+		},
+		cli.StringFlag{
+			Name:  optionDecryptKey + ", " + optionDecryptKeyShort,
+			Usage: "Private key of the querier signing the request (optional)",
+		},
+	}
+
+	verifyFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  optionProofBundle + ", " + optionProofBundleShort,
+			Usage: "Proof bundle file written by a server",
+		},
+		cli.StringFlag{
+			Name:  optionGroupFile + ", " + optionGroupFileShort,
+			Value: DefaultGroupFile,
+			Usage: "Unlynx group definition file",
+		},
+	}
+
 	cliApp.Commands = []cli.Command{
 		// BEGIN CLIENT: DATA ENCRYPTION ----------
 		{
@@ -207,6 +309,16 @@ func main() {
 		},
 		// CLIENT END: MAPPING TABLE GENERATION ------------
 
+		// BEGIN CLIENT: PROOF VERIFICATION ----------
+		{
+			Name:    "verify",
+			Aliases: []string{"v"},
+			Usage:   "Verify offline the proofs of a survey from a proof bundle",
+			Action:  verifyProofsFromApp,
+			Flags:   verifyFlags,
+		},
+		// CLIENT END: PROOF VERIFICATION ------------
+
 		// BEGIN SERVER --------
 		{
 			Name:  "server",
@@ -253,7 +365,35 @@ func main() {
 					Aliases: []string{"gs"},
 					Usage:   "Generate DDT Secrets for the participating nodes",
 					Action:  generateTaggingSecrets,
-					Flags:   getAggregateKeyFlags,
+					Flags:   taggingSecretsFlags,
+				},
+				{
+					Name:    "rotateTaggingSecrets",
+					Aliases: []string{"rs"},
+					Usage: "Add a new epoch of DDT Secrets for the participating nodes (the previous ones are kept); " +
+						"stop the server first with the leveldb store",
+					Action: rotateTaggingSecrets,
+					Flags:  taggingSecretsFlags,
+				},
+				{
+					Name:    "encryptTaggingSecrets",
+					Aliases: []string{"es"},
+					Usage:   "Encrypt the plaintext DDT Secrets file of the server with the key set by UNLYNX_DDT_SECRETS_ENCRYPTION",
+					Action:  encryptTaggingSecrets,
+					Flags:   taggingSecretsFlags,
+				},
+				{
+					Name:   "dkg",
+					Usage:  "Generate a collective key shared among the nodes of group.toml by distributed key generation",
+					Action: dkgSetup,
+					Flags:  dkgFlags,
+				},
+				{
+					Name:    "auditLog",
+					Aliases: []string{"al"},
+					Usage:   "Verify the chain of an audit log and print its records",
+					Action:  auditLogFromApp,
+					Flags:   auditLogFlags,
 				},
 			},
 		},
@@ -1,17 +1,42 @@
 package main
 
 import (
+	"os"
+	"os/signal"
+	"syscall"
+
 	// Empty imports to have the init-functions called which should
 	// register the protocol
-	_ "github.com/ldsec/medco-unlynx/services"
+	"github.com/ldsec/medco-unlynx/services"
 	_ "github.com/ldsec/unlynx/protocols"
 	"github.com/urfave/cli"
 	"go.dedis.ch/onet/v3/app"
+	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
 )
 
 func runServer(ctx *cli.Context) error {
 	// first check the options
 	config := ctx.String("config")
-	app.RunServer(config)
-	return nil
+	if _, err := os.Stat(config); os.IsNotExist(err) {
+		return xerrors.Errorf("configuration file does not exist: %s", config)
+	}
+	_, server, err := app.ParseCothority(config)
+	if err != nil {
+		return xerrors.Errorf("couldn't parse config: %+v", err)
+	}
+
+	// stop the server on an interruption, so that the databases of the service are released
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Lvl1("Stopping the server")
+		if err := server.Close(); err != nil {
+			log.Error(err)
+		}
+	}()
+
+	server.Start()
+	return server.Service(servicesmedco.Name).(*servicesmedco.Service).Close()
 }
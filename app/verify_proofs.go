@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ldsec/medco-unlynx/services"
+	"github.com/urfave/cli"
+	"go.dedis.ch/onet/v3/app"
+	"go.dedis.ch/onet/v3/log"
+)
+
+// verifyProofsFromApp verifies offline the proofs of a proof bundle against the roster of the group file and the
+// ciphertexts of the survey, and prints the result of each node
+func verifyProofsFromApp(c *cli.Context) error {
+	// cli arguments
+	bundlePath := c.String(optionProofBundle)
+	groupTomlPath := c.String(optionGroupFile)
+
+	if bundlePath == "" || groupTomlPath == "" || c.NArg() != 0 {
+		err := fmt.Errorf("arguments not OK")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	fGroup, err := os.Open(groupTomlPath)
+	if err != nil {
+		log.Error("Error while opening group file", err)
+		return cli.NewExitError(err, 4)
+	}
+	defer fGroup.Close()
+	el, err := app.ReadGroupDescToml(fGroup)
+	if err != nil {
+		log.Error("Error while reading group file", err)
+		return cli.NewExitError(err, 4)
+	}
+	if len(el.Roster.List) <= 0 {
+		err := fmt.Errorf("empty or invalid group file")
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	fBundle, err := os.Open(bundlePath)
+	if err != nil {
+		log.Error("Error while opening proof bundle", err)
+		return cli.NewExitError(err, 4)
+	}
+	defer fBundle.Close()
+	bundle, err := servicesmedco.ReadProofBundle(fBundle)
+	if err != nil {
+		log.Error("Error while reading proof bundle", err)
+		return cli.NewExitError(err, 4)
+	}
+
+	failures := 0
+	for _, nv := range servicesmedco.VerifyProofBundle(bundle, el.Roster) {
+		fields := []string{"PASS", nv.Address, "verified=" + strconv.Itoa(nv.Verified)}
+		if !nv.OK() {
+			failures++
+			fields[0] = "FAIL"
+		}
+		if len(nv.Failed) > 0 {
+			fields = append(fields, "failed="+strings.Join(nv.Failed, ","))
+		}
+		if len(nv.Missing) > 0 {
+			fields = append(fields, "missing="+strings.Join(nv.Missing, ","))
+		}
+		if _, err := io.WriteString(os.Stdout, strings.Join(fields, " ")+"\n"); err != nil {
+			log.Error("Error while writing result.", err)
+			return cli.NewExitError(err, 4)
+		}
+	}
+
+	// the proofs have to be made on the ciphertexts of the survey
+	unbound, err := servicesmedco.VerifyProofBundleBinding(bundle, el.Roster)
+	if err != nil {
+		log.Error("Error while verifying the ciphertexts of the proofs", err)
+		return cli.NewExitError(err, 5)
+	}
+	fields := []string{"PASS", "ciphertexts"}
+	if len(unbound) > 0 {
+		failures++
+		fields = []string{"FAIL", "ciphertexts", "unbound=" + strings.Join(unbound, ",")}
+	}
+	if _, err := io.WriteString(os.Stdout, strings.Join(fields, " ")+"\n"); err != nil {
+		log.Error("Error while writing result.", err)
+		return cli.NewExitError(err, 4)
+	}
+
+	if failures > 0 {
+		err := fmt.Errorf("proofs of survey %s not verified (%d failures)", bundle.SurveyID, failures)
+		log.Error(err)
+		return cli.NewExitError(err, 5)
+	}
+	log.Info("Proofs of survey", bundle.SurveyID, "verified")
+	return nil
+}
@@ -12,7 +12,9 @@ require (
 	github.com/urfave/cli v1.22.3
 	go.dedis.ch/kyber/v3 v3.0.12
 	go.dedis.ch/onet/v3 v3.2.0
+	golang.org/x/crypto v0.0.0-20200317142112-1b76d66859c6
 	golang.org/x/lint v0.0.0-20200302205851-738671d3881b // indirect
+	golang.org/x/sys v0.0.0-20200317113312-5766fd39f98d
 	golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	gopkg.in/yaml.v2 v2.2.7 // indirect
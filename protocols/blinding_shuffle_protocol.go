@@ -0,0 +1,248 @@
+package protocols
+
+import (
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/util/random"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+// BlindingShuffleProtocolName is the registered name for the blinding shuffle protocol.
+const BlindingShuffleProtocolName = "BlindingShuffle"
+
+func init() {
+	network.RegisterMessage(BlindingShuffleMessage{})
+	_, err := onet.GlobalProtocolRegister(BlindingShuffleProtocolName, NewBlindingShuffleProtocol)
+	log.ErrFatal(err, "Failed to register the <BlindingShuffle> protocol:")
+}
+
+// Messages
+//______________________________________________________________________________________________________________________
+
+// BlindingShuffleMessage carries the ciphertexts from one node of the circuit to the next one
+type BlindingShuffleMessage struct {
+	Data libunlynx.CipherVector
+	// ciphertexts moved along with the ones of Data (re-randomized, not blinded), the payloads of Data[i] are
+	// Payloads[i*len(Payloads)/len(Data):(i+1)*len(Payloads)/len(Data)]
+	Payloads libunlynx.CipherVector
+}
+
+// Structs
+//______________________________________________________________________________________________________________________
+
+type blindingShuffleStruct struct {
+	*onet.TreeNode
+	BlindingShuffleMessage
+}
+
+// Protocol
+//______________________________________________________________________________________________________________________
+
+// BlindingShuffleProtocol passes a list of ciphertexts through all the nodes, each one multiplying every ciphertext by
+// its own random non-zero scalar and permuting them. In the end, a plaintext is zero if and only if one of the original
+// plaintexts was, but its value and its position are lost: once decrypted, the list only tells whether it contained an
+// encryption of zero. Payloads (encrypted with the collective key) can be attached to the ciphertexts: they follow
+// them through the permutations and are re-randomized by each node, so that the one attached to an encryption of zero
+// can be picked without being linked to its original position.
+type BlindingShuffleProtocol struct {
+	*onet.TreeNodeInstance
+
+	// Protocol feedback channel, the shuffled payloads are in ShuffledPayloads once the blinded ciphertexts are sent
+	FeedbackChannel  chan libunlynx.CipherVector
+	ShuffledPayloads []libunlynx.CipherVector
+
+	// Protocol communication channels
+	PreviousNodeChannel chan blindingShuffleStruct
+
+	// Protocol root data
+	TargetOfBlinding *libunlynx.CipherVector
+	Payloads         []libunlynx.CipherVector // each one has as many ciphertexts as TargetOfBlinding
+
+	nextNodeInCircuit *onet.TreeNode
+	aloneChannel      chan BlindingShuffleMessage // used instead of the circuit when the root is alone in the tree
+
+	// Timeout is how long a node waits for the previous node of the circuit
+	Timeout  time.Duration
+	ExecTime time.Duration
+
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewBlindingShuffleProtocol initializes the protocol instance.
+func NewBlindingShuffleProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	p := &BlindingShuffleProtocol{
+		TreeNodeInstance: n,
+		FeedbackChannel:  make(chan libunlynx.CipherVector),
+		Timeout:          libunlynx.TIMEOUT,
+		aloneChannel:     make(chan BlindingShuffleMessage, 1),
+		closing:          make(chan struct{}),
+	}
+
+	if err := p.RegisterChannel(&p.PreviousNodeChannel); err != nil {
+		return nil, xerrors.Errorf("couldn't register previous node channel: %+v", err)
+	}
+
+	// choose next node in circuit
+	nodeList := n.Tree().List()
+	for i, node := range nodeList {
+		if n.TreeNode().Equal(node) {
+			p.nextNodeInCircuit = nodeList[(i+1)%len(nodeList)]
+			break
+		}
+	}
+	return p, nil
+}
+
+// Start is called at the root to begin the execution of the protocol.
+func (p *BlindingShuffleProtocol) Start() error {
+	if p.TargetOfBlinding == nil {
+		return xerrors.New("no ciphertext given as blinding target")
+	}
+	for _, payload := range p.Payloads {
+		if len(payload) != len(*p.TargetOfBlinding) {
+			return xerrors.Errorf("%d payloads for %d ciphertexts", len(payload), len(*p.TargetOfBlinding))
+		}
+	}
+
+	log.Lvl2(p.ServerIdentity(), "started a Blinding Shuffle Protocol (", len(*p.TargetOfBlinding), "ciphertexts )")
+
+	start := time.Now()
+	blinded, payloads := BlindAndPermuteWithPayloads(*p.TargetOfBlinding, p.Payloads, p.Roster().Aggregate)
+	p.ExecTime = time.Since(start)
+
+	msg := BlindingShuffleMessage{Data: blinded, Payloads: joinPayloads(payloads, len(blinded))}
+	if p.nextNodeInCircuit.Equal(p.TreeNode()) {
+		p.aloneChannel <- msg
+		return nil
+	}
+	if err := p.SendTo(p.nextNodeInCircuit, &msg); err != nil {
+		return xerrors.Errorf("root "+p.ServerIdentity().String()+" failed to send BlindingShuffleMessage: %+v", err)
+	}
+	return nil
+}
+
+// Dispatch is called at each node and handle incoming messages.
+func (p *BlindingShuffleProtocol) Dispatch() error {
+	defer p.Done()
+
+	var msg blindingShuffleStruct
+	select {
+	case msg = <-p.PreviousNodeChannel:
+	case msg.BlindingShuffleMessage = <-p.aloneChannel:
+	case <-p.closing:
+		return xerrors.New(p.ServerIdentity().String() + " was shut down")
+	case <-time.After(p.Timeout):
+		return xerrors.New(p.ServerIdentity().String() + " didn't get the <BlindingShuffleMessage> on time")
+	}
+
+	received, err := splitPayloads(msg.Payloads, len(msg.Data))
+	if err != nil {
+		return xerrors.Errorf(p.ServerIdentity().String()+" got wrong payloads: %+v", err)
+	}
+	if p.IsRoot() {
+		p.ShuffledPayloads = received
+		p.feedback(msg.Data)
+		return nil
+	}
+
+	start := time.Now()
+	blinded, payloads := BlindAndPermuteWithPayloads(msg.Data, received, p.Roster().Aggregate)
+	p.ExecTime = time.Since(start)
+	if err := p.SendTo(p.nextNodeInCircuit, &BlindingShuffleMessage{Data: blinded,
+		Payloads: joinPayloads(payloads, len(blinded))}); err != nil {
+		return xerrors.Errorf("node "+p.ServerIdentity().String()+" failed to send BlindingShuffleMessage: %+v", err)
+	}
+	return nil
+}
+
+// Shutdown stops a running instance (it can be called several times).
+func (p *BlindingShuffleProtocol) Shutdown() error {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+	})
+	return nil
+}
+
+func (p *BlindingShuffleProtocol) feedback(data libunlynx.CipherVector) {
+	select {
+	case p.FeedbackChannel <- data:
+	case <-p.closing:
+	}
+}
+
+// joinPayloads puts the payloads of each ciphertext next to each other in a single vector
+func joinPayloads(payloads []libunlynx.CipherVector, count int) libunlynx.CipherVector {
+	joined := make(libunlynx.CipherVector, 0, len(payloads)*count)
+	for i := 0; i < count; i++ {
+		for _, payload := range payloads {
+			joined = append(joined, payload[i])
+		}
+	}
+	return joined
+}
+
+// splitPayloads is the inverse of joinPayloads
+func splitPayloads(joined libunlynx.CipherVector, count int) ([]libunlynx.CipherVector, error) {
+	if count == 0 || len(joined) == 0 {
+		return nil, nil
+	}
+	if len(joined)%count != 0 {
+		return nil, xerrors.Errorf("%d payloads for %d ciphertexts", len(joined), count)
+	}
+	payloads := make([]libunlynx.CipherVector, len(joined)/count)
+	for p := range payloads {
+		payloads[p] = make(libunlynx.CipherVector, count)
+		for i := range payloads[p] {
+			payloads[p][i] = joined[i*len(payloads)+p]
+		}
+	}
+	return payloads, nil
+}
+
+// BlindAndPermute multiplies each ciphertext by a random non-zero scalar and randomly permutes the result.
+func BlindAndPermute(data libunlynx.CipherVector) libunlynx.CipherVector {
+	blinded, _ := BlindAndPermuteWithPayloads(data, nil, nil)
+	return blinded
+}
+
+// BlindAndPermuteWithPayloads multiplies each ciphertext by a random non-zero scalar and randomly permutes the result,
+// the payloads are permuted the same way and re-randomized with key.
+func BlindAndPermuteWithPayloads(data libunlynx.CipherVector, payloads []libunlynx.CipherVector,
+	key kyber.Point) (libunlynx.CipherVector, []libunlynx.CipherVector) {
+	stream := random.New()
+	zero := libunlynx.SuiTe.Scalar().Zero()
+
+	blinded := make(libunlynx.CipherVector, len(data))
+	for i, v := range data {
+		r := libunlynx.SuiTe.Scalar().Pick(stream)
+		for r.Equal(zero) {
+			r = libunlynx.SuiTe.Scalar().Pick(stream)
+		}
+		blinded[i].MulCipherTextbyScalar(v, r)
+	}
+	rerandomized := make([]libunlynx.CipherVector, len(payloads))
+	for p, payload := range payloads {
+		rerandomized[p] = make(libunlynx.CipherVector, len(payload))
+		for i := range payload {
+			rerandomized[p][i].Add(payload[i], *libunlynx.EncryptInt(key, 0))
+		}
+	}
+
+	// Fisher-Yates shuffle
+	for i := len(blinded) - 1; i > 0; i-- {
+		j := int(random.Int(big.NewInt(int64(i+1)), stream).Int64())
+		blinded[i], blinded[j] = blinded[j], blinded[i]
+		for _, payload := range rerandomized {
+			payload[i], payload[j] = payload[j], payload[i]
+		}
+	}
+	return blinded, rerandomized
+}
@@ -0,0 +1,92 @@
+package protocols
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+)
+
+func TestBlindingShuffle(t *testing.T) {
+	local := onet.NewLocalTest(libunlynx.SuiTe)
+	_, _, tree := local.GenTree(4, true)
+
+	pi, err := local.CreateProtocol(BlindingShuffleProtocolName, tree)
+	require.NoError(t, err)
+	protocol := pi.(*BlindingShuffleProtocol)
+
+	secKey, pubKey := libunlynx.GenKey()
+	target := *libunlynx.EncryptIntVector(pubKey, []int64{0, 5, 0, 7, 1})
+	protocol.TargetOfBlinding = &target
+
+	go func() {
+		require.NoError(t, protocol.Start())
+	}()
+
+	select {
+	case result := <-protocol.FeedbackChannel:
+		require.Equal(t, len(target), len(result))
+		zeros := 0
+		for _, v := range result {
+			m := libunlynx.SuiTe.Point().Sub(v.C, libunlynx.SuiTe.Point().Mul(secKey, v.K))
+			if m.Equal(libunlynx.SuiTe.Point().Null()) {
+				zeros++
+			}
+		}
+		require.Equal(t, 2, zeros)
+	case <-time.After(10 * time.Second):
+		t.Fatal("didn't finish in time")
+	}
+
+	local.CloseAll()
+	log.AfterTest(t)
+}
+
+func TestBlindingShuffleWithPayloads(t *testing.T) {
+	local := onet.NewLocalTest(libunlynx.SuiTe)
+	servers, el, tree := local.GenTree(3, true)
+	collectiveSecret := libunlynx.SuiTe.Scalar().Zero()
+	for _, server := range servers {
+		collectiveSecret.Add(collectiveSecret, local.GetPrivate(server))
+	}
+
+	pi, err := local.CreateProtocol(BlindingShuffleProtocolName, tree)
+	require.NoError(t, err)
+	protocol := pi.(*BlindingShuffleProtocol)
+
+	// the ciphertexts are blinded under the key of the querier, the payloads are encrypted with the collective key
+	secKey, pubKey := libunlynx.GenKey()
+	target := *libunlynx.EncryptIntVector(pubKey, []int64{5, 0, 7})
+	protocol.TargetOfBlinding = &target
+	protocol.Payloads = []libunlynx.CipherVector{*libunlynx.EncryptIntVector(el.Aggregate, []int64{10, 11, 12})}
+
+	go func() {
+		require.NoError(t, protocol.Start())
+	}()
+
+	select {
+	case result := <-protocol.FeedbackChannel:
+		require.Equal(t, 1, len(protocol.ShuffledPayloads))
+		require.Equal(t, len(target), len(protocol.ShuffledPayloads[0]))
+		found := false
+		for i, v := range result {
+			m := libunlynx.SuiTe.Point().Sub(v.C, libunlynx.SuiTe.Point().Mul(secKey, v.K))
+			if m.Equal(libunlynx.SuiTe.Point().Null()) {
+				// the payload moved with the encryption of zero, and was re-randomized
+				payload := protocol.ShuffledPayloads[0][i]
+				require.False(t, payload.C.Equal(protocol.Payloads[0][1].C))
+				require.Equal(t, int64(11), libunlynx.DecryptInt(collectiveSecret, payload))
+				found = true
+			}
+		}
+		require.True(t, found)
+	case <-time.After(10 * time.Second):
+		t.Fatal("didn't finish in time")
+	}
+
+	local.CloseAll()
+	log.AfterTest(t)
+}
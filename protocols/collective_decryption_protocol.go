@@ -0,0 +1,236 @@
+package protocols
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/proof/dleq"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+// CollectiveDecryptionProtocolName is the registered name for the collective decryption protocol.
+const CollectiveDecryptionProtocolName = "CollectiveDecryption"
+
+func init() {
+	network.RegisterMessage(CDAnnouncementMessage{})
+	network.RegisterMessage(CDShareMessage{})
+	_, err := onet.GlobalProtocolRegister(CollectiveDecryptionProtocolName, NewCollectiveDecryptionProtocol)
+	log.ErrFatal(err, "Failed to register the <CollectiveDecryption> protocol:")
+}
+
+// Messages
+//______________________________________________________________________________________________________________________
+
+// CDAnnouncementMessage is sent by the root to the other nodes with the ciphertexts to decrypt
+type CDAnnouncementMessage struct {
+	Targets libunlynx.CipherVector
+}
+
+// CDShareMessage is sent back to the root by each node with its decryption shares x_i.K and the proofs that they are
+// made with the key of the node, unless it refuses to decrypt
+type CDShareMessage struct {
+	Refused bool
+	Shares  []kyber.Point
+	Proofs  []*dleq.Proof
+}
+
+// Structs
+//______________________________________________________________________________________________________________________
+
+type cdAnnouncementStruct struct {
+	*onet.TreeNode
+	CDAnnouncementMessage
+}
+
+type cdShareStruct struct {
+	*onet.TreeNode
+	CDShareMessage
+}
+
+// Protocol
+//______________________________________________________________________________________________________________________
+
+// CollectiveDecryptionProtocol decrypts ciphertexts encrypted with the collective key of the roster: each node sends
+// its decryption shares with proofs to the root, which verifies them and removes them from the ciphertexts. The result
+// is the plaintext points m.B, every node has to take part. It runs on a star tree (every node is a child of the
+// root).
+type CollectiveDecryptionProtocol struct {
+	*onet.TreeNodeInstance
+
+	// Protocol feedback channel
+	FeedbackChannel chan []kyber.Point
+
+	// Protocol communication channels
+	AnnouncementChannel chan cdAnnouncementStruct
+	ShareChannel        chan cdShareStruct
+
+	// TargetOfDecryption is set at the root
+	TargetOfDecryption *libunlynx.CipherVector
+	// Allowed is whether this node accepts to decrypt (true by default)
+	Allowed bool
+	// Decryptable, if set, tells whether this node accepts to decrypt the targets it receives from the root
+	Decryptable func(targets libunlynx.CipherVector) bool
+
+	// Timeout is how long the nodes wait for each other
+	Timeout  time.Duration
+	ExecTime time.Duration
+
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewCollectiveDecryptionProtocol initializes the protocol instance.
+func NewCollectiveDecryptionProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	p := &CollectiveDecryptionProtocol{
+		TreeNodeInstance: n,
+		FeedbackChannel:  make(chan []kyber.Point),
+		Allowed:          true,
+		Timeout:          libunlynx.TIMEOUT,
+		closing:          make(chan struct{}),
+	}
+
+	if err := p.RegisterChannel(&p.AnnouncementChannel); err != nil {
+		return nil, xerrors.Errorf("couldn't register announcement channel: %+v", err)
+	}
+	if err := p.RegisterChannelLength(&p.ShareChannel, len(n.Tree().List())); err != nil {
+		return nil, xerrors.Errorf("couldn't register share channel: %+v", err)
+	}
+	return p, nil
+}
+
+// Start is called at the root to begin the execution of the protocol.
+func (p *CollectiveDecryptionProtocol) Start() error {
+	if p.TargetOfDecryption == nil {
+		return xerrors.New("no ciphertext given as decryption target")
+	}
+	if !p.Allowed {
+		return xerrors.New("root " + p.ServerIdentity().String() + " refuses the collective decryption")
+	}
+
+	log.Lvl2(p.ServerIdentity(), "started a Collective Decryption Protocol (", len(p.Children()), "children )")
+
+	if errs := p.SendToChildrenInParallel(&CDAnnouncementMessage{Targets: *p.TargetOfDecryption}); len(errs) > 0 {
+		return xerrors.Errorf("root "+p.ServerIdentity().String()+" failed to send CDAnnouncementMessage: %+v", errs)
+	}
+	return nil
+}
+
+// Dispatch is called at each node and handle incoming messages.
+func (p *CollectiveDecryptionProtocol) Dispatch() error {
+	defer p.Done()
+
+	deadline := time.After(p.Timeout)
+	if !p.IsRoot() {
+		var targets libunlynx.CipherVector
+		select {
+		case msg := <-p.AnnouncementChannel:
+			targets = msg.Targets
+		case <-p.closing:
+			return xerrors.New(p.ServerIdentity().String() + " was shut down")
+		case <-deadline:
+			return xerrors.New(p.ServerIdentity().String() + " didn't get the <CDAnnouncementMessage> on time")
+		}
+
+		start := time.Now()
+		msg := CDShareMessage{Refused: true}
+		if p.Allowed && (p.Decryptable == nil || p.Decryptable(targets)) {
+			var err error
+			if msg, err = p.decryptionShares(targets); err != nil {
+				return err
+			}
+		} else {
+			log.Lvl2(p.ServerIdentity(), "refused a collective decryption")
+		}
+		p.ExecTime = time.Since(start)
+		if err := p.SendToParent(&msg); err != nil {
+			return xerrors.Errorf("node "+p.ServerIdentity().String()+" failed to send CDShareMessage: %+v", err)
+		}
+		return nil
+	}
+
+	if p.TargetOfDecryption == nil || !p.Allowed {
+		return nil // Start failed
+	}
+	targets := *p.TargetOfDecryption
+	start := time.Now()
+	own, err := p.decryptionShares(targets)
+	if err != nil {
+		return err
+	}
+	plaintexts := make([]kyber.Point, len(targets))
+	for i, ct := range targets {
+		plaintexts[i] = libunlynx.SuiTe.Point().Sub(ct.C, own.Shares[i])
+	}
+	for received := 0; received < len(p.Children()); received++ {
+		select {
+		case msg := <-p.ShareChannel:
+			if msg.Refused {
+				return xerrors.Errorf("node %s refuses the collective decryption", msg.ServerIdentity)
+			}
+			if err := verifyDecryptionShares(targets, p.NodePublic(msg.ServerIdentity), msg.CDShareMessage); err != nil {
+				return xerrors.Errorf("wrong decryption shares from %s: %+v", msg.ServerIdentity, err)
+			}
+			for i := range plaintexts {
+				plaintexts[i].Sub(plaintexts[i], msg.Shares[i])
+			}
+		case <-p.closing:
+			return xerrors.New(p.ServerIdentity().String() + " was shut down")
+		case <-deadline:
+			return xerrors.New(p.ServerIdentity().String() + " didn't get all the <CDShareMessage> on time")
+		}
+	}
+	p.ExecTime = time.Since(start)
+
+	select {
+	case p.FeedbackChannel <- plaintexts:
+	case <-p.closing:
+	}
+	return nil
+}
+
+// Shutdown stops a running instance (it can be called several times).
+func (p *CollectiveDecryptionProtocol) Shutdown() error {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+	})
+	return nil
+}
+
+// decryptionShares computes the decryption shares x_i.K of this node and the proofs that log_B(X_i) = log_K(x_i.K)
+func (p *CollectiveDecryptionProtocol) decryptionShares(targets libunlynx.CipherVector) (CDShareMessage, error) {
+	bases := make([]kyber.Point, len(targets))
+	ks := make([]kyber.Point, len(targets))
+	secrets := make([]kyber.Scalar, len(targets))
+	for i, ct := range targets {
+		bases[i] = libunlynx.SuiTe.Point().Base()
+		ks[i] = ct.K
+		secrets[i] = p.Private()
+	}
+	proofs, _, shares, err := dleq.NewDLEQProofBatch(libunlynx.SuiTe, bases, ks, secrets)
+	if err != nil {
+		return CDShareMessage{}, xerrors.Errorf("couldn't create the decryption proofs: %+v", err)
+	}
+	return CDShareMessage{Shares: shares, Proofs: proofs}, nil
+}
+
+// verifyDecryptionShares checks the decryption shares of a node with public key X against their proofs
+func verifyDecryptionShares(targets libunlynx.CipherVector, X kyber.Point, msg CDShareMessage) error {
+	if len(msg.Shares) != len(targets) || len(msg.Proofs) != len(targets) {
+		return xerrors.Errorf("%d shares and %d proofs for %d ciphertexts", len(msg.Shares), len(msg.Proofs),
+			len(targets))
+	}
+	for i, ct := range targets {
+		if msg.Proofs[i] == nil {
+			return xerrors.Errorf("no proof for ciphertext %d", i)
+		}
+		if err := msg.Proofs[i].Verify(libunlynx.SuiTe, libunlynx.SuiTe.Point().Base(), ct.K, X, msg.Shares[i]); err != nil {
+			return xerrors.Errorf("ciphertext %d: %+v", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package protocols
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+)
+
+func init() {
+	_, err := onet.GlobalProtocolRegister("CollectiveDecryptionRefusedTest", newCollectiveDecryptionRefusedTest)
+	log.ErrFatal(err, "Failed to register the <CollectiveDecryptionRefusedTest> protocol:")
+	_, err = onet.GlobalProtocolRegister("CollectiveDecryptionUndecryptableTest", newCollectiveDecryptionUndecryptableTest)
+	log.ErrFatal(err, "Failed to register the <CollectiveDecryptionUndecryptableTest> protocol:")
+}
+
+// the node at index 2 refuses to decrypt
+func newCollectiveDecryptionRefusedTest(tni *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	pi, err := NewCollectiveDecryptionProtocol(tni)
+	if err != nil {
+		return nil, err
+	}
+	protocol := pi.(*CollectiveDecryptionProtocol)
+	protocol.Timeout = 2 * time.Second
+	protocol.Allowed = tni.TreeNode().RosterIndex != 2
+	return protocol, nil
+}
+
+// the node at index 3 only decrypts a single value
+func newCollectiveDecryptionUndecryptableTest(tni *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	pi, err := NewCollectiveDecryptionProtocol(tni)
+	if err != nil {
+		return nil, err
+	}
+	protocol := pi.(*CollectiveDecryptionProtocol)
+	protocol.Timeout = 2 * time.Second
+	if tni.TreeNode().RosterIndex == 3 {
+		protocol.Decryptable = func(targets libunlynx.CipherVector) bool {
+			return len(targets) == 1
+		}
+	}
+	return protocol, nil
+}
+
+func TestCollectiveDecryption(t *testing.T) {
+	local := onet.NewLocalTest(libunlynx.SuiTe)
+	_, el, _ := local.GenTree(4, true)
+	targets := *libunlynx.EncryptIntVector(el.Aggregate, []int64{3, 0, 7})
+
+	pi, err := local.CreateProtocol(CollectiveDecryptionProtocolName, el.GenerateStar())
+	require.NoError(t, err)
+	protocol := pi.(*CollectiveDecryptionProtocol)
+	protocol.TargetOfDecryption = &targets
+	require.NoError(t, protocol.Start())
+
+	select {
+	case plaintexts := <-protocol.FeedbackChannel:
+		require.Equal(t, 3, len(plaintexts))
+		for i, v := range []int64{3, 0, 7} {
+			require.True(t, libunlynx.IntToPoint(v).Equal(plaintexts[i]))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("didn't finish in time")
+	}
+
+	local.CloseAll()
+	log.AfterTest(t)
+}
+
+func TestCollectiveDecryptionRefused(t *testing.T) {
+	local := onet.NewLocalTest(libunlynx.SuiTe)
+	_, el, _ := local.GenTree(4, true)
+	targets := *libunlynx.EncryptIntVector(el.Aggregate, []int64{1})
+
+	pi, err := local.CreateProtocol("CollectiveDecryptionRefusedTest", el.GenerateStar())
+	require.NoError(t, err)
+	protocol := pi.(*CollectiveDecryptionProtocol)
+	protocol.TargetOfDecryption = &targets
+	require.NoError(t, protocol.Start())
+
+	select {
+	case <-protocol.FeedbackChannel:
+		t.Fatal("got a result without the node that refused")
+	case <-time.After(2 * time.Second):
+	}
+
+	local.CloseAll()
+	log.AfterTest(t)
+}
+
+func TestCollectiveDecryptionUndecryptable(t *testing.T) {
+	local := onet.NewLocalTest(libunlynx.SuiTe)
+	_, el, _ := local.GenTree(4, true)
+
+	for _, values := range [][]int64{{4}, {4, 2}} {
+		targets := *libunlynx.EncryptIntVector(el.Aggregate, values)
+		pi, err := local.CreateProtocol("CollectiveDecryptionUndecryptableTest", el.GenerateStar())
+		require.NoError(t, err)
+		protocol := pi.(*CollectiveDecryptionProtocol)
+		protocol.TargetOfDecryption = &targets
+		require.NoError(t, protocol.Start())
+
+		select {
+		case plaintexts := <-protocol.FeedbackChannel:
+			require.Equal(t, 1, len(values), "got a result the node at index 3 refused to decrypt")
+			require.True(t, libunlynx.IntToPoint(4).Equal(plaintexts[0]))
+		case <-time.After(3 * time.Second):
+			require.Equal(t, 2, len(values), "didn't finish in time")
+		}
+	}
+
+	local.CloseAll()
+	log.AfterTest(t)
+}
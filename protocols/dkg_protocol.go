@@ -0,0 +1,318 @@
+package protocols
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/group/edwards25519"
+	"go.dedis.ch/kyber/v3/share/dkg/pedersen"
+	"go.dedis.ch/kyber/v3/share/vss/pedersen"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+// DKGProtocolName is the registered name for the distributed key generation protocol.
+const DKGProtocolName = "DKG"
+
+// DKGSuite is the suite of the distributed key generation (the group of libunlynx.SuiTe)
+var DKGSuite = edwards25519.NewBlakeSHA256Ed25519()
+
+func init() {
+	network.RegisterMessage(DKGAnnouncementMessage{})
+	network.RegisterMessage(DKGDealMessage{})
+	network.RegisterMessage(DKGResponseMessage{})
+	network.RegisterMessage(DKGDoneMessage{})
+	_, err := onet.GlobalProtocolRegister(DKGProtocolName, NewDKGProtocol)
+	log.ErrFatal(err, "Failed to register the <DKG> protocol:")
+}
+
+// Messages
+//______________________________________________________________________________________________________________________
+
+// DKGAnnouncementMessage is sent by the root to start the key generation
+type DKGAnnouncementMessage struct {
+	Threshold int
+}
+
+// DKGDealMessage carries the deal of a node (its share of the secret polynomial of the dealer) to another node
+type DKGDealMessage struct {
+	Deal *dkg.Deal
+}
+
+// DKGResponseMessage carries the approval of a deal by a node to all the other nodes
+type DKGResponseMessage struct {
+	Response *dkg.Response
+}
+
+// DKGDoneMessage is sent back to the root by each node once it holds its share of the collective key
+type DKGDoneMessage struct {
+	Public kyber.Point
+}
+
+// Structs
+//______________________________________________________________________________________________________________________
+
+type dkgAnnouncementStruct struct {
+	*onet.TreeNode
+	DKGAnnouncementMessage
+}
+
+type dkgDealStruct struct {
+	*onet.TreeNode
+	DKGDealMessage
+}
+
+type dkgResponseStruct struct {
+	*onet.TreeNode
+	DKGResponseMessage
+}
+
+type dkgDoneStruct struct {
+	*onet.TreeNode
+	DKGDoneMessage
+}
+
+// DKGResult is the outcome of the key generation at the root
+type DKGResult struct {
+	Share     *dkg.DistKeyShare // share of the root
+	Threshold int
+}
+
+// Protocol
+//______________________________________________________________________________________________________________________
+
+// DKGProtocol runs a Pedersen distributed key generation among the nodes of the roster, in the order of the roster: in
+// the end each node holds a share of a collective private key that nobody knows, and any Threshold of them can use it.
+// The messages are exchanged directly between the nodes, whatever the shape of the tree. The generation fails
+// if a node complains about a deal.
+type DKGProtocol struct {
+	*onet.TreeNodeInstance
+
+	// Protocol feedback channel
+	FeedbackChannel chan DKGResult
+
+	// Protocol communication channels
+	AnnouncementChannel chan dkgAnnouncementStruct
+	DealChannel         chan dkgDealStruct
+	ResponseChannel     chan dkgResponseStruct
+	DoneChannel         chan dkgDoneStruct
+
+	// Threshold is the number of shares needed to use the collective key (set at the root)
+	Threshold int
+	// Longterm is the private key of this node and Participants the public keys of the nodes of the roster, the deals
+	// are encrypted and signed with them (the keys of the nodes by default)
+	Longterm     kyber.Scalar
+	Participants []kyber.Point
+	// ShareFunc is called at each node with its share before it reports to the root
+	ShareFunc func(share *dkg.DistKeyShare, threshold int) error
+
+	// Timeout is how long the nodes wait for the whole generation
+	Timeout  time.Duration
+	ExecTime time.Duration
+
+	aloneChannel chan int // announcement of the root to itself
+	closing      chan struct{}
+	closeOnce    sync.Once
+}
+
+// NewDKGProtocol initializes the protocol instance.
+func NewDKGProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	p := &DKGProtocol{
+		TreeNodeInstance: n,
+		FeedbackChannel:  make(chan DKGResult),
+		Longterm:         n.Private(),
+		Participants:     n.Roster().Publics(),
+		Timeout:          libunlynx.TIMEOUT,
+		aloneChannel:     make(chan int, 1),
+		closing:          make(chan struct{}),
+	}
+
+	nodes := len(n.Tree().List())
+	if err := p.RegisterChannel(&p.AnnouncementChannel); err != nil {
+		return nil, xerrors.Errorf("couldn't register announcement channel: %+v", err)
+	}
+	if err := p.RegisterChannelLength(&p.DealChannel, nodes); err != nil {
+		return nil, xerrors.Errorf("couldn't register deal channel: %+v", err)
+	}
+	if err := p.RegisterChannelLength(&p.ResponseChannel, nodes*nodes); err != nil {
+		return nil, xerrors.Errorf("couldn't register response channel: %+v", err)
+	}
+	if err := p.RegisterChannelLength(&p.DoneChannel, nodes); err != nil {
+		return nil, xerrors.Errorf("couldn't register done channel: %+v", err)
+	}
+	return p, nil
+}
+
+// Start is called at the root to begin the execution of the protocol.
+func (p *DKGProtocol) Start() error {
+	if p.Threshold < 2 || p.Threshold > len(p.Tree().List()) {
+		return xerrors.Errorf("wrong threshold %d for %d nodes", p.Threshold, len(p.Tree().List()))
+	}
+
+	log.Lvl2(p.ServerIdentity(), "started a DKG Protocol (", len(p.Tree().List()), "nodes, threshold", p.Threshold, ")")
+
+	p.aloneChannel <- p.Threshold
+	for _, tn := range p.Tree().List() {
+		if tn.Equal(p.TreeNode()) {
+			continue
+		}
+		if err := p.SendTo(tn, &DKGAnnouncementMessage{Threshold: p.Threshold}); err != nil {
+			return xerrors.Errorf("root "+p.ServerIdentity().String()+" failed to send DKGAnnouncementMessage: %+v", err)
+		}
+	}
+	return nil
+}
+
+// Dispatch is called at each node and handle incoming messages.
+func (p *DKGProtocol) Dispatch() error {
+	defer p.Done()
+
+	deadline := time.After(p.Timeout)
+	threshold := 0
+	select {
+	case msg := <-p.AnnouncementChannel:
+		threshold = msg.Threshold
+	case threshold = <-p.aloneChannel:
+	case <-p.closing:
+		return xerrors.New(p.ServerIdentity().String() + " was shut down")
+	case <-deadline:
+		return xerrors.New(p.ServerIdentity().String() + " didn't get the <DKGAnnouncementMessage> on time")
+	}
+
+	start := time.Now()
+	share, err := p.generate(threshold, deadline)
+	if err != nil {
+		return err
+	}
+	if p.ShareFunc != nil {
+		if err := p.ShareFunc(share, threshold); err != nil {
+			return xerrors.Errorf("node "+p.ServerIdentity().String()+" couldn't keep its DKG share: %+v", err)
+		}
+	}
+	p.ExecTime = time.Since(start)
+
+	if !p.IsRoot() {
+		if err := p.SendTo(p.Root(), &DKGDoneMessage{Public: share.Public()}); err != nil {
+			return xerrors.Errorf("node "+p.ServerIdentity().String()+" failed to send DKGDoneMessage: %+v", err)
+		}
+		return nil
+	}
+
+	for i := 1; i < len(p.Tree().List()); i++ {
+		select {
+		case msg := <-p.DoneChannel:
+			if !msg.Public.Equal(share.Public()) {
+				return xerrors.Errorf("node %s got a different collective key", msg.ServerIdentity)
+			}
+		case <-p.closing:
+			return xerrors.New(p.ServerIdentity().String() + " was shut down")
+		case <-deadline:
+			return xerrors.New(p.ServerIdentity().String() + " didn't get the <DKGDoneMessage> on time")
+		}
+	}
+
+	select {
+	case p.FeedbackChannel <- DKGResult{Share: share, Threshold: threshold}:
+	case <-p.closing:
+	}
+	return nil
+}
+
+// Shutdown stops a running instance (it can be called several times).
+func (p *DKGProtocol) Shutdown() error {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+	})
+	return nil
+}
+
+// generate deals the shares of this node and processes the deals and the responses of the other nodes until all the
+// deals are certified
+func (p *DKGProtocol) generate(threshold int, deadline <-chan time.Time) (*dkg.DistKeyShare, error) {
+	gen, err := dkg.NewDistKeyGenerator(DKGSuite, p.Longterm, p.Participants, threshold)
+	if err != nil {
+		return nil, xerrors.Errorf("couldn't create the key generator: %+v", err)
+	}
+
+	nodes := make([]*onet.TreeNode, len(p.Roster().List))
+	for _, tn := range p.Tree().List() {
+		nodes[tn.RosterIndex] = tn
+	}
+	self := uint32(p.TreeNode().RosterIndex)
+
+	deals, err := gen.Deals()
+	if err != nil {
+		return nil, xerrors.Errorf("couldn't create the deals: %+v", err)
+	}
+	for i, deal := range deals {
+		if err := p.SendTo(nodes[i], &DKGDealMessage{Deal: deal}); err != nil {
+			return nil, xerrors.Errorf("node "+p.ServerIdentity().String()+" failed to send DKGDealMessage: %+v", err)
+		}
+	}
+
+	// the responses to a deal can arrive before the deal itself
+	dealt := map[uint32]bool{self: true}
+	pending := make(map[uint32][]*dkg.Response)
+	processResponse := func(resp *dkg.Response) error {
+		justification, err := gen.ProcessResponse(resp)
+		if err != nil {
+			return xerrors.Errorf("wrong response to the deal of node %d: %+v", resp.Index, err)
+		}
+		if justification != nil || resp.Response.Status != vss.StatusApproval {
+			return xerrors.Errorf("node %d complained about the deal of node %d", resp.Response.Index, resp.Index)
+		}
+		return nil
+	}
+
+	for !gen.Certified() {
+		select {
+		case msg := <-p.DealChannel:
+			resp, err := gen.ProcessDeal(msg.Deal)
+			if err != nil {
+				return nil, xerrors.Errorf("wrong deal from %s: %+v", msg.ServerIdentity, err)
+			}
+			if resp.Response.Status != vss.StatusApproval {
+				return nil, xerrors.Errorf("complaint about the deal of %s", msg.ServerIdentity)
+			}
+			for i, tn := range nodes {
+				if uint32(i) == self {
+					continue
+				}
+				if err := p.SendTo(tn, &DKGResponseMessage{Response: resp}); err != nil {
+					return nil, xerrors.Errorf("node "+p.ServerIdentity().String()+
+						" failed to send DKGResponseMessage: %+v", err)
+				}
+			}
+
+			dealt[msg.Deal.Index] = true
+			for _, resp := range pending[msg.Deal.Index] {
+				if err := processResponse(resp); err != nil {
+					return nil, err
+				}
+			}
+			delete(pending, msg.Deal.Index)
+		case msg := <-p.ResponseChannel:
+			if !dealt[msg.Response.Index] {
+				pending[msg.Response.Index] = append(pending[msg.Response.Index], msg.Response)
+				continue
+			}
+			if err := processResponse(msg.Response); err != nil {
+				return nil, err
+			}
+		case <-p.closing:
+			return nil, xerrors.New(p.ServerIdentity().String() + " was shut down")
+		case <-deadline:
+			return nil, xerrors.New(p.ServerIdentity().String() + " didn't get all the deals and responses on time")
+		}
+	}
+
+	share, err := gen.DistKeyShare()
+	if err != nil {
+		return nil, xerrors.Errorf("couldn't compute the share: %+v", err)
+	}
+	return share, nil
+}
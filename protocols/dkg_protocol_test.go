@@ -0,0 +1,96 @@
+package protocols
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/kyber/v3/share"
+	"go.dedis.ch/kyber/v3/share/dkg/pedersen"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
+)
+
+var dkgShares struct {
+	sync.Mutex
+	shares []*dkg.DistKeyShare
+}
+
+func init() {
+	_, err := onet.GlobalProtocolRegister("DKGTest", newDKGTest)
+	log.ErrFatal(err, "Failed to register the <DKGTest> protocol:")
+}
+
+// the shares of all the nodes are collected
+func newDKGTest(tni *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	pi, err := NewDKGProtocol(tni)
+	if err != nil {
+		return nil, err
+	}
+	protocol := pi.(*DKGProtocol)
+	protocol.ShareFunc = func(share *dkg.DistKeyShare, threshold int) error {
+		if threshold != 3 {
+			return xerrors.Errorf("wrong threshold %d", threshold)
+		}
+		dkgShares.Lock()
+		defer dkgShares.Unlock()
+		dkgShares.shares = append(dkgShares.shares, share)
+		return nil
+	}
+	return protocol, nil
+}
+
+func TestDKG(t *testing.T) {
+	local := onet.NewLocalTest(libunlynx.SuiTe)
+	_, _, tree := local.GenTree(4, true)
+
+	pi, err := local.CreateProtocol("DKGTest", tree)
+	require.NoError(t, err)
+	protocol := pi.(*DKGProtocol)
+	protocol.Threshold = 3
+	require.NoError(t, protocol.Start())
+
+	select {
+	case result := <-protocol.FeedbackChannel:
+		require.Equal(t, 3, result.Threshold)
+		dkgShares.Lock()
+		shares := dkgShares.shares
+		dkgShares.Unlock()
+		require.Equal(t, 4, len(shares))
+
+		// any 3 shares recover the collective private key
+		priShares := make([]*share.PriShare, 0)
+		for _, s := range shares[:3] {
+			require.True(t, s.Public().Equal(result.Share.Public()))
+			priShares = append(priShares, s.Share)
+		}
+		secret, err := share.RecoverSecret(DKGSuite, priShares, 3, 4)
+		require.NoError(t, err)
+		require.True(t, DKGSuite.Point().Mul(secret, nil).Equal(result.Share.Public()))
+
+		_, err = share.RecoverSecret(DKGSuite, priShares[:2], 3, 4)
+		require.Error(t, err)
+	case <-time.After(20 * time.Second):
+		t.Fatal("didn't finish in time")
+	}
+
+	local.CloseAll()
+	log.AfterTest(t)
+}
+
+func TestDKGWrongThreshold(t *testing.T) {
+	local := onet.NewLocalTest(libunlynx.SuiTe)
+	_, _, tree := local.GenTree(3, true)
+
+	pi, err := local.CreateProtocol(DKGProtocolName, tree)
+	require.NoError(t, err)
+	protocol := pi.(*DKGProtocol)
+	protocol.Threshold = 4
+	require.Error(t, protocol.Start())
+	protocol.Shutdown()
+
+	local.CloseAll()
+}
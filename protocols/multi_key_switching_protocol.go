@@ -0,0 +1,268 @@
+package protocols
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"github.com/ldsec/unlynx/lib/key_switch"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+// MultiKeySwitchingProtocolName is the registered name for the key switching protocol to several keys.
+const MultiKeySwitchingProtocolName = "MultiKeySwitching"
+
+func init() {
+	network.RegisterMessage(MKSAnnouncementMessage{})
+	network.RegisterMessage(MKSContributionMessage{})
+	_, err := onet.GlobalProtocolRegister(MultiKeySwitchingProtocolName, NewMultiKeySwitchingProtocol)
+	log.ErrFatal(err, "Failed to register the <MultiKeySwitching> protocol:")
+}
+
+// KeySwitch is the switch of the ciphertext at index Target to the public key at index Key
+type KeySwitch struct {
+	Target int
+	Key    int
+}
+
+// Messages
+//______________________________________________________________________________________________________________________
+
+// MKSAnnouncementMessage is sent down the tree with the ephemeral keys K of the ciphertexts, the public keys and the
+// switches to make (each ciphertext and each key is only sent once, whatever the number of switches using it)
+type MKSAnnouncementMessage struct {
+	Rbs        []kyber.Point
+	PublicKeys []kyber.Point
+	Switches   []KeySwitch
+}
+
+// MKSContributionMessage is sent up the tree by each node with the sum of the contributions of its subtree to each
+// switch
+type MKSContributionMessage struct {
+	Contribution libunlynx.CipherVector
+}
+
+// Structs
+//______________________________________________________________________________________________________________________
+
+type mksAnnouncementStruct struct {
+	*onet.TreeNode
+	MKSAnnouncementMessage
+}
+
+type mksContributionStruct struct {
+	*onet.TreeNode
+	MKSContributionMessage
+}
+
+// Protocol
+//______________________________________________________________________________________________________________________
+
+// MultiKeySwitchingProtocol switches ciphertexts encrypted with the collective key of the roster to several public
+// keys in a single run: the announcement goes down the tree once and each node makes its contribution (r.B, r.Q - x.K)
+// to every switch of a ciphertext (K, C) to a key Q in one pass, the contributions being summed up the tree as in the
+// key switching protocol of unlynx. The result holds one ciphertext per switch, in the order of the switches.
+type MultiKeySwitchingProtocol struct {
+	*onet.TreeNodeInstance
+
+	// Protocol feedback channel
+	FeedbackChannel chan libunlynx.CipherVector
+
+	// Protocol communication channels
+	AnnouncementChannel chan mksAnnouncementStruct
+	ContributionChannel chan mksContributionStruct
+
+	// TargetOfSwitch, TargetPublicKeys and Switches are set at the root
+	TargetOfSwitch   *libunlynx.CipherVector
+	TargetPublicKeys *[]kyber.Point
+	Switches         []KeySwitch
+	// SwitchTimes are, at the root, the times spent on the switches to each key (contribution of the root and
+	// combination of the contributions), in the order of TargetPublicKeys
+	SwitchTimes []time.Duration
+
+	// Timeout is how long the nodes wait for each other
+	Timeout  time.Duration
+	ExecTime time.Duration
+
+	aloneChannel chan MKSAnnouncementMessage // announcement of the root to itself
+	closing      chan struct{}
+	closeOnce    sync.Once
+}
+
+// NewMultiKeySwitchingProtocol initializes the protocol instance.
+func NewMultiKeySwitchingProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	p := &MultiKeySwitchingProtocol{
+		TreeNodeInstance: n,
+		FeedbackChannel:  make(chan libunlynx.CipherVector),
+		Timeout:          libunlynx.TIMEOUT,
+		aloneChannel:     make(chan MKSAnnouncementMessage, 1),
+		closing:          make(chan struct{}),
+	}
+
+	if err := p.RegisterChannel(&p.AnnouncementChannel); err != nil {
+		return nil, xerrors.Errorf("couldn't register announcement channel: %+v", err)
+	}
+	if err := p.RegisterChannelLength(&p.ContributionChannel, len(n.Tree().List())); err != nil {
+		return nil, xerrors.Errorf("couldn't register contribution channel: %+v", err)
+	}
+	return p, nil
+}
+
+// Start is called at the root to begin the execution of the protocol.
+func (p *MultiKeySwitchingProtocol) Start() error {
+	if p.TargetOfSwitch == nil {
+		return xerrors.New("no ciphertext given as key switching target")
+	}
+	if p.TargetPublicKeys == nil {
+		return xerrors.New("no new public keys to be switched on provided")
+	}
+
+	msg := MKSAnnouncementMessage{
+		Rbs:        make([]kyber.Point, len(*p.TargetOfSwitch)),
+		PublicKeys: *p.TargetPublicKeys,
+		Switches:   p.Switches,
+	}
+	for i, ct := range *p.TargetOfSwitch {
+		msg.Rbs[i] = ct.K
+	}
+	if err := checkKeySwitches(msg); err != nil {
+		return err
+	}
+
+	log.Lvl2(p.ServerIdentity(), "started a Multi Key Switching Protocol (", len(p.Switches), "switches to",
+		len(msg.PublicKeys), "keys )")
+
+	p.aloneChannel <- msg
+	if err := p.SendToChildren(&msg); err != nil {
+		return xerrors.Errorf("root "+p.ServerIdentity().String()+" failed to send MKSAnnouncementMessage: %+v", err)
+	}
+	return nil
+}
+
+// Dispatch is called at each node and handle incoming messages.
+func (p *MultiKeySwitchingProtocol) Dispatch() error {
+	defer p.Done()
+
+	deadline := time.After(p.Timeout)
+	var announcement MKSAnnouncementMessage
+	select {
+	case msg := <-p.AnnouncementChannel:
+		announcement = msg.MKSAnnouncementMessage
+		if err := p.SendToChildren(&announcement); err != nil {
+			return xerrors.Errorf("node "+p.ServerIdentity().String()+" failed to send MKSAnnouncementMessage: %+v", err)
+		}
+		if err := checkKeySwitches(announcement); err != nil {
+			return err
+		}
+	case announcement = <-p.aloneChannel:
+	case <-p.closing:
+		return xerrors.New(p.ServerIdentity().String() + " was shut down")
+	case <-deadline:
+		return xerrors.New(p.ServerIdentity().String() + " didn't get the <MKSAnnouncementMessage> on time")
+	}
+
+	start := time.Now()
+	contribution, switchTimes := p.contribution(announcement)
+	execTime := time.Since(start)
+
+	// the contributions of the subtree are summed
+	for received := 0; received < len(p.Children()); received++ {
+		select {
+		case msg := <-p.ContributionChannel:
+			if len(msg.Contribution) != len(contribution) {
+				return xerrors.Errorf("%d contributions from %s for %d switches", len(msg.Contribution),
+					msg.ServerIdentity, len(contribution))
+			}
+			start := time.Now()
+			contribution.Add(contribution, msg.Contribution)
+			execTime += time.Since(start)
+		case <-p.closing:
+			return xerrors.New(p.ServerIdentity().String() + " was shut down")
+		case <-deadline:
+			return xerrors.New(p.ServerIdentity().String() + " didn't get the <MKSContributionMessage> on time")
+		}
+	}
+
+	if !p.IsRoot() {
+		p.ExecTime = execTime
+		if err := p.SendToParent(&MKSContributionMessage{Contribution: contribution}); err != nil {
+			return xerrors.Errorf("node "+p.ServerIdentity().String()+" failed to send MKSContributionMessage: %+v", err)
+		}
+		return nil
+	}
+
+	// (sum r_i.B, C + sum r_i.Q - x_i.K) = (r.B, m.B + r.Q)
+	switched := make(libunlynx.CipherVector, len(announcement.Switches))
+	for i, sw := range announcement.Switches {
+		start := time.Now()
+		switched[i].K = contribution[i].K
+		switched[i].C = libunlynx.SuiTe.Point().Add(contribution[i].C, (*p.TargetOfSwitch)[sw.Target].C)
+		switchTimes[sw.Key] += time.Since(start)
+	}
+	p.SwitchTimes = switchTimes
+	p.ExecTime = execTime
+
+	select {
+	case p.FeedbackChannel <- switched:
+	case <-p.closing:
+	}
+	return nil
+}
+
+// Shutdown stops a running instance (it can be called several times).
+func (p *MultiKeySwitchingProtocol) Shutdown() error {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+	})
+	return nil
+}
+
+// contribution computes the contribution (r.B, r.Q - x.K) of this node to each switch, the switches to the same key
+// being made together. It also returns the time spent on the switches to each key.
+func (p *MultiKeySwitchingProtocol) contribution(announcement MKSAnnouncementMessage) (libunlynx.CipherVector,
+	[]time.Duration) {
+	groups := make([][]int, len(announcement.PublicKeys))
+	for i, sw := range announcement.Switches {
+		groups[sw.Key] = append(groups[sw.Key], i)
+	}
+
+	contribution := make(libunlynx.CipherVector, len(announcement.Switches))
+	switchTimes := make([]time.Duration, len(announcement.PublicKeys))
+	for key, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		start := time.Now()
+		rBs := make([]kyber.Point, len(group))
+		for j, i := range group {
+			rBs[j] = announcement.Rbs[announcement.Switches[i].Target]
+		}
+		switched, _, _, _ := libunlynxkeyswitch.KeySwitchSequence(announcement.PublicKeys[key], rBs, p.Private())
+		for j, i := range group {
+			contribution[i] = switched[j]
+		}
+		switchTimes[key] = time.Since(start)
+	}
+	return contribution, switchTimes
+}
+
+// checkKeySwitches verifies that the switches of an announcement refer to its ciphertexts and keys
+func checkKeySwitches(announcement MKSAnnouncementMessage) error {
+	if len(announcement.Switches) == 0 {
+		return xerrors.New("no switch to make")
+	}
+	for i, sw := range announcement.Switches {
+		if sw.Target < 0 || sw.Target >= len(announcement.Rbs) || sw.Key < 0 || sw.Key >= len(announcement.PublicKeys) {
+			return xerrors.Errorf("switch %d of ciphertext %d to key %d out of the %d ciphertexts and %d keys", i,
+				sw.Target, sw.Key, len(announcement.Rbs), len(announcement.PublicKeys))
+		}
+		if announcement.PublicKeys[sw.Key] == nil {
+			return xerrors.Errorf("no public key %d", sw.Key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package protocols
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+)
+
+func init() {
+	_, err := onet.GlobalProtocolRegister("MultiKeySwitchingTest", newMultiKeySwitchingTest)
+	log.ErrFatal(err, "Failed to register the <MultiKeySwitchingTest> protocol:")
+}
+
+func newMultiKeySwitchingTest(tni *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	pi, err := NewMultiKeySwitchingProtocol(tni)
+	if err != nil {
+		return nil, err
+	}
+	pi.(*MultiKeySwitchingProtocol).Timeout = 5 * time.Second
+	return pi, nil
+}
+
+func TestMultiKeySwitching(t *testing.T) {
+	local := onet.NewLocalTest(libunlynx.SuiTe)
+	_, el, tree := local.GenTree(5, true)
+
+	secrets := make([]kyber.Scalar, 3)
+	keys := make([]kyber.Point, 3)
+	for i := range keys {
+		secrets[i], keys[i] = libunlynx.GenKey()
+	}
+	targets := *libunlynx.EncryptIntVector(el.Aggregate, []int64{0, 1, 42})
+	// the first ciphertext to the first key, the second one to the second and third keys, the third one to all the
+	// keys
+	switches := []KeySwitch{{Target: 0, Key: 0}, {Target: 1, Key: 1}, {Target: 1, Key: 2}, {Target: 2, Key: 2},
+		{Target: 2, Key: 0}, {Target: 2, Key: 1}}
+
+	pi, err := local.CreateProtocol("MultiKeySwitchingTest", tree)
+	require.NoError(t, err)
+	protocol := pi.(*MultiKeySwitchingProtocol)
+	protocol.TargetOfSwitch = &targets
+	protocol.TargetPublicKeys = &keys
+	protocol.Switches = switches
+	require.NoError(t, protocol.Start())
+
+	select {
+	case result := <-protocol.FeedbackChannel:
+		require.Equal(t, len(switches), len(result))
+		expected := []int64{0, 1, 1, 42, 42, 42}
+		for i, sw := range switches {
+			require.Equal(t, expected[i], libunlynx.DecryptInt(secrets[sw.Key], result[i]))
+		}
+		require.Equal(t, len(keys), len(protocol.SwitchTimes))
+	case <-time.After(10 * time.Second):
+		t.Fatal("didn't finish in time")
+	}
+
+	local.CloseAll()
+	log.AfterTest(t)
+}
+
+func TestMultiKeySwitchingWrongSwitches(t *testing.T) {
+	local := onet.NewLocalTest(libunlynx.SuiTe)
+	_, el, tree := local.GenTree(3, true)
+
+	_, key := libunlynx.GenKey()
+	keys := []kyber.Point{key}
+	targets := *libunlynx.EncryptIntVector(el.Aggregate, []int64{1})
+
+	for _, switches := range [][]KeySwitch{nil, {{Target: 1, Key: 0}}, {{Target: 0, Key: 1}}} {
+		pi, err := local.CreateProtocol("MultiKeySwitchingTest", tree)
+		require.NoError(t, err)
+		protocol := pi.(*MultiKeySwitchingProtocol)
+		protocol.TargetOfSwitch = &targets
+		protocol.TargetPublicKeys = &keys
+		protocol.Switches = switches
+		require.Error(t, protocol.Start())
+		require.NoError(t, protocol.Shutdown())
+	}
+
+	local.CloseAll()
+	log.AfterTest(t)
+}
@@ -0,0 +1,211 @@
+package protocols
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+// ThresholdAggregationProtocolName is the registered name for the threshold-tolerant aggregation protocol.
+const ThresholdAggregationProtocolName = "ThresholdAggregation"
+
+// dataPollInterval is how often a node checks whether its data has arrived
+const dataPollInterval = 100 * time.Millisecond
+
+func init() {
+	network.RegisterMessage(TAAnnouncementMessage{})
+	network.RegisterMessage(TAContributionMessage{})
+	_, err := onet.GlobalProtocolRegister(ThresholdAggregationProtocolName, NewThresholdAggregationProtocol)
+	log.ErrFatal(err, "Failed to register the <ThresholdAggregation> protocol:")
+}
+
+// Messages
+//______________________________________________________________________________________________________________________
+
+// TAAnnouncementMessage is sent by the root to trigger the aggregation
+type TAAnnouncementMessage struct{}
+
+// TAContributionMessage is sent back to the root by each node, with its data if it got it in time
+type TAContributionMessage struct {
+	Contributed  bool
+	Contribution libunlynx.CipherVector
+}
+
+// Structs
+//______________________________________________________________________________________________________________________
+
+type taAnnouncementStruct struct {
+	*onet.TreeNode
+	TAAnnouncementMessage
+}
+
+type taContributionStruct struct {
+	*onet.TreeNode
+	TAContributionMessage
+}
+
+// ThresholdAggregationResult is the aggregate of the data of the nodes that contributed before the deadline
+type ThresholdAggregationResult struct {
+	Aggregate    libunlynx.CipherVector
+	Contributors []*network.ServerIdentity
+}
+
+// Protocol
+//______________________________________________________________________________________________________________________
+
+// ThresholdAggregationProtocol aggregates the data of the nodes that answer before a deadline instead of failing when
+// one of them doesn't. It runs on a star tree (every node is a child of the root) so that a missing node doesn't take a
+// subtree with it.
+type ThresholdAggregationProtocol struct {
+	*onet.TreeNodeInstance
+
+	// Protocol feedback channel
+	FeedbackChannel chan ThresholdAggregationResult
+
+	// Protocol communication channels
+	AnnouncementChannel chan taAnnouncementStruct
+	ContributionChannel chan taContributionStruct
+
+	// DataFunc returns the data of this node, or false if it didn't arrive (yet)
+	DataFunc func() (libunlynx.CipherVector, bool)
+
+	// Timeout is how long the root waits for the contributions (and the other nodes for their data)
+	Timeout  time.Duration
+	ExecTime time.Duration
+
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewThresholdAggregationProtocol initializes the protocol instance.
+func NewThresholdAggregationProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	p := &ThresholdAggregationProtocol{
+		TreeNodeInstance: n,
+		FeedbackChannel:  make(chan ThresholdAggregationResult),
+		Timeout:          libunlynx.TIMEOUT,
+		closing:          make(chan struct{}),
+	}
+
+	if err := p.RegisterChannel(&p.AnnouncementChannel); err != nil {
+		return nil, xerrors.Errorf("couldn't register announcement channel: %+v", err)
+	}
+	if err := p.RegisterChannelLength(&p.ContributionChannel, len(n.Tree().List())); err != nil {
+		return nil, xerrors.Errorf("couldn't register contribution channel: %+v", err)
+	}
+	return p, nil
+}
+
+// Start is called at the root to begin the execution of the protocol.
+func (p *ThresholdAggregationProtocol) Start() error {
+	if p.DataFunc == nil {
+		return xerrors.New("no data function given to the root")
+	}
+
+	log.Lvl2(p.ServerIdentity(), "started a Threshold Aggregation Protocol (", len(p.Children()), "children )")
+
+	// the nodes that can't be reached are simply missing from the result
+	for _, err := range p.SendToChildrenInParallel(&TAAnnouncementMessage{}) {
+		log.Warn(p.ServerIdentity(), "couldn't send TAAnnouncementMessage:", err)
+	}
+	return nil
+}
+
+// Dispatch is called at each node and handle incoming messages.
+func (p *ThresholdAggregationProtocol) Dispatch() error {
+	defer p.Done()
+
+	if !p.IsRoot() {
+		return p.contribute()
+	}
+
+	deadline := time.After(p.Timeout)
+	start := time.Now()
+
+	data, ok := p.DataFunc()
+	if !ok {
+		return xerrors.New("root " + p.ServerIdentity().String() + " has no data to aggregate")
+	}
+	result := ThresholdAggregationResult{
+		Aggregate:    append(libunlynx.CipherVector{}, data...),
+		Contributors: []*network.ServerIdentity{p.ServerIdentity()},
+	}
+
+collecting:
+	for received := 0; received < len(p.Children()); received++ {
+		select {
+		case msg := <-p.ContributionChannel:
+			if !msg.Contributed {
+				log.Lvl2(p.ServerIdentity(), "got no data from", msg.ServerIdentity)
+				continue
+			}
+			if len(msg.Contribution) != len(result.Aggregate) {
+				log.Warn(p.ServerIdentity(), "ignored the contribution of", msg.ServerIdentity, ": wrong length",
+					len(msg.Contribution), "instead of", len(result.Aggregate))
+				continue
+			}
+			result.Aggregate.Add(result.Aggregate, msg.Contribution)
+			result.Contributors = append(result.Contributors, msg.ServerIdentity)
+		case <-p.closing:
+			return xerrors.New(p.ServerIdentity().String() + " was shut down")
+		case <-deadline:
+			log.Lvl2(p.ServerIdentity(), "deadline reached with", len(result.Contributors), "contributions out of",
+				len(p.Tree().List()))
+			break collecting
+		}
+	}
+	p.ExecTime = time.Since(start)
+
+	select {
+	case p.FeedbackChannel <- result:
+	case <-p.closing:
+	}
+	return nil
+}
+
+// Shutdown stops a running instance (it can be called several times).
+func (p *ThresholdAggregationProtocol) Shutdown() error {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+	})
+	return nil
+}
+
+// contribute waits for the announcement of the root and sends it the data of this node, as soon as it is there
+func (p *ThresholdAggregationProtocol) contribute() error {
+	select {
+	case <-p.AnnouncementChannel:
+	case <-p.closing:
+		return xerrors.New(p.ServerIdentity().String() + " was shut down")
+	case <-time.After(p.Timeout):
+		return xerrors.New(p.ServerIdentity().String() + " didn't get the <TAAnnouncementMessage> on time")
+	}
+
+	// a node without data still answers so that the root doesn't wait for it until the deadline
+	msg := TAContributionMessage{}
+	deadline := time.After(p.Timeout)
+polling:
+	for p.DataFunc != nil {
+		if data, ok := p.DataFunc(); ok {
+			msg = TAContributionMessage{Contributed: true, Contribution: data}
+			break
+		}
+		select {
+		case <-time.After(dataPollInterval):
+		case <-p.closing:
+			return xerrors.New(p.ServerIdentity().String() + " was shut down")
+		case <-deadline:
+			log.Lvl2(p.ServerIdentity(), "didn't get its data on time")
+			break polling
+		}
+	}
+
+	if err := p.SendToParent(&msg); err != nil {
+		return xerrors.Errorf("node "+p.ServerIdentity().String()+" failed to send TAContributionMessage: %+v", err)
+	}
+	return nil
+}
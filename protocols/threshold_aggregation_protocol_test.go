@@ -0,0 +1,66 @@
+package protocols
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+)
+
+var thresholdAggregationKey kyber.Point
+
+func init() {
+	_, err := onet.GlobalProtocolRegister("ThresholdAggregationTest", newThresholdAggregationTest)
+	log.ErrFatal(err, "Failed to register the <ThresholdAggregationTest> protocol:")
+}
+
+// the node at index 3 never gets its data
+func newThresholdAggregationTest(tni *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	pi, err := NewThresholdAggregationProtocol(tni)
+	if err != nil {
+		return nil, err
+	}
+	protocol := pi.(*ThresholdAggregationProtocol)
+	protocol.Timeout = 2 * time.Second
+	index := tni.TreeNode().RosterIndex
+	protocol.DataFunc = func() (libunlynx.CipherVector, bool) {
+		if index == 3 {
+			return nil, false
+		}
+		return *libunlynx.EncryptIntVector(thresholdAggregationKey, []int64{int64(index), 1}), true
+	}
+	return protocol, nil
+}
+
+func TestThresholdAggregation(t *testing.T) {
+	local := onet.NewLocalTest(libunlynx.SuiTe)
+	_, el, _ := local.GenTree(5, true)
+	secKey, pubKey := libunlynx.GenKey()
+	thresholdAggregationKey = pubKey
+
+	pi, err := local.CreateProtocol("ThresholdAggregationTest", el.GenerateStar())
+	require.NoError(t, err)
+	protocol := pi.(*ThresholdAggregationProtocol)
+
+	go func() {
+		require.NoError(t, protocol.Start())
+	}()
+
+	select {
+	case result := <-protocol.FeedbackChannel:
+		require.Equal(t, 4, len(result.Contributors))
+		for _, si := range result.Contributors {
+			require.NotEqual(t, el.List[3].ID, si.ID)
+		}
+		require.Equal(t, []int64{0 + 1 + 2 + 4, 4}, libunlynx.DecryptIntVector(secKey, &result.Aggregate))
+	case <-time.After(10 * time.Second):
+		t.Fatal("didn't finish in time")
+	}
+
+	local.CloseAll()
+	log.AfterTest(t)
+}
@@ -0,0 +1,308 @@
+package protocols
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"github.com/ldsec/unlynx/lib/key_switch"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/share"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+// ThresholdKeySwitchingProtocolName is the registered name for the threshold (t-of-n) key switching protocol.
+const ThresholdKeySwitchingProtocolName = "ThresholdKeySwitching"
+
+func init() {
+	network.RegisterMessage(TKSAnnouncementMessage{})
+	network.RegisterMessage(TKSPartialMessage{})
+	_, err := onet.GlobalProtocolRegister(ThresholdKeySwitchingProtocolName, NewThresholdKeySwitchingProtocol)
+	log.ErrFatal(err, "Failed to register the <ThresholdKeySwitching> protocol:")
+}
+
+// Messages
+//______________________________________________________________________________________________________________________
+
+// TKSAnnouncementMessage is sent by the root to the other nodes with the ciphertexts to switch
+type TKSAnnouncementMessage struct {
+	Targets         libunlynx.CipherVector
+	TargetPublicKey kyber.Point
+}
+
+// TKSPartialMessage is sent back to the root by each node, with its partial switch if it holds a share of the key
+type TKSPartialMessage struct {
+	Contributed bool
+	Index       int                    // index of the share of the node
+	Partial     libunlynx.CipherVector // (r.B, r.Q - x_i.K) for each target (K, C)
+	Proofs      [][]byte               // proofs of the partial switch of each target (see verifyPartialSwitch)
+}
+
+// Structs
+//______________________________________________________________________________________________________________________
+
+type tksAnnouncementStruct struct {
+	*onet.TreeNode
+	TKSAnnouncementMessage
+}
+
+type tksPartialStruct struct {
+	*onet.TreeNode
+	TKSPartialMessage
+}
+
+// ThresholdKeySwitchingResult is the outcome of the key switching at the root
+type ThresholdKeySwitchingResult struct {
+	Switched     libunlynx.CipherVector
+	Contributors []*network.ServerIdentity
+}
+
+// Protocol
+//______________________________________________________________________________________________________________________
+
+// ThresholdKeySwitchingProtocol switches ciphertexts encrypted with a collective key shared by Shamir secret sharing
+// (e.g. generated by the DKG protocol) to the key of a querier: each node holding a share sends a partial switch made
+// with it and the root combines the first Quorum of them by Lagrange interpolation, without waiting for the other
+// nodes. It runs on a star tree (every node is a child of the root) so that a missing node doesn't take a subtree with
+// it.
+type ThresholdKeySwitchingProtocol struct {
+	*onet.TreeNodeInstance
+
+	// Protocol feedback channel
+	FeedbackChannel chan ThresholdKeySwitchingResult
+
+	// Protocol communication channels
+	AnnouncementChannel chan tksAnnouncementStruct
+	PartialChannel      chan tksPartialStruct
+
+	// TargetOfSwitch, TargetPublicKey and Quorum (the number of partial switches combined, at least the threshold of
+	// the key) are set at the root
+	TargetOfSwitch  *libunlynx.CipherVector
+	TargetPublicKey *kyber.Point
+	Quorum          int
+	// Share is the share of the collective private key of this node (nil if it has none)
+	Share *share.PriShare
+	// ShareOf returns, at the root, the index of the share of a node and its public share x_i.B (false if the node has
+	// no share): the partial switches are only combined if they are made with the share of the node that sends them
+	ShareOf func(si *network.ServerIdentity) (int, kyber.Point, bool)
+
+	// Timeout is how long the nodes wait for each other
+	Timeout  time.Duration
+	ExecTime time.Duration
+
+	aloneChannel chan TKSAnnouncementMessage // announcement of the root to itself
+	closing      chan struct{}
+	closeOnce    sync.Once
+}
+
+// NewThresholdKeySwitchingProtocol initializes the protocol instance.
+func NewThresholdKeySwitchingProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	p := &ThresholdKeySwitchingProtocol{
+		TreeNodeInstance: n,
+		FeedbackChannel:  make(chan ThresholdKeySwitchingResult),
+		Timeout:          libunlynx.TIMEOUT,
+		aloneChannel:     make(chan TKSAnnouncementMessage, 1),
+		closing:          make(chan struct{}),
+	}
+
+	if err := p.RegisterChannel(&p.AnnouncementChannel); err != nil {
+		return nil, xerrors.Errorf("couldn't register announcement channel: %+v", err)
+	}
+	if err := p.RegisterChannelLength(&p.PartialChannel, len(n.Tree().List())); err != nil {
+		return nil, xerrors.Errorf("couldn't register partial channel: %+v", err)
+	}
+	return p, nil
+}
+
+// Start is called at the root to begin the execution of the protocol.
+func (p *ThresholdKeySwitchingProtocol) Start() error {
+	if p.TargetOfSwitch == nil {
+		return xerrors.New("no ciphertext given as key switching target")
+	}
+	if p.TargetPublicKey == nil {
+		return xerrors.New("no new public key to be switched on provided")
+	}
+	if p.Quorum < 1 || p.Quorum > len(p.Tree().List()) {
+		return xerrors.Errorf("wrong quorum %d for %d nodes", p.Quorum, len(p.Tree().List()))
+	}
+	if p.ShareOf == nil {
+		return xerrors.New("no public shares to verify the partial switches with")
+	}
+
+	log.Lvl2(p.ServerIdentity(), "started a Threshold Key Switching Protocol (", len(p.Children()), "children, quorum",
+		p.Quorum, ")")
+
+	msg := TKSAnnouncementMessage{Targets: *p.TargetOfSwitch, TargetPublicKey: *p.TargetPublicKey}
+	p.aloneChannel <- msg
+	// the nodes that can't be reached are simply missing from the result
+	for _, err := range p.SendToChildrenInParallel(&msg) {
+		log.Warn(p.ServerIdentity(), "couldn't send TKSAnnouncementMessage:", err)
+	}
+	return nil
+}
+
+// Dispatch is called at each node and handle incoming messages.
+func (p *ThresholdKeySwitchingProtocol) Dispatch() error {
+	defer p.Done()
+
+	deadline := time.After(p.Timeout)
+	var announcement TKSAnnouncementMessage
+	select {
+	case msg := <-p.AnnouncementChannel:
+		announcement = msg.TKSAnnouncementMessage
+	case announcement = <-p.aloneChannel:
+	case <-p.closing:
+		return xerrors.New(p.ServerIdentity().String() + " was shut down")
+	case <-deadline:
+		return xerrors.New(p.ServerIdentity().String() + " didn't get the <TKSAnnouncementMessage> on time")
+	}
+
+	start := time.Now()
+	partial, err := p.partialSwitch(announcement)
+	if err != nil {
+		return err
+	}
+	if !p.IsRoot() {
+		p.ExecTime = time.Since(start)
+		if err := p.SendToParent(&partial); err != nil {
+			return xerrors.Errorf("node "+p.ServerIdentity().String()+" failed to send TKSPartialMessage: %+v", err)
+		}
+		return nil
+	}
+
+	// the partial switches are combined as soon as there are enough of them
+	partials := make(map[int]libunlynx.CipherVector, p.Quorum)
+	var contributors []*network.ServerIdentity
+	addPartial := func(si *network.ServerIdentity, msg TKSPartialMessage) {
+		if !msg.Contributed {
+			log.Lvl2(p.ServerIdentity(), "got no partial switch from", si)
+			return
+		}
+		index, publicShare, ok := p.ShareOf(si)
+		switch {
+		case !ok:
+			log.Warn(p.ServerIdentity(), "ignored the partial switch of", si, ": it holds no share of the key")
+		case msg.Index != index:
+			log.Warn(p.ServerIdentity(), "ignored the partial switch of", si, ": share", msg.Index, "instead of", index)
+		case partials[msg.Index] != nil:
+			log.Warn(p.ServerIdentity(), "ignored the partial switch of", si, ": share", msg.Index, "already used")
+		default:
+			if err := verifyPartialSwitch(announcement, publicShare, msg); err != nil {
+				log.Warn(p.ServerIdentity(), "ignored the partial switch of", si, ":", err)
+				return
+			}
+			partials[msg.Index] = msg.Partial
+			contributors = append(contributors, si)
+		}
+	}
+	addPartial(p.ServerIdentity(), partial)
+	for received := 0; len(partials) < p.Quorum; received++ {
+		if received == len(p.Children()) {
+			return xerrors.Errorf("only %d partial switches out of the quorum of %d", len(partials), p.Quorum)
+		}
+		select {
+		case msg := <-p.PartialChannel:
+			addPartial(msg.ServerIdentity, msg.TKSPartialMessage)
+		case <-p.closing:
+			return xerrors.New(p.ServerIdentity().String() + " was shut down")
+		case <-deadline:
+			return xerrors.Errorf("only %d partial switches out of the quorum of %d on time", len(partials), p.Quorum)
+		}
+	}
+
+	switched, err := combinePartialSwitches(announcement.Targets, partials)
+	if err != nil {
+		return xerrors.Errorf("couldn't combine the partial switches: %+v", err)
+	}
+	p.ExecTime = time.Since(start)
+
+	select {
+	case p.FeedbackChannel <- ThresholdKeySwitchingResult{Switched: switched, Contributors: contributors}:
+	case <-p.closing:
+	}
+	return nil
+}
+
+// Shutdown stops a running instance (it can be called several times).
+func (p *ThresholdKeySwitchingProtocol) Shutdown() error {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+	})
+	return nil
+}
+
+// partialSwitch switches the targets with the share of this node and proves it, a node without a share still answers
+// so that the root doesn't wait for it
+func (p *ThresholdKeySwitchingProtocol) partialSwitch(announcement TKSAnnouncementMessage) (TKSPartialMessage, error) {
+	if p.Share == nil {
+		return TKSPartialMessage{}, nil
+	}
+	rBs := make([]kyber.Point, len(announcement.Targets))
+	for i, ct := range announcement.Targets {
+		rBs[i] = ct.K
+	}
+	partial, ks2s, rBNegs, rs := libunlynxkeyswitch.KeySwitchSequence(announcement.TargetPublicKey, rBs, p.Share.V)
+	publicShare := libunlynx.SuiTe.Point().Mul(p.Share.V, nil)
+	proofs, err := libunlynxkeyswitch.KeySwitchListProofCreation(publicShare, announcement.TargetPublicKey, p.Share.V,
+		ks2s, rBNegs, rs)
+	if err != nil {
+		return TKSPartialMessage{}, xerrors.Errorf("couldn't prove the partial switch: %+v", err)
+	}
+	msg := TKSPartialMessage{Contributed: true, Index: p.Share.I, Partial: partial, Proofs: make([][]byte, len(partial))}
+	for i, proof := range proofs.List {
+		msg.Proofs[i] = proof.Proof
+	}
+	return msg, nil
+}
+
+// verifyPartialSwitch checks the partial switch of a node with public share X_i = x_i.B against its proofs. They show
+// that for each target (K, C) the partial switch (r.B, r.Q - x_i.K) is made with x_i, like the decryption shares of the
+// collective decryption, but without revealing x_i.K (a quorum of them would decrypt the target).
+func verifyPartialSwitch(announcement TKSAnnouncementMessage, publicShare kyber.Point, msg TKSPartialMessage) error {
+	if len(msg.Partial) != len(announcement.Targets) || len(msg.Proofs) != len(announcement.Targets) {
+		return xerrors.Errorf("%d partial switches and %d proofs for %d ciphertexts", len(msg.Partial),
+			len(msg.Proofs), len(announcement.Targets))
+	}
+	for i, ct := range announcement.Targets {
+		proof := libunlynxkeyswitch.PublishedKSProof{
+			Proof: msg.Proofs[i],
+			K:     publicShare,
+			ViB:   msg.Partial[i].K,
+			Ks2:   msg.Partial[i].C,
+			RbNeg: libunlynx.SuiTe.Point().Neg(ct.K),
+			Q:     announcement.TargetPublicKey,
+		}
+		if !libunlynxkeyswitch.KeySwitchProofVerification(proof) {
+			return xerrors.Errorf("wrong proof for ciphertext %d", i)
+		}
+	}
+	return nil
+}
+
+// combinePartialSwitches interpolates the partial switches of the shares at 0: for each target (K, C) the result is
+// (sum l_i.r_i.B, C + sum l_i.(r_i.Q - x_i.K)) = (r.B, C - x.K + r.Q) where the l_i are the Lagrange coefficients
+func combinePartialSwitches(targets libunlynx.CipherVector, partials map[int]libunlynx.CipherVector) (libunlynx.CipherVector, error) {
+	switched := make(libunlynx.CipherVector, len(targets))
+	ks := make([]*share.PubShare, 0, len(partials))
+	cs := make([]*share.PubShare, 0, len(partials))
+	for i := range targets {
+		ks, cs = ks[:0], cs[:0]
+		for index, partial := range partials {
+			ks = append(ks, &share.PubShare{I: index, V: partial[i].K})
+			cs = append(cs, &share.PubShare{I: index, V: partial[i].C})
+		}
+		k, err := share.RecoverCommit(libunlynx.SuiTe, ks, len(partials), len(partials))
+		if err != nil {
+			return nil, err
+		}
+		c, err := share.RecoverCommit(libunlynx.SuiTe, cs, len(partials), len(partials))
+		if err != nil {
+			return nil, err
+		}
+		switched[i] = libunlynx.CipherText{K: k, C: libunlynx.SuiTe.Point().Add(targets[i].C, c)}
+	}
+	return switched, nil
+}
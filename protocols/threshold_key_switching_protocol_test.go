@@ -0,0 +1,154 @@
+package protocols
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"github.com/stretchr/testify/require"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/share"
+	"go.dedis.ch/kyber/v3/util/random"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+)
+
+// shares used by the nodes (nil if a node has none) and public shares of the key (nil if a node has no share)
+var thresholdKeySwitchingShares []*share.PriShare
+var thresholdKeySwitchingPublicShares []kyber.Point
+
+func init() {
+	_, err := onet.GlobalProtocolRegister("ThresholdKeySwitchingTest", newThresholdKeySwitchingTest)
+	log.ErrFatal(err, "Failed to register the <ThresholdKeySwitchingTest> protocol:")
+}
+
+func newThresholdKeySwitchingTest(tni *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	pi, err := NewThresholdKeySwitchingProtocol(tni)
+	if err != nil {
+		return nil, err
+	}
+	protocol := pi.(*ThresholdKeySwitchingProtocol)
+	protocol.Timeout = 5 * time.Second
+	protocol.Share = thresholdKeySwitchingShares[tni.TreeNode().RosterIndex]
+	protocol.ShareOf = func(si *network.ServerIdentity) (int, kyber.Point, bool) {
+		index, _ := tni.Roster().Search(si.ID)
+		if index < 0 || thresholdKeySwitchingPublicShares[index] == nil {
+			return 0, nil, false
+		}
+		return index, thresholdKeySwitchingPublicShares[index], true
+	}
+	return protocol, nil
+}
+
+// setThresholdKeySwitchingShares shares a collective key 3-of-5 between the nodes, except the ones at the indexes
+// without a share
+func setThresholdKeySwitchingShares(without ...int) kyber.Point {
+	poly := share.NewPriPoly(libunlynx.SuiTe, 3, nil, random.New())
+	thresholdKeySwitchingShares = poly.Shares(5)
+	thresholdKeySwitchingPublicShares = make([]kyber.Point, 5)
+	for _, ps := range poly.Commit(nil).Shares(5) {
+		thresholdKeySwitchingPublicShares[ps.I] = ps.V
+	}
+	for _, index := range without {
+		thresholdKeySwitchingShares[index] = nil
+		thresholdKeySwitchingPublicShares[index] = nil
+	}
+	return libunlynx.SuiTe.Point().Mul(poly.Secret(), nil)
+}
+
+func TestThresholdKeySwitching(t *testing.T) {
+	local := onet.NewLocalTest(libunlynx.SuiTe)
+	_, el, _ := local.GenTree(5, true)
+
+	// collective key shared 3-of-5, the nodes at index 1 and 3 hold no share
+	collectiveKey := setThresholdKeySwitchingShares(1, 3)
+	clientSecret, clientKey := libunlynx.GenKey()
+	targets := *libunlynx.EncryptIntVector(collectiveKey, []int64{0, 1, 42})
+
+	pi, err := local.CreateProtocol("ThresholdKeySwitchingTest", el.GenerateStar())
+	require.NoError(t, err)
+	protocol := pi.(*ThresholdKeySwitchingProtocol)
+	protocol.TargetOfSwitch = &targets
+	protocol.TargetPublicKey = &clientKey
+	protocol.Quorum = 3
+	require.NoError(t, protocol.Start())
+
+	select {
+	case result := <-protocol.FeedbackChannel:
+		require.Equal(t, 3, len(result.Contributors))
+		for _, si := range result.Contributors {
+			require.NotEqual(t, el.List[1].ID, si.ID)
+			require.NotEqual(t, el.List[3].ID, si.ID)
+		}
+		require.Equal(t, []int64{0, 1, 42}, libunlynx.DecryptIntVector(clientSecret, &result.Switched))
+	case <-time.After(10 * time.Second):
+		t.Fatal("didn't finish in time")
+	}
+
+	local.CloseAll()
+	log.AfterTest(t)
+}
+
+func TestThresholdKeySwitchingNoQuorum(t *testing.T) {
+	local := onet.NewLocalTest(libunlynx.SuiTe)
+	_, el, _ := local.GenTree(5, true)
+
+	collectiveKey := setThresholdKeySwitchingShares(1, 3)
+	_, clientKey := libunlynx.GenKey()
+	targets := *libunlynx.EncryptIntVector(collectiveKey, []int64{1})
+
+	pi, err := local.CreateProtocol("ThresholdKeySwitchingTest", el.GenerateStar())
+	require.NoError(t, err)
+	protocol := pi.(*ThresholdKeySwitchingProtocol)
+	protocol.TargetOfSwitch = &targets
+	protocol.TargetPublicKey = &clientKey
+	protocol.Quorum = 4
+	require.NoError(t, protocol.Start())
+
+	select {
+	case <-protocol.FeedbackChannel:
+		t.Fatal("got a result without the quorum")
+	case <-time.After(2 * time.Second):
+	}
+
+	local.CloseAll()
+	log.AfterTest(t)
+}
+
+func TestThresholdKeySwitchingWrongPartials(t *testing.T) {
+	local := onet.NewLocalTest(libunlynx.SuiTe)
+	_, el, _ := local.GenTree(5, true)
+
+	collectiveKey := setThresholdKeySwitchingShares()
+	clientSecret, clientKey := libunlynx.GenKey()
+	targets := *libunlynx.EncryptIntVector(collectiveKey, []int64{7})
+
+	// the node at index 4 makes its partial switch with another value than its share, the one at index 1 with the
+	// share of index 2: only the partial switches of the nodes at index 0, 2 and 3 can be combined
+	thresholdKeySwitchingShares[4] = &share.PriShare{I: 4, V: libunlynx.SuiTe.Scalar().Pick(random.New())}
+	thresholdKeySwitchingShares[1] = thresholdKeySwitchingShares[2]
+
+	pi, err := local.CreateProtocol("ThresholdKeySwitchingTest", el.GenerateStar())
+	require.NoError(t, err)
+	protocol := pi.(*ThresholdKeySwitchingProtocol)
+	protocol.TargetOfSwitch = &targets
+	protocol.TargetPublicKey = &clientKey
+	protocol.Quorum = 3
+	require.NoError(t, protocol.Start())
+
+	select {
+	case result := <-protocol.FeedbackChannel:
+		require.Equal(t, 3, len(result.Contributors))
+		for _, si := range result.Contributors {
+			require.NotEqual(t, el.List[1].ID, si.ID)
+			require.NotEqual(t, el.List[4].ID, si.ID)
+		}
+		require.Equal(t, []int64{7}, libunlynx.DecryptIntVector(clientSecret, &result.Switched))
+	case <-time.After(10 * time.Second):
+		t.Fatal("didn't finish in time")
+	}
+
+	local.CloseAll()
+	log.AfterTest(t)
+}
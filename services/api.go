@@ -7,6 +7,8 @@ import (
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+	"strings"
 	"time"
 )
 
@@ -14,14 +16,33 @@ import (
 type API struct {
 	*onet.Client
 	ClientID   string
+	Timeout    time.Duration // timeout sent with the surveys (0 = maximum allowed by the nodes)
+	DP         DPParameters  // noise added to the aggregation and shuffling results (decrypt them with DecryptIntWithNeg)
 	entryPoint *network.ServerIdentity
 	public     kyber.Point
 	private    kyber.Scalar
+
+	// aggregation results below SuppressionThreshold are replaced by 0 (or by the threshold)
+	SuppressionThreshold          int64
+	SuppressionReplaceByThreshold bool
+
+	// with proofs, the calls fail (ErrInvalidProofs) if a proof of a node is missing or doesn't verify
+	FailOnInvalidProofs bool
+	// called with the verification of the proofs of each survey run with proofs
+	OnProofsSummary func(SurveyID, *ProofsSummary)
+
+	// epoch of the DDT secrets the query terms are tagged with
+	DDTEpoch int
 }
 
 // NewMedCoClient constructor of a client.
 func NewMedCoClient(entryPoint *network.ServerIdentity, clientID string) *API {
-	keys := key.NewKeyPair(libunlynx.SuiTe)
+	return NewMedCoClientWithKeys(entryPoint, clientID, key.NewKeyPair(libunlynx.SuiTe))
+}
+
+// NewMedCoClientWithKeys constructor of a client signing its requests with the key pair of a querier (the public key
+// has to be in the allowlist of the nodes that authorize the requests).
+func NewMedCoClientWithKeys(entryPoint *network.ServerIdentity, clientID string, keys *key.Pair) *API {
 	newClient := &API{
 		Client:     onet.NewClient(libunlynx.SuiTe, Name),
 		ClientID:   clientID,
@@ -32,6 +53,11 @@ func NewMedCoClient(entryPoint *network.ServerIdentity, clientID string) *API {
 	return newClient
 }
 
+// PublicKey returns the public key the client signs its requests with
+func (c *API) PublicKey() kyber.Point {
+	return c.public
+}
+
 // Send Queries
 //______________________________________________________________________________________________________________________
 
@@ -45,13 +71,15 @@ func (c *API) SendSurveyDDTRequestTerms(entities *onet.Roster, surveyID SurveyID
 		Roster:   *entities,
 		Proofs:   proofs,
 		Testing:  testing,
+		Timeout:  c.Timeout,
+		Epoch:    c.DDTEpoch,
 
 		// query parameters to DDT
 		Terms: terms,
 	}
 
 	resp := ResultDDT{}
-	err := c.SendProtobuf(c.entryPoint, &sdq, &resp)
+	err := c.send(&sdq, &resp)
 	if err != nil {
 		return nil, nil, TimeResults{}, err
 	}
@@ -59,6 +87,58 @@ func (c *API) SendSurveyDDTRequestTerms(entities *onet.Roster, surveyID SurveyID
 	return &surveyID, resp.Result, TimeResults{resp.TR}, nil
 }
 
+// SendSurveyDDTRetagRequest re-tags terms tagged with the DDT secrets of fromEpoch with the ones of toEpoch. The terms
+// are re-tagged by chunks of chunkSize (0 = DefaultRetagChunkSize), and onChunk is called with the old and new tags of
+// each chunk as soon as they arrive. If onChunk returns an error, the re-tagging is stopped.
+func (c *API) SendSurveyDDTRetagRequest(entities *onet.Roster, surveyID SurveyID, terms libunlynx.CipherVector,
+	fromEpoch, toEpoch, chunkSize int, testing bool,
+	onChunk func(offset int, oldTags, newTags []libunlynx.GroupingKey) error) (TimeResults, error) {
+	start := time.Now()
+	log.Lvl2("Client", c.ClientID, "is creating a DDT re-tagging survey with ID:", surveyID)
+
+	sdr := SurveyDDTRetagRequest{
+		SurveyID:  surveyID,
+		Roster:    *entities,
+		Testing:   testing,
+		Timeout:   c.Timeout,
+		FromEpoch: fromEpoch,
+		ToEpoch:   toEpoch,
+		ChunkSize: chunkSize,
+		Terms:     terms,
+	}
+	if err := SignRequest(&sdr, c.public, c.private); err != nil {
+		return TimeResults{}, err
+	}
+
+	// the stream has its own connection, closed once the re-tagging is over
+	client := onet.NewClient(libunlynx.SuiTe, Name)
+	defer client.Close()
+	conn, err := client.Stream(c.entryPoint, &sdr)
+	if err != nil {
+		return TimeResults{}, err
+	}
+
+	tr := TimeResults{MapTR: make(map[string]time.Duration)}
+	for {
+		chunk := ResultDDTRetagChunk{}
+		if err := conn.ReadMessage(&chunk); err != nil {
+			return TimeResults{}, err
+		}
+		if chunk.Error != "" {
+			return TimeResults{}, remoteError(xerrors.New(chunk.Error))
+		}
+		if err := onChunk(chunk.Offset, chunk.OldTags, chunk.NewTags); err != nil {
+			return TimeResults{}, err
+		}
+		tr.MapTR[DDTRetagTime] += chunk.TR[DDTRetagTime]
+		if chunk.Last {
+			break
+		}
+	}
+	tr.MapTR[DDTRequestTime] = time.Since(start)
+	return tr, nil
+}
+
 // SendSurveyKSRequest performs key switching in a list of values
 func (c *API) SendSurveyKSRequest(entities *onet.Roster, surveyID SurveyID, cPK kyber.Point, values libunlynx.CipherVector, proofs bool) (*SurveyID, libunlynx.CipherVector, TimeResults, error) {
 	start := time.Now()
@@ -69,18 +149,128 @@ func (c *API) SendSurveyKSRequest(entities *onet.Roster, surveyID SurveyID, cPK
 		Roster:       *entities,
 		Proofs:       proofs,
 		ClientPubKey: cPK,
+		Timeout:      c.Timeout,
 		KSTarget:     values,
 	}
 
 	resp := Result{}
-	err := c.SendProtobuf(c.entryPoint, &skr, &resp)
+	err := c.send(&skr, &resp)
 	if err != nil {
 		return nil, nil, TimeResults{}, err
 	}
+	if err := c.checkProofs(surveyID, resp.Proofs); err != nil {
+		return nil, nil, TimeResults{}, err
+	}
 	resp.TR.MapTR[KSRequestTime] = time.Since(start)
 	return &surveyID, resp.Result, resp.TR, nil
 }
 
+// SendSurveyKSRequestMultiKeys performs key switching in a list of values to each of the keys cPKs in a single run, the
+// results are returned in the order of the keys
+func (c *API) SendSurveyKSRequestMultiKeys(entities *onet.Roster, surveyID SurveyID, cPKs []kyber.Point, values libunlynx.CipherVector) (*SurveyID, []ResultRecipient, TimeResults, error) {
+	start := time.Now()
+	log.Lvl2("Client", c.ClientID, "is creating a KS survey with ID:", surveyID, "(", len(cPKs), "keys )")
+
+	skr := SurveyKSRequest{
+		SurveyID:      surveyID,
+		Roster:        *entities,
+		ClientPubKeys: cPKs,
+		Timeout:       c.Timeout,
+		KSTarget:      values,
+	}
+
+	resp := Result{}
+	err := c.send(&skr, &resp)
+	if err != nil {
+		return nil, nil, TimeResults{}, err
+	}
+	resp.TR.MapTR[KSRequestTime] = time.Since(start)
+	return &surveyID, resp.Recipients, resp.TR, nil
+}
+
+// SendSurveyKSRequestThreshold performs key switching in a list of values encrypted with the collective key keyID
+// generated by DKG, with the first quorum nodes holding a share of it that answer. It also returns these nodes.
+func (c *API) SendSurveyKSRequestThreshold(entities *onet.Roster, surveyID SurveyID, cPK kyber.Point, values libunlynx.CipherVector, keyID string, quorum int) (*SurveyID, libunlynx.CipherVector, []*network.ServerIdentity, TimeResults, error) {
+	start := time.Now()
+	log.Lvl2("Client", c.ClientID, "is creating a threshold KS survey with ID:", surveyID, "(", quorum, "nodes )")
+
+	skr := SurveyKSRequest{
+		SurveyID:     surveyID,
+		Roster:       *entities,
+		ClientPubKey: cPK,
+		Timeout:      c.Timeout,
+		KSTarget:     values,
+		Quorum:       quorum,
+		DKGKeyID:     keyID,
+	}
+
+	resp := Result{}
+	err := c.send(&skr, &resp)
+	if err != nil {
+		return nil, nil, nil, TimeResults{}, err
+	}
+	resp.TR.MapTR[KSRequestTime] = time.Since(start)
+	return &surveyID, resp.Result, resp.Contributors, resp.TR, nil
+}
+
+// SendSurveyDecryptRequest collectively decrypts the results of the survey surveyID (before their key switching), in
+// the order they were switched. The survey has to be run first with the same roster, all the nodes have to allow it.
+func (c *API) SendSurveyDecryptRequest(entities *onet.Roster, surveyID SurveyID) (*SurveyID, []int64, TimeResults, error) {
+	start := time.Now()
+	log.Lvl2("Client", c.ClientID, "is decrypting the results of survey:", surveyID)
+
+	sdr := SurveyDecryptRequest{
+		SurveyID: surveyID,
+		Roster:   *entities,
+		Timeout:  c.Timeout,
+	}
+
+	resp := ResultDecrypt{}
+	err := c.send(&sdr, &resp)
+	if err != nil {
+		return nil, nil, TimeResults{}, err
+	}
+	resp.TR.MapTR[DecryptRequestTime] = time.Since(start)
+	return &surveyID, resp.Result, resp.TR, nil
+}
+
+// SendSurveyKSBatchRequest performs key switching of several independent surveys in a single protocol instance, each
+// survey to its own public key. It returns the times of each survey and the times of the whole batch.
+func (c *API) SendSurveyKSBatchRequest(entities *onet.Roster, batchID SurveyID, surveys []SurveyKSBatchEntry, proofs bool) (*SurveyID, map[SurveyID]libunlynx.CipherVector, map[SurveyID]TimeResults, TimeResults, error) {
+	start := time.Now()
+	log.Lvl2("Client", c.ClientID, "is creating a KS batch survey with ID:", batchID, "(", len(surveys), "surveys )")
+
+	skbr := SurveyKSBatchRequest{
+		SurveyID: batchID,
+		Roster:   *entities,
+		Proofs:   proofs,
+		Timeout:  c.Timeout,
+		Surveys:  surveys,
+	}
+
+	resp := ResultKSBatch{}
+	err := c.send(&skbr, &resp)
+	if err != nil {
+		return nil, nil, nil, TimeResults{}, err
+	}
+
+	results := make(map[SurveyID]libunlynx.CipherVector, len(resp.Results))
+	trs := make(map[SurveyID]TimeResults, len(resp.Results))
+	for _, entry := range resp.Results {
+		if entry.TR.MapTR == nil {
+			entry.TR.MapTR = make(map[string]time.Duration)
+		}
+		entry.TR.MapTR[KSRequestTime] = time.Since(start)
+		results[entry.SurveyID] = entry.Result
+		trs[entry.SurveyID] = entry.TR
+	}
+	if resp.TR.MapTR == nil {
+		resp.TR.MapTR = make(map[string]time.Duration)
+	}
+	resp.TR.MapTR[KSRequestTime] = time.Since(start)
+	return &batchID, results, trs, resp.TR, nil
+}
+
 // SendSurveyShuffleRequest performs shuffling + key switching on a list of values
 func (c *API) SendSurveyShuffleRequest(entities *onet.Roster, surveyID SurveyID, cPK kyber.Point, value *libunlynx.CipherText, proofs bool) (*SurveyID, libunlynx.CipherText, TimeResults, error) {
 	start := time.Now()
@@ -95,14 +285,19 @@ func (c *API) SendSurveyShuffleRequest(entities *onet.Roster, surveyID SurveyID,
 		Roster:        *entities,
 		Proofs:        proofs,
 		ClientPubKey:  cPK,
+		Timeout:       c.Timeout,
 		ShuffleTarget: target,
+		DP:            c.DP,
 	}
 
 	resp := Result{}
-	err := c.SendProtobuf(c.entryPoint, &ssr, &resp)
+	err := c.send(&ssr, &resp)
 	if err != nil {
 		return nil, libunlynx.CipherText{}, TimeResults{}, err
 	}
+	if err := c.checkProofs(surveyID, resp.Proofs); err != nil {
+		return nil, libunlynx.CipherText{}, TimeResults{}, err
+	}
 	resp.TR.MapTR[ShuffleRequestTime] = time.Since(start)
 	return &surveyID, resp.Result[0], resp.TR, nil
 }
@@ -112,21 +307,335 @@ func (c *API) SendSurveyAggRequest(entities *onet.Roster, surveyID SurveyID, cPK
 	start := time.Now()
 	log.Lvl2("Client", c.ClientID, "is creating a Agg survey with ID:", surveyID)
 
+	sar := SurveyAggRequest{
+		SurveyID:                      surveyID,
+		Roster:                        *entities,
+		Proofs:                        proofs,
+		ClientPubKey:                  cPK,
+		Timeout:                       c.Timeout,
+		AggregateTarget:               value,
+		DP:                            c.DP,
+		SuppressionThreshold:          c.SuppressionThreshold,
+		SuppressionReplaceByThreshold: c.SuppressionReplaceByThreshold,
+	}
+
+	resp := Result{}
+	err := c.send(&sar, &resp)
+	if err != nil {
+
+		return nil, libunlynx.CipherText{}, TimeResults{}, err
+	}
+	if err := c.checkProofs(surveyID, resp.Proofs); err != nil {
+		return nil, libunlynx.CipherText{}, TimeResults{}, err
+	}
+	resp.TR.MapTR[AggrRequestTime] = time.Since(start)
+	return &surveyID, resp.Result[0], resp.TR, nil
+
+}
+
+// SendSurveyAggRequestThreshold sends the encrypted aggregate local results at each node and aggregates the values of
+// the nodes that answer in time, as long as at least minContributors of them did. It also returns the nodes whose
+// values were aggregated.
+func (c *API) SendSurveyAggRequestThreshold(entities *onet.Roster, surveyID SurveyID, cPK kyber.Point, value libunlynx.CipherText, proofs bool, minContributors int) (*SurveyID, libunlynx.CipherText, []*network.ServerIdentity, TimeResults, error) {
+	start := time.Now()
+	log.Lvl2("Client", c.ClientID, "is creating a threshold Agg survey with ID:", surveyID, "(", minContributors, "contributors at least )")
+
+	sar := SurveyAggRequest{
+		SurveyID:                      surveyID,
+		Roster:                        *entities,
+		Proofs:                        proofs,
+		ClientPubKey:                  cPK,
+		Timeout:                       c.Timeout,
+		AggregateTarget:               value,
+		MinContributors:               minContributors,
+		DP:                            c.DP,
+		SuppressionThreshold:          c.SuppressionThreshold,
+		SuppressionReplaceByThreshold: c.SuppressionReplaceByThreshold,
+	}
+
+	resp := Result{}
+	err := c.send(&sar, &resp)
+	if err != nil {
+		return nil, libunlynx.CipherText{}, nil, TimeResults{}, err
+	}
+	if err := c.checkProofs(surveyID, resp.Proofs); err != nil {
+		return nil, libunlynx.CipherText{}, nil, TimeResults{}, err
+	}
+	resp.TR.MapTR[AggrRequestTime] = time.Since(start)
+	return &surveyID, resp.Result[0], resp.Contributors, resp.TR, nil
+}
+
+// SendSurveyAggRequestThresholdKey sends the encrypted aggregate local results, encrypted with the collective key keyID
+// generated by DKG, at each node and aggregates the values of the nodes that answer in time, as long as at least
+// minContributors of them did. The result is switched by the nodes holding a share of the key that answer, so that
+// nodes that are down don't block the survey. It also returns the nodes whose values were aggregated.
+func (c *API) SendSurveyAggRequestThresholdKey(entities *onet.Roster, surveyID SurveyID, cPK kyber.Point, value libunlynx.CipherText, minContributors int, keyID string) (*SurveyID, libunlynx.CipherText, []*network.ServerIdentity, TimeResults, error) {
+	start := time.Now()
+	log.Lvl2("Client", c.ClientID, "is creating a threshold Agg survey with ID:", surveyID, "(", minContributors,
+		"contributors at least, DKG key", keyID, ")")
+
 	sar := SurveyAggRequest{
 		SurveyID:        surveyID,
 		Roster:          *entities,
-		Proofs:          proofs,
 		ClientPubKey:    cPK,
+		Timeout:         c.Timeout,
 		AggregateTarget: value,
+		MinContributors: minContributors,
+		DKGKeyID:        keyID,
+		DP:              c.DP,
+	}
+
+	resp := Result{}
+	err := c.send(&sar, &resp)
+	if err != nil {
+		return nil, libunlynx.CipherText{}, nil, TimeResults{}, err
+	}
+	resp.TR.MapTR[AggrRequestTime] = time.Since(start)
+	return &surveyID, resp.Result[0], resp.Contributors, resp.TR, nil
+}
+
+// SendSurveyAggRequestDecrypt sends the encrypted aggregate local results at each node and collectively decrypts the
+// final result (after the noise and the suppression) instead of switching it to a client key. All the nodes have to
+// take part in collective decryptions (see CollectiveDecryptionEnv).
+func (c *API) SendSurveyAggRequestDecrypt(entities *onet.Roster, surveyID SurveyID, value libunlynx.CipherText) (*SurveyID, int64, TimeResults, error) {
+	start := time.Now()
+	log.Lvl2("Client", c.ClientID, "is creating a decrypted Agg survey with ID:", surveyID)
+
+	sar := SurveyAggRequest{
+		SurveyID:                      surveyID,
+		Roster:                        *entities,
+		Timeout:                       c.Timeout,
+		AggregateTarget:               value,
+		Decrypt:                       true,
+		DP:                            c.DP,
+		SuppressionThreshold:          c.SuppressionThreshold,
+		SuppressionReplaceByThreshold: c.SuppressionReplaceByThreshold,
 	}
 
 	resp := Result{}
-	err := c.SendProtobuf(c.entryPoint, &sar, &resp)
+	err := c.send(&sar, &resp)
 	if err != nil {
+		return nil, 0, TimeResults{}, err
+	}
+	if len(resp.Decrypted) != 1 {
+		return nil, 0, TimeResults{}, xerrors.Errorf("%d decrypted results instead of 1", len(resp.Decrypted))
+	}
+	resp.TR.MapTR[AggrRequestTime] = time.Since(start)
+	return &surveyID, resp.Decrypted[0], resp.TR, nil
+}
 
+// SendSurveyAggRequestHistogram sends the encrypted local histogram at each node and aggregates the histograms bucket
+// by bucket (result is the same for all nodes)
+func (c *API) SendSurveyAggRequestHistogram(entities *onet.Roster, surveyID SurveyID, cPK kyber.Point, values libunlynx.CipherVector, proofs bool) (*SurveyID, libunlynx.CipherVector, TimeResults, error) {
+	start := time.Now()
+	log.Lvl2("Client", c.ClientID, "is creating a histogram Agg survey with ID:", surveyID, "(", len(values), "buckets )")
+
+	sar := SurveyAggRequest{
+		SurveyID:                      surveyID,
+		Roster:                        *entities,
+		Proofs:                        proofs,
+		ClientPubKey:                  cPK,
+		Timeout:                       c.Timeout,
+		AggregateTargets:              values,
+		DP:                            c.DP,
+		SuppressionThreshold:          c.SuppressionThreshold,
+		SuppressionReplaceByThreshold: c.SuppressionReplaceByThreshold,
+	}
+
+	resp := Result{}
+	err := c.send(&sar, &resp)
+	if err != nil {
+		return nil, nil, TimeResults{}, err
+	}
+	if err := c.checkProofs(surveyID, resp.Proofs); err != nil {
+		return nil, nil, TimeResults{}, err
+	}
+	resp.TR.MapTR[AggrRequestTime] = time.Since(start)
+	return &surveyID, resp.Result, resp.TR, nil
+}
+
+// SendSurveyStatisticsRequest sends the encrypted local counts, sums and sums of squares of the values (in
+// [0, maxValue]) of some groups of patients at each node and aggregates them (result is the same for all nodes). The
+// mean and variance of the values are then computed with ComputeStatistics.
+func (c *API) SendSurveyStatisticsRequest(entities *onet.Roster, surveyID SurveyID, cPK kyber.Point, counts, sums, sumsOfSquares libunlynx.CipherVector, maxValue int64, proofs bool) (*SurveyID, *ResultStatistics, error) {
+	start := time.Now()
+	log.Lvl2("Client", c.ClientID, "is creating a statistics survey with ID:", surveyID, "(", len(counts), "groups )")
+
+	ssr := SurveyStatisticsRequest{
+		SurveyID:             surveyID,
+		Roster:               *entities,
+		Proofs:               proofs,
+		ClientPubKey:         cPK,
+		Timeout:              c.Timeout,
+		Counts:               counts,
+		Sums:                 sums,
+		SumsOfSquares:        sumsOfSquares,
+		MaxValue:             maxValue,
+		DP:                   c.DP,
+		SuppressionThreshold: c.SuppressionThreshold,
+	}
+
+	resp := ResultStatistics{}
+	err := c.send(&ssr, &resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := c.checkProofs(surveyID, resp.Proofs); err != nil {
+		return nil, nil, err
+	}
+	resp.TR.MapTR[StatisticsRequestTime] = time.Since(start)
+	return &surveyID, &resp, nil
+}
+
+// SendSurveyAggRequestComparison sends the encrypted aggregate local results at each node and only gets an encryption
+// of 1 if their aggregation is at least threshold, of 0 otherwise
+func (c *API) SendSurveyAggRequestComparison(entities *onet.Roster, surveyID SurveyID, cPK kyber.Point, value libunlynx.CipherText, proofs bool, threshold int64) (*SurveyID, libunlynx.CipherText, TimeResults, error) {
+	start := time.Now()
+	log.Lvl2("Client", c.ClientID, "is creating a comparison Agg survey with ID:", surveyID, "( threshold", threshold, ")")
+
+	sar := SurveyAggRequest{
+		SurveyID:            surveyID,
+		Roster:              *entities,
+		Proofs:              proofs,
+		ClientPubKey:        cPK,
+		Timeout:             c.Timeout,
+		AggregateTarget:     value,
+		ComparisonThreshold: threshold,
+	}
+
+	resp := Result{}
+	err := c.send(&sar, &resp)
+	if err != nil {
+		return nil, libunlynx.CipherText{}, TimeResults{}, err
+	}
+	if err := c.checkProofs(surveyID, resp.Proofs); err != nil {
 		return nil, libunlynx.CipherText{}, TimeResults{}, err
 	}
 	resp.TR.MapTR[AggrRequestTime] = time.Since(start)
 	return &surveyID, resp.Result[0], resp.TR, nil
+}
+
+// GetPrivacyBudget asks the entry point about the privacy budget of the querier with the public key cPK (of the
+// querier signing the request if the node checks the queriers)
+func (c *API) GetPrivacyBudget(cPK kyber.Point) (*PrivacyBudgetResponse, error) {
+	log.Lvl2("Client", c.ClientID, "is asking for a privacy budget")
+
+	resp := PrivacyBudgetResponse{}
+	err := c.send(&PrivacyBudgetRequest{ClientPubKey: cPK}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetSurveyStatus asks the entry point about the progress of some surveys
+func (c *API) GetSurveyStatus(surveyIDs ...SurveyID) ([]SurveyStatus, error) {
+	log.Lvl2("Client", c.ClientID, "is asking for the status of", len(surveyIDs), "surveys")
+
+	resp := SurveyStatusResponse{}
+	err := c.send(&SurveyStatusRequest{SurveyIDs: surveyIDs}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	for i := range resp.Statuses {
+		if resp.Statuses[i].TR.MapTR == nil {
+			resp.Statuses[i].TR.MapTR = make(map[string]time.Duration)
+		}
+	}
+	return resp.Statuses, nil
+}
+
+// SendSurveyCancelRequest abandons a survey on all the nodes of the roster and returns the number of nodes on which it
+// was still running. With authorization, it must be sent to a node the survey was submitted to by the same querier.
+func (c *API) SendSurveyCancelRequest(entities *onet.Roster, surveyID SurveyID) (int, error) {
+	log.Lvl2("Client", c.ClientID, "is cancelling survey:", surveyID)
+
+	scr := SurveyCancelRequest{
+		SurveyID: surveyID,
+		Roster:   *entities,
+	}
+
+	resp := SurveyCancelResponse{}
+	err := c.send(&scr, &resp)
+	if err != nil {
+		return 0, err
+	}
+	return resp.NodesRunning, nil
+}
+
+// SendDKGRequest asks the nodes of the roster to generate a collective key, any threshold of them can then use it
+// (0 = majority of the nodes)
+func (c *API) SendDKGRequest(entities *onet.Roster, id string, threshold int) (*DKGResponse, error) {
+	log.Lvl2("Client", c.ClientID, "is creating the collective key:", id)
+
+	dr := DKGRequest{
+		ID:        id,
+		Roster:    *entities,
+		Threshold: threshold,
+	}
+
+	resp := DKGResponse{}
+	err := c.send(&dr, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Support functions
+//______________________________________________________________________________________________________________________
 
+// send signs a request with the key of the client and sends it to the entry point
+func (c *API) send(req signableRequest, resp interface{}) error {
+	if err := SignRequest(req, c.public, c.private); err != nil {
+		return err
+	}
+	if err := c.SendProtobuf(c.entryPoint, req, resp); err != nil {
+		return remoteError(err)
+	}
+	return nil
+}
+
+// checkProofs reports the verification of the proofs of a survey, and fails if asked to when it is not OK
+func (c *API) checkProofs(surveyID SurveyID, summary *ProofsSummary) error {
+	if summary == nil {
+		return nil
+	}
+	if c.OnProofsSummary != nil {
+		c.OnProofsSummary(surveyID, summary)
+	}
+	if c.FailOnInvalidProofs && !summary.OK() {
+		return xerrors.Errorf("survey %s: %w (failed: %v, missing: %v, unbound: %v)", surveyID, ErrInvalidProofs,
+			summary.Failed, summary.Missing, summary.Unbound)
+	}
+	return nil
+}
+
+// matchedError is an error received from a node that matches (errors.Is) one of the errors of the service
+type matchedError struct {
+	err    error
+	target error
+}
+
+func (e *matchedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *matchedError) Is(target error) bool {
+	return target == e.target
+}
+
+func (e *matchedError) Unwrap() error {
+	return e.err
+}
+
+// remoteError restores the errors of the service that a client can check for (only their message goes through the
+// network)
+func remoteError(err error) error {
+	for _, target := range []error{ErrPrivacyBudgetExceeded, ErrSurveyCancelled, ErrUnauthorized} {
+		if strings.Contains(err.Error(), target.Error()) {
+			return &matchedError{err: err, target: target}
+		}
+	}
+	return err
 }
@@ -0,0 +1,299 @@
+package servicesmedco
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+// AuditLogPathEnv is the environment variable holding the directory of the audit log of the node (no audit log if it
+// is not set)
+const AuditLogPathEnv = "UNLYNX_AUDIT_LOG_PATH"
+
+// AuditLogName is the prefix of the audit log file (followed by the address of the node)
+const AuditLogName = "audit"
+
+// AuditOutcomeSuccess is the outcome of the surveys that succeeded (the others record their error)
+const AuditOutcomeSuccess = "success"
+
+// AuditOutcomeParticipation is the outcome recorded by the nodes taking part in a protocol of a survey submitted to
+// another node, which only know that they took part in it
+const AuditOutcomeParticipation = "participation"
+
+// AuditRecord is an entry of the audit log. Each record holds the hash of the previous one, so that a record can't be
+// modified or removed without breaking the chain, and is signed by the node, so that the chain can't be rebuilt
+// without its private key.
+type AuditRecord struct {
+	Index         uint64
+	Time          time.Time
+	SurveyID      SurveyID
+	RequestType   string   // type of the request, or name of the protocol for a participation
+	Root          string   `json:",omitempty"` // node that ran the protocol, for a participation
+	Querier       string   `json:",omitempty"` // key that signed the request, if it was signed
+	ClientPubKeys []string `json:",omitempty"` // keys the results were switched to
+	Roster        []string
+	Proofs        bool
+	Outcome       string
+	Duration      time.Duration
+	TR            map[string]time.Duration `json:",omitempty"`
+
+	PrevHash  string
+	Hash      string
+	Signature string // Schnorr signature of the hash by the node (base64)
+}
+
+// computeHash hashes the record (without its own hash and signature)
+func (r AuditRecord) computeHash() (string, error) {
+	r.Hash = ""
+	r.Signature = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", xerrors.Errorf("couldn't marshal audit record: %+v", err)
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// verifySignature checks the signature of the record by the node of public key public
+func (r AuditRecord) verifySignature(public kyber.Point) error {
+	sig, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil {
+		return xerrors.Errorf("wrong signature encoding: %+v", err)
+	}
+	return schnorr.Verify(libunlynx.SuiTe, public, []byte(r.Hash), sig)
+}
+
+// AuditLog is an append-only, hash-chained log of the surveys processed by a node, one JSON record per line
+type AuditLog struct {
+	sync.Mutex
+	path      string
+	private   func() kyber.Scalar // key of the node the records are signed with
+	nextIndex uint64
+	lastHash  string
+}
+
+// OpenAuditLog opens (or creates) the audit log at path, after verifying the chain of its records and their signatures
+// by the node of private key private.
+func OpenAuditLog(path string, private kyber.Scalar) (*AuditLog, error) {
+	return openSignedAuditLog(path, libunlynx.SuiTe.Point().Mul(private, nil), func() kyber.Scalar { return private })
+}
+
+// openSignedAuditLog opens the audit log of the node of public key public. The private key is only read when a record
+// is appended: the key of a node can be set after its services are created (e.g. in the local tests).
+func openSignedAuditLog(path string, public kyber.Point, private func() kyber.Scalar) (*AuditLog, error) {
+	al := &AuditLog{path: path, private: private}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return al, nil
+	} else if err != nil {
+		return nil, xerrors.Errorf("couldn't open audit log: %+v", err)
+	}
+	defer f.Close()
+
+	records, err := VerifyAuditLog(f, public)
+	if err != nil {
+		return nil, xerrors.Errorf("audit log %s is corrupted: %+v", path, err)
+	}
+	if len(records) > 0 {
+		last := records[len(records)-1]
+		al.nextIndex = last.Index + 1
+		al.lastHash = last.Hash
+	}
+	return al, nil
+}
+
+// Append chains the record to the log and writes it to the disk
+func (al *AuditLog) Append(record AuditRecord) error {
+	al.Lock()
+	defer al.Unlock()
+
+	record.Index = al.nextIndex
+	record.PrevHash = al.lastHash
+	hash, err := record.computeHash()
+	if err != nil {
+		return err
+	}
+	record.Hash = hash
+	sig, err := schnorr.Sign(libunlynx.SuiTe, al.private(), []byte(hash))
+	if err != nil {
+		return xerrors.Errorf("couldn't sign audit record: %+v", err)
+	}
+	record.Signature = base64.StdEncoding.EncodeToString(sig)
+	b, err := json.Marshal(record)
+	if err != nil {
+		return xerrors.Errorf("couldn't marshal audit record: %+v", err)
+	}
+
+	f, err := os.OpenFile(al.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return xerrors.Errorf("couldn't open audit log: %+v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return xerrors.Errorf("couldn't write audit log: %+v", err)
+	}
+	if err := f.Sync(); err != nil {
+		return xerrors.Errorf("couldn't write audit log: %+v", err)
+	}
+
+	al.nextIndex++
+	al.lastHash = hash
+	return nil
+}
+
+// VerifyAuditLog reads the records of an audit log and checks their chain, and their signatures by the node of public
+// key public if it is not nil. It returns the records read up to the first broken link or wrong signature, if any.
+func VerifyAuditLog(r io.Reader, public kyber.Point) ([]AuditRecord, error) {
+	records := make([]AuditRecord, 0)
+	reader := bufio.NewReader(r)
+	prevHash := ""
+	for line := 1; ; line++ {
+		b, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(b) == 0 {
+			return records, nil
+		} else if err != nil && err != io.EOF {
+			return records, xerrors.Errorf("couldn't read line %d: %+v", line, err)
+		}
+
+		var record AuditRecord
+		if err := json.Unmarshal(b, &record); err != nil {
+			return records, xerrors.Errorf("wrong record at line %d: %+v", line, err)
+		}
+		if record.Index != uint64(len(records)) {
+			return records, xerrors.Errorf("record at line %d has index %d (%d expected)", line, record.Index, len(records))
+		}
+		if record.PrevHash != prevHash {
+			return records, xerrors.Errorf("record %d doesn't follow the previous record", record.Index)
+		}
+		hash, err := record.computeHash()
+		if err != nil {
+			return records, err
+		}
+		if hash != record.Hash {
+			return records, xerrors.Errorf("record %d was modified", record.Index)
+		}
+		if public != nil {
+			if err := record.verifySignature(public); err != nil {
+				return records, xerrors.Errorf("record %d isn't signed by the node: %+v", record.Index, err)
+			}
+		}
+		records = append(records, record)
+		prevHash = record.Hash
+	}
+}
+
+// openAuditLog opens the audit log of the node, if there is one
+func (s *Service) openAuditLog() error {
+	dir := os.Getenv(AuditLogPathEnv)
+	if dir == "" {
+		return nil
+	}
+	path := filepath.Join(dir, AuditLogName+"_"+s.ServerIdentity().Address.Host()+":"+s.ServerIdentity().Address.Port()+".log")
+	si := s.ServerIdentity()
+	al, err := openSignedAuditLog(path, si.ServicePublic(Name), func() kyber.Scalar { return si.ServicePrivate(Name) })
+	if err != nil {
+		return err
+	}
+	s.auditLog = al
+	return nil
+}
+
+// audit records a request processed by the node in its audit log (if there is one)
+func (s *Service) audit(surveyID SurveyID, requestType string, sig *QuerierSignature, clientPubKeys []kyber.Point,
+	roster onet.Roster, proofs bool, start time.Time, resp network.Message, err error) {
+	if s.auditLog == nil {
+		return
+	}
+
+	record := AuditRecord{
+		Time:        start.UTC(),
+		SurveyID:    surveyID,
+		RequestType: requestType,
+		Proofs:      proofs,
+		Outcome:     AuditOutcomeSuccess,
+		Duration:    time.Since(start),
+		TR:          auditTimers(resp),
+	}
+	if sig != nil && sig.Querier != nil {
+		record.Querier = serializeAuditKey(sig.Querier)
+	}
+	for _, key := range clientPubKeys {
+		record.ClientPubKeys = append(record.ClientPubKeys, serializeAuditKey(key))
+	}
+	for _, si := range roster.List {
+		record.Roster = append(record.Roster, si.Address.String())
+	}
+	if err != nil {
+		record.Outcome = err.Error()
+	}
+	s.appendAudit(record)
+}
+
+// auditParticipation records in the audit log (if there is one) a protocol of a survey run by another node that this
+// node took part in
+func (s *Service) auditParticipation(tn *onet.TreeNodeInstance, protoConf ProtocolConfig, start time.Time) {
+	if s.auditLog == nil {
+		return
+	}
+
+	record := AuditRecord{
+		Time:        start.UTC(),
+		SurveyID:    protoConf.SurveyID,
+		RequestType: tn.ProtocolName(),
+		Root:        tn.Root().ServerIdentity.Address.String(),
+		Proofs:      protoConf.Proofs,
+		Outcome:     AuditOutcomeParticipation,
+		Duration:    time.Since(start),
+	}
+	for _, si := range tn.Roster().List {
+		record.Roster = append(record.Roster, si.Address.String())
+	}
+	s.appendAudit(record)
+}
+
+func (s *Service) appendAudit(record AuditRecord) {
+	if err := s.auditLog.Append(record); err != nil {
+		log.Error(s.ServerIdentity().String(), "couldn't audit survey", record.SurveyID, ":", err)
+	}
+}
+
+func serializeAuditKey(key kyber.Point) string {
+	if key == nil {
+		return ""
+	}
+	str, err := libunlynx.SerializePoint(key)
+	if err != nil {
+		return key.String()
+	}
+	return str
+}
+
+// auditTimers returns the durations of the phases of a survey from its result
+func auditTimers(resp network.Message) map[string]time.Duration {
+	switch r := resp.(type) {
+	case *ResultDDT:
+		return r.TR
+	case *Result:
+		return r.TR.MapTR
+	case *ResultKSBatch:
+		if len(r.Results) > 0 {
+			return r.Results[0].TR.MapTR
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package servicesmedco
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/sign/schnorr"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+func init() {
+	// the requests are encoded to be signed on the client side, where no handler registers them
+	network.RegisterMessages(QuerierSignature{}, SurveyDDTRequest{}, SurveyKSRequest{}, SurveyKSBatchRequest{},
+		SurveyShuffleRequest{}, SurveyAggRequest{}, PrivacyBudgetRequest{}, SurveyStatusRequest{}, SurveyCancelRequest{})
+}
+
+// AuthorizedQueriersFileEnv is the environment variable holding the path of the file listing the public keys of the
+// queriers allowed to send requests to the node. If it is not set, the requests are not checked.
+const AuthorizedQueriersFileEnv = "UNLYNX_AUTHORIZED_QUERIERS_FILE"
+
+// SignatureValidity is how far the time of a signature can be from the one of the node, the signatures are remembered
+// during this time to reject the requests that are replayed
+const SignatureValidity = 5 * time.Minute
+
+// ErrUnauthorized is matched (errors.Is) by the errors returned when a request is not signed by an authorized querier
+var ErrUnauthorized = xerrors.New("unauthorized request")
+
+// AuthorizationError is returned when a request is refused because of its signature
+type AuthorizationError struct {
+	Reason string
+}
+
+func (e *AuthorizationError) Error() string {
+	return ErrUnauthorized.Error() + ": " + e.Reason
+}
+
+// Is makes the error match ErrUnauthorized
+func (e *AuthorizationError) Is(target error) bool {
+	return target == ErrUnauthorized
+}
+
+// QuerierSignature is the Schnorr signature of a request by the key of its querier
+type QuerierSignature struct {
+	Querier   kyber.Point
+	Time      int64 // when the request was signed (Unix time in nanoseconds), it is signed with the request
+	Signature []byte
+}
+
+// Signed is embedded in the client requests to carry the signature of their querier
+type Signed struct {
+	Signature *QuerierSignature
+}
+
+func (s *Signed) signature() *QuerierSignature {
+	return s.Signature
+}
+
+func (s *Signed) setSignature(sig *QuerierSignature) {
+	s.Signature = sig
+}
+
+// signableRequest is a client request carrying a QuerierSignature (i.e. embedding Signed)
+type signableRequest interface {
+	signature() *QuerierSignature
+	setSignature(sig *QuerierSignature)
+}
+
+// seenSignatures are the signatures of the requests received by the node during the last SignatureValidity
+type seenSignatures struct {
+	sync.Mutex
+	times map[string]time.Time // time of each signature, by signature
+}
+
+// add records a signature and returns false if it was already seen. The signatures that are no longer valid are
+// forgotten.
+func (ss *seenSignatures) add(sig *QuerierSignature) bool {
+	ss.Lock()
+	defer ss.Unlock()
+	for k, t := range ss.times {
+		if time.Since(t) > SignatureValidity {
+			delete(ss.times, k)
+		}
+	}
+	if _, ok := ss.times[string(sig.Signature)]; ok {
+		return false
+	}
+	ss.times[string(sig.Signature)] = time.Unix(0, sig.Time)
+	return true
+}
+
+// AuthorizedQueriers is the allowlist of the queriers of a node
+type AuthorizedQueriers struct {
+	names map[string]string // querier name by serialized public key
+}
+
+// LoadAuthorizedQueriers reads an allowlist file. Each line holds a public key (serialized like the ones printed by the
+// key generation command), optionally followed by a name; the empty lines and the ones starting with '#' are ignored.
+func LoadAuthorizedQueriers(path string) (*AuthorizedQueriers, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, xerrors.Errorf("couldn't open authorized queriers file: %+v", err)
+	}
+	defer f.Close()
+
+	aq := &AuthorizedQueriers{names: make(map[string]string)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		pubKey, err := libunlynx.DeserializePoint(fields[0])
+		if err != nil {
+			return nil, xerrors.Errorf("wrong public key at line %d of %s: %+v", line, path, err)
+		}
+		aq.names[pubKey.String()] = strings.Join(fields[1:], " ")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, xerrors.Errorf("couldn't read authorized queriers file: %+v", err)
+	}
+	return aq, nil
+}
+
+// Authorized returns whether the querier is in the allowlist, and its name
+func (aq *AuthorizedQueriers) Authorized(querier kyber.Point) (string, bool) {
+	name, ok := aq.names[querier.String()]
+	return name, ok
+}
+
+// requestDigest is what the querier signs: the hash of the encoding of the request without its signature, followed by
+// the time of the signature. The signature is removed from the request while it is encoded.
+func requestDigest(req signableRequest, signed int64) ([]byte, error) {
+	sig := req.signature()
+	req.setSignature(nil)
+	b, err := network.Marshal(req)
+	req.setSignature(sig)
+	if err != nil {
+		return nil, xerrors.Errorf("couldn't marshal request: %+v", err)
+	}
+	h := sha256.New()
+	h.Write(b)
+	binary.Write(h, binary.BigEndian, signed)
+	return h.Sum(nil), nil
+}
+
+// SignRequest signs a request with the key of its querier, at the current time
+func SignRequest(req signableRequest, public kyber.Point, private kyber.Scalar) error {
+	return SignRequestAt(req, public, private, time.Now())
+}
+
+// SignRequestAt signs a request with the key of its querier, at the given time: the nodes only accept it within
+// SignatureValidity of this time
+func SignRequestAt(req signableRequest, public kyber.Point, private kyber.Scalar, at time.Time) error {
+	digest, err := requestDigest(req, at.UnixNano())
+	if err != nil {
+		return err
+	}
+	sig, err := schnorr.Sign(libunlynx.SuiTe, private, digest)
+	if err != nil {
+		return xerrors.Errorf("couldn't sign request: %+v", err)
+	}
+	req.setSignature(&QuerierSignature{Querier: public, Time: at.UnixNano(), Signature: sig})
+	return nil
+}
+
+// loadAuthorizedQueriers reads the allowlist of the node, if there is one
+func (s *Service) loadAuthorizedQueriers() error {
+	path := os.Getenv(AuthorizedQueriersFileEnv)
+	if path == "" {
+		log.Warn(s.ServerIdentity().String(), "the requests are not authorized (", AuthorizedQueriersFileEnv, "not set )")
+		return nil
+	}
+	aq, err := LoadAuthorizedQueriers(path)
+	if err != nil {
+		return err
+	}
+	s.authorizedQueriers = aq
+	return nil
+}
+
+// authorize checks that a request is signed by a querier of the allowlist of the node (if there is one), within
+// SignatureValidity of the time of the node, and that it is not the replay of a request already received
+func (s *Service) authorize(req signableRequest) error {
+	if s.authorizedQueriers == nil {
+		return nil
+	}
+	sig := req.signature()
+	if sig == nil || sig.Querier == nil {
+		return &AuthorizationError{Reason: "request not signed"}
+	}
+	name, ok := s.authorizedQueriers.Authorized(sig.Querier)
+	if !ok {
+		return &AuthorizationError{Reason: "unknown querier"}
+	}
+	digest, err := requestDigest(req, sig.Time)
+	if err != nil {
+		return err
+	}
+	if err := schnorr.Verify(libunlynx.SuiTe, sig.Querier, digest, sig.Signature); err != nil {
+		return &AuthorizationError{Reason: "wrong signature"}
+	}
+	if age := time.Since(time.Unix(0, sig.Time)); age > SignatureValidity || age < -SignatureValidity {
+		return &AuthorizationError{Reason: "signature expired or from the future"}
+	}
+	if !s.seenSignatures.add(sig) {
+		return &AuthorizationError{Reason: "replayed request"}
+	}
+	log.Lvl3(s.ServerIdentity().String(), "authorized request of querier", name)
+	return nil
+}
@@ -0,0 +1,235 @@
+package servicesmedco
+
+import (
+	"time"
+
+	"github.com/ldsec/medco-unlynx/protocols"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+// ErrSurveyCancelled is returned (wrapped) by the handlers and phases of a survey that was cancelled by the client
+var ErrSurveyCancelled = xerrors.New("survey cancelled")
+
+// surveyCancellation keeps track of what has to be stopped when a survey is cancelled
+type surveyCancellation struct {
+	refs        int                     // number of handlers and protocol instances running for the survey
+	cancelled   chan struct{}           // closed when the survey is cancelled
+	cancelledAt time.Time               // when the survey was cancelled
+	instances   []onet.ProtocolInstance // protocol instances running for the survey
+	querier     kyber.Point             // querier who submitted the survey to this node (nil without authorization)
+}
+
+func surveyCancelledError(sid SurveyID) error {
+	return xerrors.Errorf("survey %s: %w", sid, ErrSurveyCancelled)
+}
+
+// requestQuerier returns the querier who signed the request (nil if it isn't signed or without authorization)
+func (s *Service) requestQuerier(req signableRequest) kyber.Point {
+	if s.authorizedQueriers == nil {
+		return nil
+	}
+	if sig := req.signature(); sig != nil {
+		return sig.Querier
+	}
+	return nil
+}
+
+// acquireSurvey registers that a handler or a protocol instance is running for the survey and returns an error if the
+// survey was already cancelled. querier is the querier submitting the survey to this node (nil for the protocol
+// instances), a survey can't be submitted by several queriers. Each successful call must be followed by a call to
+// releaseSurvey.
+func (s *Service) acquireSurvey(sid SurveyID, querier kyber.Point) error {
+	s.cancelMutex.Lock()
+	defer s.cancelMutex.Unlock()
+
+	sc, ok := s.cancellations[sid]
+	if !ok {
+		sc = &surveyCancellation{cancelled: make(chan struct{})}
+		s.cancellations[sid] = sc
+	}
+	select {
+	case <-sc.cancelled:
+		return surveyCancelledError(sid)
+	default:
+	}
+	if querier != nil {
+		if sc.querier != nil && !sc.querier.Equal(querier) {
+			return &AuthorizationError{Reason: "survey submitted by another querier"}
+		}
+		sc.querier = querier
+	}
+	sc.refs++
+	return nil
+}
+
+// releaseSurvey is called once a handler or a protocol instance of the survey is done. The cancelled surveys are kept
+// so that their late requests are rejected.
+func (s *Service) releaseSurvey(sid SurveyID) {
+	s.cancelMutex.Lock()
+	defer s.cancelMutex.Unlock()
+
+	sc, ok := s.cancellations[sid]
+	if !ok {
+		return
+	}
+	sc.refs--
+	select {
+	case <-sc.cancelled:
+	default:
+		if sc.refs <= 0 {
+			delete(s.cancellations, sid)
+		}
+	}
+}
+
+// trackInstance registers a protocol instance running for the survey, so that it can be shut down if the survey is
+// cancelled. onDone (if not nil) is called once the instance is done.
+func (s *Service) trackInstance(sid SurveyID, tn *onet.TreeNodeInstance, pi onet.ProtocolInstance, onDone func()) error {
+	if err := s.acquireSurvey(sid, nil); err != nil {
+		return err
+	}
+
+	s.cancelMutex.Lock()
+	sc := s.cancellations[sid]
+	sc.instances = append(sc.instances, pi)
+	s.cancelMutex.Unlock()
+
+	tn.OnDoneCallback(func() bool {
+		s.cancelMutex.Lock()
+		for i, inst := range sc.instances {
+			if inst == pi {
+				sc.instances = append(sc.instances[:i], sc.instances[i+1:]...)
+				break
+			}
+		}
+		s.cancelMutex.Unlock()
+		s.releaseSurvey(sid)
+		if onDone != nil {
+			onDone()
+		}
+		return true
+	})
+	return nil
+}
+
+// cancelChannel returns the channel that is closed when the survey is cancelled (nil if nothing runs for the survey)
+func (s *Service) cancelChannel(sid SurveyID) <-chan struct{} {
+	s.cancelMutex.Lock()
+	defer s.cancelMutex.Unlock()
+
+	if sc, ok := s.cancellations[sid]; ok {
+		return sc.cancelled
+	}
+	return nil
+}
+
+// isCancelled returns whether the survey was cancelled
+func (s *Service) isCancelled(sid SurveyID) bool {
+	select {
+	case <-s.cancelChannel(sid):
+		return true
+	default:
+		return false
+	}
+}
+
+// checkSurveyCanceller returns an error if the querier can't cancel the survey: with authorization, only the querier
+// who submitted the survey to this node can cancel it (the other nodes trust this check).
+func (s *Service) checkSurveyCanceller(sid SurveyID, querier kyber.Point) error {
+	if s.authorizedQueriers == nil {
+		return nil
+	}
+	s.cancelMutex.Lock()
+	defer s.cancelMutex.Unlock()
+
+	sc, ok := s.cancellations[sid]
+	if !ok || sc.querier == nil {
+		return xerrors.Errorf("survey %s was not submitted to this node", sid)
+	}
+	if querier == nil || !sc.querier.Equal(querier) {
+		return &AuthorizationError{Reason: "survey submitted by another querier"}
+	}
+	return nil
+}
+
+// cancelSurvey cancels the survey on this node: the blocked handlers return, the running protocol instances are shut
+// down and the survey is removed from the maps. It returns whether the survey was running on this node. Only the
+// surveys known to the node are recorded as cancelled (to reject their late requests), until the maximum timeout.
+func (s *Service) cancelSurvey(sid SurveyID) bool {
+	running := false
+	for _, m := range []SurveyMap{s.MapSurveyKS, s.MapSurveyKSBatch, s.MapSurveyShuffle, s.MapSurveyAgg} {
+		if surv, err := m.Remove(string(sid)); err == nil && surv != nil {
+			running = true
+		}
+	}
+
+	s.cancelMutex.Lock()
+	s.expireCancellations()
+	sc, ok := s.cancellations[sid]
+	if !ok {
+		if !running {
+			s.cancelMutex.Unlock()
+			log.Lvl2(s.ServerIdentity().String(), "ignored the cancellation of unknown survey", sid)
+			return false
+		}
+		sc = &surveyCancellation{cancelled: make(chan struct{})}
+		s.cancellations[sid] = sc
+	}
+	running = running || sc.refs > 0
+	instances := append([]onet.ProtocolInstance{}, sc.instances...)
+	select {
+	case <-sc.cancelled:
+	default:
+		sc.cancelledAt = time.Now()
+		close(sc.cancelled)
+	}
+	s.cancelMutex.Unlock()
+
+	for _, pi := range instances {
+		if err := pi.Shutdown(); err != nil {
+			log.Warn(s.ServerIdentity().String(), "couldn't shut down protocol instance of survey", sid, ":", err)
+		}
+	}
+
+	log.Lvl2(s.ServerIdentity().String(), "cancelled survey", sid, "(running =", running, ")")
+	return running
+}
+
+// expireCancellations forgets the cancelled surveys that no longer run and were cancelled more than the maximum
+// timeout ago (their requests would have timed out anyway), it must be called with cancelMutex held
+func (s *Service) expireCancellations() {
+	for sid, sc := range s.cancellations {
+		select {
+		case <-sc.cancelled:
+			if sc.refs <= 0 && time.Since(sc.cancelledAt) > s.maxTimeout {
+				delete(s.cancellations, sid)
+			}
+		default:
+		}
+	}
+}
+
+// propagate runs a propagation function but returns as soon as the survey is cancelled
+func (s *Service) propagate(sid SurveyID, propagationFunc protocols.PropagationFunc, roster *onet.Roster,
+	msg network.Message, timeout time.Duration) ([]network.Message, error) {
+	type propagationResult struct {
+		msgs []network.Message
+		err  error
+	}
+	done := make(chan propagationResult, 1)
+	go func() {
+		msgs, err := propagationFunc(roster, msg, timeout)
+		done <- propagationResult{msgs, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.msgs, res.err
+	case <-s.cancelChannel(sid):
+		return nil, surveyCancelledError(sid)
+	}
+}
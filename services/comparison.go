@@ -0,0 +1,39 @@
+package servicesmedco
+
+import (
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"go.dedis.ch/onet/v3"
+	"golang.org/x/xerrors"
+)
+
+// checkComparison verifies that a comparison request can be run: its threshold complies with the suppression policy of
+// the node (the bit it reveals is as sensitive as a suppressed count), and only the bit is released.
+func (s *Service) checkComparison(sar *SurveyAggRequest) error {
+	if sar.ComparisonThreshold <= 0 {
+		return xerrors.Errorf("wrong comparison threshold: %d", sar.ComparisonThreshold)
+	}
+	if err := s.checkSuppressionThreshold(sar.ComparisonThreshold); err != nil {
+		return err
+	}
+	if sar.SuppressionThreshold != 0 || sar.DP.Enabled() {
+		return xerrors.New("a comparison can't be combined with a suppression or noise")
+	}
+	return nil
+}
+
+// ComparisonPhase replaces the aggregated result by an encryption with the collective key of 1 if the value it
+// encrypts is at least threshold, of 0 otherwise. The result is supposed to be a count (not negative). As for the
+// suppression, the nodes never learn the result and the bit is computed in the encrypted domain (see thresholdSelect):
+// the ciphertext returned is re-randomized by all the nodes, this one only learns the bit and picks it.
+func (s *Service) ComparisonPhase(targetSurvey SurveyID, roster *onet.Roster, result libunlynx.CipherText,
+	threshold int64, timeout time.Duration) (libunlynx.CipherText, time.Duration, error) {
+	start := time.Now()
+	bit, _, err := s.thresholdSelect(targetSurvey, roster, result, threshold,
+		libunlynx.CipherVector{trivialEncryption(0)}, libunlynx.CipherVector{trivialEncryption(1)}, timeout)
+	if err != nil {
+		return libunlynx.CipherText{}, 0, err
+	}
+	return bit[0], time.Since(start), nil
+}
@@ -0,0 +1,255 @@
+package servicesmedco
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/ldsec/unlynx/lib"
+	"go.dedis.ch/kyber/v3"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/xerrors"
+)
+
+// Environment variables configuring the encryption of the DDT secrets at rest
+const (
+	// DDTSecretsEncryptionEnv selects the key the DDT secrets files are encrypted with: DDTSecretsKeyPassphrase or
+	// DDTSecretsKeyPrivateKey (not encrypted if it is not set)
+	DDTSecretsEncryptionEnv = "UNLYNX_DDT_SECRETS_ENCRYPTION"
+	// DDTSecretsPassphraseEnv is the passphrase the key is derived from with DDTSecretsKeyPassphrase
+	DDTSecretsPassphraseEnv = "UNLYNX_DDT_SECRETS_PASSPHRASE"
+)
+
+// Sources of the key of the DDT secrets
+const (
+	// DDTSecretsKeyPassphrase derives the key from a passphrase (scrypt)
+	DDTSecretsKeyPassphrase = "passphrase"
+	// DDTSecretsKeyPrivateKey derives the key from the private key of the node (HKDF)
+	DDTSecretsKeyPrivateKey = "privateKey"
+)
+
+// ddtSecretsCheck is encrypted in the secrets files to detect a wrong key
+const ddtSecretsCheck = "medco-unlynx DDT secrets"
+
+// DDTSecretsKey is what the key encrypting the DDT secrets at rest is derived from (with the salt of the file)
+type DDTSecretsKey struct {
+	Source   string
+	material []byte
+}
+
+// secretsEncryption describes how the secrets of a file are encrypted
+type secretsEncryption struct {
+	KeySource string
+	Salt      string
+	Check     string
+}
+
+// NewPassphraseDDTSecretsKey returns a DDT secrets key derived from a passphrase
+func NewPassphraseDDTSecretsKey(passphrase string) (*DDTSecretsKey, error) {
+	if passphrase == "" {
+		return nil, xerrors.New("empty passphrase")
+	}
+	return &DDTSecretsKey{Source: DDTSecretsKeyPassphrase, material: []byte(passphrase)}, nil
+}
+
+// NewPrivateKeyDDTSecretsKey returns a DDT secrets key derived from the private key of a node
+func NewPrivateKeyDDTSecretsKey(private kyber.Scalar) (*DDTSecretsKey, error) {
+	if private == nil {
+		return nil, xerrors.New("no private key")
+	}
+	b, err := private.MarshalBinary()
+	if err != nil {
+		return nil, xerrors.Errorf("couldn't marshal private key: %+v", err)
+	}
+	return &DDTSecretsKey{Source: DDTSecretsKeyPrivateKey, material: b}, nil
+}
+
+// DDTSecretsKeyFromEnv returns the DDT secrets key configured by the environment (nil if the secrets are not encrypted).
+// private is the private key of the node, needed with DDTSecretsKeyPrivateKey.
+func DDTSecretsKeyFromEnv(private kyber.Scalar) (*DDTSecretsKey, error) {
+	switch source := os.Getenv(DDTSecretsEncryptionEnv); source {
+	case "":
+		return nil, nil
+	case DDTSecretsKeyPassphrase:
+		return NewPassphraseDDTSecretsKey(os.Getenv(DDTSecretsPassphraseEnv))
+	case DDTSecretsKeyPrivateKey:
+		return NewPrivateKeyDDTSecretsKey(private)
+	default:
+		return nil, xerrors.Errorf("wrong value for %s (%s)", DDTSecretsEncryptionEnv, source)
+	}
+}
+
+// derive derives the AES-256 key of a secrets file from its salt
+func (k *DDTSecretsKey) derive(salt []byte) ([]byte, error) {
+	switch k.Source {
+	case DDTSecretsKeyPassphrase:
+		return scrypt.Key(k.material, salt, 1<<15, 8, 1, 32)
+	case DDTSecretsKeyPrivateKey:
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, k.material, salt, []byte(ddtSecretsCheck)), key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	return nil, xerrors.Errorf("unknown DDT secrets key source: %s", k.Source)
+}
+
+// newSecretsEncryption sets up the encryption of a new secrets file
+func newSecretsEncryption(key *DDTSecretsKey) (*secretsEncryption, cipher.AEAD, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	enc := &secretsEncryption{KeySource: key.Source, Salt: base64.URLEncoding.EncodeToString(salt)}
+	aead, err := enc.cipher(key, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if enc.Check, err = seal(aead, []byte(ddtSecretsCheck), nil); err != nil {
+		return nil, nil, err
+	}
+	return enc, aead, nil
+}
+
+// cipher returns the cipher of the secrets of a file, after checking the key (unless it is a new file)
+func (enc *secretsEncryption) cipher(key *DDTSecretsKey, check bool) (cipher.AEAD, error) {
+	if key == nil {
+		return nil, xerrors.Errorf("the DDT secrets are encrypted with a %s key: set %s", enc.KeySource,
+			DDTSecretsEncryptionEnv)
+	}
+	if key.Source != enc.KeySource {
+		return nil, xerrors.Errorf("the DDT secrets are encrypted with a %s key, not a %s one", enc.KeySource,
+			key.Source)
+	}
+	salt, err := base64.URLEncoding.DecodeString(enc.Salt)
+	if err != nil {
+		return nil, xerrors.Errorf("wrong salt: %+v", err)
+	}
+	derived, err := key.derive(salt)
+	if err != nil {
+		return nil, xerrors.Errorf("couldn't derive the DDT secrets key: %+v", err)
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if check {
+		plain, err := open(aead, enc.Check, nil)
+		if err != nil || subtle.ConstantTimeCompare(plain, []byte(ddtSecretsCheck)) != 1 {
+			return nil, xerrors.New("wrong DDT secrets key")
+		}
+	}
+	return aead, nil
+}
+
+// secretsCipher returns the cipher of the secrets of the file (nil if they are not encrypted)
+func (contents *privateTOML) secretsCipher(key *DDTSecretsKey) (cipher.AEAD, error) {
+	if contents.Encryption == nil {
+		return nil, nil
+	}
+	return contents.Encryption.cipher(key, true)
+}
+
+// secretAD binds an encrypted secret to its 'source' server and epoch
+func secretAD(serverID string, epoch int) []byte {
+	return []byte(serverID + "/" + strconv.Itoa(epoch))
+}
+
+func seal(aead cipher.AEAD, plain, ad []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", xerrors.Errorf("couldn't draw a nonce: %+v", err)
+	}
+	return base64.URLEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, ad)), nil
+}
+
+func open(aead cipher.AEAD, sealed string, ad []byte) ([]byte, error) {
+	b, err := base64.URLEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < aead.NonceSize() {
+		return nil, xerrors.New("encrypted secret too short")
+	}
+	return aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], ad)
+}
+
+// encodeDDTSecret encodes a secret for the file, encrypted if aead is not nil
+func encodeDDTSecret(aead cipher.AEAD, serverID string, epoch int, secret kyber.Scalar) (string, error) {
+	b, err := secret.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	if aead == nil {
+		return base64.URLEncoding.EncodeToString(b), nil
+	}
+	return seal(aead, b, secretAD(serverID, epoch))
+}
+
+// decodeDDTSecret decodes a secret of the file, encrypted if aead is not nil
+func decodeDDTSecret(aead cipher.AEAD, el secretDDT) (kyber.Scalar, error) {
+	var b []byte
+	var err error
+	if aead == nil {
+		b, err = base64.URLEncoding.DecodeString(el.Secret)
+	} else {
+		b, err = open(aead, el.Secret, secretAD(el.ServerID, el.Epoch))
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("couldn't decode DDT secret of %s (epoch %d): %+v", el.ServerID, el.Epoch, err)
+	}
+
+	secret := libunlynx.SuiTe.Scalar()
+	if err := secret.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// EncryptDDTSecretsFile encrypts the secrets of a plaintext DDT secrets file with a key
+func EncryptDDTSecretsFile(path string, key *DDTSecretsKey) error {
+	if key == nil {
+		return xerrors.New("no DDT secrets key")
+	}
+	unlock, err := lockDDTSecretsFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	contents, err := readTOMLSecrets(path)
+	if err != nil {
+		return err
+	}
+	if contents.Encryption != nil {
+		return xerrors.Errorf("the DDT secrets of %s are already encrypted", path)
+	}
+
+	enc, aead, err := newSecretsEncryption(key)
+	if err != nil {
+		return xerrors.Errorf("couldn't set up the encryption: %+v", err)
+	}
+	for i, el := range contents.Secrets {
+		secret, err := decodeDDTSecret(nil, el)
+		if err != nil {
+			return err
+		}
+		if contents.Secrets[i].Secret, err = encodeDDTSecret(aead, el.ServerID, el.Epoch, secret); err != nil {
+			return err
+		}
+	}
+	contents.Encryption = enc
+	return addTOMLSecret(path, contents)
+}
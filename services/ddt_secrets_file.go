@@ -0,0 +1,132 @@
+package servicesmedco
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
+)
+
+// DDTSecretsFilePathEnv is the environment variable holding the path of the DDT secrets file of the node. The writes
+// of the file are serialized with a lock on a <path>.lock file next to it (see lockDDTSecretsFile), which is created
+// at the first write and left in place: it is empty and can be ignored, but must not be removed while a node or a
+// rotation may write the secrets.
+const DDTSecretsFilePathEnv = "UNLYNX_DDT_SECRETS_FILE_PATH"
+
+// ddtSecretsChecksum returns the checksum of the contents of a secrets file (computed without the checksum itself)
+func ddtSecretsChecksum(contents privateTOML) (string, error) {
+	contents.Checksum = ""
+	b, err := json.Marshal(contents)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return base64.URLEncoding.EncodeToString(sum[:]), nil
+}
+
+// readTOMLSecrets reads a secrets file and verifies its checksum, so that a corrupted file is not completed with new
+// random secrets. The files written before the checksums were introduced are accepted, they get a checksum at their
+// next write. A file without secrets (e.g. created empty by the operator) is valid: the secrets are added to it.
+func readTOMLSecrets(path string) (privateTOML, error) {
+	contents := privateTOML{}
+	if _, err := toml.DecodeFile(path, &contents); err != nil {
+		return privateTOML{}, xerrors.Errorf("couldn't read the DDT secrets of %s: %+v", path, err)
+	}
+
+	if contents.Checksum == "" {
+		if len(contents.Secrets) > 0 {
+			log.Warn("the DDT secrets file", path, "has no checksum")
+		}
+		return contents, nil
+	}
+	checksum, err := ddtSecretsChecksum(contents)
+	if err != nil {
+		return privateTOML{}, err
+	}
+	if checksum != contents.Checksum {
+		return privateTOML{}, xerrors.Errorf("the DDT secrets file %s is corrupted (wrong checksum)", path)
+	}
+	return contents, nil
+}
+
+// addTOMLSecret writes the contents of a secrets file with their checksum
+func addTOMLSecret(path string, content privateTOML) error {
+	var err error
+	if content.Checksum, err = ddtSecretsChecksum(content); err != nil {
+		return err
+	}
+	return writeFileAtomically(path, func(w io.Writer) error {
+		return toml.NewEncoder(w).Encode(&content)
+	})
+}
+
+// writeFileAtomically writes a file to a temporary file that is then renamed, so that a crash leaves either the
+// previous file or the new one
+func writeFileAtomically(path string, write func(w io.Writer) error) error {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	fileHandle, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fileHandle.Name()) // no-op once renamed
+
+	if err := write(fileHandle); err != nil {
+		fileHandle.Close()
+		return err
+	}
+	if err := fileHandle.Sync(); err != nil {
+		fileHandle.Close()
+		return err
+	}
+	if err := fileHandle.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(fileHandle.Name(), path); err != nil {
+		return err
+	}
+
+	// persist the rename
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// checkDDTSecretsFile verifies at startup that the secrets file of the node (if it exists) is intact and readable with
+// its key
+func checkDDTSecretsFile(path string, key *DDTSecretsKey) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	unlock, err := lockDDTSecretsFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	contents, err := readTOMLSecrets(path)
+	if err != nil {
+		return err
+	}
+	aead, err := contents.secretsCipher(key)
+	if err != nil {
+		return err
+	}
+	for _, el := range contents.Secrets {
+		if _, err := decodeDDTSecret(aead, el); err != nil {
+			return err
+		}
+	}
+	return nil
+}
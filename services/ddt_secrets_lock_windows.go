@@ -0,0 +1,28 @@
+package servicesmedco
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/xerrors"
+)
+
+// lockDDTSecretsFile takes an exclusive lock on a secrets file, held across processes until the returned function is
+// called. The lock is taken on a separate file since the secrets file is replaced at each write. The lock file is
+// never removed: a process could otherwise lock a file just unlinked by another one and both would write.
+func lockDDTSecretsFile(path string) (func(), error) {
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, xerrors.Errorf("couldn't open the lock of the DDT secrets: %+v", err)
+	}
+	handle := windows.Handle(f.Fd())
+	overlapped := &windows.Overlapped{}
+	if err := windows.LockFileEx(handle, windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, overlapped); err != nil {
+		f.Close()
+		return nil, xerrors.Errorf("couldn't lock the DDT secrets: %+v", err)
+	}
+	return func() {
+		windows.UnlockFileEx(handle, 0, 1, 0, overlapped)
+		f.Close()
+	}, nil
+}
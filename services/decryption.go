@@ -0,0 +1,268 @@
+package servicesmedco
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ldsec/medco-unlynx/protocols"
+	"github.com/ldsec/unlynx/lib"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+func init() {
+	network.RegisterMessages(SurveyDecryptRequest{}, ResultDecrypt{})
+}
+
+// DecryptRequestName is the type of the collective decryption requests
+const DecryptRequestName = "DecryptRequestName"
+
+// DecryptTimeExec and DecryptTimeCommunication are the timers of the collective decryption, DecryptRequestTime the
+// timer of the whole request at the client
+const (
+	DecryptTimeExec          = "DecryptTimeExec"
+	DecryptTimeCommunication = "DecryptTimeCommunication"
+	DecryptRequestTime       = "DecryptRequestTime"
+)
+
+// CollectiveDecryptionEnv is the environment variable holding whether the node takes part in collective decryptions,
+// which give the plaintext results of an aggregation survey to its querier (false by default), instead of their key
+// switching (SurveyAggRequest.Decrypt) or in addition to it (SurveyDecryptRequest). Only the final results of the
+// aggregation surveys, after their noise and suppression, can be decrypted: each node only decrypts the results it
+// computed itself for the survey, so that these phases are not bypassed.
+const CollectiveDecryptionEnv = "UNLYNX_COLLECTIVE_DECRYPTION"
+
+// DecryptableResultsRetention is how long the final results of a survey can be collectively decrypted after the survey
+const DecryptableResultsRetention = time.Hour
+
+// SurveyDecryptRequest is the message used to collectively decrypt the results of an aggregation survey (with the same
+// ID) that was run by the same roster, all the nodes of the roster have to allow it
+type SurveyDecryptRequest struct {
+	SurveyID SurveyID
+	Roster   onet.Roster
+	Timeout  time.Duration // how long the nodes wait for each other (0 = maximum allowed by the nodes)
+
+	Signed // signature of the request by its querier
+}
+
+// decryptableResults are the final results of an aggregation survey computed by this node
+type decryptableResults struct {
+	results libunlynx.CipherVector
+	querier kyber.Point // querier who submitted the survey to this node (nil without authorization)
+	added   time.Time
+}
+
+// ResultDecrypt contains the decrypted values of a SurveyDecryptRequest
+type ResultDecrypt struct {
+	Result []int64
+	TR     TimeResults
+}
+
+// loadCollectiveDecryptionPolicy reads from the environment whether the node takes part in collective decryptions
+func loadCollectiveDecryptionPolicy() (bool, error) {
+	v := os.Getenv(CollectiveDecryptionEnv)
+	if v == "" {
+		return false, nil
+	}
+	allowed, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, xerrors.Errorf("wrong value for %s (%s): %+v", CollectiveDecryptionEnv, v, err)
+	}
+	return allowed, nil
+}
+
+// HandleSurveyDecryptRequest handles the reception of values to collectively decrypt
+func (s *Service) HandleSurveyDecryptRequest(sdr *SurveyDecryptRequest) (network.Message, error) {
+	start := time.Now()
+	resp, err := s.handleSurveyDecryptRequest(sdr)
+	s.audit(sdr.SurveyID, DecryptRequestName, sdr.Signature, nil, sdr.Roster, true, start, resp, err)
+	return resp, err
+}
+
+func (s *Service) handleSurveyDecryptRequest(sdr *SurveyDecryptRequest) (network.Message, error) {
+	if err := s.authorize(sdr); err != nil {
+		return nil, err
+	}
+	if !s.collectiveDecryption {
+		return nil, xerrors.New("this node doesn't take part in collective decryptions")
+	}
+
+	// sanitize params
+	if err := emptySurveyID(sdr.SurveyID); err != nil {
+		return nil, xerrors.Errorf("%+v", err)
+	}
+	if err := emptyRoster(sdr.Roster); err != nil {
+		return nil, xerrors.Errorf("%+v", err)
+	}
+	targets, querier, _ := s.getDecryptableResults(sdr.SurveyID)
+	if len(targets) == 0 {
+		return nil, xerrors.Errorf("survey %s has no results to decrypt on this node", sdr.SurveyID)
+	}
+	if querier != nil && !querier.Equal(s.requestQuerier(sdr)) {
+		return nil, &AuthorizationError{Reason: "results of another querier"}
+	}
+
+	if err := s.checkInterrupted(sdr.SurveyID); err != nil {
+		return nil, err
+	}
+	if err := s.acquireSurvey(sdr.SurveyID, s.requestQuerier(sdr)); err != nil {
+		return nil, err
+	}
+	defer s.releaseSurvey(sdr.SurveyID)
+
+	log.Lvl2(s.ServerIdentity().String(), " received a SurveyDecryptRequest:", sdr.SurveyID)
+
+	result, execTime, communicationTime, err := s.CollectiveDecryptionPhase(sdr.SurveyID, targets, &sdr.Roster,
+		s.surveyTimeout(sdr.Timeout))
+	if err != nil {
+		return nil, xerrors.Errorf("collective decryption error: %+v", err)
+	}
+
+	return &ResultDecrypt{Result: result, TR: TimeResults{MapTR: map[string]time.Duration{
+		DecryptTimeExec:          execTime,
+		DecryptTimeCommunication: communicationTime,
+	}}}, nil
+}
+
+// checkAggDecrypt verifies that the results of an aggregation request can be collectively decrypted instead of key
+// switched. The threshold aggregations are refused since each node may leave different nodes out of its results.
+func (s *Service) checkAggDecrypt(sar *SurveyAggRequest) error {
+	if !s.collectiveDecryption {
+		return xerrors.New("this node doesn't take part in collective decryptions")
+	}
+	if sar.ClientPubKey != nil {
+		return xerrors.New("a target public key for results to decrypt")
+	}
+	if sar.Proofs || sar.MinContributors != 0 {
+		return xerrors.New("proofs and minimum numbers of contributors are not supported with a collective decryption")
+	}
+	return nil
+}
+
+// CollectiveDecryptionPhase decrypts the final results of a survey, encrypted with the collective key of the roster.
+func (s *Service) CollectiveDecryptionPhase(targetSurvey SurveyID, targets libunlynx.CipherVector, roster *onet.Roster,
+	timeout time.Duration) ([]int64, time.Duration, time.Duration, error) {
+	start := time.Now()
+	s.putDecryptionTarget(targetSurvey, targets)
+	defer s.deleteDecryptionTarget(targetSurvey)
+
+	pi, err := s.StartProtocol(protocols.CollectiveDecryptionProtocolName, "",
+		ProtocolConfig{SurveyID: targetSurvey, Timeout: timeout}, roster)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	select {
+	case plaintexts := <-pi.(*protocols.CollectiveDecryptionProtocol).FeedbackChannel:
+		execTime := pi.(*protocols.CollectiveDecryptionProtocol).ExecTime
+		result := make([]int64, len(plaintexts))
+		for i, m := range plaintexts {
+			if result[i], err = decodeInt(m); err != nil {
+				return nil, 0, 0, err
+			}
+		}
+		return result, execTime, time.Since(start) - execTime, nil
+	case <-s.cancelChannel(targetSurvey):
+		return nil, 0, 0, surveyCancelledError(targetSurvey)
+	case <-time.After(timeout):
+		return nil, 0, 0, xerrors.Errorf("couldn't finish collective decryption protocol in time")
+	}
+}
+
+// decodeInt returns m from m.B. The lookup table of libunlynx is shared by the whole process and only holds the negative
+// values if it was always extended with them, so -m is looked up for the negative values.
+func decodeInt(m kyber.Point) (int64, error) {
+	for _, sign := range []int64{1, -1} {
+		p := libunlynx.SuiTe.Point().Mul(libunlynx.SuiTe.Scalar().SetInt64(sign), m)
+		v := libunlynx.DecryptInt(libunlynx.SuiTe.Scalar().Zero(), libunlynx.PointToCipherText(p))
+		if libunlynx.IntToPoint(v).Equal(p) {
+			return sign * v, nil
+		}
+	}
+	return 0, xerrors.Errorf("decrypted value out of [-%d, %d]", libunlynx.MaxHomomorphicInt, libunlynx.MaxHomomorphicInt)
+}
+
+// putDecryptableResults keeps the final results of an aggregation survey computed by this node, for their collective
+// decryption
+func (s *Service) putDecryptableResults(sid SurveyID, results libunlynx.CipherVector, querier kyber.Point) {
+	s.decryptionMutex.Lock()
+	defer s.decryptionMutex.Unlock()
+	if _, ok := s.decryptableResults[sid]; !ok {
+		time.AfterFunc(DecryptableResultsRetention, func() { s.expireDecryptableResults(sid) })
+	}
+	s.decryptableResults[sid] = &decryptableResults{
+		results: append(libunlynx.CipherVector{}, results...),
+		querier: querier,
+		added:   time.Now(),
+	}
+}
+
+// expireDecryptableResults removes the results of a survey kept for DecryptableResultsRetention
+func (s *Service) expireDecryptableResults(sid SurveyID) {
+	s.decryptionMutex.Lock()
+	defer s.decryptionMutex.Unlock()
+	results, ok := s.decryptableResults[sid]
+	if !ok {
+		return
+	}
+	if remaining := DecryptableResultsRetention - time.Since(results.added); remaining > 0 {
+		// the results were put again in the meantime
+		time.AfterFunc(remaining, func() { s.expireDecryptableResults(sid) })
+		return
+	}
+	delete(s.decryptableResults, sid)
+}
+
+// getDecryptableResults returns the final results of a survey computed by this node and the querier who submitted
+// the survey to it
+func (s *Service) getDecryptableResults(sid SurveyID) (libunlynx.CipherVector, kyber.Point, bool) {
+	s.decryptionMutex.Lock()
+	defer s.decryptionMutex.Unlock()
+	results, ok := s.decryptableResults[sid]
+	if !ok {
+		return nil, nil, false
+	}
+	return append(libunlynx.CipherVector{}, results.results...), results.querier, true
+}
+
+// isDecryptable returns whether the ciphertexts to decrypt are the final results of the survey computed by this node.
+// The root of a decryption may be ahead of this node in the survey: its results are waited for until the timeout.
+func (s *Service) isDecryptable(sid SurveyID, targets libunlynx.CipherVector, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	results, _, ok := s.getDecryptableResults(sid)
+	for !ok && time.Now().Before(deadline) && !s.isCancelled(sid) {
+		time.Sleep(100 * time.Millisecond)
+		results, _, ok = s.getDecryptableResults(sid)
+	}
+	if !ok || len(targets) != len(results) {
+		return false
+	}
+	for i := range targets {
+		if !targets[i].K.Equal(results[i].K) || !targets[i].C.Equal(results[i].C) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Service) putDecryptionTarget(sid SurveyID, targets libunlynx.CipherVector) {
+	s.decryptionMutex.Lock()
+	defer s.decryptionMutex.Unlock()
+	s.decryptionTargets[sid] = targets
+}
+
+func (s *Service) getDecryptionTarget(sid SurveyID) (libunlynx.CipherVector, bool) {
+	s.decryptionMutex.Lock()
+	defer s.decryptionMutex.Unlock()
+	targets, ok := s.decryptionTargets[sid]
+	return targets, ok
+}
+
+func (s *Service) deleteDecryptionTarget(sid SurveyID) {
+	s.decryptionMutex.Lock()
+	defer s.decryptionMutex.Unlock()
+	delete(s.decryptionTargets, sid)
+}
@@ -0,0 +1,347 @@
+package servicesmedco
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/ldsec/medco-unlynx/protocols"
+	"github.com/ldsec/unlynx/lib"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/share"
+	"go.dedis.ch/kyber/v3/share/dkg/pedersen"
+	"go.dedis.ch/kyber/v3/util/encoding"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+func init() {
+	network.RegisterMessages(DKGRequest{}, DKGResponse{})
+}
+
+// DKGRequestName is the type of the distributed key generation requests
+const DKGRequestName = "DKGRequestName"
+
+// DKGTime is the time spent generating a collective key
+const DKGTime = "DKGTime"
+
+// DKGSharesPathEnv is the environment variable holding the directory where the node keeps its shares of the collective
+// keys (they are only kept in memory if it is not set)
+const DKGSharesPathEnv = "UNLYNX_DKG_SHARES_PATH"
+
+// DKGShareName is the prefix of the share files (followed by the ID of the key and the address of the node)
+const DKGShareName = "dkgshare"
+
+// DKGRequest asks the nodes of the roster to generate a collective key by distributed key generation: each node gets a
+// share of the private key, which nobody knows, and any Threshold of them can use it
+type DKGRequest struct {
+	ID        string // identifies the key among the ones the nodes hold
+	Roster    onet.Roster
+	Threshold int           // 0 = majority of the nodes
+	Timeout   time.Duration // how long the nodes wait for each other (0 = maximum allowed by the nodes)
+
+	Signed // signature of the request by its querier
+}
+
+// DKGResponse is the public outcome of a distributed key generation
+type DKGResponse struct {
+	ID            string
+	Threshold     int
+	CollectiveKey kyber.Point
+	Commits       []kyber.Point // public polynomial of the key, the public share of the node i is its evaluation at i
+	TR            map[string]time.Duration
+}
+
+// DKGShare is the share of a collective key held by a node
+type DKGShare struct {
+	ID        string
+	Threshold int
+	Index     int // index of the node in the roster of the generation
+	Share     kyber.Scalar
+	Commits   []kyber.Point
+	Nodes     []network.Address // roster of the generation
+}
+
+// Public returns the collective key
+func (ds *DKGShare) Public() kyber.Point {
+	return ds.Commits[0]
+}
+
+// PublicShare returns the public share of the node at index i of the roster of the generation
+func (ds *DKGShare) PublicShare(i int) kyber.Point {
+	return share.NewPubPoly(libunlynx.SuiTe, nil, ds.Commits).Eval(i).V
+}
+
+// shareOf returns the index of the share of a node (its position in the roster of the generation) and its public share
+func (ds *DKGShare) shareOf(si *network.ServerIdentity) (int, kyber.Point, bool) {
+	for i, address := range ds.Nodes {
+		if address == si.Address {
+			return i, ds.PublicShare(i), true
+		}
+	}
+	return 0, nil, false
+}
+
+// dkgShareTOML is how a share is written to its file
+type dkgShareTOML struct {
+	ID        string
+	Threshold int
+	Index     int
+	Share     string
+	Commits   []string
+	Nodes     []string
+}
+
+// dkgShares holds the shares of the node, by ID of the key
+type dkgShares struct {
+	sync.Mutex
+	dir    string // empty if they are only kept in memory
+	shares map[string]*DKGShare
+}
+
+// HandleDKGRequest handles the reception of a distributed key generation request
+func (s *Service) HandleDKGRequest(dr *DKGRequest) (network.Message, error) {
+	start := time.Now()
+	resp, err := s.handleDKGRequest(dr)
+	s.audit(SurveyID(dr.ID), DKGRequestName, dr.Signature, nil, dr.Roster, false, start, resp, err)
+	return resp, err
+}
+
+func (s *Service) handleDKGRequest(dr *DKGRequest) (network.Message, error) {
+	if err := s.authorize(dr); err != nil {
+		return nil, err
+	}
+
+	// sanitize params
+	if dr.ID == "" {
+		return nil, xerrors.New("DKG id is empty")
+	}
+	if err := emptyRoster(dr.Roster); err != nil {
+		return nil, xerrors.Errorf("%+v", err)
+	}
+	threshold := dr.Threshold
+	if threshold == 0 {
+		threshold = len(dr.Roster.List)/2 + 1
+	}
+	if threshold < 2 || threshold > len(dr.Roster.List) {
+		return nil, xerrors.Errorf("wrong DKG threshold %d for %d nodes", threshold, len(dr.Roster.List))
+	}
+	if _, err := s.dkgShare(dr.ID); err == nil {
+		return nil, xerrors.Errorf("DKG key %s already exists", dr.ID)
+	}
+
+	log.Lvl2(s.ServerIdentity().String(), " received a DKGRequest:", dr.ID, "(", len(dr.Roster.List), "nodes, threshold",
+		threshold, ")")
+
+	start := time.Now()
+	timeout := s.surveyTimeout(dr.Timeout)
+	resolved := *dr
+	resolved.Threshold = threshold
+	resolved.Signature = nil
+	pc, err := newProtocolConfig(SurveyID(dr.ID), "", &resolved)
+	if err != nil {
+		return nil, xerrors.Errorf("couldn't create protocolConfig: %+v", err)
+	}
+	pc.Timeout = timeout
+	pi, err := s.StartProtocol(protocols.DKGProtocolName, "", pc, &dr.Roster)
+	if err != nil {
+		return nil, err
+	}
+	var result protocols.DKGResult
+	select {
+	case result = <-pi.(*protocols.DKGProtocol).FeedbackChannel:
+	case <-time.After(timeout):
+		return nil, xerrors.Errorf("couldn't finish the DKG protocol in time")
+	}
+
+	return &DKGResponse{
+		ID:            dr.ID,
+		Threshold:     result.Threshold,
+		CollectiveKey: result.Share.Public(),
+		Commits:       result.Share.Commits,
+		TR:            map[string]time.Duration{DKGTime: time.Since(start)},
+	}, nil
+}
+
+// newDKGProtocol sets up the distributed key generation at a node, which refuses to generate a key it already has
+func (s *Service) newDKGProtocol(tn *onet.TreeNodeInstance, protoConf *ProtocolConfig) (onet.ProtocolInstance, error) {
+	id := string(protoConf.SurveyID)
+	if _, err := s.dkgShare(id); err == nil {
+		return nil, xerrors.Errorf("DKG key %s already exists", id)
+	}
+
+	pi, err := protocols.NewDKGProtocol(tn)
+	if err != nil {
+		return nil, err
+	}
+	dkgProtocol := pi.(*protocols.DKGProtocol)
+	dkgProtocol.Timeout = s.surveyTimeout(protoConf.Timeout)
+	if tn.IsRoot() {
+		_, msg, err := network.Unmarshal(protoConf.Data, libunlynx.SuiTe)
+		if err != nil {
+			return nil, xerrors.Errorf("couldn't unmarshal the DKG request: %+v", err)
+		}
+		dkgProtocol.Threshold = msg.(*DKGRequest).Threshold
+	}
+	dkgProtocol.Longterm = s.ServerIdentity().ServicePrivate(Name)
+	dkgProtocol.Participants = make([]kyber.Point, len(tn.Roster().List))
+	nodes := make([]network.Address, len(tn.Roster().List))
+	for i, si := range tn.Roster().List {
+		dkgProtocol.Participants[i] = si.ServicePublic(Name)
+		nodes[i] = si.Address
+	}
+	dkgProtocol.ShareFunc = func(distShare *dkg.DistKeyShare, threshold int) error {
+		return s.putDKGShare(&DKGShare{
+			ID:        id,
+			Threshold: threshold,
+			Index:     distShare.Share.I,
+			Share:     distShare.Share.V,
+			Commits:   distShare.Commits,
+			Nodes:     nodes,
+		})
+	}
+	return pi, nil
+}
+
+// checkQuorum verifies that the quorum of a key switching request can switch its data with the collective key it names
+func (s *Service) checkQuorum(skr *SurveyKSRequest) error {
+	if skr.Proofs {
+		return xerrors.New("proofs are not supported with a quorum")
+	}
+	ds, err := s.dkgShare(skr.DKGKeyID)
+	if err != nil {
+		return xerrors.Errorf("unknown DKG key %s", skr.DKGKeyID)
+	}
+	if skr.Quorum < ds.Threshold || skr.Quorum > len(skr.Roster.List) {
+		return xerrors.Errorf("wrong quorum %d for the DKG key %s (threshold %d, %d nodes)", skr.Quorum, skr.DKGKeyID,
+			ds.Threshold, len(skr.Roster.List))
+	}
+	return nil
+}
+
+// checkAggDKGKey verifies that an aggregation request whose data is encrypted with a collective key generated by DKG
+// only runs the phases that the nodes holding a share of the key can complete without the others
+func (s *Service) checkAggDKGKey(sar *SurveyAggRequest) error {
+	if sar.MinContributors == 0 {
+		return xerrors.New("a DKG key requires a minimum number of contributors")
+	}
+	if sar.Proofs || sar.DP.Enabled() || sar.SuppressionThreshold != 0 || sar.ComparisonThreshold != 0 {
+		return xerrors.New("proofs, noise, suppression and comparison are not supported with a DKG key")
+	}
+	if _, err := s.dkgShare(sar.DKGKeyID); err != nil {
+		return xerrors.Errorf("unknown DKG key %s", sar.DKGKeyID)
+	}
+	return nil
+}
+
+// dkgShare returns the share of the node for a collective key
+func (s *Service) dkgShare(id string) (*DKGShare, error) {
+	s.dkgShares.Lock()
+	defer s.dkgShares.Unlock()
+
+	if ds, ok := s.dkgShares.shares[id]; ok {
+		return ds, nil
+	}
+	if s.dkgShares.dir == "" {
+		return nil, xerrors.Errorf("no DKG share for key %s", id)
+	}
+	ds, err := ReadDKGShare(s.dkgSharePath(id))
+	if err != nil {
+		return nil, err
+	}
+	s.dkgShares.shares[id] = ds
+	return ds, nil
+}
+
+// putDKGShare keeps a new share of the node (it never replaces an existing one)
+func (s *Service) putDKGShare(ds *DKGShare) error {
+	s.dkgShares.Lock()
+	defer s.dkgShares.Unlock()
+
+	if _, ok := s.dkgShares.shares[ds.ID]; ok {
+		return xerrors.Errorf("DKG key %s already exists", ds.ID)
+	}
+	if s.dkgShares.dir != "" {
+		path := s.dkgSharePath(ds.ID)
+		if _, err := os.Stat(path); err == nil {
+			return xerrors.Errorf("DKG key %s already exists", ds.ID)
+		}
+		if err := writeDKGShare(path, ds); err != nil {
+			return xerrors.Errorf("couldn't write the DKG share: %+v", err)
+		}
+	}
+	s.dkgShares.shares[ds.ID] = ds
+	return nil
+}
+
+func (s *Service) dkgSharePath(id string) string {
+	return filepath.Join(s.dkgShares.dir, DKGShareName+"_"+url.PathEscape(id)+"_"+s.ServerIdentity().Address.Host()+
+		":"+s.ServerIdentity().Address.Port()+".toml")
+}
+
+// writeDKGShare writes a share to a file readable by the node only
+func writeDKGShare(path string, ds *DKGShare) error {
+	shareString, err := encoding.ScalarToStringHex(libunlynx.SuiTe, ds.Share)
+	if err != nil {
+		return err
+	}
+	contents := dkgShareTOML{ID: ds.ID, Threshold: ds.Threshold, Index: ds.Index, Share: shareString}
+	for _, commit := range ds.Commits {
+		commitString, err := encoding.PointToStringHex(libunlynx.SuiTe, commit)
+		if err != nil {
+			return err
+		}
+		contents.Commits = append(contents.Commits, commitString)
+	}
+	for _, node := range ds.Nodes {
+		contents.Nodes = append(contents.Nodes, node.String())
+	}
+
+	return writeFileAtomically(path, func(w io.Writer) error {
+		if f, ok := w.(*os.File); ok {
+			if err := f.Chmod(0600); err != nil {
+				return err
+			}
+		}
+		return toml.NewEncoder(w).Encode(&contents)
+	})
+}
+
+// ReadDKGShare reads the share of a collective key written by a node
+func ReadDKGShare(path string) (*DKGShare, error) {
+	contents := dkgShareTOML{}
+	if _, err := toml.DecodeFile(path, &contents); err != nil {
+		return nil, xerrors.Errorf("couldn't read the DKG share %s: %+v", path, err)
+	}
+	if len(contents.Commits) == 0 || contents.Threshold != len(contents.Commits) {
+		return nil, xerrors.Errorf("the DKG share %s is corrupted", path)
+	}
+
+	ds := &DKGShare{ID: contents.ID, Threshold: contents.Threshold, Index: contents.Index}
+	var err error
+	if ds.Share, err = encoding.StringHexToScalar(libunlynx.SuiTe, contents.Share); err != nil {
+		return nil, xerrors.Errorf("wrong DKG share in %s: %+v", path, err)
+	}
+	for _, c := range contents.Commits {
+		commit, err := encoding.StringHexToPoint(libunlynx.SuiTe, c)
+		if err != nil {
+			return nil, xerrors.Errorf("wrong DKG commit in %s: %+v", path, err)
+		}
+		ds.Commits = append(ds.Commits, commit)
+	}
+	for _, node := range contents.Nodes {
+		ds.Nodes = append(ds.Nodes, network.Address(node))
+	}
+
+	// the share has to match the public polynomial
+	if !libunlynx.SuiTe.Point().Mul(ds.Share, nil).Equal(ds.PublicShare(ds.Index)) {
+		return nil, xerrors.Errorf("the DKG share %s doesn't match its commits", path)
+	}
+	return ds, nil
+}
@@ -0,0 +1,318 @@
+package servicesmedco
+
+import (
+	"math"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"github.com/ldsec/unlynx/protocols"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+func init() {
+	network.RegisterMessages(DPParameters{}, SurveyRootResults{})
+}
+
+// NoiseShuffleName is the type of the shuffling protocols run on the lists of noise values
+const NoiseShuffleName = "NoiseShuffleName"
+
+var propagateRootResults = "PropRootResults"
+
+// SurveyRootResults are the final results of an aggregation survey (suppressed, compared or noisy), sent by the root of
+// the roster to the other nodes
+type SurveyRootResults struct {
+	SurveyID SurveyID
+	Results  libunlynx.CipherVector
+}
+
+// Environment variables holding the differential privacy policy of the node
+const (
+	// DPMaxEpsilonEnv is the largest epsilon accepted (DPDefaultMaxEpsilon by default)
+	DPMaxEpsilonEnv = "UNLYNX_DP_MAX_EPSILON"
+	// DPMinSensitivityEnv is the smallest sensitivity accepted (1 by default, i.e. one patient)
+	DPMinSensitivityEnv = "UNLYNX_DP_MIN_SENSITIVITY"
+	// DPMandatoryEnv set to true refuses the aggregation and shuffling requests without noise
+	DPMandatoryEnv = "UNLYNX_DP_MANDATORY"
+	// DPNoiseListSizeEnv is the number of values of the noise lists (1000 by default), the largest noise scale they
+	// can represent grows with it (about 10 for 1000 values, 100 for 10000 values)
+	DPNoiseListSizeEnv = "UNLYNX_DP_NOISE_LIST_SIZE"
+)
+
+// DPDefaultMaxEpsilon is the largest epsilon accepted by a node without DPMaxEpsilonEnv
+const DPDefaultMaxEpsilon = 10
+
+// DPParameters are the differential privacy parameters of a request. The noise follows a discrete Laplace distribution
+// of scale Sensitivity/Epsilon; it is disabled if Epsilon is 0.
+type DPParameters struct {
+	Epsilon     float64
+	Sensitivity float64
+}
+
+// Enabled returns whether noise has to be added to the results
+func (dp DPParameters) Enabled() bool {
+	return dp.Epsilon != 0
+}
+
+// DPPolicy is what a node accepts as differential privacy parameters
+type DPPolicy struct {
+	MaxEpsilon     float64
+	MinSensitivity float64
+	Mandatory      bool
+	NoiseListSize  int
+}
+
+// loadDPPolicy reads the differential privacy policy of the node from the environment
+func loadDPPolicy() (DPPolicy, error) {
+	policy := DPPolicy{MaxEpsilon: DPDefaultMaxEpsilon, MinSensitivity: 1, NoiseListSize: 1000}
+
+	var err error
+	if v := os.Getenv(DPMaxEpsilonEnv); v != "" {
+		if policy.MaxEpsilon, err = strconv.ParseFloat(v, 64); err != nil || !(policy.MaxEpsilon > 0) ||
+			math.IsInf(policy.MaxEpsilon, 0) {
+			return DPPolicy{}, xerrors.Errorf("wrong value for %s (%s): %+v", DPMaxEpsilonEnv, v, err)
+		}
+	}
+	if v := os.Getenv(DPMinSensitivityEnv); v != "" {
+		if policy.MinSensitivity, err = strconv.ParseFloat(v, 64); err != nil || !(policy.MinSensitivity > 0) ||
+			math.IsInf(policy.MinSensitivity, 0) {
+			return DPPolicy{}, xerrors.Errorf("wrong value for %s (%s): %+v", DPMinSensitivityEnv, v, err)
+		}
+	}
+	if v := os.Getenv(DPMandatoryEnv); v != "" {
+		if policy.Mandatory, err = strconv.ParseBool(v); err != nil {
+			return DPPolicy{}, xerrors.Errorf("wrong value for %s (%s): %+v", DPMandatoryEnv, v, err)
+		}
+	}
+	if v := os.Getenv(DPNoiseListSizeEnv); v != "" {
+		if policy.NoiseListSize, err = strconv.Atoi(v); err != nil || policy.NoiseListSize <= 0 {
+			return DPPolicy{}, xerrors.Errorf("wrong value for %s (%s): %+v", DPNoiseListSizeEnv, v, err)
+		}
+	}
+	return policy, nil
+}
+
+// checkDPParameters verifies that the differential privacy parameters of a request comply with the policy of the node
+func (s *Service) checkDPParameters(dp DPParameters) error {
+	if !dp.Enabled() {
+		if s.dpPolicy.Mandatory {
+			return xerrors.New("this node only accepts requests with differential privacy noise")
+		}
+		return nil
+	}
+	if math.IsNaN(dp.Epsilon) || math.IsInf(dp.Epsilon, 0) || dp.Epsilon < 0 {
+		return xerrors.Errorf("wrong differential privacy epsilon: %v", dp.Epsilon)
+	}
+	if dp.Epsilon > s.dpPolicy.MaxEpsilon {
+		return xerrors.Errorf("differential privacy epsilon %v is above the maximum accepted by this node (%v)",
+			dp.Epsilon, s.dpPolicy.MaxEpsilon)
+	}
+	if math.IsNaN(dp.Sensitivity) || math.IsInf(dp.Sensitivity, 0) {
+		return xerrors.Errorf("wrong differential privacy sensitivity: %v", dp.Sensitivity)
+	}
+	if dp.Sensitivity < s.dpPolicy.MinSensitivity {
+		return xerrors.Errorf("differential privacy sensitivity %v is below the minimum accepted by this node (%v)",
+			dp.Sensitivity, s.dpPolicy.MinSensitivity)
+	}
+	if _, err := noiseValues(dp, s.dpPolicy.NoiseListSize); err != nil {
+		return err
+	}
+	return nil
+}
+
+// noiseTailMass is the largest probability mass of the tails of the noise distribution that can be left out of the
+// noise lists
+const noiseTailMass = 0.01
+
+// noiseValues builds the list the noise values are drawn from: each value appears a number of times proportional to
+// its probability under a discrete Laplace distribution of scale sensitivity/epsilon, rounded to the nearest integer.
+// The list has about size values and the values that would appear less than half a time are left out, which cuts off
+// the tails: an error is returned if they weigh more than noiseTailMass, i.e. if the scale is too large for the size.
+func noiseValues(dp DPParameters, size int) ([]int64, error) {
+	p := math.Exp(-dp.Epsilon / dp.Sensitivity)
+	values := make([]int64, 0, size)
+	mass := 0.0
+	for k := int64(0); ; k++ {
+		prob := (1 - p) / (1 + p) * math.Pow(p, float64(k))
+		copies := int(math.Round(prob * float64(size)))
+		if copies == 0 {
+			break
+		}
+		for i := 0; i < copies; i++ {
+			values = append(values, k)
+			if k != 0 {
+				values = append(values, -k)
+			}
+		}
+		mass += prob
+		if k != 0 {
+			mass += prob
+		}
+	}
+	if 1-mass > noiseTailMass {
+		return nil, xerrors.Errorf("the noise lists of %d values can't represent a noise of scale %v", size,
+			dp.Sensitivity/dp.Epsilon)
+	}
+	return values, nil
+}
+
+func (s *Service) putNoiseList(sid SurveyID, noise []libunlynx.CipherVector) {
+	s.noiseMutex.Lock()
+	defer s.noiseMutex.Unlock()
+	s.noiseLists[sid] = noise
+}
+
+func (s *Service) popNoiseList(sid SurveyID) ([]libunlynx.CipherVector, bool) {
+	s.noiseMutex.Lock()
+	defer s.noiseMutex.Unlock()
+	noise, ok := s.noiseLists[sid]
+	delete(s.noiseLists, sid)
+	return noise, ok
+}
+
+// isRosterRoot returns whether this node is the first of the roster, the one suppressing or comparing the results of
+// the aggregation surveys and drawing their noise
+func (s *Service) isRosterRoot(roster *onet.Roster) bool {
+	return roster.List[0].Equal(s.ServerIdentity())
+}
+
+// rootResultsChannel returns the channel through which the final results of the survey are handed over
+func (s *Service) rootResultsChannel(sid SurveyID) chan libunlynx.CipherVector {
+	s.noiseMutex.Lock()
+	defer s.noiseMutex.Unlock()
+	ch, ok := s.rootResults[sid]
+	if !ok {
+		ch = make(chan libunlynx.CipherVector, 1)
+		s.rootResults[sid] = ch
+	}
+	return ch
+}
+
+// sendRootResults sends the final results of an aggregation survey to the other nodes of the roster. In these surveys
+// each node releases the results to the querier: the root of the roster alone suppresses or compares them and draws
+// the noise. Otherwise the querier would get as many independent noise values as there are nodes and could average
+// them out, and every node would learn which results are below the suppression or comparison threshold (see
+// thresholdSelect). The nodes that don't get the results (e.g. the ones left out of a threshold aggregation) fail when
+// their timeout is reached.
+func (s *Service) sendRootResults(sid SurveyID, roster *onet.Roster, results libunlynx.CipherVector,
+	timeout time.Duration) {
+	if len(roster.List) < 2 {
+		return
+	}
+	if _, err := s.propagate(sid, s.rootResultsPutData, roster, &SurveyRootResults{SurveyID: sid, Results: results},
+		timeout); err != nil {
+		log.Warn(s.ServerIdentity().String(), "couldn't send the final results of survey", sid, "to all the nodes:", err)
+	}
+}
+
+// waitRootResults waits for the count final results of an aggregation survey computed by the root of the roster
+func (s *Service) waitRootResults(sid SurveyID, count int, timeout time.Duration) (libunlynx.CipherVector, error) {
+	ch := s.rootResultsChannel(sid)
+	defer func() {
+		s.noiseMutex.Lock()
+		delete(s.rootResults, sid)
+		s.noiseMutex.Unlock()
+	}()
+
+	select {
+	case results := <-ch:
+		if len(results) != count {
+			return nil, xerrors.Errorf("got %d final results from the root, %d expected", len(results), count)
+		}
+		return results, nil
+	case <-s.cancelChannel(sid):
+		return nil, surveyCancelledError(sid)
+	case <-time.After(timeout):
+		return nil, xerrors.New("didn't get the final results from the root in time")
+	}
+}
+
+// receiveRootResults hands the final results sent by the root over to the handler of the survey (they are ignored if
+// the survey isn't running on this node)
+func (s *Service) receiveRootResults(srr *SurveyRootResults) {
+	if _, err := s.getSurveyAgg(srr.SurveyID); err != nil {
+		log.Lvl2(s.ServerIdentity().String(), "ignored the final results of unknown survey", srr.SurveyID)
+		return
+	}
+	select {
+	case s.rootResultsChannel(srr.SurveyID) <- srr.Results:
+	default:
+	}
+}
+
+// NoisePhase draws count noise values encrypted under the collective key: the list of noise values is encrypted and
+// collectively shuffled, so that no node knows which values are drawn.
+func (s *Service) NoisePhase(targetSurvey SurveyID, roster *onet.Roster, dp DPParameters, count int,
+	timeout time.Duration) (libunlynx.CipherVector, time.Duration, error) {
+	start := time.Now()
+	values, err := noiseValues(dp, s.dpPolicy.NoiseListSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	if count > len(values) {
+		return nil, 0, xerrors.Errorf("%d noise values needed but the noise lists have only %d values", count,
+			len(values))
+	}
+
+	noise := protocolsunlynx.AdaptCipherTextArray(*libunlynx.EncryptIntVector(roster.Aggregate, values))
+	s.putNoiseList(targetSurvey, noise)
+	defer s.popNoiseList(targetSurvey)
+
+	pc, err := newProtocolConfig(targetSurvey, NoiseShuffleName, &dp)
+	if err != nil {
+		return nil, 0, xerrors.Errorf("couldn't get protoConfig: %+v", err)
+	}
+	pc.Timeout = timeout
+	pi, err := s.StartProtocol(protocolsunlynx.ShufflingProtocolName, "", pc, roster)
+	if err != nil {
+		return nil, 0, err
+	}
+	select {
+	case shufflingResult := <-pi.(*protocolsunlynx.ShufflingProtocol).FeedbackChannel:
+		drawn := make(libunlynx.CipherVector, count)
+		for i := range drawn {
+			drawn[i] = shufflingResult[i][0]
+		}
+		return drawn, time.Since(start), nil
+	case <-s.cancelChannel(targetSurvey):
+		return nil, 0, surveyCancelledError(targetSurvey)
+	case <-time.After(timeout):
+		return nil, 0, xerrors.Errorf("couldn't finish noise shuffling protocol in time")
+	}
+}
+
+// newNoiseShufflingProtocol creates the instance of a shuffling protocol run on a list of noise values, after checking
+// that the differential privacy parameters of the survey comply with the policy of this node
+func (s *Service) newNoiseShufflingProtocol(tn *onet.TreeNodeInstance, protoConf ProtocolConfig) (onet.ProtocolInstance, error) {
+	_, msg, err := network.Unmarshal(protoConf.Data, libunlynx.SuiTe)
+	if err != nil {
+		return nil, xerrors.Errorf("couldn't unmarshal: %+v", err)
+	}
+	dp, ok := msg.(*DPParameters)
+	if !ok {
+		return nil, xerrors.New("didn't get the differential privacy parameters")
+	}
+	if err := s.checkDPParameters(*dp); err != nil {
+		return nil, err
+	}
+
+	pi, err := protocolsunlynx.NewShufflingProtocol(tn)
+	if err != nil {
+		return nil, err
+	}
+	shuffle := pi.(*protocolsunlynx.ShufflingProtocol)
+	shuffle.Precomputed = nil
+
+	if tn.IsRoot() {
+		noise, ok := s.popNoiseList(protoConf.SurveyID)
+		if !ok {
+			return nil, xerrors.Errorf("no noise list for survey %s", protoConf.SurveyID)
+		}
+		shuffle.ShuffleTarget = &noise
+	}
+	return pi, nil
+}
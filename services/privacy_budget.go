@@ -0,0 +1,218 @@
+package servicesmedco
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/btcsuite/goleveldb/leveldb"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3/log"
+	"golang.org/x/xerrors"
+)
+
+// Environment variables holding the privacy budget configuration of the node
+const (
+	// DPBudgetEnv is the total epsilon each querier can consume on this node (no budget by default)
+	DPBudgetEnv = "UNLYNX_DP_BUDGET"
+	// DPBudgetPathEnv is the directory of the ledger of the consumed budgets (kept in memory if not set)
+	DPBudgetPathEnv = "UNLYNX_DP_BUDGET_PATH"
+)
+
+// budgetTolerance absorbs the rounding errors of the sums of epsilons
+const budgetTolerance = 1e-9
+
+// PrivacyBudgetLedgerName is the prefix of the privacy budget ledger database (followed by the address of the node)
+const PrivacyBudgetLedgerName = "budget"
+
+// ErrPrivacyBudgetExceeded is matched (errors.Is) by the errors returned when a querier has exhausted its budget
+var ErrPrivacyBudgetExceeded = xerrors.New("privacy budget exceeded")
+
+// PrivacyBudgetExceededError is returned when a request would consume more epsilon than the querier has left
+type PrivacyBudgetExceededError struct {
+	Querier   string
+	Requested float64
+	Remaining float64
+}
+
+// Error leaves the querier out of the message, which has to be short to reach the client (websocket close reason)
+func (e *PrivacyBudgetExceededError) Error() string {
+	return ErrPrivacyBudgetExceeded.Error() + ": epsilon " + strconv.FormatFloat(e.Requested, 'g', -1, 64) +
+		" requested, " + strconv.FormatFloat(e.Remaining, 'g', -1, 64) + " remaining"
+}
+
+// Is makes the error match ErrPrivacyBudgetExceeded
+func (e *PrivacyBudgetExceededError) Is(target error) bool {
+	return target == ErrPrivacyBudgetExceeded
+}
+
+// PrivacyBudgetLedger keeps track of the epsilon consumed by each querier (identified by its public key), in memory or
+// in a goleveldb database so that it survives the restarts of the node
+type PrivacyBudgetLedger struct {
+	sync.Mutex
+	db       *leveldb.DB
+	consumed map[string]float64
+}
+
+// NewPrivacyBudgetLedger creates a ledger kept in memory
+func NewPrivacyBudgetLedger() *PrivacyBudgetLedger {
+	return &PrivacyBudgetLedger{consumed: make(map[string]float64)}
+}
+
+// OpenPrivacyBudgetLedger opens (or creates) the persistent ledger at path.
+func OpenPrivacyBudgetLedger(path string) (*PrivacyBudgetLedger, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("couldn't open privacy budget ledger %s: %+v", path, err)
+	}
+	return &PrivacyBudgetLedger{db: db, consumed: make(map[string]float64)}, nil
+}
+
+// Close closes the underlying database, if any.
+func (l *PrivacyBudgetLedger) Close() error {
+	if l.db == nil {
+		return nil
+	}
+	return l.db.Close()
+}
+
+// Consumed returns the epsilon consumed by querier
+func (l *PrivacyBudgetLedger) Consumed(querier string) (float64, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.get(querier)
+}
+
+// Spend consumes epsilon from the budget of querier, unless it would exceed budget
+func (l *PrivacyBudgetLedger) Spend(querier string, epsilon, budget float64) error {
+	l.Lock()
+	defer l.Unlock()
+
+	consumed, err := l.get(querier)
+	if err != nil {
+		return err
+	}
+	if consumed+epsilon > budget+budgetTolerance {
+		return &PrivacyBudgetExceededError{Querier: querier, Requested: epsilon, Remaining: math.Max(budget-consumed, 0)}
+	}
+	return l.set(querier, consumed+epsilon)
+}
+
+// Refund gives epsilon back to querier (e.g. when its survey failed before any result was released)
+func (l *PrivacyBudgetLedger) Refund(querier string, epsilon float64) error {
+	l.Lock()
+	defer l.Unlock()
+
+	consumed, err := l.get(querier)
+	if err != nil {
+		return err
+	}
+	return l.set(querier, math.Max(consumed-epsilon, 0))
+}
+
+func (l *PrivacyBudgetLedger) get(querier string) (float64, error) {
+	if l.db == nil {
+		return l.consumed[querier], nil
+	}
+	b, err := l.db.Get([]byte(querier), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, xerrors.Errorf("couldn't read privacy budget ledger: %+v", err)
+	}
+	consumed, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return 0, xerrors.Errorf("corrupted privacy budget ledger entry for %s: %+v", querier, err)
+	}
+	return consumed, nil
+}
+
+func (l *PrivacyBudgetLedger) set(querier string, consumed float64) error {
+	if l.db == nil {
+		l.consumed[querier] = consumed
+		return nil
+	}
+	if err := l.db.Put([]byte(querier), []byte(strconv.FormatFloat(consumed, 'g', -1, 64)), nil); err != nil {
+		return xerrors.Errorf("couldn't write privacy budget ledger: %+v", err)
+	}
+	return nil
+}
+
+// openPrivacyBudget sets the privacy budget of the queriers and opens the ledger of the consumed budgets
+func (s *Service) openPrivacyBudget() error {
+	v := os.Getenv(DPBudgetEnv)
+	if v == "" {
+		return nil
+	}
+	budget, err := strconv.ParseFloat(v, 64)
+	if err != nil || budget <= 0 || math.IsNaN(budget) {
+		return xerrors.Errorf("wrong value for %s (%s): %+v", DPBudgetEnv, v, err)
+	}
+	s.dpBudget = budget
+
+	dir := os.Getenv(DPBudgetPathEnv)
+	if dir == "" {
+		log.Warn(s.ServerIdentity().String(), "the consumed privacy budgets are kept in memory (", DPBudgetPathEnv, "not set )")
+		s.budgetLedger = NewPrivacyBudgetLedger()
+		return nil
+	}
+	path := filepath.Join(dir, PrivacyBudgetLedgerName+"_"+s.ServerIdentity().Address.Host()+":"+s.ServerIdentity().Address.Port())
+	s.budgetLedger, err = OpenPrivacyBudgetLedger(path)
+	return err
+}
+
+// budgetAccount returns the key the budget of a request is charged to: the querier who signed it with authorization,
+// the target public key of the results otherwise (which a querier can change at will, the budget only binds the
+// queriers with authorization)
+func (s *Service) budgetAccount(req signableRequest, clientKey kyber.Point) kyber.Point {
+	if querier := s.requestQuerier(req); querier != nil {
+		return querier
+	}
+	return clientKey
+}
+
+// spendPrivacyBudget consumes the epsilon of a request from the budget of the querier. With a budget, the requests
+// without noise are refused since their cost can't be accounted for. Each node of the roster charges the epsilon of
+// the surveys it handles: all the nodes release the same noisy results (the noise is drawn once per survey, see
+// sendRootResults), a survey costs its epsilon whatever the number of nodes it is sent to.
+func (s *Service) spendPrivacyBudget(querier kyber.Point, dp DPParameters) error {
+	if s.budgetLedger == nil {
+		return nil
+	}
+	if querier == nil {
+		return xerrors.New("this node enforces a privacy budget: requests without a querier or a target public key are refused")
+	}
+	if !dp.Enabled() {
+		return xerrors.New("this node enforces a privacy budget: requests without differential privacy noise are refused")
+	}
+	return s.budgetLedger.Spend(querier.String(), dp.Epsilon, s.dpBudget)
+}
+
+// refundPrivacyBudget gives back the epsilon of a request that failed
+func (s *Service) refundPrivacyBudget(querier kyber.Point, dp DPParameters) {
+	if s.budgetLedger == nil || !dp.Enabled() {
+		return
+	}
+	if err := s.budgetLedger.Refund(querier.String(), dp.Epsilon); err != nil {
+		log.Error(s.ServerIdentity().String(), "couldn't refund privacy budget:", err)
+	}
+}
+
+// privacyBudget reports the budget of a querier on this node
+func (s *Service) privacyBudget(querier kyber.Point) (*PrivacyBudgetResponse, error) {
+	if s.budgetLedger == nil {
+		return &PrivacyBudgetResponse{Limited: false}, nil
+	}
+	consumed, err := s.budgetLedger.Consumed(querier.String())
+	if err != nil {
+		return nil, err
+	}
+	return &PrivacyBudgetResponse{
+		Limited:   true,
+		Budget:    s.dpBudget,
+		Consumed:  consumed,
+		Remaining: math.Max(s.dpBudget-consumed, 0),
+	}, nil
+}
@@ -0,0 +1,255 @@
+package servicesmedco
+
+import (
+	"github.com/ldsec/unlynx/lib"
+	"github.com/ldsec/unlynx/lib/aggregation"
+	"github.com/ldsec/unlynx/lib/key_switch"
+	"github.com/ldsec/unlynx/lib/shuffle"
+	"go.dedis.ch/kyber/v3"
+)
+
+// ProofBinding holds the ciphertexts of a survey known by the node that verifies its proofs. A proof only shows that a
+// node did its part correctly on some ciphertexts: the proofs of the nodes are checked against these, so that proofs
+// made on other ciphertexts (e.g. of another survey) aren't accepted. The empty fields are not checked.
+type ProofBinding struct {
+	// contribution of the verifying node to the aggregation and result of the aggregation it ran
+	AggregationInputs  libunlynx.CipherVector
+	AggregationResults libunlynx.CipherVector
+
+	// contribution of the verifying node to the shuffling (all the ciphertexts shuffled for the root) and its result
+	ShufflingInputs  libunlynx.CipherVector
+	ShufflingResults libunlynx.CipherVector
+
+	// ciphertexts key switched, key they were switched to and results released to the client
+	KSTargets libunlynx.CipherVector
+	KSKey     kyber.Point
+	KSResults libunlynx.CipherVector
+}
+
+// verifyProofBinding checks that the proofs of the nodes of the roster (in the order of the roster) were made on the
+// ciphertexts of the binding, and returns the phases whose proofs don't match them. verifier is the index in the roster
+// of the node that verifies the proofs. The phases with a missing or unreadable proof are left out, they are already
+// reported by verifyNodeProofs.
+func verifyProofBinding(phases []ProofPhase, nodeProofs [][]NodeProof, verifier int, binding *ProofBinding) []string {
+	if binding == nil {
+		return nil
+	}
+
+	var unbound []string
+	for _, phase := range phases {
+		data := make([][]byte, 0, len(nodeProofs))
+		for _, proofs := range nodeProofs {
+			for _, proof := range proofs {
+				if proof.Phase == phase {
+					data = append(data, proof.Data)
+					break
+				}
+			}
+		}
+		if len(data) != len(nodeProofs) {
+			continue
+		}
+
+		bound, complete := true, true
+		switch phase.Name {
+		case PhaseKeySwitching:
+			proofs := make([]libunlynxkeyswitch.PublishedKSListProof, len(data))
+			for i := range data {
+				proofs[i], complete = readKeySwitchingProof(data[i])
+				if !complete {
+					break
+				}
+			}
+			bound = !complete || keySwitchingBound(proofs, binding)
+		case PhaseShuffling:
+			proofs := make([]libunlynxshuffle.PublishedShufflingProof, len(data))
+			for i := range data {
+				proofs[i], complete = readShufflingProof(data[i])
+				if !complete {
+					break
+				}
+			}
+			bound = !complete || shufflingBound(proofs, binding)
+		case PhaseAggregation:
+			proofs := make([]libunlynxaggr.PublishedAggregationListProof, len(data))
+			for i := range data {
+				proofs[i], complete = readAggregationProof(data[i])
+				if !complete {
+					break
+				}
+			}
+			bound = !complete || aggregationBound(proofs, verifier, binding)
+		}
+		if !bound {
+			unbound = append(unbound, phase.Name)
+		}
+	}
+	return unbound
+}
+
+// keySwitchingBound checks that the key switching proofs of the nodes switch the targets to the key, and that their
+// contributions add up to the released results
+func keySwitchingBound(proofs []libunlynxkeyswitch.PublishedKSListProof, binding *ProofBinding) bool {
+	if len(binding.KSTargets) == 0 {
+		return true
+	}
+
+	// result of the key switching: K = sum(viB), C = C + sum(ks2)
+	switched := make(libunlynx.CipherVector, len(binding.KSTargets))
+	for i, target := range binding.KSTargets {
+		switched[i].K = libunlynx.SuiTe.Point().Null()
+		switched[i].C = libunlynx.SuiTe.Point().Set(target.C)
+	}
+	for _, proof := range proofs {
+		if len(proof.List) != len(binding.KSTargets) {
+			return false
+		}
+		for i, ksp := range proof.List {
+			if binding.KSKey != nil && !ksp.Q.Equal(binding.KSKey) {
+				return false
+			}
+			if !ksp.RbNeg.Equal(libunlynx.SuiTe.Point().Neg(binding.KSTargets[i].K)) {
+				return false
+			}
+			switched[i].K.Add(switched[i].K, ksp.ViB)
+			switched[i].C.Add(switched[i].C, ksp.Ks2)
+		}
+	}
+
+	if binding.KSResults == nil {
+		return true
+	}
+	return switched.Equal(&binding.KSResults)
+}
+
+// aggregationBound checks that the aggregation proof of the verifier includes its contribution and gives the result of
+// the aggregation, and that the result of each other node is aggregated by another node
+func aggregationBound(proofs []libunlynxaggr.PublishedAggregationListProof, verifier int, binding *ProofBinding) bool {
+	if len(binding.AggregationResults) == 0 {
+		return true
+	}
+	values := len(binding.AggregationResults)
+	for _, proof := range proofs {
+		if len(proof.List) != values {
+			return false
+		}
+	}
+
+	own := proofs[verifier].List
+	for v := 0; v < values; v++ {
+		if !own[v].AggregationResult.Equal(&binding.AggregationResults[v]) {
+			return false
+		}
+		if len(binding.AggregationInputs) == values && !containsCipherText(own[v].Data, binding.AggregationInputs[v]) {
+			return false
+		}
+		for i, proof := range proofs {
+			if i == verifier {
+				continue
+			}
+			aggregated := false
+			for j, parent := range proofs {
+				if j != i && containsCipherText(parent.List[v].Data, proof.List[v].AggregationResult) {
+					aggregated = true
+					break
+				}
+			}
+			if !aggregated {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// shufflingBound checks that the shuffling proofs of the nodes chain up (each node shuffles the output of the previous
+// one), from a list including the inputs to the results
+func shufflingBound(proofs []libunlynxshuffle.PublishedShufflingProof, binding *ProofBinding) bool {
+	if len(binding.ShufflingInputs) == 0 && len(binding.ShufflingResults) == 0 {
+		return true
+	}
+
+	// the first node shuffles a list no other node produced
+	first := -1
+	for i, proof := range proofs {
+		preceded := false
+		for j, other := range proofs {
+			if j != i && equalCipherLists(other.ShuffledList, proof.OriginalList) {
+				preceded = true
+				break
+			}
+		}
+		if !preceded {
+			if first >= 0 {
+				return false
+			}
+			first = i
+		}
+	}
+	if first < 0 {
+		return false
+	}
+
+	for _, input := range binding.ShufflingInputs {
+		found := false
+		for _, row := range proofs[first].OriginalList {
+			if len(row) > 0 && row[0].Equal(&input) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	last := first
+	visited := map[int]bool{first: true}
+	for len(visited) < len(proofs) {
+		next := -1
+		for i, proof := range proofs {
+			if !visited[i] && equalCipherLists(proofs[last].ShuffledList, proof.OriginalList) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return false
+		}
+		visited[next] = true
+		last = next
+	}
+
+	if len(binding.ShufflingResults) == 0 {
+		return true
+	}
+	results := make(libunlynx.CipherVector, 0, len(proofs[last].ShuffledList))
+	for _, row := range proofs[last].ShuffledList {
+		if len(row) != 1 {
+			return false
+		}
+		results = append(results, row[0])
+	}
+	return results.Equal(&binding.ShufflingResults)
+}
+
+func containsCipherText(cv libunlynx.CipherVector, ct libunlynx.CipherText) bool {
+	for i := range cv {
+		if cv[i].Equal(&ct) {
+			return true
+		}
+	}
+	return false
+}
+
+func equalCipherLists(a, b []libunlynx.CipherVector) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(&b[i]) {
+			return false
+		}
+	}
+	return true
+}
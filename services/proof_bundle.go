@@ -0,0 +1,153 @@
+package servicesmedco
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+// ProofBundlePathEnv is the environment variable holding the directory where a node writes the proofs it collects for
+// the surveys it answers (no proof bundle if it is not set)
+const ProofBundlePathEnv = "UNLYNX_PROOF_BUNDLE_PATH"
+
+// ProofBundleName is the prefix of the proof bundle files (followed by the survey ID and the address of the node)
+const ProofBundleName = "proofs"
+
+// ProofBundle holds the proofs of a survey collected by a node, and the ciphertexts of the survey they were checked
+// against, so that they can be verified offline
+type ProofBundle struct {
+	SurveyID SurveyID
+	Time     time.Time
+	Verifier string
+	Phases   []ProofPhase
+	Nodes    []ProofBundleNode
+	Binding  []byte // ProofBinding encoded with network.Marshal (empty if the proofs of the survey aren't bound)
+}
+
+// ProofBundleNode holds the proofs of a node of the roster of a survey
+type ProofBundleNode struct {
+	Address   string
+	PublicKey string
+	Proofs    []NodeProof
+}
+
+// NodeVerification is the result of the offline verification of the proofs of a node
+type NodeVerification struct {
+	Address  string
+	Verified int
+	Failed   []string // phases whose proof doesn't verify
+	Missing  []string // phases whose proof is not in the bundle
+}
+
+// OK returns whether all the proofs of the node were found and verified
+func (nv NodeVerification) OK() bool {
+	return len(nv.Failed) == 0 && len(nv.Missing) == 0
+}
+
+// writeProofBundle writes the proofs collected for a survey in the proof bundle directory of the node
+func (s *Service) writeProofBundle(targetSurvey SurveyID, roster *onet.Roster, phases []ProofPhase,
+	binding *ProofBinding, nodeProofs map[network.ServerIdentityID][]NodeProof) error {
+	bundle := ProofBundle{
+		SurveyID: targetSurvey,
+		Time:     time.Now().UTC(),
+		Verifier: s.ServerIdentity().Address.String(),
+		Phases:   phases,
+	}
+	if binding != nil {
+		data, err := network.Marshal(binding)
+		if err != nil {
+			return xerrors.Errorf("couldn't marshal proof binding: %+v", err)
+		}
+		bundle.Binding = data
+	}
+	for _, si := range roster.List {
+		bundle.Nodes = append(bundle.Nodes, ProofBundleNode{
+			Address:   si.Address.String(),
+			PublicKey: serializeAuditKey(si.ServicePublic(Name)),
+			Proofs:    nodeProofs[si.ID],
+		})
+	}
+	b, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return xerrors.Errorf("couldn't marshal proof bundle: %+v", err)
+	}
+
+	name := ProofBundleName + "_" + url.PathEscape(string(targetSurvey)) + "_" +
+		s.ServerIdentity().Address.Host() + ":" + s.ServerIdentity().Address.Port() + ".json"
+	if err := ioutil.WriteFile(filepath.Join(s.proofBundleDir, name), b, 0600); err != nil {
+		return xerrors.Errorf("couldn't write proof bundle: %+v", err)
+	}
+	return nil
+}
+
+// ReadProofBundle reads a proof bundle written by a node
+func ReadProofBundle(r io.Reader) (*ProofBundle, error) {
+	bundle := &ProofBundle{}
+	if err := json.NewDecoder(r).Decode(bundle); err != nil {
+		return nil, xerrors.Errorf("couldn't read proof bundle: %+v", err)
+	}
+	return bundle, nil
+}
+
+// VerifyProofBundle verifies offline the proofs of a bundle for each node of the roster of the survey. The nodes are
+// found in the bundle by their public key, their key switching proofs have to be made with that key, and the shuffling
+// proofs are verified against the collective key of the roster. What the proofs were made on is verified by
+// VerifyProofBundleBinding.
+func VerifyProofBundle(bundle *ProofBundle, roster *onet.Roster) []NodeVerification {
+	verifications := make([]NodeVerification, 0, len(roster.List))
+	for _, si := range roster.List {
+		verified, failed, missing := verifyNodeProofs(bundle.Phases, bundle.nodeProofs(si), si.ServicePublic(Name),
+			roster.Aggregate)
+		verifications = append(verifications, NodeVerification{Address: si.Address.String(), Verified: verified,
+			Failed: failed, Missing: missing})
+	}
+	return verifications
+}
+
+// VerifyProofBundleBinding verifies offline that the proofs of a bundle were made on the ciphertexts of the survey it
+// holds (see ProofBinding), and returns the phases whose proofs don't match them. The results released to the client
+// are among these ciphertexts: the querier can compare them with what it received.
+func VerifyProofBundleBinding(bundle *ProofBundle, roster *onet.Roster) ([]string, error) {
+	if len(bundle.Binding) == 0 {
+		return nil, xerrors.New("the bundle has no ciphertexts to check the proofs against")
+	}
+	_, msg, err := network.Unmarshal(bundle.Binding, libunlynx.SuiTe)
+	if err != nil {
+		return nil, xerrors.Errorf("couldn't unmarshal proof binding: %+v", err)
+	}
+	binding, ok := msg.(*ProofBinding)
+	if !ok {
+		return nil, xerrors.Errorf("wrong proof binding type: %T", msg)
+	}
+
+	verifier := -1
+	nodeProofs := make([][]NodeProof, len(roster.List))
+	for i, si := range roster.List {
+		if si.Address.String() == bundle.Verifier {
+			verifier = i
+		}
+		nodeProofs[i] = bundle.nodeProofs(si)
+	}
+	if verifier < 0 {
+		return nil, xerrors.Errorf("the verifier of the bundle (%s) is not in the roster", bundle.Verifier)
+	}
+	return verifyProofBinding(bundle.Phases, nodeProofs, verifier, binding), nil
+}
+
+// nodeProofs returns the proofs of a node in the bundle, found by its public key
+func (pb *ProofBundle) nodeProofs(si *network.ServerIdentity) []NodeProof {
+	for _, node := range pb.Nodes {
+		if node.PublicKey == serializeAuditKey(si.ServicePublic(Name)) {
+			return node.Proofs
+		}
+	}
+	return nil
+}
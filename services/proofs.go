@@ -0,0 +1,347 @@
+package servicesmedco
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"github.com/ldsec/unlynx/lib/aggregation"
+	"github.com/ldsec/unlynx/lib/key_switch"
+	"github.com/ldsec/unlynx/lib/shuffle"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+func init() {
+	network.RegisterMessages(ProofsRequest{}, NodeProofs{}, ProofBinding{})
+}
+
+var propagateProofsFromChildren = "PropProofsFromChildren"
+
+// ErrInvalidProofs is returned to the clients that asked to fail when the proofs of a survey don't all verify
+var ErrInvalidProofs = xerrors.New("proofs not verified")
+
+// ProofPhase designates the proofs produced by the nodes for a phase (PhaseKeySwitching, PhaseShuffling or
+// PhaseAggregation) of a survey, in the protocol run by the root node
+type ProofPhase struct {
+	Name string
+	Root network.ServerIdentityID
+}
+
+// ProofsRequest is the message the node answering a client sends to the other nodes to collect their proofs
+type ProofsRequest struct {
+	SurveyID SurveyID
+	Phases   []ProofPhase
+	Timeout  time.Duration
+}
+
+// NodeProof is a proof of a node for a phase (the JSON encoding of the 'bytes' equivalent of the unlynx proof)
+type NodeProof struct {
+	Phase ProofPhase
+	Data  []byte
+}
+
+// NodeProofs are the proofs a node sends back for a ProofsRequest
+type NodeProofs struct {
+	Node   *network.ServerIdentity
+	Proofs []NodeProof
+}
+
+// ProofsSummary reports the verification of the proofs of a survey by the node that answered the client: one proof is
+// expected from each node for each phase, made on the ciphertexts of the survey (see ProofBinding). The threshold
+// aggregations, the noise, the suppressions and the DDT (whose proofs unlynx doesn't expose) have no proofs.
+type ProofsSummary struct {
+	Verifier *network.ServerIdentity
+	Verified int
+	Failed   []string // phase and address of the node of the proofs that don't verify
+	Missing  []string // phase and address of the node of the proofs that didn't arrive
+	Unbound  []string // phases whose proofs weren't made on the ciphertexts of the survey
+}
+
+// OK returns whether all the proofs were received and verified
+func (ps *ProofsSummary) OK() bool {
+	return len(ps.Failed) == 0 && len(ps.Missing) == 0 && len(ps.Unbound) == 0
+}
+
+// storedProof is a proof waiting to be collected
+type storedProof struct {
+	proof NodeProof
+	added time.Time
+}
+
+// putProof keeps a proof for twice the maximum timeout of a survey, for the nodes that collect it
+func (s *Service) putProof(sid SurveyID, phase ProofPhase, proof interface{}) {
+	data, err := json.Marshal(proof)
+	if err != nil {
+		log.Error(s.ServerIdentity().String(), "couldn't encode", phase.Name, "proof of survey", sid, ":", err)
+		return
+	}
+
+	s.proofsMutex.Lock()
+	defer s.proofsMutex.Unlock()
+	if len(s.proofs[sid]) == 0 {
+		time.AfterFunc(2*s.maxTimeout, func() { s.expireProofs(sid) })
+	}
+	s.proofs[sid] = append(s.proofs[sid], storedProof{proof: NodeProof{Phase: phase, Data: data}, added: time.Now()})
+}
+
+// expireProofs removes the proofs of a survey kept for twice the maximum timeout, whether they were collected or not
+func (s *Service) expireProofs(sid SurveyID) {
+	s.proofsMutex.Lock()
+	defer s.proofsMutex.Unlock()
+	proofs := s.proofs[sid]
+	if len(proofs) == 0 {
+		return
+	}
+	if remaining := 2*s.maxTimeout - time.Since(proofs[0].added); remaining > 0 {
+		// the proofs were removed and put again in the meantime
+		time.AfterFunc(remaining, func() { s.expireProofs(sid) })
+		return
+	}
+	delete(s.proofs, sid)
+}
+
+// getProofs returns the proofs of the phases of a survey (nil if one of them is not there yet). The proofs are not
+// removed: the shuffling proofs are collected by each node that answers a client.
+func (s *Service) getProofs(sid SurveyID, phases []ProofPhase) []NodeProof {
+	s.proofsMutex.Lock()
+	defer s.proofsMutex.Unlock()
+
+	found := make([]NodeProof, 0, len(phases))
+	for _, phase := range phases {
+		for _, sp := range s.proofs[sid] {
+			if sp.proof.Phase == phase {
+				found = append(found, sp.proof)
+				break
+			}
+		}
+	}
+	if len(found) < len(phases) {
+		return nil
+	}
+	return found
+}
+
+// waitProofs waits for the proofs of the phases of a survey, and returns the ones produced in time
+func (s *Service) waitProofs(sid SurveyID, phases []ProofPhase, timeout time.Duration) []NodeProof {
+	deadline := time.Now().Add(timeout)
+	for {
+		if proofs := s.getProofs(sid, phases); proofs != nil {
+			return proofs
+		}
+		if time.Now().After(deadline) || s.isCancelled(sid) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// some proofs are missing, take the others
+	proofs := make([]NodeProof, 0)
+	for _, phase := range phases {
+		if p := s.getProofs(sid, []ProofPhase{phase}); p != nil {
+			proofs = append(proofs, p...)
+		}
+	}
+	return proofs
+}
+
+// keySwitchingProofFunc creates and keeps the proofs of the key switching of a survey run by root
+func (s *Service) keySwitchingProofFunc(sid SurveyID, root network.ServerIdentityID) func(kyber.Point, kyber.Point,
+	kyber.Scalar, []kyber.Point, []kyber.Point, []kyber.Scalar) *libunlynxkeyswitch.PublishedKSListProof {
+	return func(K, Q kyber.Point, k kyber.Scalar, ks2s, rBNegs []kyber.Point, vis []kyber.Scalar) *libunlynxkeyswitch.PublishedKSListProof {
+		proof, err := libunlynxkeyswitch.KeySwitchListProofCreation(K, Q, k, ks2s, rBNegs, vis)
+		if err != nil {
+			log.Error(s.ServerIdentity().String(), "couldn't create key switching proof of survey", sid, ":", err)
+			return nil
+		}
+		pb, err := proof.ToBytes()
+		if err != nil {
+			log.Error(s.ServerIdentity().String(), "couldn't encode key switching proof of survey", sid, ":", err)
+			return nil
+		}
+		s.putProof(sid, ProofPhase{Name: PhaseKeySwitching, Root: root}, pb)
+		return &proof
+	}
+}
+
+// shufflingProofFunc creates and keeps the proofs of the shuffling of a survey run by root
+func (s *Service) shufflingProofFunc(sid SurveyID, root network.ServerIdentityID) func([]libunlynx.CipherVector,
+	[]libunlynx.CipherVector, kyber.Point, [][]kyber.Scalar, []int) *libunlynxshuffle.PublishedShufflingProof {
+	return func(original, shuffled []libunlynx.CipherVector, collectiveKey kyber.Point, beta [][]kyber.Scalar, pi []int) *libunlynxshuffle.PublishedShufflingProof {
+		proof, err := libunlynxshuffle.ShuffleProofCreation(original, shuffled, libunlynx.SuiTe.Point().Base(),
+			collectiveKey, beta, pi)
+		if err != nil {
+			log.Error(s.ServerIdentity().String(), "couldn't create shuffling proof of survey", sid, ":", err)
+			return nil
+		}
+		pb, err := proof.ToBytes()
+		if err != nil {
+			log.Error(s.ServerIdentity().String(), "couldn't encode shuffling proof of survey", sid, ":", err)
+			return nil
+		}
+		s.putProof(sid, ProofPhase{Name: PhaseShuffling, Root: root}, pb)
+		return &proof
+	}
+}
+
+// aggregationProofFunc creates and keeps the proofs of the aggregation of a survey run by root
+func (s *Service) aggregationProofFunc(sid SurveyID, root network.ServerIdentityID) func([]libunlynx.CipherVector,
+	libunlynx.CipherVector) *libunlynxaggr.PublishedAggregationListProof {
+	return func(data []libunlynx.CipherVector, results libunlynx.CipherVector) *libunlynxaggr.PublishedAggregationListProof {
+		proof := libunlynxaggr.AggregationListProofCreation(data, results)
+		pb, err := proof.ToBytes()
+		if err != nil {
+			log.Error(s.ServerIdentity().String(), "couldn't encode aggregation proof of survey", sid, ":", err)
+			return nil
+		}
+		s.putProof(sid, ProofPhase{Name: PhaseAggregation, Root: root}, pb)
+		return &proof
+	}
+}
+
+func readKeySwitchingProof(data []byte) (libunlynxkeyswitch.PublishedKSListProof, bool) {
+	var pb libunlynxkeyswitch.PublishedKSListProofBytes
+	var p libunlynxkeyswitch.PublishedKSListProof
+	if json.Unmarshal(data, &pb) != nil || p.FromBytes(pb) != nil {
+		return p, false
+	}
+	return p, true
+}
+
+func readShufflingProof(data []byte) (libunlynxshuffle.PublishedShufflingProof, bool) {
+	var pb libunlynxshuffle.PublishedShufflingProofBytes
+	var p libunlynxshuffle.PublishedShufflingProof
+	if json.Unmarshal(data, &pb) != nil || p.FromBytes(pb) != nil {
+		return p, false
+	}
+	return p, true
+}
+
+func readAggregationProof(data []byte) (libunlynxaggr.PublishedAggregationListProof, bool) {
+	var pb libunlynxaggr.PublishedAggregationListProofBytes
+	var p libunlynxaggr.PublishedAggregationListProof
+	if json.Unmarshal(data, &pb) != nil || p.FromBytes(pb) != nil {
+		return p, false
+	}
+	return p, true
+}
+
+// verifyProof checks a proof of a node. The key switching proofs have to be made with the key of the node, the shuffling
+// proofs are verified against the collective key. What the proofs were made on is checked by verifyProofBinding.
+func verifyProof(proof NodeProof, nodeKey, collectiveKey kyber.Point) bool {
+	switch proof.Phase.Name {
+	case PhaseKeySwitching:
+		p, ok := readKeySwitchingProof(proof.Data)
+		if !ok {
+			return false
+		}
+		for _, ksp := range p.List {
+			if !ksp.K.Equal(nodeKey) {
+				return false
+			}
+		}
+		return libunlynxkeyswitch.KeySwitchListProofVerification(p, 1.0)
+	case PhaseShuffling:
+		p, ok := readShufflingProof(proof.Data)
+		return ok && libunlynxshuffle.ShuffleProofVerification(p, collectiveKey)
+	case PhaseAggregation:
+		p, ok := readAggregationProof(proof.Data)
+		return ok && libunlynxaggr.AggregationListProofVerification(p, 1.0)
+	}
+	return false
+}
+
+// verifyNodeProofs checks the proofs of a node for the phases of a survey, and returns the number of proofs verified and
+// the phases whose proof failed or is missing
+func verifyNodeProofs(phases []ProofPhase, proofs []NodeProof, nodeKey, collectiveKey kyber.Point) (int, []string, []string) {
+	verified := 0
+	var failed, missing []string
+	for _, phase := range phases {
+		found := false
+		for _, proof := range proofs {
+			if proof.Phase != phase {
+				continue
+			}
+			found = true
+			if verifyProof(proof, nodeKey, collectiveKey) {
+				verified++
+			} else {
+				failed = append(failed, phase.Name)
+			}
+		}
+		if !found {
+			missing = append(missing, phase.Name)
+		}
+	}
+	return verified, failed, missing
+}
+
+// ProofsPhase collects the proofs of the phases of a survey from all the nodes of the roster and verifies them, and that
+// they were made on the ciphertexts of the binding
+func (s *Service) ProofsPhase(targetSurvey SurveyID, roster *onet.Roster, phases []ProofPhase, binding *ProofBinding,
+	timeout time.Duration) (*ProofsSummary, time.Duration, error) {
+	start := time.Now()
+
+	nodeProofs := map[network.ServerIdentityID][]NodeProof{
+		s.ServerIdentity().ID: s.waitProofs(targetSurvey, phases, timeout),
+	}
+	if len(roster.List) > 1 {
+		msgs, err := s.propagate(targetSurvey, s.proofsGetData, roster,
+			&ProofsRequest{SurveyID: targetSurvey, Phases: phases, Timeout: timeout}, timeout)
+		if err != nil {
+			return nil, 0, xerrors.Errorf("couldn't collect the proofs: %+v", err)
+		}
+		for _, msg := range msgs {
+			np, ok := msg.(*NodeProofs)
+			if !ok || np.Node == nil {
+				continue
+			}
+			nodeProofs[np.Node.ID] = np.Proofs
+		}
+	}
+
+	summary := &ProofsSummary{Verifier: s.ServerIdentity()}
+	ordered := make([][]NodeProof, len(roster.List))
+	for i, si := range roster.List {
+		ordered[i] = nodeProofs[si.ID]
+		verified, failed, missing := verifyNodeProofs(phases, nodeProofs[si.ID], si.ServicePublic(Name), roster.Aggregate)
+		summary.Verified += verified
+		for _, phase := range failed {
+			summary.Failed = append(summary.Failed, phase+"@"+si.Address.String())
+		}
+		for _, phase := range missing {
+			summary.Missing = append(summary.Missing, phase+"@"+si.Address.String())
+		}
+	}
+	verifier, _ := roster.Search(s.ServerIdentity().ID)
+	if verifier >= 0 {
+		summary.Unbound = verifyProofBinding(phases, ordered, verifier, binding)
+	}
+	if s.proofBundleDir != "" {
+		if err := s.writeProofBundle(targetSurvey, roster, phases, binding, nodeProofs); err != nil {
+			log.Error(s.ServerIdentity().String(), "couldn't write proof bundle of survey", targetSurvey, ":", err)
+		}
+	}
+	if !summary.OK() {
+		log.Warn(s.ServerIdentity().String(), "proofs of survey", targetSurvey, "not verified: failed", summary.Failed,
+			"missing", summary.Missing, "unbound", summary.Unbound)
+	}
+	return summary, time.Since(start), nil
+}
+
+// surveyProofs collects and verifies the proofs of a survey, if they were requested
+func (s *Service) surveyProofs(targetSurvey SurveyID, roster *onet.Roster, proofs bool, phases []ProofPhase,
+	binding *ProofBinding, timeout time.Duration, tr TimeResults) (*ProofsSummary, error) {
+	if !proofs {
+		return nil, nil
+	}
+	summary, proofsTime, err := s.ProofsPhase(targetSurvey, roster, phases, binding, timeout)
+	if err != nil {
+		return nil, err
+	}
+	s.setTime(tr, ProofsTime, proofsTime)
+	return summary, nil
+}
@@ -0,0 +1,160 @@
+package servicesmedco
+
+import (
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+func init() {
+	network.RegisterMessages(SurveyDDTRetagRequest{}, ResultDDTRetagChunk{})
+}
+
+// DDTRetagRequestName the name of this type of query
+const DDTRetagRequestName = "DDTRetagRequestName"
+
+// DefaultRetagChunkSize is the number of terms re-tagged by each run of the tagging protocol when the request doesn't
+// set it
+const DefaultRetagChunkSize = 1000
+
+// DDTRetagTime is the time spent re-tagging a chunk
+const DDTRetagTime = "DDTRetagTime"
+
+// SurveyDDTRetagRequest is the message used to re-tag terms tagged with the DDT secrets of an epoch with the ones of
+// another epoch. The terms are tagged with both epochs chunk by chunk, and the tags of each chunk are streamed back.
+type SurveyDDTRetagRequest struct {
+	SurveyID  SurveyID
+	Roster    onet.Roster
+	Testing   bool
+	Timeout   time.Duration // how long the nodes wait for each phase of the survey (0 = maximum allowed by the nodes)
+	FromEpoch int
+	ToEpoch   int
+	ChunkSize int // number of terms of each chunk (0 = DefaultRetagChunkSize)
+
+	Terms libunlynx.CipherVector // encrypted terms
+
+	Signed // signature of the request by its querier
+}
+
+// ResultDDTRetagChunk contains the tags of a chunk of the terms of a SurveyDDTRetagRequest, in both epochs
+type ResultDDTRetagChunk struct {
+	SurveyID SurveyID
+	Offset   int // index of the first term of the chunk
+	OldTags  []libunlynx.GroupingKey
+	NewTags  []libunlynx.GroupingKey
+	TR       map[string]time.Duration
+	Last     bool
+
+	// set if the re-tagging failed, no chunk follows
+	Error string
+}
+
+// HandleSurveyDDTRetagRequest handles the reception of terms to re-tag. The tags are streamed back chunk by chunk, the
+// re-tagging stops if the client closes the stream.
+func (s *Service) HandleSurveyDDTRetagRequest(sdr *SurveyDDTRetagRequest) (chan *ResultDDTRetagChunk, chan bool, error) {
+	chunks := make(chan *ResultDDTRetagChunk, 1)
+	stop := make(chan bool, 1)
+	go func() {
+		defer close(chunks)
+		start := time.Now()
+		err := s.handleSurveyDDTRetagRequest(sdr, chunks, stop)
+		if err != nil {
+			log.Error(s.ServerIdentity().String(), "couldn't re-tag terms of survey", sdr.SurveyID, ":", err)
+			select {
+			case chunks <- &ResultDDTRetagChunk{SurveyID: sdr.SurveyID, Last: true, Error: err.Error()}:
+			case <-stop:
+			}
+		}
+		s.audit(sdr.SurveyID, DDTRetagRequestName, sdr.Signature, nil, sdr.Roster, false, start, nil, err)
+	}()
+	return chunks, stop, nil
+}
+
+func (s *Service) handleSurveyDDTRetagRequest(sdr *SurveyDDTRetagRequest, chunks chan *ResultDDTRetagChunk,
+	stop chan bool) error {
+	if err := s.authorize(sdr); err != nil {
+		return err
+	}
+
+	// sanitize params
+	if err := emptySurveyID(sdr.SurveyID); err != nil {
+		return xerrors.Errorf("%+v", err)
+	}
+	if err := emptyRoster(sdr.Roster); err != nil {
+		return xerrors.Errorf("%+v", err)
+	}
+	if len(sdr.Terms) == 0 {
+		return xerrors.Errorf("survey %s has no terms to re-tag", sdr.SurveyID)
+	}
+	if sdr.FromEpoch < 0 || sdr.ToEpoch < 0 || sdr.FromEpoch == sdr.ToEpoch {
+		return xerrors.Errorf("wrong DDT secrets epochs: %d to %d", sdr.FromEpoch, sdr.ToEpoch)
+	}
+	chunkSize := sdr.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = DefaultRetagChunkSize
+	} else if chunkSize < 0 {
+		return xerrors.Errorf("wrong chunk size: %d", chunkSize)
+	}
+
+	if err := s.acquireSurvey(sdr.SurveyID, s.requestQuerier(sdr)); err != nil {
+		return err
+	}
+	defer s.releaseSurvey(sdr.SurveyID)
+
+	log.Lvl2(s.ServerIdentity().String(), " received a SurveyDDTRetagRequest:", sdr.SurveyID, "(", len(sdr.Terms),
+		"terms from epoch", sdr.FromEpoch, "to", sdr.ToEpoch, ")")
+
+	for offset := 0; offset < len(sdr.Terms); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(sdr.Terms) {
+			end = len(sdr.Terms)
+		}
+		chunk := &ResultDDTRetagChunk{SurveyID: sdr.SurveyID, Offset: offset, TR: make(map[string]time.Duration),
+			Last: end == len(sdr.Terms)}
+
+		start := time.Now()
+		var err error
+		if chunk.OldTags, err = s.retagChunk(sdr, sdr.FromEpoch, sdr.Terms[offset:end]); err != nil {
+			return xerrors.Errorf("couldn't tag terms %d to %d with epoch %d: %+v", offset, end, sdr.FromEpoch, err)
+		}
+		if chunk.NewTags, err = s.retagChunk(sdr, sdr.ToEpoch, sdr.Terms[offset:end]); err != nil {
+			return xerrors.Errorf("couldn't tag terms %d to %d with epoch %d: %+v", offset, end, sdr.ToEpoch, err)
+		}
+		chunk.TR[DDTRetagTime] = time.Since(start)
+
+		select {
+		case chunks <- chunk:
+		case <-stop:
+			log.Lvl2(s.ServerIdentity().String(), "re-tagging of survey", sdr.SurveyID, "stopped by the client after",
+				offset, "terms")
+			return nil
+		}
+	}
+	return nil
+}
+
+// retagChunk tags a chunk of terms with the DDT secrets of an epoch
+func (s *Service) retagChunk(sdr *SurveyDDTRetagRequest, epoch int, terms libunlynx.CipherVector) ([]libunlynx.GroupingKey, error) {
+	request := SurveyDDTRequest{
+		SurveyID:      sdr.SurveyID,
+		Testing:       sdr.Testing,
+		Epoch:         epoch,
+		Terms:         terms,
+		Timeout:       s.surveyTimeout(sdr.Timeout),
+		MessageSource: s.ServerIdentity(),
+	}
+	result, _, _, err := s.TaggingPhase(&request, &sdr.Roster)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]libunlynx.GroupingKey, 0, len(result))
+	for _, el := range result {
+		tags = append(tags, libunlynx.GroupingKey(el.String()))
+	}
+	return tags, nil
+}
@@ -0,0 +1,385 @@
+package servicesmedco
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/btcsuite/goleveldb/leveldb"
+	"github.com/ldsec/unlynx/lib"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/util/random"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+// Environment variables selecting where the DDT secrets of the node are stored
+const (
+	// DDTSecretsStoreEnv selects the store of the DDT secrets: DDTSecretsStoreTOML (default), DDTSecretsStoreLevelDB or
+	// DDTSecretsStoreCommand. The TOML file and the goleveldb database are at DDTSecretsFilePathEnv.
+	DDTSecretsStoreEnv = "UNLYNX_DDT_SECRETS_STORE"
+	// DDTSecretsCommandEnv is the command the DDT secrets are fetched from and stored with by DDTSecretsStoreCommand
+	DDTSecretsCommandEnv = "UNLYNX_DDT_SECRETS_COMMAND"
+)
+
+// Kinds of DDT secrets stores
+const (
+	DDTSecretsStoreTOML    = "toml"
+	DDTSecretsStoreLevelDB = "leveldb"
+	DDTSecretsStoreCommand = "command"
+)
+
+// SecretStore holds the DDT secrets of a node: one secret per 'source' server and per epoch
+type SecretStore interface {
+	// Secret returns the secret of a 'source' server for an epoch. A missing secret of epoch 0 is set to the provided
+	// one (or to a random one if it is nil), the ones of the other epochs are only added by Rotate.
+	Secret(id network.Address, epoch int, secret kyber.Scalar) (kyber.Scalar, error)
+	// Rotate adds a new epoch, with a secret for each 'source' server (the provided ones or random ones), and returns it
+	Rotate(ids []network.Address, secrets []kyber.Scalar) (int, error)
+	Close() error
+}
+
+// OpenSecretStoreFromEnv opens the DDT secrets store selected by the environment. path is the one of the TOML file or
+// of the goleveldb database, key the one the secrets are encrypted with (nil if they are not, ignored by the command
+// store which is in charge of protecting them).
+func OpenSecretStoreFromEnv(path string, key *DDTSecretsKey) (SecretStore, error) {
+	switch kind := os.Getenv(DDTSecretsStoreEnv); kind {
+	case "", DDTSecretsStoreTOML:
+		if err := checkDDTSecretsFile(path, key); err != nil {
+			return nil, err
+		}
+		return NewTOMLSecretStore(path, key), nil
+	case DDTSecretsStoreLevelDB:
+		return OpenLevelDBSecretStore(path, key)
+	case DDTSecretsStoreCommand:
+		return NewCommandSecretStore(os.Getenv(DDTSecretsCommandEnv))
+	default:
+		return nil, xerrors.Errorf("wrong value for %s (%s)", DDTSecretsStoreEnv, kind)
+	}
+}
+
+// openDDTSecretsStore opens the DDT secrets store of the node, if it has one
+func (s *Service) openDDTSecretsStore() error {
+	path := os.Getenv(DDTSecretsFilePathEnv)
+	if path == "" && os.Getenv(DDTSecretsStoreEnv) != DDTSecretsStoreCommand {
+		return nil
+	}
+	store, err := OpenSecretStoreFromEnv(path, s.ddtSecretsKey)
+	if err != nil {
+		return err
+	}
+	s.ddtSecrets = store
+	return nil
+}
+
+// checkRotation verifies that the provided secrets of a rotation match the 'source' servers and completes them with
+// random ones if none are provided
+func checkRotation(ids []network.Address, secrets []kyber.Scalar) ([]kyber.Scalar, error) {
+	if len(secrets) > 0 {
+		if len(secrets) != len(ids) {
+			return nil, xerrors.Errorf("%d secrets provided for %d servers", len(secrets), len(ids))
+		}
+		return secrets, nil
+	}
+	secrets = make([]kyber.Scalar, len(ids))
+	for i := range secrets {
+		secrets[i] = libunlynx.SuiTe.Scalar().Pick(random.New())
+	}
+	return secrets, nil
+}
+
+// TOMLSecretStore
+//______________________________________________________________________________________________________________________
+
+// TOMLSecretStore keeps the DDT secrets in a TOML file (see CheckDDTSecretsWithKey)
+type TOMLSecretStore struct {
+	path string
+	key  *DDTSecretsKey
+}
+
+// NewTOMLSecretStore returns the store of the TOML file at path, encrypted with key (nil if it is not)
+func NewTOMLSecretStore(path string, key *DDTSecretsKey) *TOMLSecretStore {
+	return &TOMLSecretStore{path: path, key: key}
+}
+
+// Secret implements SecretStore
+func (st *TOMLSecretStore) Secret(id network.Address, epoch int, secret kyber.Scalar) (kyber.Scalar, error) {
+	return CheckDDTSecretsWithKey(st.path, id, epoch, secret, st.key)
+}
+
+// Rotate implements SecretStore
+func (st *TOMLSecretStore) Rotate(ids []network.Address, secrets []kyber.Scalar) (int, error) {
+	return RotateDDTSecrets(st.path, ids, secrets, st.key)
+}
+
+// Close implements SecretStore
+func (st *TOMLSecretStore) Close() error {
+	return nil
+}
+
+// LevelDBSecretStore
+//______________________________________________________________________________________________________________________
+
+var (
+	levelDBEncryptionKey = []byte("encryption")
+	levelDBEpochKey      = []byte("epoch")
+)
+
+// LevelDBSecretStore keeps the DDT secrets in a goleveldb database, encrypted like the ones of a TOML file. The
+// database can only be opened by one process at a time.
+type LevelDBSecretStore struct {
+	sync.Mutex
+	db   *leveldb.DB
+	aead cipher.AEAD // nil if the secrets are not encrypted
+}
+
+// OpenLevelDBSecretStore opens (or creates) the goleveldb secrets store at path, encrypted with key (nil if it is not).
+// A new store is encrypted if a key is given.
+func OpenLevelDBSecretStore(path string, key *DDTSecretsKey) (*LevelDBSecretStore, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("couldn't open DDT secrets store %s: %+v", path, err)
+	}
+	st := &LevelDBSecretStore{db: db}
+	if err := st.setupEncryption(key); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+func (st *LevelDBSecretStore) setupEncryption(key *DDTSecretsKey) error {
+	b, err := st.db.Get(levelDBEncryptionKey, nil)
+	if err == nil {
+		enc := &secretsEncryption{}
+		if err := json.Unmarshal(b, enc); err != nil {
+			return xerrors.Errorf("couldn't decode the encryption of the DDT secrets: %+v", err)
+		}
+		st.aead, err = enc.cipher(key, true)
+		return err
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+	if key == nil {
+		return nil
+	}
+
+	if _, err := st.latestEpoch(); err == nil {
+		log.Warn("the DDT secrets store is not encrypted")
+		return nil
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+	enc, aead, err := newSecretsEncryption(key)
+	if err != nil {
+		return err
+	}
+	if b, err = json.Marshal(enc); err != nil {
+		return err
+	}
+	if err := st.db.Put(levelDBEncryptionKey, b, nil); err != nil {
+		return err
+	}
+	st.aead = aead
+	return nil
+}
+
+func levelDBSecretKey(id string, epoch int) []byte {
+	return []byte("secret/" + strconv.Itoa(epoch) + "/" + id)
+}
+
+func (st *LevelDBSecretStore) latestEpoch() (int, error) {
+	b, err := st.db.Get(levelDBEpochKey, nil)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(b))
+}
+
+func (st *LevelDBSecretStore) put(batch *leveldb.Batch, id string, epoch int, secret kyber.Scalar) error {
+	encoded, err := encodeDDTSecret(st.aead, id, epoch, secret)
+	if err != nil {
+		return err
+	}
+	batch.Put(levelDBSecretKey(id, epoch), []byte(encoded))
+	return nil
+}
+
+// Secret implements SecretStore
+func (st *LevelDBSecretStore) Secret(id network.Address, epoch int, secret kyber.Scalar) (kyber.Scalar, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	b, err := st.db.Get(levelDBSecretKey(id.String(), epoch), nil)
+	if err == nil {
+		return decodeDDTSecret(st.aead, secretDDT{ServerID: id.String(), Secret: string(b), Epoch: epoch})
+	} else if err != leveldb.ErrNotFound {
+		return nil, xerrors.Errorf("couldn't read the DDT secrets: %+v", err)
+	}
+
+	// no secret for this 'source' server; set to the provided one or generate a random one
+	if epoch != 0 {
+		return nil, xerrors.Errorf("no DDT secret of epoch %d for %s", epoch, id.String())
+	}
+	if secret == nil {
+		secret = libunlynx.SuiTe.Scalar().Pick(random.New())
+	}
+	batch := new(leveldb.Batch)
+	if err := st.put(batch, id.String(), 0, secret); err != nil {
+		return nil, err
+	}
+	if _, err := st.latestEpoch(); err == leveldb.ErrNotFound {
+		batch.Put(levelDBEpochKey, []byte("0"))
+	}
+	if err := st.db.Write(batch, nil); err != nil {
+		return nil, xerrors.Errorf("couldn't write the DDT secrets: %+v", err)
+	}
+	return secret, nil
+}
+
+// Rotate implements SecretStore
+func (st *LevelDBSecretStore) Rotate(ids []network.Address, secrets []kyber.Scalar) (int, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	secrets, err := checkRotation(ids, secrets)
+	if err != nil {
+		return 0, err
+	}
+	epoch, err := st.latestEpoch()
+	if err != nil {
+		return 0, xerrors.Errorf("couldn't read the DDT secrets to rotate: %+v", err)
+	}
+	epoch++
+
+	// the secrets and the new epoch are written atomically
+	batch := new(leveldb.Batch)
+	for i, id := range ids {
+		if err := st.put(batch, id.String(), epoch, secrets[i]); err != nil {
+			return 0, err
+		}
+	}
+	batch.Put(levelDBEpochKey, []byte(strconv.Itoa(epoch)))
+	if err := st.db.Write(batch, nil); err != nil {
+		return 0, xerrors.Errorf("couldn't write the DDT secrets: %+v", err)
+	}
+	return epoch, nil
+}
+
+// Close implements SecretStore
+func (st *LevelDBSecretStore) Close() error {
+	return st.db.Close()
+}
+
+// CommandSecretStore
+//______________________________________________________________________________________________________________________
+
+// CommandSecretStore delegates the storage of the DDT secrets to an external command (e.g. a wrapper of a PKCS#11 token
+// or of a vault), so that they never touch the filesystem of the node. The command signals its errors with a non-zero
+// exit status, it is run with the arguments:
+//   - "get <server> <epoch>": prints the secret (base64url of the marshalled scalar), or nothing if there is none
+//   - "put <server> <epoch>": stores the secret read from its standard input
+//   - "epoch": prints the latest epoch, or nothing if there is no secret
+type CommandSecretStore struct {
+	sync.Mutex
+	command []string
+}
+
+// NewCommandSecretStore returns the store delegating to command (split on spaces)
+func NewCommandSecretStore(command string) (*CommandSecretStore, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil, xerrors.Errorf("no DDT secrets command (%s)", DDTSecretsCommandEnv)
+	}
+	return &CommandSecretStore{command: fields}, nil
+}
+
+func (st *CommandSecretStore) run(stdin string, args ...string) (string, error) {
+	cmd := exec.Command(st.command[0], append(st.command[1:], args...)...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", xerrors.Errorf("DDT secrets command failed (%s): %+v: %s", args[0], err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (st *CommandSecretStore) put(id string, epoch int, secret kyber.Scalar) error {
+	b, err := secret.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = st.run(base64.URLEncoding.EncodeToString(b), "put", id, strconv.Itoa(epoch))
+	return err
+}
+
+// Secret implements SecretStore
+func (st *CommandSecretStore) Secret(id network.Address, epoch int, secret kyber.Scalar) (kyber.Scalar, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	out, err := st.run("", "get", id.String(), strconv.Itoa(epoch))
+	if err != nil {
+		return nil, err
+	}
+	if out != "" {
+		return decodeDDTSecret(nil, secretDDT{ServerID: id.String(), Secret: out, Epoch: epoch})
+	}
+
+	// no secret for this 'source' server; set to the provided one or generate a random one
+	if epoch != 0 {
+		return nil, xerrors.Errorf("no DDT secret of epoch %d for %s", epoch, id.String())
+	}
+	if secret == nil {
+		secret = libunlynx.SuiTe.Scalar().Pick(random.New())
+	}
+	if err := st.put(id.String(), 0, secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// Rotate implements SecretStore
+func (st *CommandSecretStore) Rotate(ids []network.Address, secrets []kyber.Scalar) (int, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	secrets, err := checkRotation(ids, secrets)
+	if err != nil {
+		return 0, err
+	}
+	out, err := st.run("", "epoch")
+	if err != nil {
+		return 0, err
+	}
+	if out == "" {
+		return 0, xerrors.New("couldn't read the DDT secrets to rotate: no secret")
+	}
+	epoch, err := strconv.Atoi(out)
+	if err != nil {
+		return 0, xerrors.Errorf("wrong epoch from the DDT secrets command (%s): %+v", out, err)
+	}
+	epoch++
+
+	for i, id := range ids {
+		if err := st.put(id.String(), epoch, secrets[i]); err != nil {
+			return 0, err
+		}
+	}
+	return epoch, nil
+}
+
+// Close implements SecretStore
+func (st *CommandSecretStore) Close() error {
+	return nil
+}
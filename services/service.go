@@ -1,20 +1,22 @@
 package servicesmedco
 
 import (
-	"encoding/base64"
+	"crypto/cipher"
 	"fmt"
-	"github.com/BurntSushi/toml"
 	"github.com/fanliao/go-concurrentMap"
 	"github.com/ldsec/medco-unlynx/protocols"
 	"github.com/ldsec/unlynx/lib"
 	"github.com/ldsec/unlynx/protocols"
 	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/share"
 	"go.dedis.ch/kyber/v3/util/random"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
 	"golang.org/x/xerrors"
+	"math"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -24,12 +26,19 @@ func init() {
 	_, err := onet.RegisterNewService(Name, NewService)
 	log.ErrFatal(err)
 
-	// Register SurveyShuffleRequest for propagation-protocol
+	// Register SurveyShuffleRequest and SurveyCancelRequest for propagation-protocol
 	network.RegisterMessage(&SurveyShuffleRequest{})
+	network.RegisterMessage(&SurveyCancelRequest{})
+	network.RegisterMessage(&SurveyCancelResponse{})
 }
 
 var propagateShuffleFromChildren = "PropShuffleFromChildren"
 var propagateShuffleToChildren = "PropShuffleToChildren"
+var propagateSurveyCancel = "PropSurveyCancel"
+
+// MaxSurveyTimeoutEnv is the environment variable holding the maximum timeout (e.g. "5m") a client can ask for a survey.
+// It defaults to libunlynx.TIMEOUT.
+const MaxSurveyTimeoutEnv = "UNLYNX_MAX_SURVEY_TIMEOUT"
 
 // Service defines a service in unlynx
 type Service struct {
@@ -37,11 +46,76 @@ type Service struct {
 
 	shuffleGetData protocols.PropagationFunc
 	shufflePutData protocols.PropagationFunc
+	surveyCancel   protocols.PropagationFunc
+	proofsGetData  protocols.PropagationFunc
+
+	rootResultsPutData protocols.PropagationFunc
 
-	MapSurveyKS      *concurrent.ConcurrentMap
-	MapSurveyShuffle *concurrent.ConcurrentMap
-	MapSurveyAgg     *concurrent.ConcurrentMap
+	MapSurveyKS      SurveyMap
+	MapSurveyKSBatch SurveyMap
+	MapSurveyShuffle SurveyMap
+	MapSurveyAgg     SurveyMap
 	Mutex            *sync.Mutex
+
+	// public keys of the queriers allowed to send requests (nil if the requests aren't checked) and signatures of the
+	// requests recently received
+	authorizedQueriers *AuthorizedQueriers
+	seenSignatures     seenSignatures
+
+	// log of the surveys processed by the node (nil if there is no audit log)
+	auditLog *AuditLog
+
+	// proofs produced by the node, kept until they are collected
+	proofsMutex sync.Mutex
+	proofs      map[SurveyID][]storedProof
+	// directory where the proofs collected by the node are written (empty if they are not)
+	proofBundleDir string
+
+	// upper bound of the timeouts requested by the clients
+	maxTimeout time.Duration
+
+	// differential privacy parameters accepted by the node, noise lists being shuffled and final results of the
+	// aggregation surveys sent by the root of their roster
+	dpPolicy    DPPolicy
+	noiseMutex  sync.Mutex
+	noiseLists  map[SurveyID][]libunlynx.CipherVector
+	rootResults map[SurveyID]chan libunlynx.CipherVector
+
+	// small-cell suppression thresholds accepted by the node and ciphertexts being blinded
+	suppressionPolicy  SuppressionPolicy
+	suppressionMutex   sync.Mutex
+	suppressionTargets map[SurveyID]*suppressionTarget
+
+	// whether the node takes part in collective decryptions, ciphertexts being decrypted and results of the surveys
+	// that can be decrypted
+	collectiveDecryption bool
+	decryptionMutex      sync.Mutex
+	decryptionTargets    map[SurveyID]libunlynx.CipherVector
+	decryptableResults   map[SurveyID]*decryptableResults
+
+	// key the DDT secrets are encrypted with at rest (nil if they are not) and store of the secrets (nil if the node
+	// has none, only the testing DDT requests are then served)
+	ddtSecretsKey *DDTSecretsKey
+	ddtSecrets    SecretStore
+
+	// shares of the collective keys generated by the nodes
+	dkgShares dkgShares
+
+	// epsilon each querier can consume and ledger of the consumed budgets (nil if there is no budget)
+	dpBudget     float64
+	budgetLedger *PrivacyBudgetLedger
+
+	// protects the timers of the surveys being processed (they can be read by a SurveyStatusRequest)
+	trMutex sync.RWMutex
+
+	// persistent survey store (nil if the surveys are only kept in memory) and surveys that were in flight when the
+	// node was last stopped
+	surveyStore        *SurveyStore
+	interruptedSurveys map[SurveyID]SurveyRecord
+
+	// what has to be stopped when a survey is cancelled
+	cancelMutex   sync.Mutex
+	cancellations map[SurveyID]*surveyCancellation
 }
 
 // NewService constructor which registers the needed messages.
@@ -49,11 +123,65 @@ func NewService(c *onet.Context) (onet.Service, error) {
 	newUnLynxInstance := &Service{
 		ServiceProcessor: onet.NewServiceProcessor(c),
 		MapSurveyKS:      concurrent.NewConcurrentMap(),
+		MapSurveyKSBatch: concurrent.NewConcurrentMap(),
 		MapSurveyShuffle: concurrent.NewConcurrentMap(),
 		MapSurveyAgg:     concurrent.NewConcurrentMap(),
 		Mutex:            &sync.Mutex{},
+		maxTimeout:       libunlynx.TIMEOUT,
+
+		noiseLists:         make(map[SurveyID][]libunlynx.CipherVector),
+		rootResults:        make(map[SurveyID]chan libunlynx.CipherVector),
+		suppressionTargets: make(map[SurveyID]*suppressionTarget),
+		decryptionTargets:  make(map[SurveyID]libunlynx.CipherVector),
+		decryptableResults: make(map[SurveyID]*decryptableResults),
+		proofs:             make(map[SurveyID][]storedProof),
+		interruptedSurveys: make(map[SurveyID]SurveyRecord),
+		cancellations:      make(map[SurveyID]*surveyCancellation),
+		seenSignatures:     seenSignatures{times: make(map[string]time.Time)},
+		proofBundleDir:     os.Getenv(ProofBundlePathEnv),
+		dkgShares:          dkgShares{dir: os.Getenv(DKGSharesPathEnv), shares: make(map[string]*DKGShare)},
+	}
+	if maxTimeout := os.Getenv(MaxSurveyTimeoutEnv); maxTimeout != "" {
+		d, err := time.ParseDuration(maxTimeout)
+		if err != nil || d <= 0 {
+			return nil, xerrors.Errorf("wrong value for %s (%s): %+v", MaxSurveyTimeoutEnv, maxTimeout, err)
+		}
+		newUnLynxInstance.maxTimeout = d
 	}
-	var err error
+	if err := newUnLynxInstance.loadAuthorizedQueriers(); err != nil {
+		return nil, err
+	}
+	if err := newUnLynxInstance.openAuditLog(); err != nil {
+		return nil, err
+	}
+	dpPolicy, err := loadDPPolicy()
+	if err != nil {
+		return nil, err
+	}
+	newUnLynxInstance.dpPolicy = dpPolicy
+	suppressionPolicy, err := loadSuppressionPolicy()
+	if err != nil {
+		return nil, err
+	}
+	newUnLynxInstance.suppressionPolicy = suppressionPolicy
+	if newUnLynxInstance.collectiveDecryption, err = loadCollectiveDecryptionPolicy(); err != nil {
+		return nil, err
+	}
+	if newUnLynxInstance.ddtSecretsKey, err = DDTSecretsKeyFromEnv(c.ServerIdentity().ServicePrivate(Name)); err != nil {
+		return nil, err
+	}
+	if err := newUnLynxInstance.openDDTSecretsStore(); err != nil {
+		return nil, err
+	}
+	if err := newUnLynxInstance.openPrivacyBudget(); err != nil {
+		return nil, err
+	}
+	if path := os.Getenv(SurveyStorePathEnv); path != "" {
+		if err := newUnLynxInstance.openSurveyStore(path); err != nil {
+			return nil, err
+		}
+	}
+
 	newUnLynxInstance.shuffleGetData, err =
 		protocols.NewPropagationFunc(newUnLynxInstance, propagateShuffleFromChildren, -1)
 	if err != nil {
@@ -64,21 +192,91 @@ func NewService(c *onet.Context) (onet.Service, error) {
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create propagation function: %+v", err)
 	}
+	newUnLynxInstance.proofsGetData, err =
+		protocols.NewPropagationFunc(newUnLynxInstance, propagateProofsFromChildren, -1)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create propagation function: %+v", err)
+	}
+	newUnLynxInstance.surveyCancel, err =
+		protocols.NewPropagationFunc(newUnLynxInstance, propagateSurveyCancel, -1)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create propagation function: %+v", err)
+	}
+	newUnLynxInstance.rootResultsPutData, err =
+		protocols.NewPropagationFunc(newUnLynxInstance, propagateRootResults, -1)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create propagation function: %+v", err)
+	}
 
 	if cerr := newUnLynxInstance.RegisterHandlers(
 		newUnLynxInstance.HandleSurveyDDTRequestTerms,
 		newUnLynxInstance.HandleSurveyKSRequest,
+		newUnLynxInstance.HandleSurveyKSBatchRequest,
 		newUnLynxInstance.HandleSurveyShuffleRequest,
-		newUnLynxInstance.HandleSurveyAggRequest); cerr != nil {
+		newUnLynxInstance.HandleSurveyAggRequest,
+		newUnLynxInstance.HandleSurveyStatusRequest,
+		newUnLynxInstance.HandlePrivacyBudgetRequest,
+		newUnLynxInstance.HandleSurveyCancelRequest,
+		newUnLynxInstance.HandleDKGRequest,
+		newUnLynxInstance.HandleSurveyDecryptRequest,
+		newUnLynxInstance.HandleSurveyStatisticsRequest); cerr != nil {
+		log.Error("Wrong Handler.", cerr)
+		return nil, cerr
+	}
+	if cerr := newUnLynxInstance.RegisterStreamingHandlers(
+		newUnLynxInstance.HandleSurveyDDTRetagRequest); cerr != nil {
 		log.Error("Wrong Handler.", cerr)
 		return nil, cerr
 	}
+	go newUnLynxInstance.notifyInterrupted()
 
 	return newUnLynxInstance, nil
 }
 
+// Close releases the databases held by the service, it has to be called once the node is stopped
+func (s *Service) Close() error {
+	var errs []error
+	if s.surveyStore != nil {
+		if err := s.surveyStore.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if s.budgetLedger != nil {
+		if err := s.budgetLedger.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if s.ddtSecrets != nil {
+		if err := s.ddtSecrets.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return xerrors.Errorf("couldn't close the databases of the service: %+v", errs)
+	}
+	return nil
+}
+
+// TestClose releases the databases of the service when a local test stops
+func (s *Service) TestClose() {
+	if err := s.Close(); err != nil {
+		log.Error(s.ServerIdentity().String(), err)
+	}
+}
+
 // HandleSurveyDDTRequestTerms handles the reception of the query terms to be deterministically tagged
 func (s *Service) HandleSurveyDDTRequestTerms(sdq *SurveyDDTRequest) (network.Message, error) {
+	start := time.Now()
+	resp, err := s.handleSurveyDDTRequestTerms(sdq)
+	s.audit(sdq.SurveyID, DDTRequestName, sdq.Signature, nil, sdq.Roster, sdq.Proofs, start, resp, err)
+	return resp, err
+}
+
+func (s *Service) handleSurveyDDTRequestTerms(sdq *SurveyDDTRequest) (network.Message, error) {
+	if err := s.authorize(sdq); err != nil {
+		return nil, err
+	}
+
 	// sanitize params
 	if err := emptySurveyID(sdq.SurveyID); err != nil {
 		return nil, xerrors.Errorf("%+v", err)
@@ -86,6 +284,14 @@ func (s *Service) HandleSurveyDDTRequestTerms(sdq *SurveyDDTRequest) (network.Me
 	if err := emptyRoster(sdq.Roster); err != nil {
 		return nil, xerrors.Errorf("%+v", err)
 	}
+	if sdq.Epoch < 0 {
+		return nil, xerrors.Errorf("wrong DDT secrets epoch: %d", sdq.Epoch)
+	}
+
+	if err := s.acquireSurvey(sdq.SurveyID, s.requestQuerier(sdq)); err != nil {
+		return nil, err
+	}
+	defer s.releaseSurvey(sdq.SurveyID)
 
 	// if this server is the one receiving the request from the client
 	log.Lvl2(s.ServerIdentity().String(), " received a SurveyDDTRequestTerms:", sdq.SurveyID)
@@ -101,7 +307,9 @@ func (s *Service) HandleSurveyDDTRequestTerms(sdq *SurveyDDTRequest) (network.Me
 		SurveyID:      sdq.SurveyID,
 		Proofs:        sdq.Proofs,
 		Testing:       sdq.Testing,
+		Epoch:         sdq.Epoch,
 		Terms:         sdq.Terms,
+		Timeout:       s.surveyTimeout(sdq.Timeout),
 		MessageSource: s.ServerIdentity(),
 	}
 
@@ -125,6 +333,17 @@ func (s *Service) HandleSurveyDDTRequestTerms(sdq *SurveyDDTRequest) (network.Me
 
 // HandleSurveyKSRequest handles the reception of the aggregate local result to be key switched
 func (s *Service) HandleSurveyKSRequest(skr *SurveyKSRequest) (network.Message, error) {
+	start := time.Now()
+	resp, err := s.handleSurveyKSRequest(skr)
+	s.audit(skr.SurveyID, KSRequestName, skr.Signature, skr.clientPubKeys(), skr.Roster, skr.Proofs, start, resp, err)
+	return resp, err
+}
+
+func (s *Service) handleSurveyKSRequest(skr *SurveyKSRequest) (network.Message, error) {
+	if err := s.authorize(skr); err != nil {
+		return nil, err
+	}
+
 	// sanitize params
 	if err := emptySurveyID(skr.SurveyID); err != nil {
 		return nil, xerrors.Errorf("%+v", err)
@@ -132,20 +351,42 @@ func (s *Service) HandleSurveyKSRequest(skr *SurveyKSRequest) (network.Message,
 	if err := emptyRoster(skr.Roster); err != nil {
 		return nil, xerrors.Errorf("%+v", err)
 	}
-	if skr.ClientPubKey == nil {
+	if skr.ClientPubKey == nil && len(skr.ClientPubKeys) == 0 {
 		return nil, xerrors.Errorf("no target public key")
 	}
+	if len(skr.ClientPubKeys) > 0 {
+		if err := checkClientPubKeys(skr); err != nil {
+			return nil, err
+		}
+	}
 	if skr.KSTarget == nil && len(skr.KSTarget) == 0 {
 		return nil, xerrors.Errorf(s.ServerIdentity().String() + " for survey" + string(skr.SurveyID) + "has no data to key switch")
 	}
+	if skr.Quorum != 0 {
+		if err := s.checkQuorum(skr); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.checkInterrupted(skr.SurveyID); err != nil {
+		return nil, err
+	}
+	if err := s.acquireSurvey(skr.SurveyID, s.requestQuerier(skr)); err != nil {
+		return nil, err
+	}
+	defer s.releaseSurvey(skr.SurveyID)
 
 	log.Lvl2(s.ServerIdentity().String(), " received a SurveyKSRequest:", skr.SurveyID)
 
+	timeout := s.surveyTimeout(skr.Timeout)
+
 	mapTR := make(map[string]time.Duration)
 	err := s.putSurveyKS(skr.SurveyID, SurveyKS{
 		SurveyID: skr.SurveyID,
 		Request:  *skr,
 		TR:       TimeResults{MapTR: mapTR},
+		Phase:    PhaseKeySwitching,
+		Start:    time.Now(),
 	})
 	if err != nil {
 		s.deleteSurveyKS(skr.SurveyID)
@@ -153,7 +394,17 @@ func (s *Service) HandleSurveyKSRequest(skr *SurveyKSRequest) (network.Message,
 	}
 
 	// key switch the results
-	keySwitchingResult, execTime, communicationTime, err := s.KeySwitchingPhase(skr.SurveyID, KSRequestName, &skr.Roster)
+	var keySwitchingResult libunlynx.CipherVector
+	var execTime, communicationTime time.Duration
+	contributors := skr.Roster.List
+	if skr.Quorum > 0 {
+		keySwitchingResult, contributors, execTime, communicationTime, err =
+			s.ThresholdKeySwitchingPhase(skr.SurveyID, KSRequestName, skr.DKGKeyID, &skr.Roster, timeout)
+	} else if len(skr.ClientPubKeys) > 0 {
+		keySwitchingResult, _, execTime, communicationTime, err = s.MultiKeySwitchingPhase(skr.SurveyID, KSRequestName, &skr.Roster, timeout)
+	} else {
+		keySwitchingResult, execTime, communicationTime, err = s.KeySwitchingPhase(skr.SurveyID, KSRequestName, &skr.Roster, skr.Proofs, timeout)
+	}
 	if err != nil {
 		s.deleteSurveyKS(skr.SurveyID)
 		return nil, xerrors.Errorf("key switching error: %+v", err)
@@ -164,8 +415,20 @@ func (s *Service) HandleSurveyKSRequest(skr *SurveyKSRequest) (network.Message,
 		s.deleteSurveyKS(skr.SurveyID)
 		return nil, xerrors.Errorf("%+v", err)
 	}
-	surveyKS.TR.MapTR[KSTimeExec] = execTime
-	surveyKS.TR.MapTR[KSTimeCommunication] = communicationTime
+	s.setTime(surveyKS.TR, KSTimeExec, execTime)
+	s.setTime(surveyKS.TR, KSTimeCommunication, communicationTime)
+
+	// collect and verify the proofs of the nodes
+	var binding *ProofBinding
+	if skr.Quorum == 0 && len(skr.ClientPubKeys) == 0 {
+		binding = &ProofBinding{KSTargets: skr.KSTarget, KSKey: skr.ClientPubKey, KSResults: keySwitchingResult}
+	}
+	proofs, err := s.surveyProofs(skr.SurveyID, &skr.Roster, skr.Proofs,
+		[]ProofPhase{{Name: PhaseKeySwitching, Root: s.ServerIdentity().ID}}, binding, timeout, surveyKS.TR)
+	if err != nil {
+		s.deleteSurveyKS(skr.SurveyID)
+		return nil, xerrors.Errorf("proofs error: %+v", err)
+	}
 
 	// remove query from map
 	_, err = s.deleteSurveyKS(skr.SurveyID)
@@ -173,11 +436,155 @@ func (s *Service) HandleSurveyKSRequest(skr *SurveyKSRequest) (network.Message,
 		return nil, xerrors.Errorf("%+v", err)
 	}
 
-	return &Result{Result: keySwitchingResult, TR: surveyKS.TR}, nil
+	if skr.Quorum == 0 {
+		contributors = nil
+	}
+	if len(skr.ClientPubKeys) > 0 {
+		// split the results back per key
+		recipients := make([]ResultRecipient, len(skr.ClientPubKeys))
+		for i, key := range skr.ClientPubKeys {
+			recipients[i] = ResultRecipient{ClientPubKey: key,
+				Result: keySwitchingResult[i*len(skr.KSTarget) : (i+1)*len(skr.KSTarget)]}
+		}
+		return &Result{TR: surveyKS.TR, Recipients: recipients}, nil
+	}
+	return &Result{Result: keySwitchingResult, TR: surveyKS.TR, Contributors: contributors, Proofs: proofs}, nil
+}
+
+// checkClientPubKeys verifies the keys of a key switching request to several keys
+func checkClientPubKeys(skr *SurveyKSRequest) error {
+	if skr.ClientPubKey != nil {
+		return xerrors.New("both a target public key and a list of target public keys")
+	}
+	if skr.Proofs || skr.Quorum != 0 {
+		return xerrors.New("proofs and quorums are not supported with several target public keys")
+	}
+	for i, key := range skr.ClientPubKeys {
+		if key == nil {
+			return xerrors.Errorf("no target public key %d", i)
+		}
+	}
+	return nil
+}
+
+// HandleSurveyKSBatchRequest handles the reception of several independent surveys to be key switched in a single
+// protocol instance, each survey to its own key
+func (s *Service) HandleSurveyKSBatchRequest(skbr *SurveyKSBatchRequest) (network.Message, error) {
+	start := time.Now()
+	resp, err := s.handleSurveyKSBatchRequest(skbr)
+	s.audit(skbr.SurveyID, KSBatchRequestName, skbr.Signature, skbr.clientPubKeys(), skbr.Roster, skbr.Proofs, start, resp, err)
+	return resp, err
+}
+
+func (s *Service) handleSurveyKSBatchRequest(skbr *SurveyKSBatchRequest) (network.Message, error) {
+	if err := s.authorize(skbr); err != nil {
+		return nil, err
+	}
+
+	// sanitize params
+	if err := emptySurveyID(skbr.SurveyID); err != nil {
+		return nil, xerrors.Errorf("%+v", err)
+	}
+	if err := emptyRoster(skbr.Roster); err != nil {
+		return nil, xerrors.Errorf("%+v", err)
+	}
+	if len(skbr.Surveys) == 0 {
+		return nil, xerrors.Errorf(s.ServerIdentity().String() + " for survey" + string(skbr.SurveyID) + "has no survey to key switch")
+	}
+	if skbr.Proofs {
+		return nil, xerrors.New("proofs are not supported by the batch key switching")
+	}
+	surveyIDs := make(map[SurveyID]bool)
+	for _, entry := range skbr.Surveys {
+		if err := emptySurveyID(entry.SurveyID); err != nil {
+			return nil, xerrors.Errorf("%+v", err)
+		}
+		if surveyIDs[entry.SurveyID] {
+			return nil, xerrors.Errorf("survey " + string(entry.SurveyID) + " appears more than once in the batch")
+		}
+		surveyIDs[entry.SurveyID] = true
+		if entry.ClientPubKey == nil {
+			return nil, xerrors.Errorf("no target public key for survey " + string(entry.SurveyID))
+		}
+		if len(entry.KSTarget) == 0 {
+			return nil, xerrors.Errorf(s.ServerIdentity().String() + " for survey" + string(entry.SurveyID) + "has no data to key switch")
+		}
+	}
+
+	if err := s.checkInterrupted(skbr.SurveyID); err != nil {
+		return nil, err
+	}
+	if err := s.acquireSurvey(skbr.SurveyID, s.requestQuerier(skbr)); err != nil {
+		return nil, err
+	}
+	defer s.releaseSurvey(skbr.SurveyID)
+
+	log.Lvl2(s.ServerIdentity().String(), " received a SurveyKSBatchRequest:", skbr.SurveyID, "(", len(skbr.Surveys), "surveys )")
+
+	timeout := s.surveyTimeout(skbr.Timeout)
+
+	mapTR := make(map[string]time.Duration)
+	err := s.putSurveyKSBatch(skbr.SurveyID, SurveyKSBatch{
+		SurveyID: skbr.SurveyID,
+		Request:  *skbr,
+		TR:       TimeResults{MapTR: mapTR},
+		Phase:    PhaseKeySwitching,
+		Start:    time.Now(),
+	})
+	if err != nil {
+		s.deleteSurveyKSBatch(skbr.SurveyID)
+		return nil, xerrors.Errorf("%+v", err)
+	}
+
+	// key switch the results of all the surveys at once
+	keySwitchingResult, switchTimes, execTime, communicationTime, err := s.MultiKeySwitchingPhase(skbr.SurveyID, KSBatchRequestName, &skbr.Roster, timeout)
+	if err != nil {
+		s.deleteSurveyKSBatch(skbr.SurveyID)
+		return nil, xerrors.Errorf("key switching error: %+v", err)
+	}
+
+	// remove query from map
+	_, err = s.deleteSurveyKSBatch(skbr.SurveyID)
+	if err != nil {
+		return nil, xerrors.Errorf("%+v", err)
+	}
+
+	// split the results back per survey
+	results := make([]ResultKSBatchEntry, len(skbr.Surveys))
+	offset := 0
+	for i, entry := range skbr.Surveys {
+		start := time.Now()
+		result := make(libunlynx.CipherVector, len(entry.KSTarget))
+		copy(result, keySwitchingResult[offset:offset+len(entry.KSTarget)])
+		offset += len(entry.KSTarget)
+		results[i] = ResultKSBatchEntry{
+			SurveyID: entry.SurveyID,
+			Result:   result,
+			TR: TimeResults{MapTR: map[string]time.Duration{
+				KSTimeExec:       switchTimes[entry.ClientPubKey.String()],
+				KSBatchTimeSplit: time.Since(start),
+			}},
+		}
+	}
+
+	return &ResultKSBatch{Results: results, TR: TimeResults{MapTR: map[string]time.Duration{
+		KSTimeExec:          execTime,
+		KSTimeCommunication: communicationTime,
+	}}}, nil
 }
 
 // HandleSurveyShuffleRequest handles the reception of the aggregate local result to be shared/shuffled/switched
 func (s *Service) HandleSurveyShuffleRequest(ssr *SurveyShuffleRequest) (network.Message, error) {
+	start := time.Now()
+	resp, err := s.handleSurveyShuffleRequest(ssr)
+	s.audit(ssr.SurveyID, ShuffleRequestName, ssr.Signature, []kyber.Point{ssr.ClientPubKey}, ssr.Roster, ssr.Proofs, start, resp, err)
+	return resp, err
+}
+
+func (s *Service) handleSurveyShuffleRequest(ssr *SurveyShuffleRequest) (network.Message, error) {
+	if err := s.authorize(ssr); err != nil {
+		return nil, err
+	}
 
 	// sanitize params
 	if err := emptySurveyID(ssr.SurveyID); err != nil {
@@ -189,11 +596,35 @@ func (s *Service) HandleSurveyShuffleRequest(ssr *SurveyShuffleRequest) (network
 	if ssr.ClientPubKey == nil {
 		return nil, xerrors.Errorf("no target public key")
 	}
+	if err := s.checkDPParameters(ssr.DP); err != nil {
+		return nil, err
+	}
+	if err := s.checkInterrupted(ssr.SurveyID); err != nil {
+		return nil, err
+	}
+	if err := s.acquireSurvey(ssr.SurveyID, s.requestQuerier(ssr)); err != nil {
+		return nil, err
+	}
+	defer s.releaseSurvey(ssr.SurveyID)
+
+	// the budget is given back if the survey fails before its results are released
+	if err := s.spendPrivacyBudget(s.budgetAccount(ssr, ssr.ClientPubKey), ssr.DP); err != nil {
+		return nil, err
+	}
+	released := false
+	defer func() {
+		if !released {
+			s.refundPrivacyBudget(s.budgetAccount(ssr, ssr.ClientPubKey), ssr.DP)
+		}
+	}()
 
 	root := s.ServerIdentity().String() == ssr.Roster.List[0].String()
 
 	log.Lvl2(s.ServerIdentity().String(), " received a SurveyShuffleRequest:", ssr.SurveyID, "(root =", root, ")")
 
+	timeout := s.surveyTimeout(ssr.Timeout)
+
+	start := time.Now()
 	if root {
 		//Message sent to root node:
 		//1. collect encrypted data from children
@@ -206,8 +637,8 @@ func (s *Service) HandleSurveyShuffleRequest(ssr *SurveyShuffleRequest) (network
 			return nil, xerrors.Errorf(s.ServerIdentity().String() + " for survey" + string(ssr.SurveyID) + "has no data to shuffle")
 		}
 
-		childrenMsgs, err := s.shuffleGetData(&ssr.Roster,
-			&ProtocolConfig{SurveyID: ssr.SurveyID}, libunlynx.TIMEOUT)
+		childrenMsgs, err := s.propagate(ssr.SurveyID, s.shuffleGetData, &ssr.Roster,
+			&ProtocolConfig{SurveyID: ssr.SurveyID, Timeout: timeout}, timeout)
 		if err != nil {
 			return nil, fmt.Errorf("couldn't get children data: %+v", err)
 		}
@@ -218,6 +649,8 @@ func (s *Service) HandleSurveyShuffleRequest(ssr *SurveyShuffleRequest) (network
 			Request:       *ssr,
 			SurveyChannel: make(chan int, 100),
 			TR:            TimeResults{MapTR: mapTR},
+			Phase:         PhaseShuffling,
+			Start:         start,
 		}
 		for _, msg := range childrenMsgs {
 			req, ok := msg.(*SurveyShuffleRequest)
@@ -235,7 +668,7 @@ func (s *Service) HandleSurveyShuffleRequest(ssr *SurveyShuffleRequest) (network
 		}
 
 		// shuffle the results
-		shufflingResult, execTime, communicationTime, err := s.ShufflingPhase(ssr.SurveyID, &ssr.Roster)
+		shufflingResult, execTime, communicationTime, err := s.ShufflingPhase(ssr.SurveyID, &ssr.Roster, timeout)
 		if err != nil {
 			s.deleteSurveyShuffle(ssr.SurveyID)
 			return nil, xerrors.Errorf("shuffling error: %+v", err)
@@ -245,10 +678,33 @@ func (s *Service) HandleSurveyShuffleRequest(ssr *SurveyShuffleRequest) (network
 		for _, el := range shufflingResult {
 			shufflingFinalResult = append(shufflingFinalResult, el[0])
 		}
+		binding := &ProofBinding{
+			ShufflingInputs:  surveyShuffle.Request.ShuffleTarget,
+			ShufflingResults: append(libunlynx.CipherVector{}, shufflingFinalResult...),
+		}
+		s.setTime(surveyShuffle.TR, ShuffleTimeExec, execTime)
+		s.setTime(surveyShuffle.TR, ShuffleTimeCommunication, communicationTime)
+
+		// add the differential privacy noise
+		if ssr.DP.Enabled() {
+			surveyShuffle.Phase = PhaseNoise
+			err = s.putSurveyShuffle(ssr.SurveyID, surveyShuffle)
+			if err != nil {
+				s.deleteSurveyShuffle(ssr.SurveyID)
+				return nil, xerrors.Errorf("%+v", err)
+			}
+
+			noise, noiseTime, err := s.NoisePhase(ssr.SurveyID, &ssr.Roster, ssr.DP, len(shufflingFinalResult), timeout)
+			if err != nil {
+				s.deleteSurveyShuffle(ssr.SurveyID)
+				return nil, xerrors.Errorf("noise error: %+v", err)
+			}
+			shufflingFinalResult.Add(shufflingFinalResult, noise)
+			s.setTime(surveyShuffle.TR, NoiseTime, noiseTime)
+		}
 
 		surveyShuffle.Request.KSTarget = shufflingFinalResult
-		surveyShuffle.TR.MapTR[ShuffleTimeExec] = execTime
-		surveyShuffle.TR.MapTR[ShuffleTimeCommunication] = communicationTime
+		surveyShuffle.Phase = PhaseKeySwitching
 
 		err = s.putSurveyShuffle(ssr.SurveyID, surveyShuffle)
 		if err != nil {
@@ -259,6 +715,7 @@ func (s *Service) HandleSurveyShuffleRequest(ssr *SurveyShuffleRequest) (network
 		// send the shuffled results to all the other nodes
 		ssr.KSTarget = shufflingFinalResult
 		ssr.MessageSource = s.ServerIdentity()
+		ssr.Timeout = timeout
 
 		// let's delete what we don't need (less communication time)
 		ssr.ShuffleTarget = nil
@@ -266,19 +723,21 @@ func (s *Service) HandleSurveyShuffleRequest(ssr *SurveyShuffleRequest) (network
 		// signal the other nodes that they need to prepare to execute a key switching
 		// basically after shuffling the results the root server needs to send them back
 		// to the remaining nodes for key switching
-		_, err = s.shufflePutData(&ssr.Roster, ssr, libunlynx.TIMEOUT)
+		_, err = s.propagate(ssr.SurveyID, s.shufflePutData, &ssr.Roster, ssr, timeout)
 		if err != nil {
 			s.deleteSurveyShuffle(ssr.SurveyID)
 			return nil, fmt.Errorf("couldn't send data to children: %+v", err)
 		}
 
 		// key switch the results
-		keySwitchingResult, execTime, communicationTime, err := s.KeySwitchingPhase(ssr.SurveyID, ShuffleRequestName, &ssr.Roster)
+		keySwitchingResult, execTime, communicationTime, err := s.KeySwitchingPhase(ssr.SurveyID, ShuffleRequestName, &ssr.Roster, ssr.Proofs, timeout)
 		if err != nil {
 			s.deleteSurveyShuffle(ssr.SurveyID)
 			return nil, xerrors.Errorf("key switching error: %+v", err)
 		}
 
+		released = true
+
 		// get server index
 		index, _ := ssr.Roster.Search(s.ServerIdentity().ID)
 		if index < 0 {
@@ -286,8 +745,19 @@ func (s *Service) HandleSurveyShuffleRequest(ssr *SurveyShuffleRequest) (network
 			return nil, xerrors.New("couldn't find this node in the roster")
 		}
 
-		surveyShuffle.TR.MapTR[KSTimeExec] = execTime
-		surveyShuffle.TR.MapTR[KSTimeCommunication] = communicationTime
+		s.setTime(surveyShuffle.TR, KSTimeExec, execTime)
+		s.setTime(surveyShuffle.TR, KSTimeCommunication, communicationTime)
+
+		// collect and verify the proofs of the nodes
+		binding.KSTargets, binding.KSKey, binding.KSResults = shufflingFinalResult, ssr.ClientPubKey, keySwitchingResult
+		proofPhases := []ProofPhase{{Name: PhaseShuffling, Root: ssr.Roster.List[0].ID},
+			{Name: PhaseKeySwitching, Root: s.ServerIdentity().ID}}
+		proofs, err := s.surveyProofs(ssr.SurveyID, &ssr.Roster, ssr.Proofs, proofPhases, binding, timeout,
+			surveyShuffle.TR)
+		if err != nil {
+			s.deleteSurveyShuffle(ssr.SurveyID)
+			return nil, xerrors.Errorf("proofs error: %+v", err)
+		}
 
 		// remove query from map
 		_, err = s.deleteSurveyShuffle(ssr.SurveyID)
@@ -295,7 +765,7 @@ func (s *Service) HandleSurveyShuffleRequest(ssr *SurveyShuffleRequest) (network
 			return nil, xerrors.Errorf("%+v", err)
 		}
 
-		return &Result{Result: libunlynx.CipherVector{keySwitchingResult[index]}, TR: surveyShuffle.TR}, nil
+		return &Result{Result: libunlynx.CipherVector{keySwitchingResult[index]}, TR: surveyShuffle.TR, Proofs: proofs}, nil
 
 	}
 	//if message sent to children node:
@@ -312,6 +782,8 @@ func (s *Service) HandleSurveyShuffleRequest(ssr *SurveyShuffleRequest) (network
 		SurveyChannel:       make(chan int, 100),
 		FinalResultsChannel: make(chan int, 100),
 		TR:                  TimeResults{MapTR: mapTR},
+		Phase:               PhaseShuffling,
+		Start:               start,
 	}
 	err := s.putSurveyShuffle(ssr.SurveyID, surveyShuffle)
 	if err != nil {
@@ -332,14 +804,15 @@ func (s *Service) HandleSurveyShuffleRequest(ssr *SurveyShuffleRequest) (network
 		}
 
 		// key switch the results
-		keySwitchingResult, execTime, communicationTime, err := s.KeySwitchingPhase(ssr.SurveyID, ShuffleRequestName, &ssr.Roster)
+		keySwitchingResult, execTime, communicationTime, err := s.KeySwitchingPhase(ssr.SurveyID, ShuffleRequestName, &ssr.Roster, ssr.Proofs, timeout)
 		if err != nil {
 			s.deleteSurveyShuffle(ssr.SurveyID)
 			return nil, xerrors.Errorf("key switching error: %+v", err)
 		}
 
-		surveyShuffle.TR.MapTR[KSTimeExec] = execTime
-		surveyShuffle.TR.MapTR[KSTimeCommunication] = communicationTime
+		released = true
+		s.setTime(surveyShuffle.TR, KSTimeExec, execTime)
+		s.setTime(surveyShuffle.TR, KSTimeCommunication, communicationTime)
 
 		// get server index
 		index, _ := ssr.Roster.Search(s.ServerIdentity().ID)
@@ -348,6 +821,21 @@ func (s *Service) HandleSurveyShuffleRequest(ssr *SurveyShuffleRequest) (network
 			return nil, xerrors.New("couldn't find this node in the roster")
 		}
 
+		// collect and verify the proofs of the nodes (the shuffled ciphertexts are only known without noise)
+		binding := &ProofBinding{ShufflingInputs: ssr.ShuffleTarget, KSTargets: surveyShuffle.Request.KSTarget,
+			KSKey: ssr.ClientPubKey, KSResults: keySwitchingResult}
+		if !ssr.DP.Enabled() {
+			binding.ShufflingResults = surveyShuffle.Request.KSTarget
+		}
+		proofPhases := []ProofPhase{{Name: PhaseShuffling, Root: ssr.Roster.List[0].ID},
+			{Name: PhaseKeySwitching, Root: s.ServerIdentity().ID}}
+		proofs, err := s.surveyProofs(ssr.SurveyID, &ssr.Roster, ssr.Proofs, proofPhases, binding, timeout,
+			surveyShuffle.TR)
+		if err != nil {
+			s.deleteSurveyShuffle(ssr.SurveyID)
+			return nil, xerrors.Errorf("proofs error: %+v", err)
+		}
+
 		// remove query from map
 		_, err = s.deleteSurveyShuffle(ssr.SurveyID)
 		if err != nil {
@@ -355,9 +843,12 @@ func (s *Service) HandleSurveyShuffleRequest(ssr *SurveyShuffleRequest) (network
 		}
 
 		return &Result{Result: libunlynx.CipherVector{keySwitchingResult[index]},
-			TR: surveyShuffle.TR}, nil
+			TR: surveyShuffle.TR, Proofs: proofs}, nil
 
-	case <-time.After(libunlynx.TIMEOUT):
+	case <-s.cancelChannel(ssr.SurveyID):
+		return nil, surveyCancelledError(ssr.SurveyID)
+
+	case <-time.After(timeout):
 		// remove query from map
 		_, err = s.deleteSurveyShuffle(ssr.SurveyID)
 		if err != nil {
@@ -370,6 +861,17 @@ func (s *Service) HandleSurveyShuffleRequest(ssr *SurveyShuffleRequest) (network
 
 // HandleSurveyAggRequest handles the reception of the aggregate local result to be shared/shuffled/switched
 func (s *Service) HandleSurveyAggRequest(sar *SurveyAggRequest) (network.Message, error) {
+	start := time.Now()
+	resp, err := s.handleSurveyAggRequest(sar)
+	s.audit(sar.SurveyID, AggRequestName, sar.Signature, sar.clientPubKeys(), sar.Roster, sar.Proofs, start, resp, err)
+	return resp, err
+}
+
+func (s *Service) handleSurveyAggRequest(sar *SurveyAggRequest) (network.Message, error) {
+	if err := s.authorize(sar); err != nil {
+		return nil, err
+	}
+
 	// sanitize params
 	if err := emptyRoster(sar.Roster); err != nil {
 		return nil, xerrors.Errorf("%+v", err)
@@ -377,20 +879,70 @@ func (s *Service) HandleSurveyAggRequest(sar *SurveyAggRequest) (network.Message
 	if err := emptySurveyID(sar.SurveyID); err != nil {
 		return nil, xerrors.Errorf("%+v", err)
 	}
-	if sar.AggregateTarget.K == nil || sar.AggregateTarget.C == nil {
+	histogram := len(sar.AggregateTargets) > 0
+	if !histogram && (sar.AggregateTarget.K == nil || sar.AggregateTarget.C == nil) {
 		return nil, xerrors.Errorf(s.ServerIdentity().String() + " for survey" + string(sar.SurveyID) + "has no data to aggregate")
 	}
-	if sar.ClientPubKey == nil {
+	if histogram && sar.MinContributors > 0 {
+		return nil, xerrors.New("a histogram can't be aggregated with a minimum number of contributors")
+	}
+	if sar.Decrypt {
+		if err := s.checkAggDecrypt(sar); err != nil {
+			return nil, err
+		}
+	} else if sar.ClientPubKey == nil {
 		return nil, xerrors.Errorf("no target public key")
 	}
+	if err := s.checkDPParameters(sar.DP); err != nil {
+		return nil, err
+	}
+	if sar.ComparisonThreshold != 0 {
+		if err := s.checkComparison(sar); err != nil {
+			return nil, err
+		}
+	} else if err := s.checkSuppressionThreshold(sar.SuppressionThreshold); err != nil {
+		return nil, err
+	}
+	if sar.MinContributors < 0 || sar.MinContributors > len(sar.Roster.List) {
+		return nil, xerrors.Errorf("wrong minimum number of contributors: %d (%d nodes in the roster)",
+			sar.MinContributors, len(sar.Roster.List))
+	}
+	if sar.DKGKeyID != "" {
+		if err := s.checkAggDKGKey(sar); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.checkInterrupted(sar.SurveyID); err != nil {
+		return nil, err
+	}
+	if err := s.acquireSurvey(sar.SurveyID, s.requestQuerier(sar)); err != nil {
+		return nil, err
+	}
+	defer s.releaseSurvey(sar.SurveyID)
+
+	// the budget is given back if the survey fails before its result is released
+	if err := s.spendPrivacyBudget(s.budgetAccount(sar, sar.ClientPubKey), sar.DP); err != nil {
+		return nil, err
+	}
+	released := false
+	defer func() {
+		if !released {
+			s.refundPrivacyBudget(s.budgetAccount(sar, sar.ClientPubKey), sar.DP)
+		}
+	}()
 
 	log.Lvl2(s.ServerIdentity().String(), " received a SurveyAggRequest:", sar.SurveyID)
 
+	timeout := s.surveyTimeout(sar.Timeout)
+
 	mapTR := make(map[string]time.Duration)
 	surveyAgg := SurveyAgg{
 		SurveyID: sar.SurveyID,
 		Request:  *sar,
 		TR:       TimeResults{MapTR: mapTR},
+		Phase:    PhaseAggregation,
+		Start:    time.Now(),
 	}
 	err := s.putSurveyAgg(sar.SurveyID, surveyAgg)
 	if err != nil {
@@ -399,14 +951,166 @@ func (s *Service) HandleSurveyAggRequest(sar *SurveyAggRequest) (network.Message
 	}
 
 	// collectively aggregate the results
-	aggregationResult, aggrTime, err := s.CollectiveAggregationPhase(sar.SurveyID, &sar.Roster)
+	var aggregationResult libunlynx.CipherVector
+	var aggrTime time.Duration
+	contributors := sar.Roster.List
+	if sar.MinContributors > 0 {
+		var result libunlynx.CipherText
+		result, contributors, aggrTime, err = s.ThresholdAggregationPhase(sar.SurveyID, &sar.Roster, timeout)
+		if err == nil && len(contributors) < sar.MinContributors {
+			err = xerrors.Errorf("only %d of %d nodes contributed (%d required)", len(contributors),
+				len(sar.Roster.List), sar.MinContributors)
+		}
+		aggregationResult = libunlynx.CipherVector{result}
+	} else if histogram {
+		aggregationResult, aggrTime, err = s.HistogramAggregationPhase(sar.SurveyID, &sar.Roster,
+			len(sar.AggregateTargets), timeout)
+	} else {
+		var result libunlynx.CipherText
+		result, aggrTime, err = s.CollectiveAggregationPhase(sar.SurveyID, &sar.Roster, timeout)
+		aggregationResult = libunlynx.CipherVector{result}
+	}
 	if err != nil {
 		s.deleteSurveyAgg(sar.SurveyID)
 		return nil, xerrors.Errorf("aggregation error: %+v", err)
 	}
+	log.Lvl2(s.ServerIdentity().String(), "aggregated the data of", len(contributors), "of", len(sar.Roster.List),
+		"nodes for survey", sar.SurveyID)
+	binding := &ProofBinding{AggregationResults: append(libunlynx.CipherVector{}, aggregationResult...)}
+	if histogram {
+		binding.AggregationInputs = sar.AggregateTargets
+	} else {
+		binding.AggregationInputs = libunlynx.CipherVector{sar.AggregateTarget}
+	}
+
+	s.setTime(surveyAgg.TR, AggrTime, aggrTime)
+
+	// the root of the roster alone suppresses the small results, compares them and adds the noise, then sends the
+	// final results to the other nodes: only it learns which results are below a threshold (see thresholdSelect)
+	rosterRoot := s.isRosterRoot(&sar.Roster)
+	rootPhases := sar.SuppressionThreshold > 0 || sar.ComparisonThreshold > 0 || sar.DP.Enabled()
+
+	// suppress the small results
+	if sar.SuppressionThreshold > 0 && rosterRoot {
+		surveyAgg.Phase = PhaseSuppression
+		err = s.putSurveyAgg(sar.SurveyID, surveyAgg)
+		if err != nil {
+			s.deleteSurveyAgg(sar.SurveyID)
+			return nil, xerrors.Errorf("%+v", err)
+		}
+
+		replacement := int64(0)
+		if sar.SuppressionReplaceByThreshold {
+			replacement = sar.SuppressionThreshold
+		}
+		var suppressionTime time.Duration
+		for i := range aggregationResult {
+			var suppressed bool
+			var bucketTime time.Duration
+			aggregationResult[i], suppressed, bucketTime, err = s.SuppressionPhase(sar.SurveyID, &sar.Roster,
+				aggregationResult[i], sar.SuppressionThreshold, replacement, timeout)
+			if err != nil {
+				s.deleteSurveyAgg(sar.SurveyID)
+				return nil, xerrors.Errorf("suppression error: %+v", err)
+			}
+			log.Lvl2(s.ServerIdentity().String(), "suppression of the result", i, "of survey", sar.SurveyID, ":", suppressed)
+			suppressionTime += bucketTime
+		}
+		s.setTime(surveyAgg.TR, SuppressionTime, suppressionTime)
+	}
+
+	// only release whether the results reach the comparison threshold
+	if sar.ComparisonThreshold > 0 && rosterRoot {
+		surveyAgg.Phase = PhaseComparison
+		err = s.putSurveyAgg(sar.SurveyID, surveyAgg)
+		if err != nil {
+			s.deleteSurveyAgg(sar.SurveyID)
+			return nil, xerrors.Errorf("%+v", err)
+		}
+
+		var comparisonTime time.Duration
+		for i := range aggregationResult {
+			var bucketTime time.Duration
+			aggregationResult[i], bucketTime, err = s.ComparisonPhase(sar.SurveyID, &sar.Roster, aggregationResult[i],
+				sar.ComparisonThreshold, timeout)
+			if err != nil {
+				s.deleteSurveyAgg(sar.SurveyID)
+				return nil, xerrors.Errorf("comparison error: %+v", err)
+			}
+			comparisonTime += bucketTime
+		}
+		s.setTime(surveyAgg.TR, ComparisonTime, comparisonTime)
+	}
+
+	// add the differential privacy noise
+	if sar.DP.Enabled() && rosterRoot {
+		surveyAgg.Phase = PhaseNoise
+		err = s.putSurveyAgg(sar.SurveyID, surveyAgg)
+		if err != nil {
+			s.deleteSurveyAgg(sar.SurveyID)
+			return nil, xerrors.Errorf("%+v", err)
+		}
+
+		noiseStart := time.Now()
+		noise, _, err := s.NoisePhase(sar.SurveyID, &sar.Roster, sar.DP, len(aggregationResult), timeout)
+		if err != nil {
+			s.deleteSurveyAgg(sar.SurveyID)
+			return nil, xerrors.Errorf("noise error: %+v", err)
+		}
+		aggregationResult.Add(aggregationResult, noise)
+		s.setTime(surveyAgg.TR, NoiseTime, time.Since(noiseStart))
+	}
+
+	if rootPhases {
+		if rosterRoot {
+			s.sendRootResults(sar.SurveyID, &sar.Roster, aggregationResult, timeout)
+		} else {
+			waitStart := time.Now()
+			aggregationResult, err = s.waitRootResults(sar.SurveyID, len(aggregationResult), timeout)
+			if err != nil {
+				s.deleteSurveyAgg(sar.SurveyID)
+				return nil, xerrors.Errorf("root results error: %+v", err)
+			}
+			s.setTime(surveyAgg.TR, RootResultsTime, time.Since(waitStart))
+		}
+	}
+
+	// the final results can be collectively decrypted, instead of the key switching or later
+	if s.collectiveDecryption {
+		s.putDecryptableResults(sar.SurveyID, aggregationResult, s.requestQuerier(sar))
+	}
+	if sar.Decrypt {
+		surveyAgg.Phase = PhaseDecryption
+		err = s.putSurveyAgg(sar.SurveyID, surveyAgg)
+		if err != nil {
+			s.deleteSurveyAgg(sar.SurveyID)
+			return nil, xerrors.Errorf("%+v", err)
+		}
+
+		decrypted, execTime, communicationTime, err := s.CollectiveDecryptionPhase(sar.SurveyID, aggregationResult,
+			&sar.Roster, timeout)
+		if err != nil {
+			s.deleteSurveyAgg(sar.SurveyID)
+			return nil, xerrors.Errorf("collective decryption error: %+v", err)
+		}
+		released = true
+		s.setTime(surveyAgg.TR, DecryptTimeExec, execTime)
+		s.setTime(surveyAgg.TR, DecryptTimeCommunication, communicationTime)
+
+		// remove query from map
+		_, err = s.deleteSurveyAgg(sar.SurveyID)
+		if err != nil {
+			return nil, xerrors.Errorf("%+v", err)
+		}
+		return &Result{Decrypted: decrypted, TR: surveyAgg.TR, Contributors: contributors}, nil
+	}
 
-	surveyAgg.Request.KSTarget = aggregationResult
-	surveyAgg.TR.MapTR[AggrTime] = aggrTime
+	if histogram {
+		surveyAgg.Request.KSTargets = aggregationResult
+	} else {
+		surveyAgg.Request.KSTarget = aggregationResult[0]
+	}
+	surveyAgg.Phase = PhaseKeySwitching
 
 	err = s.putSurveyAgg(sar.SurveyID, surveyAgg)
 	if err != nil {
@@ -414,14 +1118,36 @@ func (s *Service) HandleSurveyAggRequest(sar *SurveyAggRequest) (network.Message
 		return nil, xerrors.Errorf("%+v", err)
 	}
 
-	// key switch the results
-	keySwitchingResult, execTime, communicationTime, err := s.KeySwitchingPhase(sar.SurveyID, AggRequestName, &sar.Roster)
+	// key switch the results (only with the nodes holding a share of the DKG key that answer, if the data is encrypted
+	// with one)
+	var keySwitchingResult libunlynx.CipherVector
+	var execTime, communicationTime time.Duration
+	if sar.DKGKeyID != "" {
+		keySwitchingResult, _, execTime, communicationTime, err = s.ThresholdKeySwitchingPhase(sar.SurveyID,
+			AggRequestName, sar.DKGKeyID, &sar.Roster, timeout)
+	} else {
+		keySwitchingResult, execTime, communicationTime, err = s.KeySwitchingPhase(sar.SurveyID, AggRequestName,
+			&sar.Roster, sar.Proofs, timeout)
+	}
 	if err != nil {
 		s.deleteSurveyAgg(sar.SurveyID)
 		return nil, xerrors.Errorf("key switching error: %+v", err)
 	}
-	surveyAgg.TR.MapTR[KSTimeExec] = execTime
-	surveyAgg.TR.MapTR[KSTimeCommunication] = communicationTime
+	released = true
+	s.setTime(surveyAgg.TR, KSTimeExec, execTime)
+	s.setTime(surveyAgg.TR, KSTimeCommunication, communicationTime)
+
+	// collect and verify the proofs of the nodes (the threshold aggregation has none)
+	binding.KSTargets, binding.KSKey, binding.KSResults = aggregationResult, sar.ClientPubKey, keySwitchingResult
+	proofPhases := []ProofPhase{{Name: PhaseKeySwitching, Root: s.ServerIdentity().ID}}
+	if sar.MinContributors == 0 {
+		proofPhases = append(proofPhases, ProofPhase{Name: PhaseAggregation, Root: s.ServerIdentity().ID})
+	}
+	proofs, err := s.surveyProofs(sar.SurveyID, &sar.Roster, sar.Proofs, proofPhases, binding, timeout, surveyAgg.TR)
+	if err != nil {
+		s.deleteSurveyAgg(sar.SurveyID)
+		return nil, xerrors.Errorf("proofs error: %+v", err)
+	}
 
 	// remove query from map
 	_, err = s.deleteSurveyAgg(sar.SurveyID)
@@ -429,7 +1155,80 @@ func (s *Service) HandleSurveyAggRequest(sar *SurveyAggRequest) (network.Message
 		return nil, xerrors.Errorf("%+v", err)
 	}
 
-	return &Result{Result: keySwitchingResult, TR: surveyAgg.TR}, nil
+	return &Result{Result: keySwitchingResult, TR: surveyAgg.TR, Contributors: contributors, Proofs: proofs}, nil
+}
+
+// HandleSurveyStatusRequest handles the reception of a request about the progress of some surveys on this node
+func (s *Service) HandleSurveyStatusRequest(ssr *SurveyStatusRequest) (network.Message, error) {
+	if err := s.authorize(ssr); err != nil {
+		return nil, err
+	}
+
+	if len(ssr.SurveyIDs) == 0 {
+		return nil, xerrors.New("no survey ID to report the status of")
+	}
+
+	log.Lvl2(s.ServerIdentity().String(), " received a SurveyStatusRequest for", len(ssr.SurveyIDs), "surveys")
+
+	statuses := make([]SurveyStatus, len(ssr.SurveyIDs))
+	for i, sid := range ssr.SurveyIDs {
+		statuses[i] = s.surveyStatus(sid)
+	}
+	return &SurveyStatusResponse{Statuses: statuses}, nil
+}
+
+// HandlePrivacyBudgetRequest handles the reception of a request about the privacy budget of a querier on this node
+func (s *Service) HandlePrivacyBudgetRequest(pbr *PrivacyBudgetRequest) (network.Message, error) {
+	if err := s.authorize(pbr); err != nil {
+		return nil, err
+	}
+
+	if pbr.ClientPubKey == nil {
+		return nil, xerrors.New("no querier public key")
+	}
+
+	log.Lvl2(s.ServerIdentity().String(), " received a PrivacyBudgetRequest")
+
+	return s.privacyBudget(s.budgetAccount(pbr, pbr.ClientPubKey))
+}
+
+// HandleSurveyCancelRequest handles the reception of a request to abandon a survey on all the nodes of the roster
+func (s *Service) HandleSurveyCancelRequest(scr *SurveyCancelRequest) (network.Message, error) {
+	if err := s.authorize(scr); err != nil {
+		return nil, err
+	}
+
+	// sanitize params
+	if err := emptySurveyID(scr.SurveyID); err != nil {
+		return nil, xerrors.Errorf("%+v", err)
+	}
+	if err := emptyRoster(scr.Roster); err != nil {
+		return nil, xerrors.Errorf("%+v", err)
+	}
+
+	log.Lvl2(s.ServerIdentity().String(), " received a SurveyCancelRequest:", scr.SurveyID)
+
+	if err := s.checkSurveyCanceller(scr.SurveyID, s.requestQuerier(scr)); err != nil {
+		return nil, err
+	}
+
+	replies, err := s.surveyCancel(&scr.Roster, &SurveyCancelRequest{SurveyID: scr.SurveyID}, s.maxTimeout)
+	if err != nil {
+		return nil, xerrors.Errorf("couldn't propagate the cancellation: %+v", err)
+	}
+
+	resp := SurveyCancelResponse{SurveyID: scr.SurveyID}
+	if s.cancelSurvey(scr.SurveyID) {
+		resp.NodesRunning++
+	}
+	for _, msg := range replies {
+		reply, ok := msg.(*SurveyCancelResponse)
+		if !ok {
+			return nil, xerrors.New("couldn't convert msg to SurveyCancelResponse")
+		}
+		resp.NodesRunning += reply.NodesRunning
+	}
+	return &resp, nil
 }
 
 // Protocol Handlers
@@ -449,34 +1248,107 @@ func (s *Service) whatRequest(target string) (bool, libunlynx.CipherVector, kybe
 	case KSRequestName:
 		surveyKS, err := s.getSurveyKS(sID)
 		if err != nil {
-			return false, nil, nil, err
+			return false, nil, nil, err
+		}
+		proofs = surveyKS.Request.Proofs
+		data = surveyKS.Request.KSTarget
+		cPubKey = surveyKS.Request.ClientPubKey
+
+	case ShuffleRequestName:
+		surveyShuffle, err := s.getSurveyShuffle(sID)
+		if err != nil {
+			return false, nil, nil, err
+		}
+		proofs = surveyShuffle.Request.Proofs
+		data = surveyShuffle.Request.KSTarget
+		cPubKey = surveyShuffle.Request.ClientPubKey
+
+	case AggRequestName:
+		surveyAgg, err := s.getSurveyAgg(sID)
+		if err != nil {
+			return false, nil, nil, err
+		}
+		proofs = surveyAgg.Request.Proofs
+		if len(surveyAgg.Request.KSTargets) > 0 {
+			data = surveyAgg.Request.KSTargets
+		} else {
+			data = libunlynx.CipherVector{surveyAgg.Request.KSTarget}
+		}
+		cPubKey = surveyAgg.Request.ClientPubKey
+
+	case SuppressionRequestName:
+		target, ok := s.getSuppressionTarget(sID)
+		if !ok || target.key == nil {
+			return false, nil, nil, fmt.Errorf("no blinded differences for survey %s", sID)
+		}
+		data = target.data
+		cPubKey = target.key
+
+	default:
+		return false, nil, nil, fmt.Errorf("could not identify the request:" + typeQ)
+	}
+	return proofs, data, cPubKey, nil
+}
+
+// whatRequestTargets fetches the data from the correct map based on the configuration string ('target') for the
+// requests where the ciphertexts are switched to several public keys. It returns the ciphertexts, the distinct keys
+// and the switches of the ciphertexts to the keys.
+func (s *Service) whatRequestTargets(target string) (bool, libunlynx.CipherVector, []kyber.Point, []protocols.KeySwitch, error) {
+	var proofs bool
+	var data libunlynx.CipherVector
+	var cPubKeys []kyber.Point
+	var switches []protocols.KeySwitch
+
+	tokens := strings.Split(target, "/")
+	sID := SurveyID(tokens[0])
+	typeQ := tokens[1]
+
+	// keyIndex gives the index of a key in cPubKeys, each key being sent once
+	keyIndexes := make(map[string]int)
+	keyIndex := func(key kyber.Point) int {
+		index, ok := keyIndexes[key.String()]
+		if !ok {
+			index = len(cPubKeys)
+			keyIndexes[key.String()] = index
+			cPubKeys = append(cPubKeys, key)
+		}
+		return index
+	}
+
+	switch typeQ {
+	case KSRequestName:
+		surveyKS, err := s.getSurveyKS(sID)
+		if err != nil {
+			return false, nil, nil, nil, err
 		}
 		proofs = surveyKS.Request.Proofs
+		// the targets are sent once and each of them is switched to every key, key after key
 		data = surveyKS.Request.KSTarget
-		cPubKey = surveyKS.Request.ClientPubKey
-
-	case ShuffleRequestName:
-		surveyShuffle, err := s.getSurveyShuffle(sID)
-		if err != nil {
-			return false, nil, nil, err
+		for _, key := range surveyKS.Request.ClientPubKeys {
+			k := keyIndex(key)
+			for i := range surveyKS.Request.KSTarget {
+				switches = append(switches, protocols.KeySwitch{Target: i, Key: k})
+			}
 		}
-		proofs = surveyShuffle.Request.Proofs
-		data = surveyShuffle.Request.KSTarget
-		cPubKey = surveyShuffle.Request.ClientPubKey
 
-	case AggRequestName:
-		surveyAgg, err := s.getSurveyAgg(sID)
+	case KSBatchRequestName:
+		surveyKSBatch, err := s.getSurveyKSBatch(sID)
 		if err != nil {
-			return false, nil, nil, err
+			return false, nil, nil, nil, err
+		}
+		proofs = surveyKSBatch.Request.Proofs
+		for _, entry := range surveyKSBatch.Request.Surveys {
+			k := keyIndex(entry.ClientPubKey)
+			for _, ct := range entry.KSTarget {
+				switches = append(switches, protocols.KeySwitch{Target: len(data), Key: k})
+				data = append(data, ct)
+			}
 		}
-		proofs = surveyAgg.Request.Proofs
-		data = libunlynx.CipherVector{surveyAgg.Request.KSTarget}
-		cPubKey = surveyAgg.Request.ClientPubKey
 
 	default:
-		return false, nil, nil, fmt.Errorf("could not identify the request:" + typeQ)
+		return false, nil, nil, nil, fmt.Errorf("could not identify the request:" + typeQ)
 	}
-	return proofs, data, cPubKey, nil
+	return proofs, data, cPubKeys, switches, nil
 }
 
 // NewProtocol creates a protocol instance executed by all nodes
@@ -493,6 +1365,10 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance,
 			return nil, err
 		}
 		target = protoConf.getTarget()
+
+		if err := s.checkInterrupted(protoConf.SurveyID); err != nil {
+			return nil, err
+		}
 	}
 
 	switch tn.ProtocolName() {
@@ -535,25 +1411,32 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance,
 			serverIDMap = surveyRequest.MessageSource
 		}
 
-		s.Mutex.Lock()
-		var aux kyber.Scalar
+		store := s.ddtSecrets
 		if surveyRequest.Testing {
 			path := DDTSecretsPath + "_" + s.ServerIdentity().Address.Host() + ":" + s.ServerIdentity().Address.Port() + ".toml"
-			aux, err = CheckDDTSecrets(path, serverIDMap.Address, nil)
-			if err != nil || aux == nil {
-				return nil, fmt.Errorf("error while reading the DDT secrets from file: %v", err)
-			}
-		} else {
-			aux, err = CheckDDTSecrets(os.Getenv("UNLYNX_DDT_SECRETS_FILE_PATH"), serverIDMap.Address, nil)
-			if err != nil || aux == nil {
-				return nil, fmt.Errorf("error while reading the DDT secrets from file: %v", err)
-			}
+			store = NewTOMLSecretStore(path, s.ddtSecretsKey)
+		} else if store == nil {
+			return nil, fmt.Errorf("no DDT secrets store: %s is not set", DDTSecretsFilePathEnv)
+		}
+		s.Mutex.Lock()
+		var aux kyber.Scalar
+		aux, err = store.Secret(serverIDMap.Address, surveyRequest.Epoch, nil)
+		s.Mutex.Unlock()
+		if err != nil || aux == nil {
+			return nil, fmt.Errorf("error while reading the DDT secrets from file: %v", err)
 		}
 		hashCreation.SurveySecretKey = &aux
 		hashCreation.Proofs = surveyRequest.Proofs
-		s.Mutex.Unlock()
 
 	case protocolsunlynx.ShufflingProtocolName:
+		if protoConf.TypeQ == NoiseShuffleName {
+			pi, err = s.newNoiseShufflingProtocol(tn, protoConf)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+
 		surveyShuffle, err := s.getSurveyShuffle(target)
 		if err != nil {
 			return nil, err
@@ -568,6 +1451,9 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance,
 
 		shuffle.Proofs = surveyShuffle.Request.Proofs
 		shuffle.Precomputed = nil
+		if shuffle.Proofs {
+			shuffle.ProofFunc = s.shufflingProofFunc(surveyShuffle.SurveyID, tn.Root().ServerIdentity.ID)
+		}
 
 		if tn.IsRoot() {
 			dataToShuffle := protocolsunlynx.AdaptCipherTextArray(surveyShuffle.Request.ShuffleTarget)
@@ -583,24 +1469,113 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance,
 
 		if tn.IsRoot() {
 			//define which map to retrieve the values to key switch
-			proofs, data, cPubKey, err := s.whatRequest(string(target))
+			_, data, cPubKey, err := s.whatRequest(string(target))
+			if err != nil {
+				return nil, err
+			}
+
+			dataToSwitch := data
+			keySwitch.TargetOfSwitch = &dataToSwitch
+			keySwitch.TargetPublicKey = &cPubKey
+		}
+
+		keySwitch.Proofs = protoConf.Proofs
+		if keySwitch.Proofs {
+			keySwitch.ProofFunc = s.keySwitchingProofFunc(protoConf.SurveyID, tn.Root().ServerIdentity.ID)
+		}
+
+	case protocols.MultiKeySwitchingProtocolName:
+		pi, err = protocols.NewMultiKeySwitchingProtocol(tn)
+		if err != nil {
+			return nil, err
+		}
+
+		keySwitch := pi.(*protocols.MultiKeySwitchingProtocol)
+		keySwitch.Timeout = s.surveyTimeout(protoConf.Timeout)
+
+		if tn.IsRoot() {
+			_, data, cPubKeys, switches, err := s.whatRequestTargets(string(target))
+			if err != nil {
+				return nil, err
+			}
+			keySwitch.TargetOfSwitch = &data
+			keySwitch.TargetPublicKeys = &cPubKeys
+			keySwitch.Switches = switches
+		}
+
+	case protocols.ThresholdKeySwitchingProtocolName:
+		pi, err = protocols.NewThresholdKeySwitchingProtocol(tn)
+		if err != nil {
+			return nil, err
+		}
+
+		keySwitch := pi.(*protocols.ThresholdKeySwitchingProtocol)
+		keySwitch.Timeout = s.surveyTimeout(protoConf.Timeout)
+		// the nodes without a share of the key answer without taking part, the partial switches of the others are
+		// verified with their public share
+		if ds, err := s.dkgShare(string(protoConf.Data)); err == nil {
+			keySwitch.Share = &share.PriShare{I: ds.Index, V: ds.Share}
+			keySwitch.ShareOf = ds.shareOf
+		} else {
+			log.Lvl2(s.ServerIdentity(), "has no share of the key", string(protoConf.Data), ":", err)
+		}
+
+		if tn.IsRoot() {
+			_, data, cPubKey, err := s.whatRequest(string(target))
 			if err != nil {
 				return nil, err
 			}
 
-			keySwitch.Proofs = proofs
 			dataToSwitch := data
 			keySwitch.TargetOfSwitch = &dataToSwitch
 			keySwitch.TargetPublicKey = &cPubKey
+			// a SurveyKSRequest gives its quorum, the other surveys are switched by as many nodes as the threshold of
+			// the key
+			if protoConf.TypeQ == KSRequestName {
+				surveyKS, err := s.getSurveyKS(protoConf.SurveyID)
+				if err != nil {
+					return nil, err
+				}
+				keySwitch.Quorum = surveyKS.Request.Quorum
+			} else {
+				ds, err := s.dkgShare(string(protoConf.Data))
+				if err != nil {
+					return nil, err
+				}
+				keySwitch.Quorum = ds.Threshold
+			}
+		}
+
+	case protocols.CollectiveDecryptionProtocolName:
+		pi, err = protocols.NewCollectiveDecryptionProtocol(tn)
+		if err != nil {
+			return nil, err
+		}
+
+		decryption := pi.(*protocols.CollectiveDecryptionProtocol)
+		decryption.Timeout = s.surveyTimeout(protoConf.Timeout)
+		decryption.Allowed = s.collectiveDecryption
+		decryption.Decryptable = func(targets libunlynx.CipherVector) bool {
+			return s.isDecryptable(protoConf.SurveyID, targets, decryption.Timeout)
+		}
+		if tn.IsRoot() {
+			targets, ok := s.getDecryptionTarget(protoConf.SurveyID)
+			if !ok {
+				return nil, xerrors.Errorf("no data to decrypt for survey %s", protoConf.SurveyID)
+			}
+			decryption.TargetOfDecryption = &targets
 		}
 
 	case protocolsunlynx.CollectiveAggregationProtocolName:
 		var surveyAgg SurveyAgg
-		maxLoop := int(libunlynx.TIMEOUT.Seconds())
+		maxLoop := int(math.Ceil(s.surveyTimeout(protoConf.Timeout).Seconds()))
 		for i := 1; i <= maxLoop; i++ {
 			surveyAgg, err = s.getSurveyAgg(target)
 			if err != nil {
 				log.Lvl3(s.ServerIdentity(), "Waiting for data to arrive for survey", target)
+				if s.isCancelled(target) {
+					return nil, surveyCancelledError(target)
+				}
 				if i == maxLoop {
 					return nil, xerrors.New("didn't get data within time - aborting")
 				}
@@ -617,11 +1592,59 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance,
 
 		aggr := pi.(*protocolsunlynx.CollectiveAggregationProtocol)
 		aggr.Proofs = surveyAgg.Request.Proofs
+		if aggr.Proofs {
+			aggr.ProofFunc = s.aggregationProofFunc(surveyAgg.SurveyID, tn.Root().ServerIdentity.ID)
+		}
 
 		data := make([]libunlynx.CipherText, 0)
-		data = append(data, surveyAgg.Request.AggregateTarget)
+		if len(surveyAgg.Request.AggregateTargets) > 0 {
+			data = append(data, surveyAgg.Request.AggregateTargets...)
+		} else {
+			data = append(data, surveyAgg.Request.AggregateTarget)
+		}
+		// the data of the nodes is added element-wise, it must have the length announced by the root
+		if buckets, err := strconv.Atoi(string(protoConf.Data)); err == nil && buckets != len(data) {
+			return nil, xerrors.Errorf("%d values to aggregate for survey %s instead of %d", len(data), target, buckets)
+		}
 		aggr.SimpleData = &data
 
+	case protocols.ThresholdAggregationProtocolName:
+		pi, err = protocols.NewThresholdAggregationProtocol(tn)
+		if err != nil {
+			return nil, err
+		}
+
+		aggr := pi.(*protocols.ThresholdAggregationProtocol)
+		aggr.Timeout = s.surveyTimeout(protoConf.Timeout)
+		aggr.DataFunc = func() (libunlynx.CipherVector, bool) {
+			surveyAgg, err := s.getSurveyAgg(target)
+			if err != nil {
+				return nil, false
+			}
+			return libunlynx.CipherVector{surveyAgg.Request.AggregateTarget}, true
+		}
+
+	case protocols.BlindingShuffleProtocolName:
+		pi, err = protocols.NewBlindingShuffleProtocol(tn)
+		if err != nil {
+			return nil, err
+		}
+
+		blinding := pi.(*protocols.BlindingShuffleProtocol)
+		blinding.Timeout = s.surveyTimeout(protoConf.Timeout)
+		if tn.IsRoot() {
+			target, ok := s.getSuppressionTarget(protoConf.SurveyID)
+			if !ok {
+				return nil, xerrors.Errorf("no differences to blind for survey %s", protoConf.SurveyID)
+			}
+			dataToBlind := target.data
+			blinding.TargetOfBlinding = &dataToBlind
+			blinding.Payloads = target.payloads
+		}
+
+	case protocols.DKGProtocolName:
+		return s.newDKGProtocol(tn, &protoConf)
+
 	case propagateShuffleFromChildren:
 		pi, err = protocols.NewPropagationProtocol(tn)
 		if err != nil {
@@ -629,41 +1652,118 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance,
 		}
 		prop := pi.(*protocols.Propagate)
 		surveyIDChan := make(chan SurveyID)
+		// onDataToChildren is called before onDataToRoot: the timeout of the survey is known when the data is sent back
+		timeout := s.maxTimeout
 		prop.RegisterOnDataToChildren(func(msg network.Message) error {
 			pc, ok := msg.(*ProtocolConfig)
 			if !ok {
 				return fmt.Errorf("didn't get ProtocolConfig")
 			}
+			timeout = s.surveyTimeout(pc.Timeout)
 			surveyIDChan <- pc.SurveyID
 			return nil
 		})
 		surveyShuffleChan := make(chan SurveyShuffle)
+		cancelledChan := make(chan SurveyID, 1)
 		prop.RegisterOnDataToRoot(func() network.Message {
 			select {
 			case ss := <-surveyShuffleChan:
 				return &ss.Request
-			case <-time.After(libunlynx.TIMEOUT):
+			case surveyID := <-cancelledChan:
+				return &SurveyShuffleRequest{SurveyID: surveyID}
+			case <-time.After(timeout):
 				return fmt.Errorf(s.ServerIdentity().String() + " didn't get the data from the nodes in time.")
 			}
 		})
 		go func() {
 			select {
 			case surveyID := <-surveyIDChan:
+				deadline := time.Now().Add(timeout)
 				for {
 					surveyShuffle, err := s.getSurveyShuffle(surveyID)
-					if err != nil {
+					if s.isCancelled(surveyID) {
+						cancelledChan <- surveyID
+						break
+					} else if err != nil && time.Now().After(deadline) {
+						log.Error(s.ServerIdentity().String() + " didn't get the survey " + string(surveyID) + " in time.")
+						return
+					} else if err != nil {
 						time.Sleep(100 * time.Millisecond)
 					} else {
 						surveyShuffleChan <- surveyShuffle
 						break
 					}
 				}
-			case <-time.After(libunlynx.TIMEOUT):
+			case <-time.After(s.maxTimeout):
 				log.Error(s.ServerIdentity().String() + "didn't get the survey notification in time.")
 				return
 			}
 		}()
 
+	case propagateProofsFromChildren:
+		pi, err = protocols.NewPropagationProtocol(tn)
+		if err != nil {
+			return nil, xerrors.Errorf("couldn't create protocol: %+v", err)
+		}
+		prop := pi.(*protocols.Propagate)
+		// onDataToChildren is called before onDataToRoot: the proofs to send back are known
+		var request *ProofsRequest
+		prop.RegisterOnDataToChildren(func(msg network.Message) error {
+			pr, ok := msg.(*ProofsRequest)
+			if !ok {
+				return xerrors.New("didn't receive ProofsRequest message")
+			}
+			request = pr
+			return nil
+		})
+		prop.RegisterOnDataToRoot(func() network.Message {
+			if request == nil {
+				return &NodeProofs{Node: s.ServerIdentity()}
+			}
+			return &NodeProofs{
+				Node:   s.ServerIdentity(),
+				Proofs: s.waitProofs(request.SurveyID, request.Phases, s.surveyTimeout(request.Timeout)),
+			}
+		})
+
+	case propagateSurveyCancel:
+		pi, err = protocols.NewPropagationProtocol(tn)
+		if err != nil {
+			return nil, xerrors.Errorf("couldn't create new protocol: %+v", err)
+		}
+		prop := pi.(*protocols.Propagate)
+		resp := SurveyCancelResponse{}
+		prop.RegisterOnDataToChildren(func(msg network.Message) error {
+			scr, ok := msg.(*SurveyCancelRequest)
+			if !ok {
+				return xerrors.New("didn't receive SurveyCancelRequest message")
+			}
+			resp.SurveyID = scr.SurveyID
+			// the root cancels the survey locally once the propagation is done
+			if !tn.IsRoot() && s.cancelSurvey(scr.SurveyID) {
+				resp.NodesRunning = 1
+			}
+			return nil
+		})
+		prop.RegisterOnDataToRoot(func() network.Message {
+			return &resp
+		})
+
+	case propagateRootResults:
+		pi, err = protocols.NewPropagationProtocol(tn)
+		if err != nil {
+			return nil, xerrors.Errorf("couldn't create new protocol: %+v", err)
+		}
+		prop := pi.(*protocols.Propagate)
+		prop.RegisterOnDataToChildren(func(msg network.Message) error {
+			srr, ok := msg.(*SurveyRootResults)
+			if !ok {
+				return xerrors.New("didn't receive SurveyRootResults message")
+			}
+			s.receiveRootResults(srr)
+			return nil
+		})
+
 	case propagateShuffleToChildren:
 		pi, err = protocols.NewPropagationProtocol(tn)
 		if err != nil {
@@ -681,6 +1781,7 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance,
 				return xerrors.Errorf("couldn't get survey: %+v", err)
 			}
 			surveyShuffle.Request.KSTarget = ssr.KSTarget
+			surveyShuffle.Phase = PhaseKeySwitching
 			err = s.putSurveyShuffle(ssr.SurveyID, surveyShuffle)
 			if err != nil {
 				return xerrors.Errorf(
@@ -694,6 +1795,19 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance,
 	default:
 		return nil, fmt.Errorf("Service attempts to start an unknown protocol: " + tn.ProtocolName())
 	}
+
+	// keep track of the instance to be able to shut it down if the survey is cancelled, the nodes taking part in it
+	// audit it once it is done (the root audits the request of the survey)
+	if protoConf.SurveyID != "" {
+		var onDone func()
+		if !tn.IsRoot() {
+			start := time.Now()
+			onDone = func() { s.auditParticipation(tn, protoConf, start) }
+		}
+		if err := s.trackInstance(protoConf.SurveyID, tn, pi, onDone); err != nil {
+			return nil, err
+		}
+	}
 	return pi, nil
 }
 
@@ -701,9 +1815,15 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance,
 func (s *Service) StartProtocol(name, typeQ string, pc ProtocolConfig,
 	roster *onet.Roster) (onet.ProtocolInstance, error) {
 	tree := roster.GenerateNaryTreeWithRoot(2, s.ServerIdentity())
+	if (name == protocols.ThresholdAggregationProtocolName || name == protocols.ThresholdKeySwitchingProtocolName ||
+		name == protocols.CollectiveDecryptionProtocolName) && len(roster.List) > 1 {
+		// every node talks directly to the root
+		tree = roster.GenerateNaryTreeWithRoot(len(roster.List)-1, s.ServerIdentity())
+	}
 	tn := s.NewTreeNodeInstance(tree, tree.Root, name)
 
-	if name == protocolsunlynx.KeySwitchingProtocolName {
+	if name == protocolsunlynx.KeySwitchingProtocolName || name == protocols.MultiKeySwitchingProtocolName ||
+		name == protocols.ThresholdKeySwitchingProtocolName {
 		pc.TypeQ = typeQ
 	}
 
@@ -749,6 +1869,7 @@ func (s *Service) TaggingPhase(targetSurvey *SurveyDDTRequest,
 	if err != nil {
 		return nil, 0, 0, fmt.Errorf("couldn't get protoConfig: %+v", err)
 	}
+	pc.Timeout = targetSurvey.Timeout
 	pi, err := s.StartProtocol(protocolsunlynx.
 		DeterministicTaggingProtocolName, "", pc, roster)
 	if err != nil {
@@ -758,38 +1879,74 @@ func (s *Service) TaggingPhase(targetSurvey *SurveyDDTRequest,
 	case deterministicTaggingResult := <-pi.(*protocolsunlynx.DeterministicTaggingProtocol).FeedbackChannel:
 		execTime := pi.(*protocolsunlynx.DeterministicTaggingProtocol).ExecTime
 		return deterministicTaggingResult, execTime, time.Since(start) - execTime, nil
-	case <-time.After(libunlynx.TIMEOUT):
+	case <-s.cancelChannel(targetSurvey.SurveyID):
+		return nil, 0, 0, surveyCancelledError(targetSurvey.SurveyID)
+	case <-time.After(s.surveyTimeout(targetSurvey.Timeout)):
 		return nil, 0, 0, fmt.Errorf("couldn't finish tagging protocol in time")
 	}
 }
 
 // CollectiveAggregationPhase performs a collective aggregation between the participating nodes
-func (s *Service) CollectiveAggregationPhase(targetSurvey SurveyID, roster *onet.Roster) (libunlynx.CipherText, time.Duration, error) {
+func (s *Service) CollectiveAggregationPhase(targetSurvey SurveyID, roster *onet.Roster, timeout time.Duration) (libunlynx.CipherText, time.Duration, error) {
+	aggregationResult, aggrTime, err := s.HistogramAggregationPhase(targetSurvey, roster, 1, timeout)
+	if err != nil {
+		return libunlynx.CipherText{}, 0, err
+	}
+	return aggregationResult[0], aggrTime, nil
+}
+
+// HistogramAggregationPhase performs a collective aggregation of the buckets values of each participating node,
+// element-wise
+func (s *Service) HistogramAggregationPhase(targetSurvey SurveyID, roster *onet.Roster, buckets int, timeout time.Duration) (libunlynx.CipherVector, time.Duration, error) {
 	start := time.Now()
 	pi, err := s.StartProtocol(protocolsunlynx.CollectiveAggregationProtocolName, "",
-		ProtocolConfig{targetSurvey, "", nil}, roster)
+		ProtocolConfig{SurveyID: targetSurvey, Timeout: timeout, Data: []byte(strconv.Itoa(buckets))}, roster)
 	if err != nil {
-		return libunlynx.CipherText{}, 0, err
+		return nil, 0, err
 	}
 	select {
 	case aggregationResult := <-pi.(*protocolsunlynx.CollectiveAggregationProtocol).FeedbackChannel:
 		// in the resulting map there is only one element
-		var finalResult libunlynx.CipherText
+		var finalResult libunlynx.CipherVector
 		for _, v := range aggregationResult.GroupedData {
-			finalResult = v.AggregatingAttributes[0]
+			finalResult = v.AggregatingAttributes
 			break
 		}
+		if len(finalResult) != buckets {
+			return nil, 0, xerrors.Errorf("%d aggregated values instead of %d", len(finalResult), buckets)
+		}
 		return finalResult, time.Since(start), nil
-	case <-time.After(libunlynx.TIMEOUT):
-		return libunlynx.CipherText{}, 0, fmt.Errorf("couldn't finish collective aggregation protocol in time")
+	case <-s.cancelChannel(targetSurvey):
+		return nil, 0, surveyCancelledError(targetSurvey)
+	case <-time.After(timeout):
+		return nil, 0, fmt.Errorf("couldn't finish collective aggregation protocol in time")
+	}
+}
+
+// ThresholdAggregationPhase aggregates the data of the nodes that send it before the timeout and reports which nodes
+// contributed
+func (s *Service) ThresholdAggregationPhase(targetSurvey SurveyID, roster *onet.Roster, timeout time.Duration) (libunlynx.CipherText, []*network.ServerIdentity, time.Duration, error) {
+	start := time.Now()
+	pi, err := s.StartProtocol(protocols.ThresholdAggregationProtocolName, "",
+		ProtocolConfig{SurveyID: targetSurvey, Timeout: timeout}, roster)
+	if err != nil {
+		return libunlynx.CipherText{}, nil, 0, err
+	}
+	select {
+	case aggregationResult := <-pi.(*protocols.ThresholdAggregationProtocol).FeedbackChannel:
+		return aggregationResult.Aggregate[0], aggregationResult.Contributors, time.Since(start), nil
+	case <-s.cancelChannel(targetSurvey):
+		return libunlynx.CipherText{}, nil, 0, surveyCancelledError(targetSurvey)
+	case <-time.After(2 * timeout): // the protocol reports what it got once the timeout is reached
+		return libunlynx.CipherText{}, nil, 0, fmt.Errorf("couldn't finish threshold aggregation protocol in time")
 	}
 }
 
 // ShufflingPhase performs the shuffling aggregated results from each of the nodes
-func (s *Service) ShufflingPhase(targetSurvey SurveyID, roster *onet.Roster) ([]libunlynx.CipherVector, time.Duration, time.Duration, error) {
+func (s *Service) ShufflingPhase(targetSurvey SurveyID, roster *onet.Roster, timeout time.Duration) ([]libunlynx.CipherVector, time.Duration, time.Duration, error) {
 	start := time.Now()
 	pi, err := s.StartProtocol(protocolsunlynx.ShufflingProtocolName, "",
-		ProtocolConfig{targetSurvey, "", nil}, roster)
+		ProtocolConfig{SurveyID: targetSurvey, Timeout: timeout}, roster)
 	if err != nil {
 		return nil, 0, 0, err
 	}
@@ -797,16 +1954,18 @@ func (s *Service) ShufflingPhase(targetSurvey SurveyID, roster *onet.Roster) ([]
 	case shufflingResult := <-pi.(*protocolsunlynx.ShufflingProtocol).FeedbackChannel:
 		execTime := pi.(*protocolsunlynx.ShufflingProtocol).ExecTime
 		return shufflingResult, execTime, time.Since(start) - execTime, nil
-	case <-time.After(libunlynx.TIMEOUT):
+	case <-s.cancelChannel(targetSurvey):
+		return nil, 0, 0, surveyCancelledError(targetSurvey)
+	case <-time.After(timeout):
 		return nil, 0, 0, fmt.Errorf("couldn't finish shuffling protocol in time")
 	}
 }
 
 // KeySwitchingPhase performs the switch to the querier key on the currently aggregated data.
-func (s *Service) KeySwitchingPhase(targetSurvey SurveyID, typeQ string, roster *onet.Roster) (libunlynx.CipherVector, time.Duration, time.Duration, error) {
+func (s *Service) KeySwitchingPhase(targetSurvey SurveyID, typeQ string, roster *onet.Roster, proofs bool, timeout time.Duration) (libunlynx.CipherVector, time.Duration, time.Duration, error) {
 	start := time.Now()
 	pi, err := s.StartProtocol(protocolsunlynx.KeySwitchingProtocolName, typeQ,
-		ProtocolConfig{targetSurvey, "", nil}, roster)
+		ProtocolConfig{SurveyID: targetSurvey, Timeout: timeout, Proofs: proofs}, roster)
 	if err != nil {
 		return nil, 0, 0, err
 	}
@@ -814,17 +1973,127 @@ func (s *Service) KeySwitchingPhase(targetSurvey SurveyID, typeQ string, roster
 	case keySwitchedAggregatedResponses := <-pi.(*protocolsunlynx.KeySwitchingProtocol).FeedbackChannel:
 		execTime := pi.(*protocolsunlynx.KeySwitchingProtocol).ExecTime
 		return keySwitchedAggregatedResponses, execTime, time.Since(start) - execTime, nil
-	case <-time.After(libunlynx.TIMEOUT):
+	case <-s.cancelChannel(targetSurvey):
+		return nil, 0, 0, surveyCancelledError(targetSurvey)
+	case <-time.After(timeout):
 		return nil, 0, 0, fmt.Errorf("couldn't finish key switching protocol in time")
 	}
 }
 
+// ThresholdKeySwitchingPhase performs the switch to the querier key of the data of a survey encrypted with the
+// collective key keyID, with the first nodes holding a share of it that answer. It also returns these nodes.
+func (s *Service) ThresholdKeySwitchingPhase(targetSurvey SurveyID, typeQ, keyID string, roster *onet.Roster, timeout time.Duration) (libunlynx.CipherVector, []*network.ServerIdentity, time.Duration, time.Duration, error) {
+	start := time.Now()
+	// the nodes find their share with the ID of the key
+	pi, err := s.StartProtocol(protocols.ThresholdKeySwitchingProtocolName, typeQ,
+		ProtocolConfig{SurveyID: targetSurvey, Timeout: timeout, Data: []byte(keyID)}, roster)
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	select {
+	case result := <-pi.(*protocols.ThresholdKeySwitchingProtocol).FeedbackChannel:
+		execTime := pi.(*protocols.ThresholdKeySwitchingProtocol).ExecTime
+		return result.Switched, result.Contributors, execTime, time.Since(start) - execTime, nil
+	case <-s.cancelChannel(targetSurvey):
+		return nil, nil, 0, 0, surveyCancelledError(targetSurvey)
+	case <-time.After(timeout):
+		return nil, nil, 0, 0, fmt.Errorf("couldn't finish threshold key switching protocol in time")
+	}
+}
+
+// MultiKeySwitchingPhase performs the switch of the ciphertexts of the request to their own querier keys, in a single
+// run of the multi key switching protocol. It also returns the time spent by this node on the switches to each key, by
+// string of the key.
+func (s *Service) MultiKeySwitchingPhase(targetSurvey SurveyID, typeQ string, roster *onet.Roster, timeout time.Duration) (libunlynx.CipherVector, map[string]time.Duration, time.Duration, time.Duration, error) {
+	start := time.Now()
+	pi, err := s.StartProtocol(protocols.MultiKeySwitchingProtocolName, typeQ,
+		ProtocolConfig{SurveyID: targetSurvey, Timeout: timeout}, roster)
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	keySwitch := pi.(*protocols.MultiKeySwitchingProtocol)
+	select {
+	case keySwitchedResponses := <-keySwitch.FeedbackChannel:
+		switchTimes := make(map[string]time.Duration, len(*keySwitch.TargetPublicKeys))
+		for i, key := range *keySwitch.TargetPublicKeys {
+			switchTimes[key.String()] = keySwitch.SwitchTimes[i]
+		}
+		return keySwitchedResponses, switchTimes, keySwitch.ExecTime, time.Since(start) - keySwitch.ExecTime, nil
+	case <-s.cancelChannel(targetSurvey):
+		return nil, nil, 0, 0, surveyCancelledError(targetSurvey)
+	case <-time.After(timeout):
+		return nil, nil, 0, 0, fmt.Errorf("couldn't finish multi key switching protocol in time")
+	}
+}
+
 // Support functions
 //______________________________________________________________________________________________________________________
 
+// surveyTimeout bounds the timeout requested for a survey by the maximum allowed on this node (no timeout requested
+// means the maximum)
+func (s *Service) surveyTimeout(requested time.Duration) time.Duration {
+	if requested <= 0 || requested > s.maxTimeout {
+		return s.maxTimeout
+	}
+	return requested
+}
+
+// setTime stores a timer of a survey being processed
+func (s *Service) setTime(tr TimeResults, name string, d time.Duration) {
+	s.trMutex.Lock()
+	defer s.trMutex.Unlock()
+	tr.MapTR[name] = d
+}
+
+// copyTime returns a copy of the timers of a survey being processed
+func (s *Service) copyTime(tr TimeResults) TimeResults {
+	s.trMutex.RLock()
+	defer s.trMutex.RUnlock()
+	mapTR := make(map[string]time.Duration, len(tr.MapTR))
+	for k, v := range tr.MapTR {
+		mapTR[k] = v
+	}
+	return TimeResults{MapTR: mapTR}
+}
+
+// surveyStatus looks for the survey in the maps of the service and reports its progress
+func (s *Service) surveyStatus(sid SurveyID) SurveyStatus {
+	status := SurveyStatus{SurveyID: sid, State: SurveyStateUnknown}
+
+	var surv surveyState
+	var tr TimeResults
+	if surveyKS, err := s.getSurveyKS(sid); err == nil {
+		status.TypeQ, surv, tr = KSRequestName, surveyKS, surveyKS.TR
+	} else if surveyKSBatch, err := s.getSurveyKSBatch(sid); err == nil {
+		status.TypeQ, surv, tr = KSBatchRequestName, surveyKSBatch, surveyKSBatch.TR
+	} else if surveyShuffle, err := s.getSurveyShuffle(sid); err == nil {
+		status.TypeQ, surv, tr = ShuffleRequestName, surveyShuffle, surveyShuffle.TR
+	} else if surveyAgg, err := s.getSurveyAgg(sid); err == nil {
+		status.TypeQ, surv, tr = AggRequestName, surveyAgg, surveyAgg.TR
+	} else if s.isCancelled(sid) {
+		status.State = SurveyStateCancelled
+		return status
+	} else if record, ok := s.interruptedSurveys[sid]; ok {
+		status.State = SurveyStateInterrupted
+		status.TypeQ = record.TypeQ
+		status.Phase = record.Phase
+		return status
+	} else {
+		return status
+	}
+
+	record := surv.record()
+	status.State = SurveyStateRunning
+	status.Phase = record.Phase
+	status.Running = time.Since(record.Start)
+	status.TR = s.copyTime(tr)
+	return status
+}
+
 type secretDDT struct {
 	ServerID string
 	Secret   string
+	Epoch    int // the secrets written before the first rotation are in epoch 0
 }
 
 type privateTOML struct {
@@ -833,31 +2102,31 @@ type privateTOML struct {
 	Address     string
 	Description string
 	Secrets     []secretDDT
+	Encryption  *secretsEncryption // nil if the secrets are stored in plaintext
+	Checksum    string             // checksum of the rest of the file
 }
 
-func createTOMLSecrets(path string, id network.Address, secret kyber.Scalar) (kyber.Scalar, error) {
-	var fileHandle *os.File
-	var err error
-	defer fileHandle.Close()
-
-	fileHandle, err = os.Create(path)
-
-	encoder := toml.NewEncoder(fileHandle)
-
+func createTOMLSecrets(path string, id network.Address, secret kyber.Scalar, key *DDTSecretsKey) (kyber.Scalar, error) {
 	// generate random secret if not provided
 	if secret == nil {
 		secret = libunlynx.SuiTe.Scalar().Pick(random.New())
 	}
-	b, err := secret.MarshalBinary()
+
+	endR := privateTOML{Public: "", Private: "", Address: "", Description: ""}
+	var aead cipher.AEAD
+	if key != nil {
+		var err error
+		if endR.Encryption, aead, err = newSecretsEncryption(key); err != nil {
+			return nil, err
+		}
+	}
+	encoded, err := encodeDDTSecret(aead, id.String(), 0, secret)
 	if err != nil {
 		return nil, err
 	}
+	endR.Secrets = []secretDDT{{ServerID: id.String(), Secret: encoded}}
 
-	aux := make([]secretDDT, 0)
-	aux = append(aux, secretDDT{ServerID: id.String(), Secret: base64.URLEncoding.EncodeToString(b)})
-	endR := privateTOML{Public: "", Private: "", Address: "", Description: "", Secrets: aux}
-
-	err = encoder.Encode(&endR)
+	err = addTOMLSecret(path, endR)
 	if err != nil {
 		return nil, err
 	}
@@ -865,65 +2134,77 @@ func createTOMLSecrets(path string, id network.Address, secret kyber.Scalar) (ky
 	return secret, nil
 }
 
-func addTOMLSecret(path string, content privateTOML) error {
-	var fileHandle *os.File
-	defer fileHandle.Close()
-
-	fileHandle, err := os.Create(path)
-
-	encoder := toml.NewEncoder(fileHandle)
+// CheckDDTSecrets checks for the existence of the DDT secrets on the private_*.toml (we need to ensure that we use the same secrets always)
+func CheckDDTSecrets(path string, id network.Address, secret kyber.Scalar) (kyber.Scalar, error) {
+	return CheckDDTSecretsEpoch(path, id, 0, secret)
+}
 
-	err = encoder.Encode(&content)
+// CheckDDTSecretsEpoch is CheckDDTSecrets for the secrets of an epoch. Only the secrets of epoch 0 are created if they
+// are missing, the ones of the other epochs are added by RotateDDTSecrets. The secrets are encrypted with the key
+// configured by the environment, if any (see DDTSecretsKeyFromEnv). The key derived from the private key of the node
+// isn't supported, CheckDDTSecretsWithKey has to be used with it.
+func CheckDDTSecretsEpoch(path string, id network.Address, epoch int, secret kyber.Scalar) (kyber.Scalar, error) {
+	if os.Getenv(DDTSecretsEncryptionEnv) == DDTSecretsKeyPrivateKey {
+		return nil, xerrors.Errorf("the DDT secrets key of %s=%s needs the private key of the node: use "+
+			"CheckDDTSecretsWithKey", DDTSecretsEncryptionEnv, DDTSecretsKeyPrivateKey)
+	}
+	key, err := DDTSecretsKeyFromEnv(nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	return nil
+	return CheckDDTSecretsWithKey(path, id, epoch, secret, key)
 }
 
-// CheckDDTSecrets checks for the existence of the DDT secrets on the private_*.toml (we need to ensure that we use the same secrets always)
-func CheckDDTSecrets(path string, id network.Address, secret kyber.Scalar) (kyber.Scalar, error) {
-	var err error
+// CheckDDTSecretsWithKey is CheckDDTSecretsEpoch with the key the secrets are encrypted with (nil if they are not). A
+// new file is encrypted if a key is given; the secrets of an existing plaintext file stay in plaintext until the file
+// is encrypted with EncryptDDTSecretsFile.
+func CheckDDTSecretsWithKey(path string, id network.Address, epoch int, secret kyber.Scalar,
+	key *DDTSecretsKey) (kyber.Scalar, error) {
+	unlock, err := lockDDTSecretsFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
 	if _, err = os.Stat(path); os.IsNotExist(err) {
-		return createTOMLSecrets(path, id, secret)
+		if epoch != 0 {
+			return nil, fmt.Errorf("no DDT secrets file %s for epoch %d", path, epoch)
+		}
+		return createTOMLSecrets(path, id, secret, key)
 	}
 
-	contents := privateTOML{}
-	if _, err := toml.DecodeFile(path, &contents); err != nil {
+	contents, err := readTOMLSecrets(path)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := contents.secretsCipher(key)
+	if err != nil {
 		return nil, err
 	}
+	if aead == nil && key != nil {
+		log.Warn("the DDT secrets of", path, "are not encrypted")
+	}
 
 	for _, el := range contents.Secrets {
-		if el.ServerID == id.String() {
-			secret := libunlynx.SuiTe.Scalar()
-
-			b, err := base64.URLEncoding.DecodeString(el.Secret)
-			if err != nil {
-				return nil, err
-			}
-
-			err = secret.UnmarshalBinary(b)
-			if err != nil {
-				return nil, err
-			}
-
-			return secret, nil
+		if el.ServerID == id.String() && el.Epoch == epoch {
+			return decodeDDTSecret(aead, el)
 		}
 	}
 
 	// no secret for this 'source' server; set to the provided one or generate a random one
+	if epoch != 0 {
+		return nil, fmt.Errorf("no DDT secret of epoch %d for %s", epoch, id.String())
+	}
 	if secret == nil {
 		secret = libunlynx.SuiTe.Scalar().Pick(random.New())
 	}
 
-	b, err := secret.MarshalBinary()
-
+	encoded, err := encodeDDTSecret(aead, id.String(), 0, secret)
 	if err != nil {
 		return nil, err
 	}
 
-	contents.Secrets = append(contents.Secrets, secretDDT{ServerID: id.String(), Secret: base64.URLEncoding.EncodeToString(b)})
+	contents.Secrets = append(contents.Secrets, secretDDT{ServerID: id.String(), Secret: encoded})
 
 	err = addTOMLSecret(path, contents)
 	if err != nil {
@@ -933,6 +2214,56 @@ func CheckDDTSecrets(path string, id network.Address, secret kyber.Scalar) (kybe
 	return secret, nil
 }
 
+// RotateDDTSecrets adds a new epoch to the DDT secrets file, with a secret for each 'source' server (the provided ones
+// or random ones). The secrets of the previous epochs are kept, so that the tags they produced can still be computed
+// until the data is migrated. key is the one the secrets are encrypted with (nil if they are not). It returns the new
+// epoch.
+func RotateDDTSecrets(path string, ids []network.Address, secrets []kyber.Scalar, key *DDTSecretsKey) (int, error) {
+	if len(secrets) > 0 && len(secrets) != len(ids) {
+		return 0, fmt.Errorf("%d secrets provided for %d servers", len(secrets), len(ids))
+	}
+
+	unlock, err := lockDDTSecretsFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	contents, err := readTOMLSecrets(path)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't read the DDT secrets to rotate: %v", err)
+	}
+	aead, err := contents.secretsCipher(key)
+	if err != nil {
+		return 0, err
+	}
+	epoch := 0
+	for _, el := range contents.Secrets {
+		if el.Epoch >= epoch {
+			epoch = el.Epoch + 1
+		}
+	}
+
+	for i, id := range ids {
+		var secret kyber.Scalar
+		if len(secrets) > 0 {
+			secret = secrets[i]
+		} else {
+			secret = libunlynx.SuiTe.Scalar().Pick(random.New())
+		}
+		encoded, err := encodeDDTSecret(aead, id.String(), epoch, secret)
+		if err != nil {
+			return 0, err
+		}
+		contents.Secrets = append(contents.Secrets, secretDDT{ServerID: id.String(), Secret: encoded, Epoch: epoch})
+	}
+
+	if err := addTOMLSecret(path, contents); err != nil {
+		return 0, err
+	}
+	return epoch, nil
+}
+
 func emptySurveyID(id SurveyID) error {
 	if id == "" {
 		return fmt.Errorf("survey id is empty")
@@ -1,16 +1,28 @@
 package servicesmedco_test
 
 import (
+	"bytes"
+	"encoding/base64"
+	"github.com/ldsec/medco-unlynx/protocols"
 	"github.com/ldsec/medco-unlynx/services"
 	"github.com/ldsec/unlynx/lib"
 	"github.com/stretchr/testify/assert"
 	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/kyber/v3/share"
+	"go.dedis.ch/kyber/v3/util/key"
+	"go.dedis.ch/kyber/v3/util/random"
 	"go.dedis.ch/onet/v3"
 	"go.dedis.ch/onet/v3/log"
 	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 )
 
 func getParam(nbServers int) (*onet.Roster, *onet.LocalTest) {
@@ -44,7 +56,23 @@ func getQueryParams(nbQp int, encKey kyber.Point) libunlynx.CipherVector {
 	return listQueryParameters
 }
 
+// inTempDir runs the rest of a test in a new temporary directory, where the nodes write the DDT secrets files of the
+// testing requests and their lock files. The returned function goes back to the previous directory and removes it.
+func inTempDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "ddtsecrets")
+	assert.NoError(t, err)
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+	return func() {
+		assert.NoError(t, os.Chdir(wd))
+		os.RemoveAll(dir)
+	}
+}
+
 func TestServiceDDT(t *testing.T) {
+	defer inTempDir(t)()
+
 	// test with 10 servers
 	nbrServers := 3
 	el, local := getParam(nbrServers)
@@ -86,7 +114,8 @@ func TestServiceDDT(t *testing.T) {
 			mutex.Unlock()
 
 			if err != nil {
-				t.Fatal("Client", client.ClientID, " service did not start: ", err)
+				t.Error("Client", client.ClientID, " service did not start: ", err)
+				return
 			}
 			log.Lvl1("Time:", tr.MapTR)
 		}(i, client)
@@ -99,6 +128,112 @@ func TestServiceDDT(t *testing.T) {
 	assert.Equal(t, results["testDDTSurvey_"+clients[0].ClientID], results["testDDTSurvey_"+clients[1].ClientID])
 }
 
+func TestServiceDDTEpochs(t *testing.T) {
+	defer inTempDir(t)()
+
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	clients := getClients(1, el)
+	defer local.CloseAll()
+	qt := getQueryParams(5, el.Aggregate)
+
+	_, tags0, _, err := clients[0].SendSurveyDDTRequestTerms(el, "testDDTEpoch0", qt, false, true)
+	assert.NoError(t, err)
+
+	// new epoch on every node, for every source server
+	ids := make([]network.Address, 0)
+	for _, si := range el.List {
+		ids = append(ids, si.Address)
+	}
+	epoch := 0
+	for _, si := range el.List {
+		epoch, err = servicesmedco.RotateDDTSecrets(servicesmedco.DDTSecretsPath+"_"+si.Address.Host()+":"+
+			si.Address.Port()+".toml", ids, nil, nil)
+		assert.NoError(t, err)
+	}
+
+	clients[0].DDTEpoch = epoch
+	_, tagsNew, _, err := clients[0].SendSurveyDDTRequestTerms(el, "testDDTEpochNew", qt, false, true)
+	assert.NoError(t, err)
+	assert.Equal(t, len(qt), len(tagsNew))
+	assert.NotEqual(t, tags0, tagsNew)
+
+	// the old epoch is still readable
+	clients[0].DDTEpoch = 0
+	_, tagsOld, _, err := clients[0].SendSurveyDDTRequestTerms(el, "testDDTEpochOld", qt, false, true)
+	assert.NoError(t, err)
+	assert.Equal(t, tags0, tagsOld)
+
+	// unknown epoch
+	clients[0].DDTEpoch = epoch + 1
+	_, _, _, err = clients[0].SendSurveyDDTRequestTerms(el, "testDDTEpochUnknown", qt, false, true)
+	assert.Error(t, err)
+
+	// the nodes still tag after the failure
+	clients[0].DDTEpoch = epoch
+	_, tags, _, err := clients[0].SendSurveyDDTRequestTerms(el, "testDDTEpochAgain", qt, false, true)
+	assert.NoError(t, err)
+	assert.Equal(t, tagsNew, tags)
+}
+
+func TestServiceDDTRetag(t *testing.T) {
+	defer inTempDir(t)()
+
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	clients := getClients(1, el)
+	defer local.CloseAll()
+	qt := getQueryParams(7, el.Aggregate)
+
+	ids := make([]network.Address, 0)
+	for _, si := range el.List {
+		ids = append(ids, si.Address)
+	}
+	// the secrets files of epoch 0 are created by a first tagging
+	_, tags0, _, err := clients[0].SendSurveyDDTRequestTerms(el, "testRetagEpoch0", qt, false, true)
+	assert.NoError(t, err)
+	epoch := 0
+	for _, si := range el.List {
+		epoch, err = servicesmedco.RotateDDTSecrets(servicesmedco.DDTSecretsPath+"_"+si.Address.Host()+":"+
+			si.Address.Port()+".toml", ids, nil, nil)
+		assert.NoError(t, err)
+	}
+	clients[0].DDTEpoch = epoch
+	_, tagsNew, _, err := clients[0].SendSurveyDDTRequestTerms(el, "testRetagEpochNew", qt, false, true)
+	assert.NoError(t, err)
+
+	// sanitization tests
+	noop := func(int, []libunlynx.GroupingKey, []libunlynx.GroupingKey) error { return nil }
+	_, err = clients[0].SendSurveyDDTRetagRequest(el, "testRetagSame", qt, epoch, epoch, 3, true, noop)
+	assert.Error(t, err)
+	_, err = clients[0].SendSurveyDDTRetagRequest(el, "testRetagEmpty", nil, 0, epoch, 3, true, noop)
+	assert.Error(t, err)
+	_, err = clients[0].SendSurveyDDTRetagRequest(el, "testRetagUnknown", qt, 0, epoch+1, 3, true, noop)
+	assert.Error(t, err)
+
+	oldTags := make([]libunlynx.GroupingKey, 0)
+	newTags := make([]libunlynx.GroupingKey, 0)
+	offsets := make([]int, 0)
+	tr, err := clients[0].SendSurveyDDTRetagRequest(el, "testRetag", qt, 0, epoch, 3, true,
+		func(offset int, oldChunk, newChunk []libunlynx.GroupingKey) error {
+			offsets = append(offsets, offset)
+			oldTags = append(oldTags, oldChunk...)
+			newTags = append(newTags, newChunk...)
+			return nil
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 3, 6}, offsets)
+	assert.Equal(t, tags0, oldTags)
+	assert.Equal(t, tagsNew, newTags)
+	log.Lvl1("Time:", tr.MapTR)
+
+	// the client stops the re-tagging
+	stopped := xerrors.New("stop")
+	_, err = clients[0].SendSurveyDDTRetagRequest(el, "testRetagStopped", qt, 0, epoch, 3, true,
+		func(int, []libunlynx.GroupingKey, []libunlynx.GroupingKey) error { return stopped })
+	assert.True(t, xerrors.Is(err, stopped))
+}
+
 func TestServiceKS(t *testing.T) {
 	// test with 10 servers
 	nbrServers := 3
@@ -147,7 +282,8 @@ func TestServiceKS(t *testing.T) {
 
 			_, res, tr, err := client.SendSurveyKSRequest(el, servicesmedco.SurveyID("testKSRequest_"+client.ClientID), pubKeys[i], targetData, proofs)
 			if err != nil {
-				t.Fatal("Client", client.ClientID, " service did not start: ", err)
+				t.Error("Client", client.ClientID, " service did not start: ", err)
+				return
 			}
 
 			decRes := make([]int64, 0)
@@ -170,6 +306,92 @@ func TestServiceKS(t *testing.T) {
 	}
 }
 
+func TestServiceKSBatch(t *testing.T) {
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	clients := getClients(1, el)
+	defer local.CloseAll()
+
+	proofs := false
+
+	// one survey per querier, each one with a different number of values
+	nbrSurveys := 4
+	secKeys := make(map[servicesmedco.SurveyID]kyber.Scalar)
+	surveys := make([]servicesmedco.SurveyKSBatchEntry, nbrSurveys)
+	for i := 0; i < nbrSurveys; i++ {
+		_, sK, pK := libunlynx.GenKeys(1)
+		sid := servicesmedco.SurveyID("testKSBatchRequest_" + strconv.Itoa(i))
+		secKeys[sid] = sK[0]
+		surveys[i] = servicesmedco.SurveyKSBatchEntry{SurveyID: sid, ClientPubKey: pK[0], KSTarget: getQueryParams(i+1, el.Aggregate)}
+	}
+	// a survey of the same querier as the first one, its key is only sent once
+	sid := servicesmedco.SurveyID("testKSBatchRequest_" + strconv.Itoa(nbrSurveys))
+	secKeys[sid] = secKeys[surveys[0].SurveyID]
+	surveys = append(surveys, servicesmedco.SurveyKSBatchEntry{SurveyID: sid, ClientPubKey: surveys[0].ClientPubKey,
+		KSTarget: getQueryParams(2, el.Aggregate)})
+	nbrSurveys++
+
+	// sanitization tests
+	// no batch ID
+	_, _, _, _, err := clients[0].SendSurveyKSBatchRequest(el, "", surveys, proofs)
+	assert.Error(t, err)
+	// no surveys
+	_, _, _, _, err = clients[0].SendSurveyKSBatchRequest(el, "testKSBatchRequest", nil, proofs)
+	assert.Error(t, err)
+	// duplicated survey
+	_, _, _, _, err = clients[0].SendSurveyKSBatchRequest(el, "testKSBatchRequest", append(surveys, surveys[0]), proofs)
+	assert.Error(t, err)
+	// no target pubKey
+	noKey := append([]servicesmedco.SurveyKSBatchEntry{}, surveys...)
+	noKey[0].ClientPubKey = nil
+	_, _, _, _, err = clients[0].SendSurveyKSBatchRequest(el, "testKSBatchRequest", noKey, proofs)
+	assert.Error(t, err)
+	// proofs
+	_, _, _, _, err = clients[0].SendSurveyKSBatchRequest(el, "testKSBatchRequest", surveys, true)
+	assert.Error(t, err)
+
+	_, results, trs, batchTR, err := clients[0].SendSurveyKSBatchRequest(el, "testKSBatchRequest", surveys, proofs)
+	assert.NoError(t, err)
+	assert.Equal(t, nbrSurveys, len(results))
+	assert.Contains(t, batchTR.MapTR, servicesmedco.KSTimeCommunication)
+
+	// Check result
+	for _, survey := range surveys {
+		res := results[survey.SurveyID]
+		assert.Equal(t, len(survey.KSTarget), len(res))
+		for i, val := range res {
+			assert.Equal(t, int64(i), libunlynx.DecryptInt(secKeys[survey.SurveyID], val))
+		}
+		assert.Contains(t, trs[survey.SurveyID].MapTR, servicesmedco.KSTimeExec)
+		assert.Contains(t, trs[survey.SurveyID].MapTR, servicesmedco.KSBatchTimeSplit)
+		log.Lvl1(survey.SurveyID, "Time:", trs[survey.SurveyID].MapTR)
+	}
+}
+
+func TestServiceKSMultiKeys(t *testing.T) {
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	clients := getClients(1, el)
+	defer local.CloseAll()
+
+	// the querier and an auditor
+	_, secKeys, pubKeys := libunlynx.GenKeys(2)
+	targetData := getQueryParams(3, el.Aggregate)
+
+	// sanitization tests
+	// no keys
+	_, _, _, err := clients[0].SendSurveyKSRequestMultiKeys(el, "testKSMultiKeysRequest", nil, targetData)
+	assert.Error(t, err)
+
+	_, results, _, err := clients[0].SendSurveyKSRequestMultiKeys(el, "testKSMultiKeysRequest", pubKeys, targetData)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(results))
+	for i, res := range results {
+		assert.True(t, pubKeys[i].Equal(res.ClientPubKey))
+		assert.Equal(t, []int64{0, 1, 2}, libunlynx.DecryptIntVector(secKeys[i], &res.Result))
+	}
+}
+
 func TestServiceAgg(t *testing.T) {
 	// test with 10 servers
 	nbrServers := 3
@@ -217,7 +439,8 @@ func TestServiceAgg(t *testing.T) {
 
 			_, res, tr, err := client.SendSurveyAggRequest(el, "testAggRequest", pubKeys[i], targetData, proofs)
 			if err != nil {
-				t.Fatal("Client", client.ClientID, " service did not start: ", err)
+				t.Error("Client", client.ClientID, " service did not start: ", err)
+				return
 			}
 
 			mutex.Lock()
@@ -234,83 +457,1703 @@ func TestServiceAgg(t *testing.T) {
 	}
 }
 
-func TestServiceShuffle(t *testing.T) {
-	// test with 10 servers
-	nbrServers := 3
+func TestServiceAggThreshold(t *testing.T) {
+	nbrServers := 4
 	el, local := getParam(nbrServers)
-	// test with as many clients as servers
-	nbHosts := nbrServers
-	clients := getClients(nbHosts, el)
+	clients := getClients(nbrServers, el)
 	defer local.CloseAll()
 
-	proofs := false
+	_, secKeys, pubKeys := libunlynx.GenKeys(nbrServers)
+	targetData := *libunlynx.EncryptInt(el.Aggregate, int64(1))
 
-	secKeys := make([]kyber.Scalar, 0)
-	pubKeys := make([]kyber.Point, 0)
-	targetData := make(libunlynx.CipherVector, 0)
-	results := make([]int64, nbHosts)
+	// wrong minimum number of contributors
+	_, _, _, _, err := clients[0].SendSurveyAggRequestThreshold(el, "testAggThresholdRequest", pubKeys[0], targetData, false, nbrServers+1)
+	assert.Error(t, err)
 
-	for i := 0; i < nbHosts; i++ {
-		_, sK, pK := libunlynx.GenKeys(1)
-		secKeys = append(secKeys, sK[0])
-		pubKeys = append(pubKeys, pK[0])
+	// the last node never gets its data
+	wg := libunlynx.StartParallelize(nbrServers - 1)
+	for i := 0; i < nbrServers-1; i++ {
+		clients[i].Timeout = 2 * time.Second
+		go func(i int) {
+			defer wg.Done()
+			_, res, contributors, _, err := clients[i].SendSurveyAggRequestThreshold(el, "testAggThresholdRequest", pubKeys[i], targetData, false, nbrServers-1)
+			if err != nil {
+				t.Error("Client", clients[i].ClientID, " service did not start: ", err)
+				return
+			}
+			assert.Equal(t, int64(nbrServers-1), libunlynx.DecryptInt(secKeys[i], res))
+			assert.Equal(t, nbrServers-1, len(contributors))
+			for _, si := range contributors {
+				assert.NotEqual(t, el.List[nbrServers-1].ID, si.ID)
+			}
+		}(i)
+	}
+	libunlynx.EndParallelize(wg)
 
-		targetData = append(targetData, *libunlynx.EncryptInt(el.Aggregate, int64(i)))
+	// not enough nodes contributed
+	_, _, _, _, err = clients[0].SendSurveyAggRequestThreshold(el, "testAggThresholdRequest2", pubKeys[0], targetData, false, 2)
+	assert.Error(t, err)
+}
+
+func TestServiceAggThresholdKey(t *testing.T) {
+	nbrServers := 4
+	el, local := getParam(nbrServers)
+	clients := getClients(nbrServers, el)
+	defer local.CloseAll()
+
+	// any 3 of the nodes can switch the data encrypted with the key
+	resp, err := clients[0].SendDKGRequest(el, "testAggThresholdKey", 3)
+	assert.NoError(t, err)
+
+	_, secKeys, pubKeys := libunlynx.GenKeys(nbrServers)
+	targetData := *libunlynx.EncryptInt(resp.CollectiveKey, int64(1))
+
+	// no minimum number of contributors, unknown key, noise
+	_, _, _, _, err = clients[0].SendSurveyAggRequestThresholdKey(el, "testAggThresholdKeyRequest", pubKeys[0], targetData, 0, "testAggThresholdKey")
+	assert.Error(t, err)
+	_, _, _, _, err = clients[0].SendSurveyAggRequestThresholdKey(el, "testAggThresholdKeyRequest", pubKeys[0], targetData, 3, "unknownKey")
+	assert.Error(t, err)
+	clients[0].DP = servicesmedco.DPParameters{Epsilon: 1, Sensitivity: 1}
+	_, _, _, _, err = clients[0].SendSurveyAggRequestThresholdKey(el, "testAggThresholdKeyRequest", pubKeys[0], targetData, 3, "testAggThresholdKey")
+	assert.Error(t, err)
+	clients[0].DP = servicesmedco.DPParameters{}
+
+	// the last node is down before the survey starts
+	assert.NoError(t, local.Servers[el.List[nbrServers-1].ID].Close())
+
+	wg := libunlynx.StartParallelize(nbrServers - 1)
+	for i := 0; i < nbrServers-1; i++ {
+		clients[i].Timeout = 2 * time.Second
+		go func(i int) {
+			defer wg.Done()
+			_, res, contributors, _, err := clients[i].SendSurveyAggRequestThresholdKey(el, "testAggThresholdKeyRequest", pubKeys[i], targetData, nbrServers-1, "testAggThresholdKey")
+			if err != nil {
+				t.Error("Client", clients[i].ClientID, " service did not start: ", err)
+				return
+			}
+			assert.Equal(t, int64(nbrServers-1), libunlynx.DecryptInt(secKeys[i], res))
+			assert.Equal(t, nbrServers-1, len(contributors))
+		}(i)
 	}
+	libunlynx.EndParallelize(wg)
+}
 
-	// sanitization tests
-	// no SurveyID
-	_, _, _, err := clients[0].SendSurveyShuffleRequest(el, "", pubKeys[0], &targetData[0], proofs)
+func TestServiceAggNoise(t *testing.T) {
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	clients := getClients(nbrServers, el)
+	defer local.CloseAll()
+
+	_, secKeys, pubKeys := libunlynx.GenKeys(nbrServers)
+	targetData := *libunlynx.EncryptInt(el.Aggregate, int64(1))
+
+	// parameters refused by the nodes
+	clients[0].DP = servicesmedco.DPParameters{Epsilon: -1, Sensitivity: 1}
+	_, _, _, err := clients[0].SendSurveyAggRequest(el, "testAggNoiseRequest", pubKeys[0], targetData, false)
 	assert.Error(t, err)
-	// no Roster
-	emptyRoster := *el
-	emptyRoster.List = nil
-	_, _, _, err = clients[0].SendSurveyShuffleRequest(&emptyRoster, "testShuffleRequest", pubKeys[0], &targetData[0], proofs)
+	clients[0].DP = servicesmedco.DPParameters{Epsilon: 1, Sensitivity: 0.5}
+	_, _, _, err = clients[0].SendSurveyAggRequest(el, "testAggNoiseRequest", pubKeys[0], targetData, false)
 	assert.Error(t, err)
-	// no target pubKey
-	_, _, _, err = clients[0].SendSurveyShuffleRequest(el, "testShuffleRequest", nil, &targetData[0], proofs)
+	// infinite parameters, an epsilon above the default maximum of the nodes
+	for _, dp := range []servicesmedco.DPParameters{{Epsilon: math.Inf(1), Sensitivity: 1},
+		{Epsilon: servicesmedco.DPDefaultMaxEpsilon + 1, Sensitivity: 1}, {Epsilon: 1, Sensitivity: math.Inf(1)}} {
+		clients[0].DP = dp
+		_, _, _, err = clients[0].SendSurveyAggRequest(el, "testAggNoiseRequest", pubKeys[0], targetData, false)
+		assert.Error(t, err)
+	}
+	// a scale too large for the noise lists
+	clients[0].DP = servicesmedco.DPParameters{Epsilon: 1, Sensitivity: 100}
+	_, _, _, err = clients[0].SendSurveyAggRequest(el, "testAggNoiseRequest", pubKeys[0], targetData, false)
 	assert.Error(t, err)
-	// no terms to aggregate
-	_, _, _, err = clients[0].SendSurveyShuffleRequest(el, "testShuffleRequest", pubKeys[0], nil, proofs)
+
+	noisy := make([]int64, nbrServers)
+	wg := libunlynx.StartParallelize(nbrServers)
+	for i, client := range clients {
+		client.DP = servicesmedco.DPParameters{Epsilon: 1, Sensitivity: 1}
+		go func(i int, client *servicesmedco.API) {
+			defer wg.Done()
+			_, res, tr, err := client.SendSurveyAggRequest(el, "testAggNoiseRequest", pubKeys[i], targetData, false)
+			if err != nil {
+				t.Error("Client", client.ClientID, " service did not start: ", err)
+				return
+			}
+			// the noise follows a discrete Laplace distribution of scale 1
+			noisy[i] = libunlynx.DecryptIntWithNeg(secKeys[i], res)
+			assert.True(t, noisy[i] > int64(nbrServers)-30 && noisy[i] < int64(nbrServers)+30, noisy[i])
+			assertRootPhase(t, i, tr, servicesmedco.NoiseTime)
+		}(i, client)
+	}
+	libunlynx.EndParallelize(wg)
+
+	// the noise is drawn once: all the nodes release the same noisy result
+	for i := 1; i < nbrServers; i++ {
+		assert.Equal(t, noisy[0], noisy[i])
+	}
+}
+
+func TestServiceAggSuppression(t *testing.T) {
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	clients := getClients(nbrServers, el)
+	defer local.CloseAll()
+
+	_, secKeys, pubKeys := libunlynx.GenKeys(nbrServers)
+	targetData := *libunlynx.EncryptInt(el.Aggregate, int64(1))
+
+	// threshold refused by the nodes
+	clients[0].SuppressionThreshold = 1001
+	_, _, _, err := clients[0].SendSurveyAggRequest(el, "testAggSuppressionRequest", pubKeys[0], targetData, false)
 	assert.Error(t, err)
 
-	wg := libunlynx.StartParallelize(nbHosts)
-	var mutex = sync.Mutex{}
+	// the aggregated result is 3
+	for _, tc := range []struct {
+		threshold int64
+		replace   bool
+		expected  int64
+	}{
+		{threshold: 3, replace: false, expected: 3},
+		{threshold: 4, replace: false, expected: 0},
+		{threshold: 5, replace: true, expected: 5},
+	} {
+		surveyID := servicesmedco.SurveyID("testAggSuppressionRequest" + strconv.FormatInt(tc.threshold, 10))
+		wg := libunlynx.StartParallelize(nbrServers)
+		for i, client := range clients {
+			client.SuppressionThreshold = tc.threshold
+			client.SuppressionReplaceByThreshold = tc.replace
+			go func(i int, client *servicesmedco.API) {
+				defer wg.Done()
+				_, res, tr, err := client.SendSurveyAggRequest(el, surveyID, pubKeys[i], targetData, false)
+				if err != nil {
+					t.Error("Client", client.ClientID, " service did not start: ", err)
+					return
+				}
+				assert.Equal(t, tc.expected, libunlynx.DecryptInt(secKeys[i], res))
+				assertRootPhase(t, i, tr, servicesmedco.SuppressionTime)
+			}(i, client)
+		}
+		libunlynx.EndParallelize(wg)
+	}
+}
+
+// assertRootPhase checks that only the root of the roster (the node of the first client) ran a phase, the other nodes
+// waiting for its final results
+func assertRootPhase(t *testing.T, i int, tr servicesmedco.TimeResults, phase string) {
+	if i == 0 {
+		assert.Contains(t, tr.MapTR, phase)
+	} else {
+		assert.NotContains(t, tr.MapTR, phase)
+		assert.Contains(t, tr.MapTR, servicesmedco.RootResultsTime)
+	}
+}
+
+func TestServiceAggSuppressionRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auditlog")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv(servicesmedco.AuditLogPathEnv, dir)
+	defer os.Unsetenv(servicesmedco.AuditLogPathEnv)
+
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	clients := getClients(nbrServers, el)
+	defer local.CloseAll()
+
+	_, _, pubKeys := libunlynx.GenKeys(nbrServers)
+	targetData := *libunlynx.EncryptInt(el.Aggregate, int64(1))
+
+	wg := libunlynx.StartParallelize(nbrServers)
 	for i, client := range clients {
+		client.SuppressionThreshold = 4
 		go func(i int, client *servicesmedco.API) {
 			defer wg.Done()
+			if _, _, _, err := client.SendSurveyAggRequest(el, "testAggSuppressionRootRequest", pubKeys[i], targetData, false); err != nil {
+				t.Error("Client", client.ClientID, " service did not start: ", err)
+			}
+		}(i, client)
+	}
+	libunlynx.EndParallelize(wg)
 
-			var err error
-			_, res, tr, err := client.SendSurveyShuffleRequest(el,
-				servicesmedco.SurveyID("testShuffleRequest"), pubKeys[i], &targetData[i], proofs)
+	readAuditLog := func(si *network.ServerIdentity) []servicesmedco.AuditRecord {
+		f, err := os.Open(filepath.Join(dir, servicesmedco.AuditLogName+"_"+si.Address.Host()+":"+si.Address.Port()+".log"))
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		records, err := servicesmedco.VerifyAuditLog(f, si.ServicePublic(servicesmedco.Name))
+		assert.NoError(t, err)
+		return records
+	}
+
+	// only the root of the roster runs the blinding shuffle of the differences and learns whether the result is
+	// suppressed, the other nodes only take part in its protocols and get the final result from it
+	for i, si := range el.List {
+		var records []servicesmedco.AuditRecord
+		var request *servicesmedco.AuditRecord
+		var blindings int
+		for attempt := 0; attempt < 10; attempt++ {
+			records, request, blindings = readAuditLog(si), nil, 0
+			for j, record := range records {
+				if record.RequestType == servicesmedco.AggRequestName {
+					request = &records[j]
+				} else if record.RequestType == protocols.BlindingShuffleProtocolName {
+					assert.Equal(t, el.List[0].Address.String(), record.Root)
+					blindings++
+				}
+			}
+			if request != nil && (i == 0 || blindings > 0) {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if !assert.NotNil(t, request) {
+			continue
+		}
+		if i == 0 {
+			assert.Contains(t, request.TR, servicesmedco.SuppressionTime)
+			assert.Equal(t, 0, blindings)
+		} else {
+			assert.NotContains(t, request.TR, servicesmedco.SuppressionTime)
+			assert.Contains(t, request.TR, servicesmedco.RootResultsTime)
+			assert.Equal(t, 1, blindings)
+		}
+	}
+}
+
+func TestServiceAggHistogram(t *testing.T) {
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	clients := getClients(nbrServers, el)
+	defer local.CloseAll()
+
+	_, secKeys, pubKeys := libunlynx.GenKeys(nbrServers)
+
+	// node i has i+1 values in the first bucket, 1 in the second and none in the third
+	wg := libunlynx.StartParallelize(nbrServers)
+	for i, client := range clients {
+		go func(i int, client *servicesmedco.API) {
+			defer wg.Done()
+			values := *libunlynx.EncryptIntVector(el.Aggregate, []int64{int64(i + 1), 1, 0})
+			_, res, tr, err := client.SendSurveyAggRequestHistogram(el, "testAggHistogramRequest", pubKeys[i], values, true)
 			if err != nil {
-				t.Fatal("Client", client.ClientID, " service did not start: ", err)
+				t.Error("Client", client.ClientID, " service did not start: ", err)
+				return
 			}
+			assert.Equal(t, []int64{6, 3, 0}, libunlynx.DecryptIntVector(secKeys[i], &res))
+			assert.Contains(t, tr.MapTR, servicesmedco.AggrTime)
+		}(i, client)
+	}
+	libunlynx.EndParallelize(wg)
 
-			mutex.Lock()
-			results[i] = libunlynx.DecryptInt(secKeys[i], res)
-			mutex.Unlock()
-			log.Lvl1(i, "Time:", tr.MapTR)
+	// small-cell suppression of each bucket
+	wg = libunlynx.StartParallelize(nbrServers)
+	for i, client := range clients {
+		client.SuppressionThreshold = 4
+		go func(i int, client *servicesmedco.API) {
+			defer wg.Done()
+			values := *libunlynx.EncryptIntVector(el.Aggregate, []int64{int64(i + 1), 1, 0})
+			_, res, _, err := client.SendSurveyAggRequestHistogram(el, "testAggHistogramSuppressionRequest", pubKeys[i], values, false)
+			if err != nil {
+				t.Error("Client", client.ClientID, " service did not start: ", err)
+				return
+			}
+			assert.Equal(t, []int64{6, 0, 0}, libunlynx.DecryptIntVector(secKeys[i], &res))
 		}(i, client)
 	}
 	libunlynx.EndParallelize(wg)
+}
 
-	// Check result
-	for i := 0; i < nbHosts; i++ {
-		assert.Contains(t, results, int64(i))
+func TestServiceStatistics(t *testing.T) {
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	clients := getClients(nbrServers, el)
+	defer local.CloseAll()
+
+	_, secKeys, pubKeys := libunlynx.GenKeys(nbrServers)
+
+	// values (scaled by 10) of the patients of each node in 2 groups
+	values := [][][]int64{
+		{{15, 30}, {100}},
+		{{20}, {}},
+		{{40, 50, 50}, {}},
+	}
+	localStatistics := func(i int) (libunlynx.CipherVector, libunlynx.CipherVector, libunlynx.CipherVector) {
+		var counts, sums, sumsOfSquares []int64
+		for _, group := range values[i] {
+			var sum, sumOfSquares int64
+			for _, v := range group {
+				sum += v
+				sumOfSquares += v * v
+			}
+			counts = append(counts, int64(len(group)))
+			sums = append(sums, sum)
+			sumsOfSquares = append(sumsOfSquares, sumOfSquares)
+		}
+		return *libunlynx.EncryptIntVector(el.Aggregate, counts), *libunlynx.EncryptIntVector(el.Aggregate, sums),
+			*libunlynx.EncryptIntVector(el.Aggregate, sumsOfSquares)
+	}
+
+	// the groups don't match
+	counts, sums, sumsOfSquares := localStatistics(0)
+	_, _, err := clients[0].SendSurveyStatisticsRequest(el, "testStatisticsWrongRequest", pubKeys[0], counts, sums[:1],
+		sumsOfSquares, 100, false)
+	assert.Error(t, err)
+
+	// the squares of the values don't fit the decryption table
+	_, _, err = clients[0].SendSurveyStatisticsRequest(el, "testStatisticsWrongRequest", pubKeys[0], counts, sums,
+		sumsOfSquares, 1000, false)
+	assert.Error(t, err)
+
+	// the noise lists can't represent the noise of the sums of squares
+	clients[0].DP = servicesmedco.DPParameters{Epsilon: 3, Sensitivity: 1}
+	_, _, err = clients[0].SendSurveyStatisticsRequest(el, "testStatisticsWrongRequest", pubKeys[0], counts, sums,
+		sumsOfSquares, 100, false)
+	assert.Error(t, err)
+	clients[0].DP = servicesmedco.DPParameters{}
+
+	// group 0: 1.5, 3, 2, 4, 5, 5
+	mean, variance := 20.5/6, (81.25-20.5*20.5/6)/5
+	for _, tc := range []struct {
+		threshold int64
+		proofs    bool
+		expected  []servicesmedco.GroupStatistics
+	}{
+		{threshold: 0, proofs: true, expected: []servicesmedco.GroupStatistics{
+			{Count: 6, Mean: mean, Variance: variance}, {Count: 1, Mean: 10, Variance: math.NaN()}}},
+		{threshold: 2, proofs: false, expected: []servicesmedco.GroupStatistics{
+			{Count: 6, Mean: mean, Variance: variance}, {Count: 0, Mean: math.NaN(), Variance: math.NaN()}}},
+	} {
+		surveyID := servicesmedco.SurveyID("testStatisticsRequest" + strconv.FormatInt(tc.threshold, 10))
+		wg := libunlynx.StartParallelize(nbrServers)
+		for i, client := range clients {
+			client.SuppressionThreshold = tc.threshold
+			go func(i int, client *servicesmedco.API) {
+				defer wg.Done()
+				counts, sums, sumsOfSquares := localStatistics(i)
+				_, res, err := client.SendSurveyStatisticsRequest(el, surveyID, pubKeys[i], counts, sums, sumsOfSquares,
+					100, tc.proofs)
+				if err != nil {
+					t.Error("Client", client.ClientID, " service did not start: ", err)
+					return
+				}
+				assert.Contains(t, res.TR.MapTR, servicesmedco.StatisticsRequestTime)
+
+				stats, err := servicesmedco.ComputeStatistics(secKeys[i], res, 10)
+				assert.NoError(t, err)
+				assert.Equal(t, len(tc.expected), len(stats))
+				for g, expected := range tc.expected {
+					assert.Equal(t, expected.Count, stats[g].Count)
+					for _, v := range [][2]float64{{expected.Mean, stats[g].Mean}, {expected.Variance, stats[g].Variance}} {
+						if math.IsNaN(v[0]) {
+							assert.True(t, math.IsNaN(v[1]), v[1])
+						} else {
+							assert.InDelta(t, v[0], v[1], 1e-9)
+						}
+					}
+				}
+			}(i, client)
+		}
+		libunlynx.EndParallelize(wg)
+	}
+
+	// noise on the counts, sums and sums of squares, the values (1 and 2 on each node) are small enough for the noise
+	// lists to represent the noise of the sums of squares
+	wg := libunlynx.StartParallelize(nbrServers)
+	for i, client := range clients {
+		client.SuppressionThreshold = 0
+		client.DP = servicesmedco.DPParameters{Epsilon: 3, Sensitivity: 1}
+		go func(i int, client *servicesmedco.API) {
+			defer wg.Done()
+			_, res, err := client.SendSurveyStatisticsRequest(el, "testStatisticsNoiseRequest", pubKeys[i],
+				libunlynx.CipherVector{*libunlynx.EncryptInt(el.Aggregate, 2)},
+				libunlynx.CipherVector{*libunlynx.EncryptInt(el.Aggregate, 3)},
+				libunlynx.CipherVector{*libunlynx.EncryptInt(el.Aggregate, 5)}, 2, false)
+			if err != nil {
+				t.Error("Client", client.ClientID, " service did not start: ", err)
+				return
+			}
+			assertRootPhase(t, i, res.TR, servicesmedco.NoiseTime)
+			stats, err := servicesmedco.ComputeStatistics(secKeys[i], res, 1)
+			assert.NoError(t, err)
+			assert.True(t, stats[0].Count > -30 && stats[0].Count < 40, stats[0].Count)
+		}(i, client)
 	}
+	libunlynx.EndParallelize(wg)
 }
 
-func TestCheckDDTSecrets(t *testing.T) {
-	addr := network.NewLocalAddress("local://127.0.0.1:2020")
-	_, err := servicesmedco.CheckDDTSecrets("secrets.toml", addr, nil)
-	assert.Nil(t, err, "Error while writing the secrets to the TOML file")
+func TestServiceAggComparison(t *testing.T) {
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	clients := getClients(nbrServers, el)
+	defer local.CloseAll()
 
-	addr = network.NewLocalAddress("local://127.0.0.1:2010")
-	_, err = servicesmedco.CheckDDTSecrets("secrets.toml", addr, nil)
-	assert.Nil(t, err, "Error while writing the secrets to the TOML file")
+	_, secKeys, pubKeys := libunlynx.GenKeys(nbrServers)
+	targetData := *libunlynx.EncryptInt(el.Aggregate, int64(1))
 
-	addr = network.NewLocalAddress("local://127.0.0.1:2000")
-	_, err = servicesmedco.CheckDDTSecrets("secrets.toml", addr, nil)
-	assert.Nil(t, err, "Error while writing the secrets to the TOML file")
+	// threshold refused by the nodes
+	_, _, _, err := clients[0].SendSurveyAggRequestComparison(el, "testAggComparisonRequest", pubKeys[0], targetData, false, 1001)
+	assert.Error(t, err)
+
+	// the aggregated result is 3
+	for _, tc := range []struct {
+		threshold int64
+		expected  int64
+	}{
+		{threshold: 1, expected: 1},
+		{threshold: 3, expected: 1},
+		{threshold: 4, expected: 0},
+	} {
+		surveyID := servicesmedco.SurveyID("testAggComparisonRequest" + strconv.FormatInt(tc.threshold, 10))
+		wg := libunlynx.StartParallelize(nbrServers)
+		for i, client := range clients {
+			go func(i int, client *servicesmedco.API) {
+				defer wg.Done()
+				_, res, tr, err := client.SendSurveyAggRequestComparison(el, surveyID, pubKeys[i], targetData, false, tc.threshold)
+				if err != nil {
+					t.Error("Client", client.ClientID, " service did not start: ", err)
+					return
+				}
+				assert.Equal(t, tc.expected, libunlynx.DecryptInt(secKeys[i], res))
+				assertRootPhase(t, i, tr, servicesmedco.ComparisonTime)
+			}(i, client)
+		}
+		libunlynx.EndParallelize(wg)
+	}
+}
+
+func TestServicePrivacyBudget(t *testing.T) {
+	os.Setenv(servicesmedco.DPBudgetEnv, "1.5")
+	defer os.Unsetenv(servicesmedco.DPBudgetEnv)
+
+	nbrServers := 2
+	el, local := getParam(nbrServers)
+	clients := getClients(nbrServers, el)
+	defer local.CloseAll()
+
+	_, _, pubKeys := libunlynx.GenKeys(1)
+	targetData := *libunlynx.EncryptInt(el.Aggregate, int64(1))
+
+	// without noise the cost of a request can't be accounted for
+	_, _, _, err := clients[0].SendSurveyAggRequest(el, "testBudgetRequest", pubKeys[0], targetData, false)
+	assert.Error(t, err)
+
+	budget, err := clients[0].GetPrivacyBudget(pubKeys[0])
+	assert.NoError(t, err)
+	assert.True(t, budget.Limited)
+	assert.Equal(t, 1.5, budget.Remaining)
+
+	wg := libunlynx.StartParallelize(nbrServers)
+	for _, client := range clients {
+		client.DP = servicesmedco.DPParameters{Epsilon: 1, Sensitivity: 1}
+		go func(client *servicesmedco.API) {
+			defer wg.Done()
+			_, _, _, err := client.SendSurveyAggRequest(el, "testBudgetRequest", pubKeys[0], targetData, false)
+			assert.NoError(t, err)
+		}(client)
+	}
+	libunlynx.EndParallelize(wg)
+
+	for _, client := range clients {
+		budget, err := client.GetPrivacyBudget(pubKeys[0])
+		assert.NoError(t, err)
+		assert.Equal(t, 1.0, budget.Consumed)
+		assert.Equal(t, 0.5, budget.Remaining)
+	}
+
+	// the querier has not enough budget left
+	_, _, _, err = clients[0].SendSurveyAggRequest(el, "testBudgetRequest2", pubKeys[0], targetData, false)
+	assert.Error(t, err)
+	assert.True(t, xerrors.Is(err, servicesmedco.ErrPrivacyBudgetExceeded))
+}
+
+func TestServicePrivacyBudgetEntryNodes(t *testing.T) {
+	os.Setenv(servicesmedco.DPBudgetEnv, "1.5")
+	defer os.Unsetenv(servicesmedco.DPBudgetEnv)
+
+	querier := key.NewKeyPair(libunlynx.SuiTe)
+	querierKey, err := libunlynx.SerializePoint(querier.Public)
+	assert.NoError(t, err)
+	dir, err := ioutil.TempDir("", "authorized_queriers")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queriers.txt")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(querierKey+" alice\n"), 0600))
+	os.Setenv(servicesmedco.AuthorizedQueriersFileEnv, path)
+	defer os.Unsetenv(servicesmedco.AuthorizedQueriersFileEnv)
+
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	defer local.CloseAll()
+	clients := make([]*servicesmedco.API, nbrServers)
+	for i := range clients {
+		clients[i] = servicesmedco.NewMedCoClientWithKeys(el.List[i], "alice", querier)
+		clients[i].DP = servicesmedco.DPParameters{Epsilon: 1, Sensitivity: 1}
+	}
+
+	// the querier sends the survey to all the nodes, with a different target key each time
+	_, secKeys, pubKeys := libunlynx.GenKeys(nbrServers + 1)
+	targetData := *libunlynx.EncryptInt(el.Aggregate, int64(1))
+	noisy := make([]int64, nbrServers)
+	wg := libunlynx.StartParallelize(nbrServers)
+	for i, client := range clients {
+		go func(i int, client *servicesmedco.API) {
+			defer wg.Done()
+			_, res, _, err := client.SendSurveyAggRequest(el, "testBudgetEntryNodes", pubKeys[i], targetData, false)
+			if err != nil {
+				t.Error("Client", client.ClientID, " service did not start: ", err)
+				return
+			}
+			noisy[i] = libunlynx.DecryptIntWithNeg(secKeys[i], res)
+		}(i, client)
+	}
+	libunlynx.EndParallelize(wg)
+
+	// the querier learnt one noisy result, which costs epsilon on each node
+	for i, client := range clients {
+		assert.Equal(t, noisy[0], noisy[i])
+		budget, err := client.GetPrivacyBudget(pubKeys[nbrServers])
+		assert.NoError(t, err)
+		assert.Equal(t, 1.0, budget.Consumed)
+	}
+
+	// the budget is bound to the querier, not to the target key
+	_, _, _, err = clients[1].SendSurveyAggRequest(el, "testBudgetEntryNodes2", pubKeys[nbrServers], targetData, false)
+	assert.True(t, xerrors.Is(err, servicesmedco.ErrPrivacyBudgetExceeded))
+}
+
+func TestPrivacyBudgetLedger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "budget")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ledger, err := servicesmedco.OpenPrivacyBudgetLedger(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, ledger.Spend("querier", 0.5, 1))
+	assert.NoError(t, ledger.Spend("querier", 0.25, 1))
+	assert.NoError(t, ledger.Refund("querier", 0.25))
+	err = ledger.Spend("querier", 0.75, 1)
+	assert.True(t, xerrors.Is(err, servicesmedco.ErrPrivacyBudgetExceeded))
+	assert.NoError(t, ledger.Close())
+
+	// the consumed budgets survive a restart
+	ledger, err = servicesmedco.OpenPrivacyBudgetLedger(dir)
+	assert.NoError(t, err)
+	consumed, err := ledger.Consumed("querier")
+	assert.NoError(t, err)
+	assert.Equal(t, 0.5, consumed)
+	consumed, err = ledger.Consumed("other querier")
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, consumed)
+	assert.NoError(t, ledger.Close())
+}
+
+func TestServiceAuthorization(t *testing.T) {
+	querier := key.NewKeyPair(libunlynx.SuiTe)
+	querierKey, err := libunlynx.SerializePoint(querier.Public)
+	assert.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "authorized_queriers")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queriers.txt")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("# test querier\n"+querierKey+" alice\n"), 0600))
+
+	os.Setenv(servicesmedco.AuthorizedQueriersFileEnv, path)
+	defer os.Unsetenv(servicesmedco.AuthorizedQueriersFileEnv)
+
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	defer local.CloseAll()
+
+	secKey, pubKey := libunlynx.GenKey()
+	targetData := libunlynx.CipherVector{*libunlynx.EncryptInt(el.Aggregate, int64(7))}
+
+	// unknown querier
+	client := servicesmedco.NewMedCoClient(el.List[0], "unknown")
+	_, _, _, err = client.SendSurveyKSRequest(el, "testAuthorizationRequest", pubKey, targetData, false)
+	assert.Error(t, err)
+	assert.True(t, xerrors.Is(err, servicesmedco.ErrUnauthorized))
+	_, err = client.GetSurveyStatus("testAuthorizationRequest")
+	assert.True(t, xerrors.Is(err, servicesmedco.ErrUnauthorized))
+
+	// authorized querier
+	client = servicesmedco.NewMedCoClientWithKeys(el.List[0], "alice", querier)
+	_, res, _, err := client.SendSurveyKSRequest(el, "testAuthorizationRequest", pubKey, targetData, false)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), libunlynx.DecryptInt(secKey, res[0]))
+
+	// a request can't be replayed, nor sent long after it was signed
+	onetClient := onet.NewClient(libunlynx.SuiTe, servicesmedco.Name)
+	defer onetClient.Close()
+	req := &servicesmedco.SurveyStatusRequest{SurveyIDs: []servicesmedco.SurveyID{"testAuthorizationRequest"}}
+	assert.NoError(t, servicesmedco.SignRequest(req, querier.Public, querier.Private))
+	assert.NoError(t, onetClient.SendProtobuf(el.List[0], req, &servicesmedco.SurveyStatusResponse{}))
+	err = onetClient.SendProtobuf(el.List[0], req, &servicesmedco.SurveyStatusResponse{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "replayed request")
+	assert.NoError(t, servicesmedco.SignRequestAt(req, querier.Public, querier.Private,
+		time.Now().Add(-2*servicesmedco.SignatureValidity)))
+	err = onetClient.SendProtobuf(el.List[0], req, &servicesmedco.SurveyStatusResponse{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "expired")
+
+	// the time is signed
+	assert.NoError(t, servicesmedco.SignRequest(req, querier.Public, querier.Private))
+	req.Signature.Time++
+	err = onetClient.SendProtobuf(el.List[0], req, &servicesmedco.SurveyStatusResponse{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "wrong signature")
+}
+
+func TestServiceShuffle(t *testing.T) {
+	// test with 10 servers
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	// test with as many clients as servers
+	nbHosts := nbrServers
+	clients := getClients(nbHosts, el)
+	defer local.CloseAll()
+
+	proofs := false
+
+	secKeys := make([]kyber.Scalar, 0)
+	pubKeys := make([]kyber.Point, 0)
+	targetData := make(libunlynx.CipherVector, 0)
+	results := make([]int64, nbHosts)
+
+	for i := 0; i < nbHosts; i++ {
+		_, sK, pK := libunlynx.GenKeys(1)
+		secKeys = append(secKeys, sK[0])
+		pubKeys = append(pubKeys, pK[0])
+
+		targetData = append(targetData, *libunlynx.EncryptInt(el.Aggregate, int64(i)))
+	}
+
+	// sanitization tests
+	// no SurveyID
+	_, _, _, err := clients[0].SendSurveyShuffleRequest(el, "", pubKeys[0], &targetData[0], proofs)
+	assert.Error(t, err)
+	// no Roster
+	emptyRoster := *el
+	emptyRoster.List = nil
+	_, _, _, err = clients[0].SendSurveyShuffleRequest(&emptyRoster, "testShuffleRequest", pubKeys[0], &targetData[0], proofs)
+	assert.Error(t, err)
+	// no target pubKey
+	_, _, _, err = clients[0].SendSurveyShuffleRequest(el, "testShuffleRequest", nil, &targetData[0], proofs)
+	assert.Error(t, err)
+	// no terms to aggregate
+	_, _, _, err = clients[0].SendSurveyShuffleRequest(el, "testShuffleRequest", pubKeys[0], nil, proofs)
+	assert.Error(t, err)
+
+	wg := libunlynx.StartParallelize(nbHosts)
+	var mutex = sync.Mutex{}
+	for i, client := range clients {
+		go func(i int, client *servicesmedco.API) {
+			defer wg.Done()
+
+			var err error
+			_, res, tr, err := client.SendSurveyShuffleRequest(el,
+				servicesmedco.SurveyID("testShuffleRequest"), pubKeys[i], &targetData[i], proofs)
+			if err != nil {
+				t.Error("Client", client.ClientID, " service did not start: ", err)
+				return
+			}
+
+			mutex.Lock()
+			results[i] = libunlynx.DecryptInt(secKeys[i], res)
+			mutex.Unlock()
+			log.Lvl1(i, "Time:", tr.MapTR)
+		}(i, client)
+	}
+	libunlynx.EndParallelize(wg)
+
+	// Check result
+	for i := 0; i < nbHosts; i++ {
+		assert.Contains(t, results, int64(i))
+	}
+}
+
+func TestServiceProofs(t *testing.T) {
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	clients := getClients(nbrServers, el)
+	defer local.CloseAll()
+
+	secKeys := make([]kyber.Scalar, 0)
+	pubKeys := make([]kyber.Point, 0)
+	summaries := make(map[servicesmedco.SurveyID][]*servicesmedco.ProofsSummary)
+	var mutex = sync.Mutex{}
+	for _, client := range clients {
+		_, sK, pK := libunlynx.GenKeys(1)
+		secKeys = append(secKeys, sK[0])
+		pubKeys = append(pubKeys, pK[0])
+
+		client.FailOnInvalidProofs = true
+		client.OnProofsSummary = func(sid servicesmedco.SurveyID, summary *servicesmedco.ProofsSummary) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			summaries[sid] = append(summaries[sid], summary)
+		}
+	}
+
+	// key switching: one proof by node
+	_, res, _, err := clients[0].SendSurveyKSRequest(el, "testProofsKS", pubKeys[0],
+		libunlynx.CipherVector{*libunlynx.EncryptInt(el.Aggregate, 5)}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), libunlynx.DecryptInt(secKeys[0], res[0]))
+
+	// aggregation and shuffling: an aggregation (or shuffling) and a key switching proof by node
+	wg := libunlynx.StartParallelize(nbrServers)
+	for i, client := range clients {
+		go func(i int, client *servicesmedco.API) {
+			defer wg.Done()
+			_, res, _, err := client.SendSurveyAggRequest(el, "testProofsAgg", pubKeys[i],
+				*libunlynx.EncryptInt(el.Aggregate, 1), true)
+			if assert.NoError(t, err) {
+				assert.Equal(t, int64(nbrServers), libunlynx.DecryptInt(secKeys[i], res))
+			}
+		}(i, client)
+	}
+	libunlynx.EndParallelize(wg)
+
+	wg = libunlynx.StartParallelize(nbrServers)
+	for i, client := range clients {
+		go func(i int, client *servicesmedco.API) {
+			defer wg.Done()
+			_, _, _, err := client.SendSurveyShuffleRequest(el, "testProofsShuffle", pubKeys[i],
+				libunlynx.EncryptInt(el.Aggregate, int64(i)), true)
+			assert.NoError(t, err)
+		}(i, client)
+	}
+	libunlynx.EndParallelize(wg)
+
+	// without proofs, there is no summary
+	_, _, _, err = clients[0].SendSurveyKSRequest(el, "testNoProofsKS", pubKeys[0],
+		libunlynx.CipherVector{*libunlynx.EncryptInt(el.Aggregate, 5)}, false)
+	assert.NoError(t, err)
+
+	expected := map[servicesmedco.SurveyID]int{"testProofsKS": 1, "testProofsAgg": nbrServers, "testProofsShuffle": nbrServers}
+	assert.Len(t, summaries, len(expected))
+	for sid, nbr := range expected {
+		if assert.Len(t, summaries[sid], nbr, sid) {
+			for _, summary := range summaries[sid] {
+				assert.True(t, summary.OK(), sid, summary.Failed, summary.Missing, summary.Unbound)
+				if sid == "testProofsKS" {
+					assert.Equal(t, nbrServers, summary.Verified)
+				} else {
+					assert.Equal(t, 2*nbrServers, summary.Verified)
+				}
+			}
+		}
+	}
+}
+
+func TestServiceProofBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proofbundle")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv(servicesmedco.ProofBundlePathEnv, dir)
+	defer os.Unsetenv(servicesmedco.ProofBundlePathEnv)
+
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	clients := getClients(1, el)
+	defer local.CloseAll()
+
+	_, pubKey := libunlynx.GenKey()
+	targetData := libunlynx.CipherVector{*libunlynx.EncryptInt(el.Aggregate, 1), *libunlynx.EncryptInt(el.Aggregate, 2)}
+	_, _, _, err = clients[0].SendSurveyKSRequest(el, "testProofBundle", pubKey, targetData, true)
+	assert.NoError(t, err)
+
+	files, err := filepath.Glob(filepath.Join(dir, servicesmedco.ProofBundleName+"_testProofBundle_*.json"))
+	assert.NoError(t, err)
+	if !assert.Len(t, files, 1) {
+		return
+	}
+	content, err := ioutil.ReadFile(files[0])
+	assert.NoError(t, err)
+	bundle, err := servicesmedco.ReadProofBundle(bytes.NewReader(content))
+	assert.NoError(t, err)
+	assert.Equal(t, servicesmedco.SurveyID("testProofBundle"), bundle.SurveyID)
+
+	verifications := servicesmedco.VerifyProofBundle(bundle, el)
+	assert.Len(t, verifications, nbrServers)
+	for _, nv := range verifications {
+		assert.True(t, nv.OK(), nv.Address, nv.Failed, nv.Missing)
+		assert.Equal(t, 1, nv.Verified)
+	}
+
+	// the proofs were made on the ciphertexts of the survey, not on other ones
+	unbound, err := servicesmedco.VerifyProofBundleBinding(bundle, el)
+	assert.NoError(t, err)
+	assert.Empty(t, unbound)
+	binding, err := network.Marshal(&servicesmedco.ProofBinding{KSTargets: targetData, KSKey: pubKey,
+		KSResults: libunlynx.CipherVector{*libunlynx.EncryptInt(pubKey, 1), *libunlynx.EncryptInt(pubKey, 2)}})
+	assert.NoError(t, err)
+	bound := bundle.Binding
+	bundle.Binding = binding
+	unbound, err = servicesmedco.VerifyProofBundleBinding(bundle, el)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{servicesmedco.PhaseKeySwitching}, unbound)
+	bundle.Binding = nil
+	_, err = servicesmedco.VerifyProofBundleBinding(bundle, el)
+	assert.Error(t, err)
+	bundle.Binding = bound
+
+	// proof of a node replaced by the one of another node, proof removed
+	bundle.Nodes[1].Proofs = bundle.Nodes[0].Proofs
+	bundle.Nodes[2].Proofs = nil
+	verifications = servicesmedco.VerifyProofBundle(bundle, el)
+	assert.True(t, verifications[0].OK())
+	assert.False(t, verifications[1].OK())
+	assert.False(t, verifications[2].OK())
+	assert.Len(t, verifications[2].Missing, 1)
+}
+
+func TestServiceSurveyStatus(t *testing.T) {
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	clients := getClients(nbrServers, el)
+	defer local.CloseAll()
+
+	// sanitization tests
+	// no survey ID
+	_, err := clients[1].GetSurveyStatus()
+	assert.Error(t, err)
+
+	// unknown survey
+	statuses, err := clients[1].GetSurveyStatus("testStatusUnknown")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(statuses))
+	assert.Equal(t, servicesmedco.SurveyStateUnknown, statuses[0].State)
+
+	// a shuffle request sent to a node that is not the root waits for the root to get the data of all the nodes
+	_, _, pK := libunlynx.GenKeys(1)
+	wg := libunlynx.StartParallelize(nbrServers)
+	for i := nbrServers - 1; i >= 0; i-- {
+		if i == 0 {
+			for j := 0; j < 50; j++ {
+				statuses, err = clients[1].GetSurveyStatus("testStatusShuffle", "testStatusUnknown")
+				assert.NoError(t, err)
+				if statuses[0].State == servicesmedco.SurveyStateRunning {
+					break
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			assert.Equal(t, 2, len(statuses))
+			assert.Equal(t, servicesmedco.SurveyID("testStatusShuffle"), statuses[0].SurveyID)
+			assert.Equal(t, servicesmedco.SurveyStateRunning, statuses[0].State)
+			assert.Equal(t, servicesmedco.ShuffleRequestName, statuses[0].TypeQ)
+			assert.Equal(t, servicesmedco.PhaseShuffling, statuses[0].Phase)
+			assert.NotNil(t, statuses[0].TR.MapTR)
+			assert.Equal(t, servicesmedco.SurveyStateUnknown, statuses[1].State)
+		}
+
+		// the root only starts once the other nodes received their request
+		go func(client *servicesmedco.API) {
+			defer wg.Done()
+			_, _, _, err := client.SendSurveyShuffleRequest(el, "testStatusShuffle", pK[0], libunlynx.EncryptInt(el.Aggregate, 1), false)
+			assert.NoError(t, err)
+		}(clients[i])
+	}
+	libunlynx.EndParallelize(wg)
+
+	// the survey is not known anymore once it is done
+	statuses, err = clients[1].GetSurveyStatus("testStatusShuffle")
+	assert.NoError(t, err)
+	assert.Equal(t, servicesmedco.SurveyStateUnknown, statuses[0].State)
+}
+
+func TestServiceSurveyCancel(t *testing.T) {
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	clients := getClients(nbrServers, el)
+	defer local.CloseAll()
+
+	// sanitization tests
+	// no SurveyID
+	_, err := clients[0].SendSurveyCancelRequest(el, "")
+	assert.Error(t, err)
+	// no Roster
+	emptyRoster := *el
+	emptyRoster.List = nil
+	_, err = clients[0].SendSurveyCancelRequest(&emptyRoster, "testCancelShuffle")
+	assert.Error(t, err)
+
+	// the nodes that are not the root wait for the root, which never gets the request
+	_, _, pK := libunlynx.GenKeys(1)
+	wg := libunlynx.StartParallelize(nbrServers - 1)
+	for i := 1; i < nbrServers; i++ {
+		go func(client *servicesmedco.API) {
+			defer wg.Done()
+			_, _, _, err := client.SendSurveyShuffleRequest(el, "testCancelShuffle", pK[0], libunlynx.EncryptInt(el.Aggregate, 1), false)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), servicesmedco.ErrSurveyCancelled.Error())
+		}(clients[i])
+	}
+	for i := 1; i < nbrServers; i++ {
+		for j := 0; j < 50; j++ {
+			statuses, err := clients[i].GetSurveyStatus("testCancelShuffle")
+			assert.NoError(t, err)
+			if statuses[0].State == servicesmedco.SurveyStateRunning {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	nodesRunning, err := clients[0].SendSurveyCancelRequest(el, "testCancelShuffle")
+	assert.NoError(t, err)
+	assert.Equal(t, nbrServers-1, nodesRunning)
+	libunlynx.EndParallelize(wg)
+
+	for i := 1; i < nbrServers; i++ {
+		statuses, err := clients[i].GetSurveyStatus("testCancelShuffle")
+		assert.NoError(t, err)
+		assert.Equal(t, servicesmedco.SurveyStateCancelled, statuses[0].State)
+	}
+	// the root never knew the survey, it doesn't keep its cancellation
+	statuses, err := clients[0].GetSurveyStatus("testCancelShuffle")
+	assert.NoError(t, err)
+	assert.Equal(t, servicesmedco.SurveyStateUnknown, statuses[0].State)
+
+	// a cancelled survey cannot be restarted on the nodes that ran it
+	_, _, _, err = clients[1].SendSurveyShuffleRequest(el, "testCancelShuffle", pK[0], libunlynx.EncryptInt(el.Aggregate, 1), false)
+	assert.Error(t, err)
+}
+
+func TestServiceSurveyCancelAuthorization(t *testing.T) {
+	alice := key.NewKeyPair(libunlynx.SuiTe)
+	aliceKey, err := libunlynx.SerializePoint(alice.Public)
+	assert.NoError(t, err)
+	bob := key.NewKeyPair(libunlynx.SuiTe)
+	bobKey, err := libunlynx.SerializePoint(bob.Public)
+	assert.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "authorized_queriers")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queriers.txt")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(aliceKey+" alice\n"+bobKey+" bob\n"), 0600))
+
+	os.Setenv(servicesmedco.AuthorizedQueriersFileEnv, path)
+	defer os.Unsetenv(servicesmedco.AuthorizedQueriersFileEnv)
+
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	defer local.CloseAll()
+
+	// bob submits the survey to a node that waits for the root, which never gets the request
+	bobClient := servicesmedco.NewMedCoClientWithKeys(el.List[1], "bob", bob)
+	_, _, pK := libunlynx.GenKeys(1)
+	wg := libunlynx.StartParallelize(1)
+	go func() {
+		defer wg.Done()
+		_, _, _, err := bobClient.SendSurveyShuffleRequest(el, "testCancelAuthorization", pK[0], libunlynx.EncryptInt(el.Aggregate, 1), false)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), servicesmedco.ErrSurveyCancelled.Error())
+	}()
+	for j := 0; j < 50; j++ {
+		statuses, err := bobClient.GetSurveyStatus("testCancelAuthorization")
+		assert.NoError(t, err)
+		if statuses[0].State == servicesmedco.SurveyStateRunning {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// alice can't cancel bob's survey
+	_, err = servicesmedco.NewMedCoClientWithKeys(el.List[1], "alice", alice).SendSurveyCancelRequest(el, "testCancelAuthorization")
+	assert.True(t, xerrors.Is(err, servicesmedco.ErrUnauthorized))
+	// nor can bob through a node the survey wasn't submitted to
+	_, err = servicesmedco.NewMedCoClientWithKeys(el.List[0], "bob", bob).SendSurveyCancelRequest(el, "testCancelAuthorization")
+	assert.Error(t, err)
+	statuses, err := bobClient.GetSurveyStatus("testCancelAuthorization")
+	assert.NoError(t, err)
+	assert.Equal(t, servicesmedco.SurveyStateRunning, statuses[0].State)
+
+	nodesRunning, err := bobClient.SendSurveyCancelRequest(el, "testCancelAuthorization")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, nodesRunning)
+	libunlynx.EndParallelize(wg)
+}
+
+func TestServiceSurveyTimeout(t *testing.T) {
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	clients := getClients(nbrServers, el)
+	defer local.CloseAll()
+
+	// a node that is not the root waits for the root, which never gets the request, only as long as the client asked
+	_, _, pK := libunlynx.GenKeys(1)
+	clients[1].Timeout = 2 * time.Second
+	start := time.Now()
+	_, _, _, err := clients[1].SendSurveyShuffleRequest(el, "testTimeoutShuffle", pK[0], libunlynx.EncryptInt(el.Aggregate, 1), false)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < libunlynx.TIMEOUT)
+
+	statuses, err := clients[1].GetSurveyStatus("testTimeoutShuffle")
+	assert.NoError(t, err)
+	assert.Equal(t, servicesmedco.SurveyStateUnknown, statuses[0].State)
+
+	// a survey with a timeout still goes through
+	for _, client := range clients {
+		client.Timeout = time.Minute
+	}
+	wg := libunlynx.StartParallelize(nbrServers)
+	for i := 0; i < nbrServers; i++ {
+		go func(i int) {
+			defer wg.Done()
+			_, _, _, err := clients[i].SendSurveyAggRequest(el, "testTimeoutAgg", pK[0], *libunlynx.EncryptInt(el.Aggregate, int64(i)), false)
+			assert.NoError(t, err)
+		}(i)
+	}
+	libunlynx.EndParallelize(wg)
+}
+
+func TestSurveyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "surveystore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := servicesmedco.OpenSurveyStore(dir)
+	assert.NoError(t, err)
+	ksMap := store.Map(servicesmedco.KSRequestName)
+	aggMap := store.Map(servicesmedco.AggRequestName)
+
+	_, err = ksMap.Put("testDone", servicesmedco.SurveyKS{SurveyID: "testDone", Phase: servicesmedco.PhaseKeySwitching})
+	assert.NoError(t, err)
+	_, err = aggMap.Put("testInFlight", servicesmedco.SurveyAgg{SurveyID: "testInFlight", Phase: servicesmedco.PhaseAggregation})
+	assert.NoError(t, err)
+	ids := make([]*network.ServerIdentity, 3)
+	for i := range ids {
+		ids[i] = network.NewServerIdentity(key.NewKeyPair(libunlynx.SuiTe).Public, network.NewTCPAddress("127.0.0.1:"+strconv.Itoa(2000+2*i)))
+	}
+	el := onet.NewRoster(ids)
+	_, err = aggMap.Put("testInFlight", servicesmedco.SurveyAgg{SurveyID: "testInFlight", Phase: servicesmedco.PhaseKeySwitching,
+		Request: servicesmedco.SurveyAggRequest{Roster: *el}, Start: time.Now()})
+	assert.NoError(t, err)
+	surv, err := ksMap.Remove("testDone")
+	assert.NoError(t, err)
+	assert.Equal(t, servicesmedco.SurveyID("testDone"), surv.(servicesmedco.SurveyKS).SurveyID)
+	assert.NoError(t, store.Close())
+
+	// simulate a restart: only the survey that was not completed is reported
+	store, err = servicesmedco.OpenSurveyStore(dir)
+	assert.NoError(t, err)
+	records, err := store.Interrupted()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, servicesmedco.SurveyID("testInFlight"), records[0].SurveyID)
+	assert.Equal(t, servicesmedco.AggRequestName, records[0].TypeQ)
+	assert.Equal(t, servicesmedco.PhaseKeySwitching, records[0].Phase)
+	assert.NotNil(t, records[0].Roster)
+	assert.True(t, el.ID.Equal(records[0].Roster.ID))
+	assert.NoError(t, store.Close())
+
+	// the interrupted surveys are still reported after another restart
+	store, err = servicesmedco.OpenSurveyStore(dir)
+	assert.NoError(t, err)
+	records, err = store.Interrupted()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, servicesmedco.SurveyID("testInFlight"), records[0].SurveyID)
+	assert.NoError(t, store.Close())
+}
+
+func TestServiceAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auditlog")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv(servicesmedco.AuditLogPathEnv, dir)
+	defer os.Unsetenv(servicesmedco.AuditLogPathEnv)
+
+	nbrServers := 3
+	el, local := getParam(nbrServers)
+	clients := getClients(1, el)
+	defer local.CloseAll()
+
+	_, pubKey := libunlynx.GenKey()
+	targetData := libunlynx.CipherVector{*libunlynx.EncryptInt(el.Aggregate, int64(1))}
+
+	_, _, _, err = clients[0].SendSurveyKSRequest(el, "testAuditRequest", pubKey, targetData, false)
+	assert.NoError(t, err)
+	_, _, _, err = clients[0].SendSurveyKSRequest(el, "testAuditRequest2", pubKey, nil, false)
+	assert.Error(t, err)
+
+	readAuditLog := func(si *network.ServerIdentity) ([]servicesmedco.AuditRecord, error) {
+		f, err := os.Open(filepath.Join(dir, servicesmedco.AuditLogName+"_"+si.Address.Host()+":"+si.Address.Port()+".log"))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return servicesmedco.VerifyAuditLog(f, si.ServicePublic(servicesmedco.Name))
+	}
+
+	records, err := readAuditLog(el.List[0])
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, servicesmedco.SurveyID("testAuditRequest"), records[0].SurveyID)
+	assert.Equal(t, servicesmedco.KSRequestName, records[0].RequestType)
+	assert.Equal(t, servicesmedco.AuditOutcomeSuccess, records[0].Outcome)
+	assert.Equal(t, nbrServers, len(records[0].Roster))
+	assert.Contains(t, records[0].TR, servicesmedco.KSTimeExec)
+	assert.NotEqual(t, servicesmedco.AuditOutcomeSuccess, records[1].Outcome)
+	assert.Equal(t, records[0].Hash, records[1].PrevHash)
+
+	// the other nodes record that they took part in the key switching (once their protocol instance is done)
+	for _, si := range el.List[1:] {
+		for i := 0; i < 10; i++ {
+			if records, err = readAuditLog(si); err == nil && len(records) > 0 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(records))
+		assert.Equal(t, servicesmedco.SurveyID("testAuditRequest"), records[0].SurveyID)
+		assert.Equal(t, servicesmedco.AuditOutcomeParticipation, records[0].Outcome)
+		assert.Equal(t, el.List[0].Address.String(), records[0].Root)
+		assert.Equal(t, nbrServers, len(records[0].Roster))
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auditlog")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	node := key.NewKeyPair(libunlynx.SuiTe)
+	al, err := servicesmedco.OpenAuditLog(path, node.Private)
+	assert.NoError(t, err)
+	assert.NoError(t, al.Append(servicesmedco.AuditRecord{SurveyID: "test0", Outcome: servicesmedco.AuditOutcomeSuccess}))
+	assert.NoError(t, al.Append(servicesmedco.AuditRecord{SurveyID: "test1", Outcome: servicesmedco.AuditOutcomeSuccess}))
+
+	// the chain goes on after a restart
+	al, err = servicesmedco.OpenAuditLog(path, node.Private)
+	assert.NoError(t, err)
+	assert.NoError(t, al.Append(servicesmedco.AuditRecord{SurveyID: "test2", Outcome: "failed"}))
+
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	records, err := servicesmedco.VerifyAuditLog(bytes.NewReader(content), node.Public)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(records))
+	assert.Equal(t, uint64(2), records[2].Index)
+
+	// modified record
+	tampered := bytes.Replace(content, []byte(`"failed"`), []byte(`"success"`), 1)
+	records, err = servicesmedco.VerifyAuditLog(bytes.NewReader(tampered), node.Public)
+	assert.Error(t, err)
+	assert.Equal(t, 2, len(records))
+
+	// removed record
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	records, err = servicesmedco.VerifyAuditLog(bytes.NewReader(append(lines[0], lines[2]...)), node.Public)
+	assert.Error(t, err)
+	assert.Equal(t, 1, len(records))
+
+	// a node doesn't start with a corrupted audit log
+	assert.NoError(t, ioutil.WriteFile(path, tampered, 0600))
+	_, err = servicesmedco.OpenAuditLog(path, node.Private)
+	assert.Error(t, err)
+
+	// a chain rebuilt without the key of the node isn't accepted, even if it is consistent
+	assert.NoError(t, os.Remove(path))
+	forger := key.NewKeyPair(libunlynx.SuiTe)
+	al, err = servicesmedco.OpenAuditLog(path, forger.Private)
+	assert.NoError(t, err)
+	assert.NoError(t, al.Append(servicesmedco.AuditRecord{SurveyID: "test0", Outcome: servicesmedco.AuditOutcomeSuccess}))
+	forged, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	records, err = servicesmedco.VerifyAuditLog(bytes.NewReader(forged), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(records))
+	records, err = servicesmedco.VerifyAuditLog(bytes.NewReader(forged), node.Public)
+	assert.Error(t, err)
+	assert.Empty(t, records)
+	_, err = servicesmedco.OpenAuditLog(path, node.Private)
+	assert.Error(t, err)
+}
+
+func TestCheckDDTSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddtsecrets")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secrets.toml")
+
+	addr := network.NewLocalAddress("local://127.0.0.1:2020")
+	_, err = servicesmedco.CheckDDTSecrets(path, addr, nil)
+	assert.Nil(t, err, "Error while writing the secrets to the TOML file")
+
+	addr = network.NewLocalAddress("local://127.0.0.1:2010")
+	_, err = servicesmedco.CheckDDTSecrets(path, addr, nil)
+	assert.Nil(t, err, "Error while writing the secrets to the TOML file")
+
+	addr = network.NewLocalAddress("local://127.0.0.1:2000")
+	_, err = servicesmedco.CheckDDTSecrets(path, addr, nil)
+	assert.Nil(t, err, "Error while writing the secrets to the TOML file")
+}
+
+func TestRotateDDTSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddtsecrets")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secrets.toml")
+	addrs := []network.Address{network.NewLocalAddress("local://127.0.0.1:2000"),
+		network.NewLocalAddress("local://127.0.0.1:2010")}
+
+	// nothing to rotate
+	_, err = servicesmedco.RotateDDTSecrets(path, addrs, nil, nil)
+	assert.Error(t, err)
+
+	secret0, err := servicesmedco.CheckDDTSecrets(path, addrs[0], nil)
+	assert.NoError(t, err)
+	epoch, err := servicesmedco.RotateDDTSecrets(path, addrs, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, epoch)
+
+	secret1, err := servicesmedco.CheckDDTSecretsEpoch(path, addrs[0], 1, nil)
+	assert.NoError(t, err)
+	assert.False(t, secret0.Equal(secret1))
+	secret, err := servicesmedco.CheckDDTSecretsEpoch(path, addrs[0], 0, nil)
+	assert.NoError(t, err)
+	assert.True(t, secret0.Equal(secret))
+
+	// the secrets of the new epochs are only added by a rotation
+	_, err = servicesmedco.CheckDDTSecretsEpoch(path, addrs[0], 2, nil)
+	assert.Error(t, err)
+
+	provided := []kyber.Scalar{libunlynx.SuiTe.Scalar().SetInt64(1), libunlynx.SuiTe.Scalar().SetInt64(2)}
+	_, err = servicesmedco.RotateDDTSecrets(path, addrs, provided[:1], nil)
+	assert.Error(t, err)
+	epoch, err = servicesmedco.RotateDDTSecrets(path, addrs, provided, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, epoch)
+	secret, err = servicesmedco.CheckDDTSecretsEpoch(path, addrs[1], 2, nil)
+	assert.NoError(t, err)
+	assert.True(t, provided[1].Equal(secret))
+}
+
+func TestEncryptDDTSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddtsecrets")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secrets.toml")
+	addrs := []network.Address{network.NewLocalAddress("local://127.0.0.1:2000"),
+		network.NewLocalAddress("local://127.0.0.1:2010")}
+
+	passphraseKey, err := servicesmedco.NewPassphraseDDTSecretsKey("correct horse battery staple")
+	assert.NoError(t, err)
+	wrongKey, err := servicesmedco.NewPassphraseDDTSecretsKey("wrong passphrase")
+	assert.NoError(t, err)
+	nodeKey, err := servicesmedco.NewPrivateKeyDDTSecretsKey(libunlynx.SuiTe.Scalar().Pick(random.New()))
+	assert.NoError(t, err)
+
+	// migration of a plaintext file
+	secret0, err := servicesmedco.CheckDDTSecretsWithKey(path, addrs[0], 0, nil, nil)
+	assert.NoError(t, err)
+	_, err = servicesmedco.RotateDDTSecrets(path, addrs, nil, nil)
+	assert.NoError(t, err)
+	secret1, err := servicesmedco.CheckDDTSecretsWithKey(path, addrs[1], 1, nil, nil)
+	assert.NoError(t, err)
+
+	assert.NoError(t, servicesmedco.EncryptDDTSecretsFile(path, passphraseKey))
+	assert.Error(t, servicesmedco.EncryptDDTSecretsFile(path, passphraseKey))
+	contents, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	b, err := secret0.MarshalBinary()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(contents), base64.URLEncoding.EncodeToString(b))
+
+	secret, err := servicesmedco.CheckDDTSecretsWithKey(path, addrs[0], 0, nil, passphraseKey)
+	assert.NoError(t, err)
+	assert.True(t, secret0.Equal(secret))
+	secret, err = servicesmedco.CheckDDTSecretsWithKey(path, addrs[1], 1, nil, passphraseKey)
+	assert.NoError(t, err)
+	assert.True(t, secret1.Equal(secret))
+
+	// no passphraseKey, a wrong one or one of the wrong kind
+	_, err = servicesmedco.CheckDDTSecretsWithKey(path, addrs[0], 0, nil, nil)
+	assert.Error(t, err)
+	_, err = servicesmedco.CheckDDTSecretsWithKey(path, addrs[0], 0, nil, wrongKey)
+	assert.Error(t, err)
+	_, err = servicesmedco.CheckDDTSecretsWithKey(path, addrs[0], 0, nil, nodeKey)
+	assert.Error(t, err)
+	_, err = servicesmedco.RotateDDTSecrets(path, addrs, nil, wrongKey)
+	assert.Error(t, err)
+
+	// the secrets added later are encrypted too
+	epoch, err := servicesmedco.RotateDDTSecrets(path, addrs, nil, passphraseKey)
+	assert.NoError(t, err)
+	secret2, err := servicesmedco.CheckDDTSecretsWithKey(path, addrs[0], epoch, nil, passphraseKey)
+	assert.NoError(t, err)
+	assert.False(t, secret0.Equal(secret2))
+
+	// a new file is encrypted with the passphraseKey of the node
+	nodePath := filepath.Join(dir, "node.toml")
+	secret, err = servicesmedco.CheckDDTSecretsWithKey(nodePath, addrs[0], 0, nil, nodeKey)
+	assert.NoError(t, err)
+	same, err := servicesmedco.CheckDDTSecretsWithKey(nodePath, addrs[0], 0, nil, nodeKey)
+	assert.NoError(t, err)
+	assert.True(t, secret.Equal(same))
+	_, err = servicesmedco.CheckDDTSecretsWithKey(nodePath, addrs[0], 0, nil, passphraseKey)
+	assert.Error(t, err)
+
+	// the key of the node can't be configured by the environment without the private key
+	os.Setenv(servicesmedco.DDTSecretsEncryptionEnv, servicesmedco.DDTSecretsKeyPrivateKey)
+	defer os.Unsetenv(servicesmedco.DDTSecretsEncryptionEnv)
+	_, err = servicesmedco.CheckDDTSecrets(nodePath, addrs[0], nil)
+	assert.Error(t, err)
+}
+
+func TestDDTSecretsIntegrity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddtsecrets")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secrets.toml")
+	addr := network.NewLocalAddress("local://127.0.0.1:2000")
+
+	// concurrent writers agree on the secret
+	secrets := make([]kyber.Scalar, 10)
+	wg := sync.WaitGroup{}
+	for i := range secrets {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			secrets[i], err = servicesmedco.CheckDDTSecrets(path, addr, nil)
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	for _, secret := range secrets {
+		assert.True(t, secrets[0].Equal(secret))
+	}
+	files, err := filepath.Glob(filepath.Join(dir, ".secrets.toml.tmp*"))
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	contents, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(contents), "Checksum")
+
+	// a truncated or modified file isn't completed with a new secret
+	for _, corrupted := range [][]byte{
+		contents[:bytes.Index(contents, []byte("[[Secrets]]"))],
+		bytes.Replace(contents, []byte("Epoch = 0"), []byte("Epoch = 1"), 1),
+	} {
+		assert.NoError(t, ioutil.WriteFile(path, corrupted, 0600))
+		_, err = servicesmedco.CheckDDTSecrets(path, addr, nil)
+		assert.Error(t, err)
+		_, err = servicesmedco.RotateDDTSecrets(path, []network.Address{addr}, nil, nil)
+		assert.Error(t, err)
+	}
+
+	// an empty file is completed with a new secret
+	assert.NoError(t, ioutil.WriteFile(path, []byte{}, 0600))
+	secret, err := servicesmedco.CheckDDTSecrets(path, addr, nil)
+	assert.NoError(t, err)
+	assert.False(t, secrets[0].Equal(secret))
+	again, err := servicesmedco.CheckDDTSecrets(path, addr, nil)
+	assert.NoError(t, err)
+	assert.True(t, secret.Equal(again))
+
+	// the files written without checksum are still read
+	legacy := "[[Secrets]]\n  ServerID = \"" + addr.String() + "\"\n  Secret = \"" +
+		secretString(t, secrets[0]) + "\"\n  Epoch = 0\n"
+	assert.NoError(t, ioutil.WriteFile(path, []byte(legacy), 0600))
+	secret, err = servicesmedco.CheckDDTSecrets(path, addr, nil)
+	assert.NoError(t, err)
+	assert.True(t, secrets[0].Equal(secret))
+}
+
+func secretString(t *testing.T, secret kyber.Scalar) string {
+	b, err := secret.MarshalBinary()
+	assert.NoError(t, err)
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+// secretsCommand is a DDT secrets command keeping the secrets in the directory given as first argument
+const secretsCommand = `#!/bin/sh
+dir=$1
+f=$dir/$(printf %s "$3" | tr '/:' '__')_$4
+case $2 in
+get) if [ -f "$f" ]; then cat "$f"; fi ;;
+put) cat > "$f"; echo "$4" > "$dir/epoch" ;;
+epoch) if [ -f "$dir/epoch" ]; then cat "$dir/epoch"; fi ;;
+*) exit 1 ;;
+esac
+`
+
+func TestSecretStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddtsecrets")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	addrs := []network.Address{network.NewLocalAddress("local://127.0.0.1:2000"),
+		network.NewLocalAddress("local://127.0.0.1:2010")}
+	passphraseKey, err := servicesmedco.NewPassphraseDDTSecretsKey("correct horse battery staple")
+	assert.NoError(t, err)
+
+	commandDir := filepath.Join(dir, "command")
+	assert.NoError(t, os.Mkdir(commandDir, 0700))
+	script := filepath.Join(dir, "secrets.sh")
+	assert.NoError(t, ioutil.WriteFile(script, []byte(secretsCommand), 0700))
+
+	leveldbStore, err := servicesmedco.OpenLevelDBSecretStore(filepath.Join(dir, "leveldb"), passphraseKey)
+	assert.NoError(t, err)
+	commandStore, err := servicesmedco.NewCommandSecretStore(script + " " + commandDir)
+	assert.NoError(t, err)
+	_, err = servicesmedco.NewCommandSecretStore("")
+	assert.Error(t, err)
+
+	for name, store := range map[string]servicesmedco.SecretStore{
+		"toml":    servicesmedco.NewTOMLSecretStore(filepath.Join(dir, "secrets.toml"), passphraseKey),
+		"leveldb": leveldbStore,
+		"command": commandStore,
+	} {
+		// nothing to rotate
+		_, err = store.Rotate(addrs, nil)
+		assert.Error(t, err, name)
+
+		secret0, err := store.Secret(addrs[0], 0, nil)
+		assert.NoError(t, err, name)
+		secret, err := store.Secret(addrs[0], 0, nil)
+		assert.NoError(t, err, name)
+		assert.True(t, secret0.Equal(secret), name)
+		provided := libunlynx.SuiTe.Scalar().SetInt64(42)
+		secret, err = store.Secret(addrs[1], 0, provided)
+		assert.NoError(t, err, name)
+		assert.True(t, provided.Equal(secret), name)
+
+		_, err = store.Secret(addrs[0], 1, nil)
+		assert.Error(t, err, name)
+		_, err = store.Rotate(addrs, []kyber.Scalar{provided})
+		assert.Error(t, err, name)
+		epoch, err := store.Rotate(addrs, nil)
+		assert.NoError(t, err, name)
+		assert.Equal(t, 1, epoch, name)
+		secret1, err := store.Secret(addrs[0], 1, nil)
+		assert.NoError(t, err, name)
+		assert.False(t, secret0.Equal(secret1), name)
+		secret, err = store.Secret(addrs[0], 0, nil)
+		assert.NoError(t, err, name)
+		assert.True(t, secret0.Equal(secret), name)
+	}
+
+	// the goleveldb store persists its secrets, encrypted
+	secret0, err := leveldbStore.Secret(addrs[0], 0, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, leveldbStore.Close())
+	wrongKey, err := servicesmedco.NewPassphraseDDTSecretsKey("wrong passphrase")
+	assert.NoError(t, err)
+	_, err = servicesmedco.OpenLevelDBSecretStore(filepath.Join(dir, "leveldb"), wrongKey)
+	assert.Error(t, err)
+	_, err = servicesmedco.OpenLevelDBSecretStore(filepath.Join(dir, "leveldb"), nil)
+	assert.Error(t, err)
+	leveldbStore, err = servicesmedco.OpenLevelDBSecretStore(filepath.Join(dir, "leveldb"), passphraseKey)
+	assert.NoError(t, err)
+	defer leveldbStore.Close()
+	secret, err := leveldbStore.Secret(addrs[0], 0, nil)
+	assert.NoError(t, err)
+	assert.True(t, secret0.Equal(secret))
+
+	// failing command
+	failing, err := servicesmedco.NewCommandSecretStore("false")
+	assert.NoError(t, err)
+	_, err = failing.Secret(addrs[0], 0, nil)
+	assert.Error(t, err)
+}
+
+func TestServiceCloseSecretStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretstore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the goleveldb store of a node is released when it stops
+	os.Setenv(servicesmedco.DDTSecretsStoreEnv, servicesmedco.DDTSecretsStoreLevelDB)
+	defer os.Unsetenv(servicesmedco.DDTSecretsStoreEnv)
+	os.Setenv(servicesmedco.DDTSecretsFilePathEnv, filepath.Join(dir, "node"))
+	defer os.Unsetenv(servicesmedco.DDTSecretsFilePathEnv)
+	_, local := getParam(1)
+	// goleveldb takes up to a second to stop its goroutines once an unused database is closed
+	local.Check = onet.CheckNone
+	_, err = servicesmedco.OpenLevelDBSecretStore(filepath.Join(dir, "node"), nil)
+	assert.Error(t, err)
+	local.CloseAll()
+	nodeStore, err := servicesmedco.OpenLevelDBSecretStore(filepath.Join(dir, "node"), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, nodeStore.Close())
+}
+
+func TestServiceDKG(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dkgshares")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv(servicesmedco.DKGSharesPathEnv, dir)
+	defer os.Unsetenv(servicesmedco.DKGSharesPathEnv)
+
+	nbrServers := 4
+	el, local := getParam(nbrServers)
+	clients := getClients(1, el)
+	defer local.CloseAll()
+
+	_, err = clients[0].SendDKGRequest(el, "testDKG", nbrServers+1)
+	assert.Error(t, err)
+
+	resp, err := clients[0].SendDKGRequest(el, "testDKG", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, resp.Threshold)
+	assert.Equal(t, 3, len(resp.Commits))
+	assert.True(t, resp.CollectiveKey.Equal(resp.Commits[0]))
+
+	// each node wrote its share, any threshold of them give the collective private key
+	var priShares []*share.PriShare
+	for i, si := range el.List {
+		ds, err := servicesmedco.ReadDKGShare(filepath.Join(dir, servicesmedco.DKGShareName+"_testDKG_"+
+			si.Address.Host()+":"+si.Address.Port()+".toml"))
+		assert.NoError(t, err)
+		assert.Equal(t, i, ds.Index)
+		assert.True(t, resp.CollectiveKey.Equal(ds.Public()))
+		priShares = append(priShares, &share.PriShare{I: ds.Index, V: ds.Share})
+	}
+	secret, err := share.RecoverSecret(libunlynx.SuiTe, priShares[1:], resp.Threshold, nbrServers)
+	assert.NoError(t, err)
+	assert.True(t, resp.CollectiveKey.Equal(libunlynx.SuiTe.Point().Mul(secret, nil)))
+
+	// a key is never generated twice
+	_, err = clients[0].SendDKGRequest(el, "testDKG", 0)
+	assert.Error(t, err)
+}
+
+func TestServiceThresholdKS(t *testing.T) {
+	el, local := getParam(4)
+	clients := getClients(1, el)
+	defer local.CloseAll()
+
+	// only the first 3 nodes hold a share of the key
+	resp, err := clients[0].SendDKGRequest(onet.NewRoster(el.List[:3]), "testThresholdKSKey", 2)
+	assert.NoError(t, err)
+
+	secKey, pubKey := libunlynx.GenKey()
+	targetData := *libunlynx.EncryptIntVector(resp.CollectiveKey, []int64{1, 2, 3})
+
+	_, _, _, _, err = clients[0].SendSurveyKSRequestThreshold(el, "testThresholdKS", pubKey, targetData, "testThresholdKSKey", 1)
+	assert.Error(t, err)
+	_, _, _, _, err = clients[0].SendSurveyKSRequestThreshold(el, "testThresholdKS", pubKey, targetData, "unknownKey", 2)
+	assert.Error(t, err)
+
+	_, result, contributors, _, err := clients[0].SendSurveyKSRequestThreshold(el, "testThresholdKS", pubKey, targetData, "testThresholdKSKey", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(contributors))
+	for _, si := range contributors {
+		assert.NotEqual(t, el.List[3].ID, si.ID)
+	}
+	assert.Equal(t, []int64{1, 2, 3}, libunlynx.DecryptIntVector(secKey, &result))
+
+	// all the shares
+	_, result, contributors, _, err = clients[0].SendSurveyKSRequestThreshold(el, "testThresholdKS2", pubKey, targetData, "testThresholdKSKey", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(contributors))
+	assert.Equal(t, []int64{1, 2, 3}, libunlynx.DecryptIntVector(secKey, &result))
+}
+
+func TestServiceThresholdKSOffline(t *testing.T) {
+	el, local := getParam(3)
+	clients := getClients(1, el)
+	defer local.CloseAll()
+
+	// any 2 of the 3 nodes can switch the data encrypted with the key
+	resp, err := clients[0].SendDKGRequest(el, "testThresholdKSOfflineKey", 2)
+	assert.NoError(t, err)
+
+	secKey, pubKey := libunlynx.GenKey()
+	targetData := *libunlynx.EncryptIntVector(resp.CollectiveKey, []int64{1, 2, 3})
+
+	// a node holding a share is down
+	assert.NoError(t, local.Servers[el.List[2].ID].Close())
+
+	clients[0].Timeout = 2 * time.Second
+	_, result, contributors, _, err := clients[0].SendSurveyKSRequestThreshold(el, "testThresholdKSOffline", pubKey, targetData, "testThresholdKSOfflineKey", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(contributors))
+	for _, si := range contributors {
+		assert.NotEqual(t, el.List[2].ID, si.ID)
+	}
+	assert.Equal(t, []int64{1, 2, 3}, libunlynx.DecryptIntVector(secKey, &result))
+
+	// the remaining nodes can't make a quorum of 3
+	_, _, _, _, err = clients[0].SendSurveyKSRequestThreshold(el, "testThresholdKSOffline2", pubKey, targetData, "testThresholdKSOfflineKey", 3)
+	assert.Error(t, err)
+}
+
+func TestServiceCollectiveDecryption(t *testing.T) {
+	el, local := getParam(3)
+	clients := getClients(1, el)
+	_, _, pubKeys := libunlynx.GenKeys(3)
+	targetData := *libunlynx.EncryptIntVector(el.Aggregate, []int64{5, -2, 0})
+
+	// disabled by default
+	_, _, _, err := clients[0].SendSurveyKSRequest(el, "testDecryptRefused", pubKeys[0], targetData, false)
+	assert.NoError(t, err)
+	_, _, _, err = clients[0].SendSurveyDecryptRequest(el, "testDecryptRefused")
+	assert.Error(t, err)
+	_, _, _, err = clients[0].SendSurveyAggRequestDecrypt(el, "testDecryptRefused", *libunlynx.EncryptInt(el.Aggregate, 1))
+	assert.Error(t, err)
+	local.CloseAll()
+
+	os.Setenv(servicesmedco.CollectiveDecryptionEnv, "true")
+	defer os.Unsetenv(servicesmedco.CollectiveDecryptionEnv)
+	el, local = getParam(3)
+	clients = getClients(3, el)
+	defer local.CloseAll()
+	targetData = *libunlynx.EncryptIntVector(el.Aggregate, []int64{5, -2, 0})
+
+	// only the final results of an aggregation survey can be decrypted
+	_, _, _, err = clients[0].SendSurveyDecryptRequest(el, "testDecrypt")
+	assert.Error(t, err)
+	_, _, _, err = clients[0].SendSurveyKSRequest(el, "testDecrypt", pubKeys[0], targetData, false)
+	assert.NoError(t, err)
+	_, _, _, err = clients[0].SendSurveyDecryptRequest(el, "testDecrypt")
+	assert.Error(t, err)
+
+	// decrypted instead of key switched, after the suppression
+	for _, threshold := range []int64{0, 4} {
+		surveyID := servicesmedco.SurveyID("testDecryptAgg" + strconv.FormatInt(threshold, 10))
+		results := make([]int64, len(clients))
+		wg := libunlynx.StartParallelize(len(clients))
+		for i, client := range clients {
+			client.SuppressionThreshold = threshold
+			go func(i int, client *servicesmedco.API) {
+				defer wg.Done()
+				_, result, tr, err := client.SendSurveyAggRequestDecrypt(el, surveyID, *libunlynx.EncryptInt(el.Aggregate, 1))
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Contains(t, tr.MapTR, servicesmedco.DecryptTimeExec)
+				results[i] = result
+			}(i, client)
+		}
+		libunlynx.EndParallelize(wg)
+		if threshold == 0 {
+			assert.Equal(t, []int64{3, 3, 3}, results)
+		} else {
+			assert.Equal(t, []int64{0, 0, 0}, results)
+		}
+	}
+	// the results are the ones released to the querier (here suppressed), on the node the survey was submitted to
+	wg := libunlynx.StartParallelize(len(clients))
+	for i, client := range clients {
+		client.SuppressionThreshold = 4
+		go func(i int, client *servicesmedco.API) {
+			defer wg.Done()
+			_, _, _, err := client.SendSurveyAggRequest(el, "testDecryptSuppressed", pubKeys[i],
+				*libunlynx.EncryptInt(el.Aggregate, 1), false)
+			assert.NoError(t, err)
+		}(i, client)
+	}
+	libunlynx.EndParallelize(wg)
+	_, result, _, err := clients[0].SendSurveyDecryptRequest(el, "testDecryptSuppressed")
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{0}, result)
 }
@@ -0,0 +1,365 @@
+package servicesmedco
+
+import (
+	"math"
+	"time"
+
+	"github.com/ldsec/unlynx/lib"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+func init() {
+	network.RegisterMessages(SurveyStatisticsRequest{}, ResultStatistics{})
+}
+
+// StatisticsRequestName is the type of the statistics requests
+const StatisticsRequestName = "StatisticsRequestName"
+
+// StatisticsRequestTime is the timer of the whole statistics request at the client
+const StatisticsRequestTime = "StatisticsRequestTime"
+
+// SurveyStatisticsRequest is the message used to aggregate, for groups of patients, their count and the sum and sum of
+// squares of one of their values (e.g. a lab value), from which the querier computes the mean and variance of the
+// values. All the nodes have to send the same number of groups.
+type SurveyStatisticsRequest struct {
+	SurveyID     SurveyID
+	Roster       onet.Roster
+	Proofs       bool
+	ClientPubKey kyber.Point   // we need this for the key switching
+	Timeout      time.Duration // how long the nodes wait for each phase of the survey (0 = maximum allowed by the nodes)
+
+	// local results of the node, one value per group. The values of the patients are integers in [0, MaxValue]
+	// (e.g. round(value * scale) for decimal values), MaxValue² can't be above libunlynx.MaxHomomorphicInt.
+	Counts        libunlynx.CipherVector
+	Sums          libunlynx.CipherVector
+	SumsOfSquares libunlynx.CipherVector
+	MaxValue      int64
+
+	// noise added to the aggregated counts, sums and sums of squares, the epsilon is split evenly between them and
+	// the sensitivity of the sums (of squares) is MaxValue (MaxValue²) times the one of the counts
+	DP DPParameters
+
+	// if > 0, the groups with an aggregated count below SuppressionThreshold are replaced by zeros, before the noise
+	// is added (see suppressGroup). The first node of the roster learns which groups are suppressed.
+	SuppressionThreshold int64
+
+	Signed // signature of the request by its querier
+}
+
+// ResultStatistics contains the key switched results of a SurveyStatisticsRequest
+type ResultStatistics struct {
+	Counts        libunlynx.CipherVector
+	Sums          libunlynx.CipherVector
+	SumsOfSquares libunlynx.CipherVector
+	TR            TimeResults
+	Proofs        *ProofsSummary // verification of the proofs of the nodes (if the proofs were requested)
+}
+
+// GroupStatistics are the statistics of the values of a group of patients
+type GroupStatistics struct {
+	Count    int64
+	Mean     float64 // NaN if the count isn't positive
+	Variance float64 // sample variance, NaN if the count is below 2
+}
+
+// HandleSurveyStatisticsRequest handles the reception of the local counts, sums and sums of squares to aggregate
+func (s *Service) HandleSurveyStatisticsRequest(ssr *SurveyStatisticsRequest) (network.Message, error) {
+	start := time.Now()
+	resp, err := s.handleSurveyStatisticsRequest(ssr)
+	s.audit(ssr.SurveyID, StatisticsRequestName, ssr.Signature, []kyber.Point{ssr.ClientPubKey}, ssr.Roster,
+		ssr.Proofs, start, resp, err)
+	return resp, err
+}
+
+func (s *Service) handleSurveyStatisticsRequest(ssr *SurveyStatisticsRequest) (network.Message, error) {
+	if err := s.authorize(ssr); err != nil {
+		return nil, err
+	}
+
+	// sanitize params
+	if err := emptyRoster(ssr.Roster); err != nil {
+		return nil, xerrors.Errorf("%+v", err)
+	}
+	if err := emptySurveyID(ssr.SurveyID); err != nil {
+		return nil, xerrors.Errorf("%+v", err)
+	}
+	groups := len(ssr.Counts)
+	if groups == 0 || len(ssr.Sums) != groups || len(ssr.SumsOfSquares) != groups {
+		return nil, xerrors.Errorf("wrong number of counts (%d), sums (%d) and sums of squares (%d)", groups,
+			len(ssr.Sums), len(ssr.SumsOfSquares))
+	}
+	if ssr.ClientPubKey == nil {
+		return nil, xerrors.Errorf("no target public key")
+	}
+	if err := s.checkStatisticsParameters(ssr); err != nil {
+		return nil, err
+	}
+	if err := s.checkSuppressionThreshold(ssr.SuppressionThreshold); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkInterrupted(ssr.SurveyID); err != nil {
+		return nil, err
+	}
+	if err := s.acquireSurvey(ssr.SurveyID, s.requestQuerier(ssr)); err != nil {
+		return nil, err
+	}
+	defer s.releaseSurvey(ssr.SurveyID)
+
+	// the budget is given back if the survey fails before its result is released
+	if err := s.spendPrivacyBudget(s.budgetAccount(ssr, ssr.ClientPubKey), ssr.DP); err != nil {
+		return nil, err
+	}
+	released := false
+	defer func() {
+		if !released {
+			s.refundPrivacyBudget(s.budgetAccount(ssr, ssr.ClientPubKey), ssr.DP)
+		}
+	}()
+
+	log.Lvl2(s.ServerIdentity().String(), " received a SurveyStatisticsRequest:", ssr.SurveyID)
+
+	timeout := s.surveyTimeout(ssr.Timeout)
+
+	// the counts, sums and sums of squares are aggregated and key switched as one histogram
+	targets := make(libunlynx.CipherVector, 0, 3*groups)
+	targets = append(targets, ssr.Counts...)
+	targets = append(targets, ssr.Sums...)
+	targets = append(targets, ssr.SumsOfSquares...)
+
+	surveyAgg := SurveyAgg{
+		SurveyID: ssr.SurveyID,
+		Request: SurveyAggRequest{
+			SurveyID:         ssr.SurveyID,
+			Roster:           ssr.Roster,
+			Proofs:           ssr.Proofs,
+			ClientPubKey:     ssr.ClientPubKey,
+			Timeout:          ssr.Timeout,
+			AggregateTargets: targets,
+		},
+		TR:    TimeResults{MapTR: make(map[string]time.Duration)},
+		Phase: PhaseAggregation,
+		Start: time.Now(),
+	}
+	err := s.putSurveyAgg(ssr.SurveyID, surveyAgg)
+	if err != nil {
+		s.deleteSurveyAgg(ssr.SurveyID)
+		return nil, xerrors.Errorf("%+v", err)
+	}
+
+	// collectively aggregate the results
+	aggregationResult, aggrTime, err := s.HistogramAggregationPhase(ssr.SurveyID, &ssr.Roster, len(targets), timeout)
+	if err != nil {
+		s.deleteSurveyAgg(ssr.SurveyID)
+		return nil, xerrors.Errorf("aggregation error: %+v", err)
+	}
+	s.setTime(surveyAgg.TR, AggrTime, aggrTime)
+	binding := &ProofBinding{AggregationInputs: targets,
+		AggregationResults: append(libunlynx.CipherVector{}, aggregationResult...)}
+	counts := aggregationResult[:groups]
+	sums := aggregationResult[groups : 2*groups]
+	sumsOfSquares := aggregationResult[2*groups:]
+
+	// the root of the roster alone suppresses the small groups and adds the noise, then sends the final results to the
+	// other nodes: only it learns which groups are suppressed (see thresholdSelect)
+	rosterRoot := s.isRosterRoot(&ssr.Roster)
+	rootPhases := ssr.SuppressionThreshold > 0 || ssr.DP.Enabled()
+
+	// suppress the small groups
+	if ssr.SuppressionThreshold > 0 && rosterRoot {
+		surveyAgg.Phase = PhaseSuppression
+		err = s.putSurveyAgg(ssr.SurveyID, surveyAgg)
+		if err != nil {
+			s.deleteSurveyAgg(ssr.SurveyID)
+			return nil, xerrors.Errorf("%+v", err)
+		}
+
+		var suppressionTime time.Duration
+		for i := range counts {
+			var values libunlynx.CipherVector
+			var groupTime time.Duration
+			counts[i], values, _, groupTime, err = s.suppressGroup(ssr.SurveyID, &ssr.Roster, counts[i],
+				libunlynx.CipherVector{sums[i], sumsOfSquares[i]}, ssr.SuppressionThreshold, timeout)
+			if err != nil {
+				s.deleteSurveyAgg(ssr.SurveyID)
+				return nil, xerrors.Errorf("suppression error: %+v", err)
+			}
+			sums[i], sumsOfSquares[i] = values[0], values[1]
+			suppressionTime += groupTime
+		}
+		s.setTime(surveyAgg.TR, SuppressionTime, suppressionTime)
+	}
+
+	// add the differential privacy noise
+	if ssr.DP.Enabled() && rosterRoot {
+		surveyAgg.Phase = PhaseNoise
+		err = s.putSurveyAgg(ssr.SurveyID, surveyAgg)
+		if err != nil {
+			s.deleteSurveyAgg(ssr.SurveyID)
+			return nil, xerrors.Errorf("%+v", err)
+		}
+
+		noiseStart := time.Now()
+		for i, dp := range statisticsDP(ssr) {
+			noise, _, err := s.NoisePhase(ssr.SurveyID, &ssr.Roster, dp, groups, timeout)
+			if err != nil {
+				s.deleteSurveyAgg(ssr.SurveyID)
+				return nil, xerrors.Errorf("noise error: %+v", err)
+			}
+			part := aggregationResult[i*groups : (i+1)*groups]
+			part.Add(part, noise)
+		}
+		s.setTime(surveyAgg.TR, NoiseTime, time.Since(noiseStart))
+	}
+
+	if rootPhases {
+		if rosterRoot {
+			s.sendRootResults(ssr.SurveyID, &ssr.Roster, aggregationResult, timeout)
+		} else {
+			waitStart := time.Now()
+			aggregationResult, err = s.waitRootResults(ssr.SurveyID, len(aggregationResult), timeout)
+			if err != nil {
+				s.deleteSurveyAgg(ssr.SurveyID)
+				return nil, xerrors.Errorf("root results error: %+v", err)
+			}
+			s.setTime(surveyAgg.TR, RootResultsTime, time.Since(waitStart))
+		}
+	}
+
+	// the final results can be collectively decrypted after the key switching
+	if s.collectiveDecryption {
+		s.putDecryptableResults(ssr.SurveyID, aggregationResult, s.requestQuerier(ssr))
+	}
+
+	surveyAgg.Request.KSTargets = aggregationResult
+	surveyAgg.Phase = PhaseKeySwitching
+
+	err = s.putSurveyAgg(ssr.SurveyID, surveyAgg)
+	if err != nil {
+		s.deleteSurveyAgg(ssr.SurveyID)
+		return nil, xerrors.Errorf("%+v", err)
+	}
+
+	// key switch the results
+	keySwitchingResult, execTime, communicationTime, err := s.KeySwitchingPhase(ssr.SurveyID, AggRequestName,
+		&ssr.Roster, ssr.Proofs, timeout)
+	if err != nil {
+		s.deleteSurveyAgg(ssr.SurveyID)
+		return nil, xerrors.Errorf("key switching error: %+v", err)
+	}
+	released = true
+	s.setTime(surveyAgg.TR, KSTimeExec, execTime)
+	s.setTime(surveyAgg.TR, KSTimeCommunication, communicationTime)
+
+	// collect and verify the proofs of the nodes
+	binding.KSTargets, binding.KSKey, binding.KSResults = aggregationResult, ssr.ClientPubKey, keySwitchingResult
+	proofs, err := s.surveyProofs(ssr.SurveyID, &ssr.Roster, ssr.Proofs, []ProofPhase{
+		{Name: PhaseKeySwitching, Root: s.ServerIdentity().ID},
+		{Name: PhaseAggregation, Root: s.ServerIdentity().ID},
+	}, binding, timeout, surveyAgg.TR)
+	if err != nil {
+		s.deleteSurveyAgg(ssr.SurveyID)
+		return nil, xerrors.Errorf("proofs error: %+v", err)
+	}
+
+	// remove query from map
+	_, err = s.deleteSurveyAgg(ssr.SurveyID)
+	if err != nil {
+		return nil, xerrors.Errorf("%+v", err)
+	}
+
+	return &ResultStatistics{
+		Counts:        keySwitchingResult[:groups],
+		Sums:          keySwitchingResult[groups : 2*groups],
+		SumsOfSquares: keySwitchingResult[2*groups:],
+		TR:            surveyAgg.TR,
+		Proofs:        proofs,
+	}, nil
+}
+
+// statisticsDP returns the differential privacy parameters of the noise of the counts, sums and sums of squares
+func statisticsDP(ssr *SurveyStatisticsRequest) []DPParameters {
+	maxValue := float64(ssr.MaxValue)
+	dps := make([]DPParameters, 0, 3)
+	for _, scale := range []float64{1, maxValue, maxValue * maxValue} {
+		dps = append(dps, DPParameters{Epsilon: ssr.DP.Epsilon / 3, Sensitivity: ssr.DP.Sensitivity * scale})
+	}
+	return dps
+}
+
+// checkStatisticsParameters verifies that the maximum value and the noise of a statistics request can be handled: the
+// square of the maximum value has to be in the range the decryption table supports, and the noise lists have to
+// represent the noise of the sums of squares (whose sensitivity is MaxValue² times the one of the counts).
+func (s *Service) checkStatisticsParameters(ssr *SurveyStatisticsRequest) error {
+	if ssr.MaxValue <= 0 || ssr.MaxValue > libunlynx.MaxHomomorphicInt ||
+		ssr.MaxValue*ssr.MaxValue > libunlynx.MaxHomomorphicInt {
+		return xerrors.Errorf("wrong maximum value: %d", ssr.MaxValue)
+	}
+	if err := s.checkDPParameters(ssr.DP); err != nil {
+		return err
+	}
+	if !ssr.DP.Enabled() {
+		return nil
+	}
+	for _, dp := range statisticsDP(ssr) {
+		if _, err := noiseValues(dp, s.dpPolicy.NoiseListSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ComputeStatistics decrypts with secKey the results of a statistics survey and computes the mean and variance of the
+// values of each group. The values were encoded as round(value * scale). The sums of squares are the first to leave
+// the range the decryption table supports ([-libunlynx.MaxHomomorphicInt, libunlynx.MaxHomomorphicInt]), the scale or
+// the groups have to be small enough for them to fit.
+func ComputeStatistics(secKey kyber.Scalar, res *ResultStatistics, scale float64) ([]GroupStatistics, error) {
+	groups := len(res.Counts)
+	if len(res.Sums) != groups || len(res.SumsOfSquares) != groups {
+		return nil, xerrors.Errorf("wrong number of counts (%d), sums (%d) and sums of squares (%d)", groups,
+			len(res.Sums), len(res.SumsOfSquares))
+	}
+	if scale <= 0 || math.IsNaN(scale) || math.IsInf(scale, 0) {
+		return nil, xerrors.Errorf("wrong scale: %v", scale)
+	}
+
+	decrypt := func(name string, i int, ct libunlynx.CipherText) (int64, error) {
+		m := libunlynx.SuiTe.Point().Sub(ct.C, libunlynx.SuiTe.Point().Mul(secKey, ct.K))
+		v, err := decodeInt(m)
+		if err != nil {
+			return 0, xerrors.Errorf("%s of group %d: %+v", name, i, err)
+		}
+		return v, nil
+	}
+
+	stats := make([]GroupStatistics, groups)
+	for i := range stats {
+		count, err := decrypt("count", i, res.Counts[i])
+		if err != nil {
+			return nil, err
+		}
+		sum, err := decrypt("sum", i, res.Sums[i])
+		if err != nil {
+			return nil, err
+		}
+		sumOfSquares, err := decrypt("sum of squares", i, res.SumsOfSquares[i])
+		if err != nil {
+			return nil, err
+		}
+
+		stats[i] = GroupStatistics{Count: count, Mean: math.NaN(), Variance: math.NaN()}
+		n, s, ss := float64(count), float64(sum)/scale, float64(sumOfSquares)/(scale*scale)
+		if count > 0 {
+			stats[i].Mean = s / n
+		}
+		if count > 1 {
+			// the noise can make it negative
+			stats[i].Variance = math.Max(0, (ss-s*s/n)/(n-1))
+		}
+	}
+	return stats, nil
+}
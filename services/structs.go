@@ -17,11 +17,15 @@ func init() {
 // Name is the registered name for the medco service.
 const Name = "medco"
 
-// DDTSecretsPath filename
+// DDTSecretsPath filename of the DDT secrets of the testing requests, in the working directory of the node (followed by
+// the address of the node and .toml)
 const DDTSecretsPath = "secrets"
 
 // Name of query/request types (important to distinguish which map to use during key switching)
 
+// DDTRequestName the name of this type of query
+const DDTRequestName = "DDTRequestName"
+
 // KSRequestName the name of this type of query
 const KSRequestName = "KSRequestName"
 
@@ -31,6 +35,9 @@ const ShuffleRequestName = "ShuffleRequestName"
 // AggRequestName the name of this type of query
 const AggRequestName = "AggRequestName"
 
+// KSBatchRequestName the name of this type of query
+const KSBatchRequestName = "KSBatchRequestName"
+
 // TimeResults includes all variables that will store the durations (to collect the execution/communication time)
 type TimeResults struct {
 	MapTR map[string]time.Duration
@@ -45,6 +52,7 @@ const (
 	KSTimeExec          = "KSTimeExec"
 	KSTimeCommunication = "KSTimeCommunication"
 	KSRequestTime       = "KSRequestTime"
+	KSBatchTimeSplit    = "KSBatchTimeSplit"
 
 	ShuffleTimeExec          = "ShuffleTimeExec"
 	ShuffleTimeCommunication = "ShuffleTimeCommunication"
@@ -52,6 +60,16 @@ const (
 
 	AggrTime        = "AggrTime"
 	AggrRequestTime = "AggrRequestTime"
+
+	NoiseTime = "NoiseTime"
+
+	SuppressionTime = "SuppressionTime"
+
+	ComparisonTime = "ComparisonTime"
+
+	RootResultsTime = "RootResultsTime" // waiting for the final results of the root of the roster
+
+	ProofsTime = "ProofsTime"
 )
 
 // ResultDDT will contain final results of the DDT of the query terms.
@@ -62,8 +80,70 @@ type ResultDDT struct {
 
 // Result will contain the final results for the other queries
 type Result struct {
-	Result libunlynx.CipherVector
-	TR     TimeResults
+	Result       libunlynx.CipherVector
+	TR           TimeResults
+	Contributors []*network.ServerIdentity // nodes whose data was aggregated or key switched (threshold surveys only)
+	Proofs       *ProofsSummary            // verification of the proofs of the nodes (if the proofs were requested)
+	Recipients   []ResultRecipient         // results switched to each key (key switching to several keys only)
+	Decrypted    []int64                   // results collectively decrypted (decrypted aggregation surveys only)
+}
+
+// ResultRecipient contains the results switched to one of the keys of a key switching request
+type ResultRecipient struct {
+	ClientPubKey kyber.Point
+	Result       libunlynx.CipherVector
+}
+
+// ResultKSBatchEntry contains the key switched results of one of the surveys of a batch, with the time spent by the root
+// on the switches to the key of the survey (KSTimeExec, shared by the surveys with the same key) and on the extraction
+// of its results (KSBatchTimeSplit)
+type ResultKSBatchEntry struct {
+	SurveyID SurveyID
+	Result   libunlynx.CipherVector
+	TR       TimeResults
+}
+
+// ResultKSBatch will contain the final results of a batch of key switching requests, one entry per survey
+type ResultKSBatch struct {
+	Results []ResultKSBatchEntry
+	TR      TimeResults // execution and communication times of the whole batch
+}
+
+// States a survey can be in, as reported by a SurveyStatusRequest
+const (
+	SurveyStateUnknown     = "Unknown"
+	SurveyStateRunning     = "Running"
+	SurveyStateInterrupted = "Interrupted"
+	SurveyStateCancelled   = "Cancelled"
+)
+
+// SurveyStatus describes the progress of a survey on a node
+type SurveyStatus struct {
+	SurveyID SurveyID
+	State    string
+	TypeQ    string        // type of request (i.e., the map the survey lives in)
+	Phase    string        // phase currently running
+	Running  time.Duration // time since the node received the survey
+	TR       TimeResults   // timers already collected
+}
+
+// SurveyStatusResponse will contain the status of the surveys asked for in a SurveyStatusRequest
+type SurveyStatusResponse struct {
+	Statuses []SurveyStatus
+}
+
+// PrivacyBudgetResponse is the answer to a PrivacyBudgetRequest
+type PrivacyBudgetResponse struct {
+	Limited   bool // false if the node doesn't enforce a privacy budget
+	Budget    float64
+	Consumed  float64
+	Remaining float64
+}
+
+// SurveyCancelResponse is the answer to a SurveyCancelRequest
+type SurveyCancelResponse struct {
+	SurveyID     SurveyID
+	NodesRunning int // number of nodes on which the survey was still running
 }
 
 // SurveyID unique ID for each survey.
@@ -75,6 +155,8 @@ type ProtocolConfig struct {
 	SurveyID SurveyID
 	TypeQ    string
 	Data     []byte
+	Timeout  time.Duration // how long the nodes wait for each other during the protocol (0 = maximum of the node)
+	Proofs   bool          // whether the nodes produce proofs during the protocol
 }
 
 // SurveyDDTRequest is the message used trigger the DDT of the query parameters
@@ -83,11 +165,15 @@ type SurveyDDTRequest struct {
 	Roster   onet.Roster
 	Proofs   bool
 	Testing  bool
+	Timeout  time.Duration // how long the nodes wait for each phase of the survey (0 = maximum allowed by the nodes)
+	Epoch    int           // epoch of the DDT secrets the terms are tagged with (0 = the secrets before any rotation)
 
 	Terms libunlynx.CipherVector // query terms
 
 	// message handling
 	MessageSource *network.ServerIdentity
+
+	Signed // signature of the request by its querier
 }
 
 // SurveyKSRequest is the message used trigger the key switching of the results
@@ -95,23 +181,77 @@ type SurveyKSRequest struct {
 	SurveyID     SurveyID
 	Roster       onet.Roster
 	Proofs       bool
+	ClientPubKey kyber.Point   // we need this for the key switching
+	Timeout      time.Duration // how long the nodes wait for each phase of the survey (0 = maximum allowed by the nodes)
+
+	KSTarget libunlynx.CipherVector // target values to key switch
+
+	// if set instead of ClientPubKey, KSTarget is switched to each of these keys in the same run, the nodes receiving
+	// KSTarget and the keys once and switching each value once per key
+	ClientPubKeys []kyber.Point
+
+	// if > 0, KSTarget is encrypted with the collective key DKGKeyID generated by DKG and is switched by the first
+	// Quorum nodes holding a share of it that answer (at least the threshold of the key), instead of all the nodes
+	Quorum   int
+	DKGKeyID string
+
+	Signed // signature of the request by its querier
+}
+
+// SurveyKSBatchEntry is one independent survey to key switch as part of a SurveyKSBatchRequest
+type SurveyKSBatchEntry struct {
+	SurveyID     SurveyID
 	ClientPubKey kyber.Point // we need this for the key switching
 
 	KSTarget libunlynx.CipherVector // target values to key switch
 }
 
+// SurveyKSBatchRequest is the message used trigger the key switching of the results of several surveys in one go
+type SurveyKSBatchRequest struct {
+	SurveyID SurveyID // ID of the batch
+	Roster   onet.Roster
+	Proofs   bool          // not supported by the batches, the requests with proofs are refused
+	Timeout  time.Duration // how long the nodes wait for each phase of the survey (0 = maximum allowed by the nodes)
+
+	Surveys []SurveyKSBatchEntry
+
+	Signed // signature of the request by its querier
+}
+
+// clientPubKeys returns the keys the values are switched to
+func (r *SurveyKSRequest) clientPubKeys() []kyber.Point {
+	if len(r.ClientPubKeys) > 0 {
+		return r.ClientPubKeys
+	}
+	return []kyber.Point{r.ClientPubKey}
+}
+
+// clientPubKeys returns the keys the surveys of the batch are switched to
+func (r *SurveyKSBatchRequest) clientPubKeys() []kyber.Point {
+	keys := make([]kyber.Point, len(r.Surveys))
+	for i, entry := range r.Surveys {
+		keys[i] = entry.ClientPubKey
+	}
+	return keys
+}
+
 // SurveyShuffleRequest is the message used trigger the shuffling and key switching of the final results
 type SurveyShuffleRequest struct {
 	SurveyID     SurveyID
 	Roster       onet.Roster
 	Proofs       bool
-	ClientPubKey kyber.Point // we need this for the key switching
+	ClientPubKey kyber.Point   // we need this for the key switching
+	Timeout      time.Duration // how long the nodes wait for each phase of the survey (0 = maximum allowed by the nodes)
 
 	ShuffleTarget libunlynx.CipherVector // target results to shuffle. the root node adds the results from the other nodes here
 	KSTarget      libunlynx.CipherVector // the final results to be key switched
 
+	DP DPParameters // differential privacy noise added to the shuffled results before the key switching
+
 	// message handling
 	MessageSource *network.ServerIdentity
+
+	Signed // signature of the request by its querier
 }
 
 // SurveyAggRequest is the message used trigger the aggregation of the final results (+ key switching)
@@ -119,10 +259,75 @@ type SurveyAggRequest struct {
 	SurveyID     SurveyID
 	Roster       onet.Roster
 	Proofs       bool
-	ClientPubKey kyber.Point // we need this for the key switching
+	ClientPubKey kyber.Point   // we need this for the key switching
+	Timeout      time.Duration // how long the nodes wait for each phase of the survey (0 = maximum allowed by the nodes)
 
 	AggregateTarget libunlynx.CipherText // target results to aggregate. the root node adds the results from the other nodes here
 	KSTarget        libunlynx.CipherText // the final aggregated result to be key switched
+
+	// if not empty, the histogram aggregated element-wise instead of AggregateTarget, the suppression, comparison and
+	// noise then apply to each bucket. All the nodes have to send the same number of buckets.
+	AggregateTargets libunlynx.CipherVector
+	KSTargets        libunlynx.CipherVector // the final aggregated histogram to be key switched
+
+	// if > 0, the nodes whose data doesn't arrive in time are left out of the aggregation, as long as at least
+	// MinContributors nodes (this one included) contributed. The key switching of the result still needs all the nodes,
+	// unless AggregateTarget is encrypted with the collective key DKGKeyID generated by DKG: the result is then switched
+	// by the first nodes holding a share of it that answer (as many as the threshold of the key), so that nodes that are
+	// down don't block the survey (noise, suppression, comparison and proofs, which need all the nodes, are refused).
+	MinContributors int
+	DKGKeyID        string
+
+	DP DPParameters // differential privacy noise added to the aggregated result before the key switching
+
+	// if > 0, an aggregated result below SuppressionThreshold is replaced by an encryption of 0 (or of the threshold if
+	// SuppressionReplaceByThreshold), before the noise is added. The result is supposed to be a count (not negative).
+	// The replacement is done in the encrypted domain by the first node of the roster, which learns whether the result
+	// is below the threshold (the other nodes and the querier don't); the requester accepts this leak.
+	SuppressionThreshold          int64
+	SuppressionReplaceByThreshold bool
+
+	// if > 0, only an encryption of 1 if the aggregated result is at least ComparisonThreshold (0 otherwise) is key
+	// switched, instead of the result. It can't be combined with a suppression or noise. As for the suppression, the
+	// first node of the roster learns the bit.
+	ComparisonThreshold int64
+
+	// if set, the final results (after the noise and suppression) are collectively decrypted instead of key switched,
+	// without ClientPubKey: all the nodes have to take part in collective decryptions (see CollectiveDecryptionEnv).
+	// It can't be combined with proofs or a minimum number of contributors.
+	Decrypt bool
+
+	Signed // signature of the request by its querier
+}
+
+// clientPubKeys returns the key the results are switched to (none if they are decrypted)
+func (r *SurveyAggRequest) clientPubKeys() []kyber.Point {
+	if r.ClientPubKey == nil {
+		return nil
+	}
+	return []kyber.Point{r.ClientPubKey}
+}
+
+// PrivacyBudgetRequest is the message used to ask a node about the privacy budget of a querier
+type PrivacyBudgetRequest struct {
+	ClientPubKey kyber.Point // ignored with authorization: the budget of the querier signing the request is reported
+
+	Signed // signature of the request by its querier
+}
+
+// SurveyStatusRequest is the message used to ask a node about the progress of some surveys
+type SurveyStatusRequest struct {
+	SurveyIDs []SurveyID
+
+	Signed // signature of the request by its querier
+}
+
+// SurveyCancelRequest is the message used to abandon a survey on all the nodes of the roster
+type SurveyCancelRequest struct {
+	SurveyID SurveyID
+	Roster   onet.Roster
+
+	Signed // signature of the request by its querier
 }
 
 // SurveyKS is the struct that we persist in the service that contains all the data for the Key Switch request phase
@@ -130,6 +335,21 @@ type SurveyKS struct {
 	SurveyID SurveyID
 	Request  SurveyKSRequest
 	TR       TimeResults
+
+	// progress information
+	Phase string
+	Start time.Time
+}
+
+// SurveyKSBatch is the struct that we persist in the service that contains all the data for the batched Key Switch request phase
+type SurveyKSBatch struct {
+	SurveyID SurveyID
+	Request  SurveyKSBatchRequest
+	TR       TimeResults
+
+	// progress information
+	Phase string
+	Start time.Time
 }
 
 // SurveyShuffle is the struct that we persist in the service that contains all the data for the Shuffle (+KS) request phase
@@ -139,6 +359,10 @@ type SurveyShuffle struct {
 	SurveyChannel       chan int // To wait for all the aggregate results to be received by the root node
 	FinalResultsChannel chan int
 	TR                  TimeResults
+
+	// progress information
+	Phase string
+	Start time.Time
 }
 
 // SurveyAgg is the struct that we persist in the service that contains all the data for the Aggregation request phase
@@ -146,6 +370,10 @@ type SurveyAgg struct {
 	SurveyID SurveyID
 	Request  SurveyAggRequest
 	TR       TimeResults
+
+	// progress information
+	Phase string
+	Start time.Time
 }
 
 // SurveyShuffleGenerated is used to ensure that the root server creates the survey before all the other nodes send it their results
@@ -158,6 +386,22 @@ type SurveyAggGenerated struct {
 	SurveyID SurveyID
 }
 
+func (surv SurveyKS) record() SurveyRecord {
+	return SurveyRecord{SurveyID: surv.SurveyID, Phase: surv.Phase, Start: surv.Start, Roster: &surv.Request.Roster}
+}
+
+func (surv SurveyKSBatch) record() SurveyRecord {
+	return SurveyRecord{SurveyID: surv.SurveyID, Phase: surv.Phase, Start: surv.Start, Roster: &surv.Request.Roster}
+}
+
+func (surv SurveyShuffle) record() SurveyRecord {
+	return SurveyRecord{SurveyID: surv.SurveyID, Phase: surv.Phase, Start: surv.Start, Roster: &surv.Request.Roster}
+}
+
+func (surv SurveyAgg) record() SurveyRecord {
+	return SurveyRecord{SurveyID: surv.SurveyID, Phase: surv.Phase, Start: surv.Start, Roster: &surv.Request.Roster}
+}
+
 func (s *Service) deleteSurveyKS(sid SurveyID) (SurveyKS, error) {
 	surv, err := s.MapSurveyKS.Remove(string(sid))
 	if err != nil {
@@ -169,6 +413,17 @@ func (s *Service) deleteSurveyKS(sid SurveyID) (SurveyKS, error) {
 	return surv.(SurveyKS), nil
 }
 
+func (s *Service) deleteSurveyKSBatch(sid SurveyID) (SurveyKSBatch, error) {
+	surv, err := s.MapSurveyKSBatch.Remove(string(sid))
+	if err != nil {
+		return SurveyKSBatch{}, fmt.Errorf("error while deleting surveyID ("+string(sid)+"): %v", err.Error())
+	}
+	if surv == nil {
+		return SurveyKSBatch{}, fmt.Errorf("no entry in map with surveyID (" + string(sid) + ")")
+	}
+	return surv.(SurveyKSBatch), nil
+}
+
 func (s *Service) deleteSurveyShuffle(sid SurveyID) (SurveyShuffle, error) {
 	surv, err := s.MapSurveyShuffle.Remove(string(sid))
 	if err != nil {
@@ -202,6 +457,17 @@ func (s *Service) getSurveyKS(sid SurveyID) (SurveyKS, error) {
 	return surv.(SurveyKS), nil
 }
 
+func (s *Service) getSurveyKSBatch(sid SurveyID) (SurveyKSBatch, error) {
+	surv, err := s.MapSurveyKSBatch.Get(string(sid))
+	if err != nil {
+		return SurveyKSBatch{}, fmt.Errorf("error while getting surveyID ("+string(sid)+"): %v", err.Error())
+	}
+	if surv == nil {
+		return SurveyKSBatch{}, fmt.Errorf("empty map entry while getting surveyID (" + string(sid) + ")")
+	}
+	return surv.(SurveyKSBatch), nil
+}
+
 func (s *Service) getSurveyShuffle(sid SurveyID) (SurveyShuffle, error) {
 	surv, err := s.MapSurveyShuffle.Get(string(sid))
 	if err != nil {
@@ -229,6 +495,11 @@ func (s *Service) putSurveyKS(sid SurveyID, surv SurveyKS) error {
 	return err
 }
 
+func (s *Service) putSurveyKSBatch(sid SurveyID, surv SurveyKSBatch) error {
+	_, err := s.MapSurveyKSBatch.Put(string(sid), surv)
+	return err
+}
+
 func (s *Service) putSurveyShuffle(sid SurveyID, surv SurveyShuffle) error {
 	_, err := s.MapSurveyShuffle.Put(string(sid), surv)
 	return err
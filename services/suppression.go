@@ -0,0 +1,218 @@
+package servicesmedco
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ldsec/medco-unlynx/protocols"
+	"github.com/ldsec/unlynx/lib"
+	"go.dedis.ch/kyber/v3"
+	"go.dedis.ch/onet/v3"
+	"golang.org/x/xerrors"
+)
+
+// SuppressionRequestName is the type of the key switching of the blinded differences of a small-cell suppression
+const SuppressionRequestName = "SuppressionRequestName"
+
+// Environment variables holding the small-cell suppression policy of the node
+const (
+	// SuppressionMinThresholdEnv is the smallest suppression threshold accepted, requests asking for a lower one (or
+	// for none) are refused (0 by default)
+	SuppressionMinThresholdEnv = "UNLYNX_SUPPRESSION_MIN_THRESHOLD"
+	// SuppressionMaxThresholdEnv is the largest suppression threshold accepted (1000 by default), the cost of the
+	// suppression grows linearly with it
+	SuppressionMaxThresholdEnv = "UNLYNX_SUPPRESSION_MAX_THRESHOLD"
+)
+
+// SuppressionPolicy is what a node accepts as small-cell suppression thresholds
+type SuppressionPolicy struct {
+	MinThreshold int64
+	MaxThreshold int64
+}
+
+// suppressionTarget holds the ciphertexts a survey is blinding and their payloads, then the key they are switched to
+type suppressionTarget struct {
+	data     libunlynx.CipherVector
+	payloads []libunlynx.CipherVector
+	key      kyber.Point
+}
+
+// loadSuppressionPolicy reads the small-cell suppression policy of the node from the environment
+func loadSuppressionPolicy() (SuppressionPolicy, error) {
+	policy := SuppressionPolicy{MinThreshold: 0, MaxThreshold: 1000}
+
+	var err error
+	if v := os.Getenv(SuppressionMinThresholdEnv); v != "" {
+		if policy.MinThreshold, err = strconv.ParseInt(v, 10, 64); err != nil || policy.MinThreshold < 0 {
+			return SuppressionPolicy{}, xerrors.Errorf("wrong value for %s (%s): %+v", SuppressionMinThresholdEnv, v, err)
+		}
+	}
+	if v := os.Getenv(SuppressionMaxThresholdEnv); v != "" {
+		if policy.MaxThreshold, err = strconv.ParseInt(v, 10, 64); err != nil || policy.MaxThreshold < 0 {
+			return SuppressionPolicy{}, xerrors.Errorf("wrong value for %s (%s): %+v", SuppressionMaxThresholdEnv, v, err)
+		}
+	}
+	if policy.MinThreshold > policy.MaxThreshold {
+		return SuppressionPolicy{}, xerrors.Errorf("%s (%d) is above %s (%d)", SuppressionMinThresholdEnv,
+			policy.MinThreshold, SuppressionMaxThresholdEnv, policy.MaxThreshold)
+	}
+	return policy, nil
+}
+
+// checkSuppressionThreshold verifies that the suppression threshold of a request complies with the policy of the node
+func (s *Service) checkSuppressionThreshold(threshold int64) error {
+	if threshold < s.suppressionPolicy.MinThreshold {
+		return xerrors.Errorf("suppression threshold %d is below the minimum required by this node (%d)", threshold,
+			s.suppressionPolicy.MinThreshold)
+	}
+	if threshold > s.suppressionPolicy.MaxThreshold {
+		return xerrors.Errorf("suppression threshold %d is above the maximum accepted by this node (%d)", threshold,
+			s.suppressionPolicy.MaxThreshold)
+	}
+	return nil
+}
+
+func (s *Service) putSuppressionTarget(sid SurveyID, target *suppressionTarget) {
+	s.suppressionMutex.Lock()
+	defer s.suppressionMutex.Unlock()
+	s.suppressionTargets[sid] = target
+}
+
+func (s *Service) getSuppressionTarget(sid SurveyID) (*suppressionTarget, bool) {
+	s.suppressionMutex.Lock()
+	defer s.suppressionMutex.Unlock()
+	target, ok := s.suppressionTargets[sid]
+	return target, ok
+}
+
+func (s *Service) deleteSuppressionTarget(sid SurveyID) {
+	s.suppressionMutex.Lock()
+	defer s.suppressionMutex.Unlock()
+	delete(s.suppressionTargets, sid)
+}
+
+// SuppressionPhase replaces the aggregated result by an encryption of replacement if the value it encrypts is in
+// [0, threshold). The replacement is done in the encrypted domain (see thresholdSelect): the nodes never learn the
+// result, this one only learns whether it was suppressed and doesn't make the ciphertext it returns.
+func (s *Service) SuppressionPhase(targetSurvey SurveyID, roster *onet.Roster, result libunlynx.CipherText,
+	threshold, replacement int64, timeout time.Duration) (libunlynx.CipherText, bool, time.Duration, error) {
+	start := time.Now()
+	if threshold <= 0 {
+		return result, false, 0, nil
+	}
+
+	// result + (replacement - result) if the result is suppressed, result + 0 otherwise
+	toReplacement := libunlynx.CipherText{
+		K: libunlynx.SuiTe.Point().Neg(result.K),
+		C: libunlynx.SuiTe.Point().Sub(libunlynx.IntToPoint(replacement), result.C),
+	}
+	selected, below, err := s.thresholdSelect(targetSurvey, roster, result, threshold,
+		libunlynx.CipherVector{toReplacement}, libunlynx.CipherVector{trivialEncryption(0)}, timeout)
+	if err != nil {
+		return result, false, 0, err
+	}
+	var suppressed libunlynx.CipherText
+	suppressed.Add(result, selected[0])
+	return suppressed, below, time.Since(start), nil
+}
+
+// suppressGroup replaces a count and the values of its group (e.g. sums) by encryptions of zero if the count is in
+// [0, threshold), in the encrypted domain like SuppressionPhase
+func (s *Service) suppressGroup(targetSurvey SurveyID, roster *onet.Roster, count libunlynx.CipherText,
+	values libunlynx.CipherVector, threshold int64, timeout time.Duration) (libunlynx.CipherText, libunlynx.CipherVector,
+	bool, time.Duration, error) {
+	start := time.Now()
+	group := append(libunlynx.CipherVector{count}, values...)
+
+	// v + (-v) if the group is suppressed, v + 0 otherwise
+	toZero := make(libunlynx.CipherVector, len(group))
+	zero := make(libunlynx.CipherVector, len(group))
+	for i, v := range group {
+		toZero[i] = libunlynx.CipherText{K: libunlynx.SuiTe.Point().Neg(v.K), C: libunlynx.SuiTe.Point().Neg(v.C)}
+		zero[i] = trivialEncryption(0)
+	}
+	selected, below, err := s.thresholdSelect(targetSurvey, roster, count, threshold, toZero, zero, timeout)
+	if err != nil {
+		return count, values, false, 0, err
+	}
+	suppressed := make(libunlynx.CipherVector, len(group))
+	for i := range group {
+		suppressed[i].Add(group[i], selected[i])
+	}
+	return suppressed[0], suppressed[1:], below, time.Since(start), nil
+}
+
+// trivialEncryption is the encryption of v with no randomness, which is only used as a payload of the blinding
+// shuffle (that re-randomizes it)
+func trivialEncryption(v int64) libunlynx.CipherText {
+	return libunlynx.CipherText{K: libunlynx.SuiTe.Point().Null(), C: libunlynx.IntToPoint(v)}
+}
+
+// thresholdSelect tells whether the value encrypted by result is in [0, threshold) and returns ifBelow if it is,
+// ifNotBelow otherwise. The differences between the result and each value below the threshold are collectively
+// blinded and shuffled, with a copy of ifBelow and ifNotBelow attached to each of them, then key switched to a key of
+// this node: once decrypted, they only tell whether one of them was zero. The ciphertexts returned are the ones
+// attached to the differences, re-randomized by all the nodes: this node only picks between ifBelow and ifNotBelow.
+// It learns whether the value is below the threshold, the aggregation surveys only run it at the root of their roster
+// (see sendRootResults).
+func (s *Service) thresholdSelect(targetSurvey SurveyID, roster *onet.Roster, result libunlynx.CipherText,
+	threshold int64, ifBelow, ifNotBelow libunlynx.CipherVector, timeout time.Duration) (libunlynx.CipherVector, bool,
+	error) {
+	// result - i, for i in [0, threshold)
+	differences := make(libunlynx.CipherVector, threshold)
+	payloads := make([]libunlynx.CipherVector, len(ifBelow)+len(ifNotBelow))
+	for p := range payloads {
+		payloads[p] = make(libunlynx.CipherVector, threshold)
+	}
+	for i := range differences {
+		differences[i].K = libunlynx.SuiTe.Point().Set(result.K)
+		differences[i].C = libunlynx.SuiTe.Point().Sub(result.C, libunlynx.IntToPoint(int64(i)))
+		for p, v := range append(append(libunlynx.CipherVector{}, ifBelow...), ifNotBelow...) {
+			payloads[p][i] = v
+		}
+	}
+	s.putSuppressionTarget(targetSurvey, &suppressionTarget{data: differences, payloads: payloads})
+	defer s.deleteSuppressionTarget(targetSurvey)
+
+	pi, err := s.StartProtocol(protocols.BlindingShuffleProtocolName, "",
+		ProtocolConfig{SurveyID: targetSurvey, Timeout: timeout}, roster)
+	if err != nil {
+		return nil, false, err
+	}
+	var blinded libunlynx.CipherVector
+	select {
+	case blinded = <-pi.(*protocols.BlindingShuffleProtocol).FeedbackChannel:
+	case <-s.cancelChannel(targetSurvey):
+		return nil, false, surveyCancelledError(targetSurvey)
+	case <-time.After(timeout):
+		return nil, false, xerrors.Errorf("couldn't finish blinding shuffle protocol in time")
+	}
+	shuffled := pi.(*protocols.BlindingShuffleProtocol).ShuffledPayloads
+	if len(shuffled) != len(payloads) {
+		return nil, false, xerrors.Errorf("got %d payloads from the blinding shuffle, %d expected", len(shuffled),
+			len(payloads))
+	}
+
+	secKey, pubKey := libunlynx.GenKey()
+	s.putSuppressionTarget(targetSurvey, &suppressionTarget{data: blinded, key: pubKey})
+	switched, _, _, err := s.KeySwitchingPhase(targetSurvey, SuppressionRequestName, roster, false, timeout)
+	if err != nil {
+		return nil, false, err
+	}
+
+	selected := make(libunlynx.CipherVector, len(ifBelow))
+	for i, v := range switched {
+		m := libunlynx.SuiTe.Point().Sub(v.C, libunlynx.SuiTe.Point().Mul(secKey, v.K))
+		if m.Equal(libunlynx.SuiTe.Point().Null()) {
+			for p := range selected {
+				selected[p] = shuffled[p][i]
+			}
+			return selected, true, nil
+		}
+	}
+	for p := range selected {
+		selected[p] = shuffled[len(ifBelow)+p][0]
+	}
+	return selected, false, nil
+}
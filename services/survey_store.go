@@ -0,0 +1,264 @@
+package servicesmedco
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/goleveldb/leveldb"
+	"github.com/btcsuite/goleveldb/leveldb/util"
+	"github.com/fanliao/go-concurrentMap"
+	"github.com/ldsec/unlynx/lib"
+	"go.dedis.ch/onet/v3"
+	"go.dedis.ch/onet/v3/log"
+	"go.dedis.ch/onet/v3/network"
+	"golang.org/x/xerrors"
+)
+
+// SurveyStorePathEnv is the environment variable holding the directory of the (optional) persistent survey store
+const SurveyStorePathEnv = "UNLYNX_SURVEY_STORE_PATH"
+
+// SurveyStoreName is the prefix of the persistent survey store database (followed by the address of the node)
+const SurveyStoreName = "surveys"
+
+// InterruptedSurveysRetention is how long the surveys interrupted by a restart are kept in the survey store (and
+// reported to the clients submitting them again)
+const InterruptedSurveysRetention = 7 * 24 * time.Hour
+
+// interruptionNotificationAttempts is how many times a restarted node tries to notify the other nodes of an
+// interrupted survey (once per second, the node may not be listening yet)
+const interruptionNotificationAttempts = 10
+
+// Phases a survey goes through (recorded as the survey progresses)
+const (
+	PhaseAggregation  = "Aggregation"
+	PhaseShuffling    = "Shuffling"
+	PhaseSuppression  = "Suppression"
+	PhaseComparison   = "Comparison"
+	PhaseNoise        = "Noise"
+	PhaseKeySwitching = "KeySwitching"
+	PhaseDecryption   = "Decryption"
+)
+
+// SurveyMap stores the surveys a node is currently processing. *concurrent.ConcurrentMap is the in-memory
+// implementation used by default.
+type SurveyMap interface {
+	Get(key interface{}) (interface{}, error)
+	Put(key interface{}, value interface{}) (interface{}, error)
+	Remove(key interface{}) (interface{}, error)
+}
+
+// SurveyRecord is the progress information the persistent survey store keeps about a survey
+type SurveyRecord struct {
+	SurveyID SurveyID
+	TypeQ    string
+	Phase    string
+	Start    time.Time
+	Roster   *onet.Roster `json:"-"` // nodes taking part in the survey
+}
+
+// storedSurveyRecord is a SurveyRecord as journaled in the store, with the protobuf encoding of its roster
+type storedSurveyRecord struct {
+	SurveyRecord
+	Roster []byte
+}
+
+// surveyState is implemented by the structs stored in a SurveyMap, it exposes their progress information
+type surveyState interface {
+	record() SurveyRecord
+}
+
+// SurveyStore journals the surveys in flight in a goleveldb database, so that the surveys that were interrupted by a
+// restart of the node can be identified and reported instead of leaving the client and the other nodes hanging.
+type SurveyStore struct {
+	db *leveldb.DB
+}
+
+// OpenSurveyStore opens (or creates) the persistent survey store at path.
+func OpenSurveyStore(path string) (*SurveyStore, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("couldn't open survey store %s: %+v", path, err)
+	}
+	return &SurveyStore{db: db}, nil
+}
+
+// Close closes the underlying database.
+func (st *SurveyStore) Close() error {
+	return st.db.Close()
+}
+
+// Map returns a SurveyMap for the surveys of type typeQ that journals every survey it holds in the store.
+func (st *SurveyStore) Map(typeQ string) SurveyMap {
+	return &persistentSurveyMap{
+		ConcurrentMap: concurrent.NewConcurrentMap(),
+		store:         st,
+		typeQ:         typeQ,
+	}
+}
+
+// Interrupted returns the surveys recorded in the store, i.e. the ones that were still in flight when the store was
+// last closed. They are kept in the store (they are still interrupted after another restart) until they are older
+// than InterruptedSurveysRetention.
+func (st *SurveyStore) Interrupted() ([]SurveyRecord, error) {
+	records := make([]SurveyRecord, 0)
+	expired := make([][]byte, 0)
+
+	iter := st.db.NewIterator(&util.Range{}, nil)
+	for iter.Next() {
+		var stored storedSurveyRecord
+		if err := json.Unmarshal(iter.Value(), &stored); err != nil {
+			iter.Release()
+			return nil, xerrors.Errorf("couldn't decode survey record %s: %+v", string(iter.Key()), err)
+		}
+		if time.Since(stored.Start) > InterruptedSurveysRetention {
+			expired = append(expired, append([]byte{}, iter.Key()...))
+			continue
+		}
+		record := stored.SurveyRecord
+		if len(stored.Roster) > 0 {
+			if _, msg, err := network.Unmarshal(stored.Roster, libunlynx.SuiTe); err == nil {
+				record.Roster, _ = msg.(*onet.Roster)
+			}
+		}
+		records = append(records, record)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, xerrors.Errorf("couldn't read survey store: %+v", err)
+	}
+
+	for _, k := range expired {
+		if err := st.db.Delete(k, nil); err != nil {
+			return nil, xerrors.Errorf("couldn't clean survey store: %+v", err)
+		}
+	}
+	return records, nil
+}
+
+func (st *SurveyStore) put(typeQ string, record SurveyRecord) error {
+	record.TypeQ = typeQ
+	stored := storedSurveyRecord{SurveyRecord: record}
+	if record.Roster != nil {
+		var err error
+		if stored.Roster, err = network.Marshal(record.Roster); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return st.db.Put(surveyStoreKey(typeQ, record.SurveyID), b, nil)
+}
+
+func (st *SurveyStore) remove(typeQ string, sid SurveyID) error {
+	return st.db.Delete(surveyStoreKey(typeQ, sid), nil)
+}
+
+func surveyStoreKey(typeQ string, sid SurveyID) []byte {
+	return []byte(typeQ + "/" + string(sid))
+}
+
+// persistentSurveyMap keeps the surveys in memory (they hold channels) and journals their progress in the store
+type persistentSurveyMap struct {
+	*concurrent.ConcurrentMap
+	sync.Mutex
+	store *SurveyStore
+	typeQ string
+}
+
+func (m *persistentSurveyMap) Put(key interface{}, value interface{}) (interface{}, error) {
+	m.Lock()
+	defer m.Unlock()
+	old, err := m.ConcurrentMap.Put(key, value)
+	if err != nil {
+		return old, err
+	}
+	if surv, ok := value.(surveyState); ok {
+		if err := m.store.put(m.typeQ, surv.record()); err != nil {
+			return old, xerrors.Errorf("couldn't journal survey %v: %+v", key, err)
+		}
+	}
+	return old, nil
+}
+
+func (m *persistentSurveyMap) Remove(key interface{}) (interface{}, error) {
+	m.Lock()
+	defer m.Unlock()
+	old, err := m.ConcurrentMap.Remove(key)
+	if err != nil {
+		return old, err
+	}
+	if err := m.store.remove(m.typeQ, SurveyID(key.(string))); err != nil {
+		return old, xerrors.Errorf("couldn't remove survey %v from journal: %+v", key, err)
+	}
+	return old, nil
+}
+
+// openSurveyStore replaces the in-memory survey maps of the service by persistent ones and loads the surveys that were
+// interrupted by the last shutdown of the node
+func (s *Service) openSurveyStore(dir string) error {
+	path := filepath.Join(dir, SurveyStoreName+"_"+s.ServerIdentity().Address.Host()+":"+s.ServerIdentity().Address.Port())
+	store, err := OpenSurveyStore(path)
+	if err != nil {
+		return err
+	}
+
+	records, err := store.Interrupted()
+	if err != nil {
+		store.Close()
+		return err
+	}
+	for _, record := range records {
+		log.Warn(s.ServerIdentity().String(), "survey", record.SurveyID, "was interrupted during the", record.Phase, "phase")
+		s.interruptedSurveys[record.SurveyID] = record
+	}
+	s.surveyStore = store
+
+	s.MapSurveyKS = store.Map(KSRequestName)
+	s.MapSurveyKSBatch = store.Map(KSBatchRequestName)
+	s.MapSurveyShuffle = store.Map(ShuffleRequestName)
+	s.MapSurveyAgg = store.Map(AggRequestName)
+	return nil
+}
+
+// notifyInterrupted cancels the surveys interrupted by the last shutdown of the node on the other nodes of their
+// rosters, which would otherwise wait for this one until their timeout. The surveys older than the maximum timeout
+// were already given up by the other nodes.
+func (s *Service) notifyInterrupted() {
+	for _, record := range s.interruptedSurveys {
+		if record.Roster == nil || len(record.Roster.List) < 2 || time.Since(record.Start) > s.maxTimeout {
+			continue
+		}
+		for attempt := 1; ; attempt++ {
+			_, err := s.surveyCancel(record.Roster, &SurveyCancelRequest{SurveyID: record.SurveyID}, s.maxTimeout)
+			if err == nil {
+				log.Lvl2(s.ServerIdentity().String(), "notified the interruption of survey", record.SurveyID)
+				break
+			}
+			if attempt == interruptionNotificationAttempts {
+				log.Warn(s.ServerIdentity().String(), "couldn't notify the interruption of survey", record.SurveyID, ":", err)
+				break
+			}
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// checkInterrupted returns an error if the survey was interrupted by a restart of the node
+func (s *Service) checkInterrupted(sid SurveyID) error {
+	if record, ok := s.interruptedSurveys[sid]; ok {
+		return surveyInterruptedError(record)
+	}
+	return nil
+}
+
+// surveyInterruptedError builds the error returned for a survey that was interrupted by a restart of the node
+func surveyInterruptedError(record SurveyRecord) error {
+	return xerrors.Errorf("survey %s (%s) was interrupted by a restart of the node during the %s phase (started %s): "+
+		"it has to be submitted again with a new survey ID", record.SurveyID, strings.TrimSuffix(record.TypeQ, "Name"),
+		record.Phase, record.Start.Format(time.RFC3339))
+}